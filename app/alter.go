@@ -0,0 +1,315 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Runs ALTER TABLE ... RENAME TO, RENAME COLUMN, ADD COLUMN and DROP
+// COLUMN. Renames rewrite the SQL of every schema entry that refers to
+// the table or column; only DROP COLUMN touches the table's rows.
+func executeAlter(db *database, sql string) error {
+	s, err := newTokenStream(sql)
+	if err != nil {
+		return err
+	}
+	if err := s.expectKeyword("ALTER"); err != nil {
+		return err
+	}
+	if err := s.expectKeyword("TABLE"); err != nil {
+		return err
+	}
+	name, err := s.expectQualifiedName()
+	if err != nil {
+		return err
+	}
+	row, def, err := alterTarget(db, name)
+	if err != nil {
+		return err
+	}
+
+	// Reads the rest of a statement that ends with one name
+	finalName := func() (string, bool, error) {
+		t := s.peek()
+		name, err := s.expectName()
+		if err != nil {
+			return "", false, err
+		}
+		s.acceptPunct(";")
+		if !s.atEnd() {
+			return "", false, s.syntaxError()
+		}
+		return name, t.quoted || t.kind == tokString, nil
+	}
+	switch {
+	case s.acceptKeyword("RENAME"):
+		if s.acceptKeyword("TO") {
+			newName, _, err := finalName()
+			if err != nil {
+				return err
+			}
+			return renameTable(db, row, newName)
+		}
+		s.acceptKeyword("COLUMN")
+		column, err := s.expectName()
+		if err != nil {
+			return err
+		}
+		if err := s.expectKeyword("TO"); err != nil {
+			return err
+		}
+		newName, quoted, err := finalName()
+		if err != nil {
+			return err
+		}
+		return renameColumn(db, row, def, column, newName, quoted)
+	case s.acceptKeyword("ADD"):
+		s.acceptKeyword("COLUMN")
+		return addColumn(db, row, def, trimStatement(s.rest()))
+	case s.acceptKeyword("DROP"):
+		s.acceptKeyword("COLUMN")
+		column, _, err := finalName()
+		if err != nil {
+			return err
+		}
+		return dropColumn(db, row, def, column)
+	}
+	return s.syntaxError()
+}
+
+// Finds the table an ALTER TABLE changes
+func alterTarget(db *database, name string) (*SQLiteSchemaRow, *tableDef, error) {
+	row := db.findSchemaRow("table", name)
+	switch {
+	case isSchemaTableName(name):
+		return nil, nil, fmt.Errorf("table sqlite_master may not be altered")
+	case row != nil && strings.HasPrefix(strings.ToLower(row.name), "sqlite_"):
+		return nil, nil, fmt.Errorf("table %s may not be altered", name)
+	case row == nil && db.findSchemaRow("view", name) != nil:
+		return nil, nil, fmt.Errorf("view %s may not be altered", name)
+	case row == nil:
+		return nil, nil, fmt.Errorf("no such table: %s", name)
+	}
+	def, err := parseCreateTable(row.sql)
+	if err != nil {
+		return nil, nil, err
+	}
+	return row, def, nil
+}
+
+// Renames a table, along with its automatic indexes, the tbl_name of its
+// indexes and triggers, its sqlite_sequence entry and every reference to
+// it in other schema SQL. The new name is always written quoted.
+func renameTable(db *database, table *SQLiteSchemaRow, newName string) (err error) {
+	if strings.HasPrefix(strings.ToLower(newName), "sqlite_") {
+		return fmt.Errorf("object name reserved for internal use: %s", newName)
+	}
+	for _, row := range db.schema {
+		if row._type != "trigger" && strings.EqualFold(row.name, newName) {
+			return fmt.Errorf("there is already another table or index with this name: %s", newName)
+		}
+	}
+
+	db.file.beginStatement()
+	defer func() { err = db.endSchemaStatement(err) }()
+
+	oldName := table.name
+	autoPrefix := "sqlite_autoindex_" + oldName + "_"
+	for i := range db.schema {
+		row := &db.schema[i]
+		name, tblName, sql := row.name, row.tblName, row.sql
+		if row.rowid == table.rowid {
+			name = newName
+		}
+		if row._type == "index" && row.sql == "" && strings.HasPrefix(strings.ToLower(name), strings.ToLower(autoPrefix)) {
+			name = "sqlite_autoindex_" + newName + "_" + name[len(autoPrefix):]
+		}
+		if strings.EqualFold(tblName, oldName) {
+			tblName = newName
+		}
+		if refs, err := scanReferences(sql); err == nil && sql != "" {
+			var edits []sqlEdit
+			for _, i := range refs.tableRefs(oldName) {
+				t := refs.tokens[i]
+				edits = append(edits, sqlEdit{t.pos, t.end, quoteIdentifier(newName)})
+			}
+			sql = applySQLEdits(sql, edits)
+		}
+		if name != row.name || tblName != row.tblName || sql != row.sql {
+			if err := db.updateSchemaRow(row, name, tblName, sql); err != nil {
+				return err
+			}
+		}
+	}
+	return db.renameSequence(oldName, newName)
+}
+
+// Renames a column in its table's definition and wherever indexes, views,
+// triggers and foreign keys refer to it. The new name is quoted when it
+// was given quoted or replaces a quoted name, as SQLite does.
+func renameColumn(db *database, table *SQLiteSchemaRow, def *tableDef, column, newName string, quoted bool) (err error) {
+	i := def.columnIndex(column)
+	if i < 0 {
+		return fmt.Errorf("no such column: \"%s\"", column)
+	}
+	if j := def.columnIndex(newName); j >= 0 && j != i {
+		return fmt.Errorf("error in table %s after rename: duplicate column name: %s", def.name, newName)
+	}
+
+	db.file.beginStatement()
+	defer func() { err = db.endSchemaStatement(err) }()
+
+	for k := range db.schema {
+		row := &db.schema[k]
+		refs, err := scanReferences(row.sql)
+		if err != nil || row.sql == "" {
+			continue
+		}
+		var edits []sqlEdit
+		for _, ref := range refs.columnRefs(def.name, def.columns[i].name) {
+			t := refs.tokens[ref]
+			text := newName
+			if quoted || t.quoted || t.kind == tokString {
+				text = quoteIdentifier(newName)
+			}
+			edits = append(edits, sqlEdit{t.pos, t.end, text})
+		}
+		if len(edits) > 0 {
+			if err := db.updateSchemaRow(row, row.name, row.tblName, applySQLEdits(row.sql, edits)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Adds a column to the end of a table's column list. Existing rows are
+// left alone: their records are shorter than the new definition and read
+// the column's default.
+func addColumn(db *database, table *SQLiteSchemaRow, def *tableDef, columnSQL string) (err error) {
+	parsed, err := parseCreateTable("CREATE TABLE x(" + columnSQL + ")")
+	if err != nil {
+		return err
+	}
+	if len(parsed.columns) != 1 {
+		return fmt.Errorf("near \"%s\": syntax error", columnSQL)
+	}
+	col := parsed.columns[0]
+	switch {
+	case def.columnIndex(col.name) >= 0:
+		return fmt.Errorf("duplicate column name: %s", col.name)
+	case col.primaryKey:
+		return fmt.Errorf("Cannot add a PRIMARY KEY column")
+	case col.unique:
+		return fmt.Errorf("Cannot add a UNIQUE column")
+	case col.generatedStored:
+		return fmt.Errorf("cannot add a STORED column")
+	}
+	// Existing rows take the default without it being evaluated, so it
+	// must be a literal, possibly signed or in parentheses
+	if _, ok := constantLiteral(col.defaultExpr); col.hasDefault && !ok {
+		return fmt.Errorf("Cannot add a column with non-constant default")
+	}
+	if col.notNull && col.generated == "" && insertDefault(col) == nil {
+		return fmt.Errorf("Cannot add a NOT NULL column with default value NULL")
+	}
+
+	body, err := scanTableBody(table.sql)
+	if err != nil {
+		return err
+	}
+	sql := table.sql[:body.end] + ", " + columnSQL + table.sql[body.end:]
+	if _, err := parseCreateTable(sql); err != nil {
+		return err
+	}
+
+	db.file.beginStatement()
+	defer func() { err = db.endSchemaStatement(err) }()
+	return db.updateSchemaRow(table, table.name, table.tblName, sql)
+}
+
+// Removes a column from a table's definition and from every row. The
+// column may not be part of a key or used by anything else in the schema.
+func dropColumn(db *database, table *SQLiteSchemaRow, def *tableDef, column string) (err error) {
+	i := def.columnIndex(column)
+	if i < 0 {
+		return fmt.Errorf("no such column: \"%s\"", column)
+	}
+	col := def.columns[i]
+	for _, pk := range def.primaryKey {
+		if strings.EqualFold(pk.name, col.name) {
+			return fmt.Errorf("cannot drop PRIMARY KEY column: \"%s\"", col.name)
+		}
+	}
+	switch {
+	case col.unique:
+		return fmt.Errorf("cannot drop UNIQUE column: \"%s\"", col.name)
+	case len(def.columns) == 1:
+		return fmt.Errorf("cannot drop column \"%s\": no other columns exist", col.name)
+	}
+
+	body, err := scanTableBody(table.sql)
+	if err != nil {
+		return err
+	}
+	span := body.columns[i]
+	var sql string
+	if i < len(body.columns)-1 {
+		sql = table.sql[:span[0]] + table.sql[body.columns[i+1][0]:]
+	} else {
+		sql = table.sql[:strings.LastIndexByte(table.sql[:span[0]], ',')] + table.sql[body.end:]
+	}
+
+	for _, row := range db.schema {
+		if row.sql == "" || row._type == "table" && row.rowid != table.rowid {
+			continue
+		}
+		refs, err := scanReferences(row.sql)
+		if err != nil {
+			continue
+		}
+		for _, ref := range refs.columnRefs(def.name, col.name) {
+			t := refs.tokens[ref]
+			if row.rowid == table.rowid && t.pos >= span[0] && t.end <= span[1] {
+				continue // inside the definition being removed
+			}
+			if refs.inForeignKey(ref) {
+				return fmt.Errorf("error in %s %s after drop column: unknown column \"%s\" in foreign key definition", row._type, row.name, t.value)
+			}
+			name := t.value
+			if q, ok := refs.qualifiers[ref]; ok {
+				name = refs.tokens[q].value + "." + name
+			}
+			return fmt.Errorf("error in %s %s after drop column: no such column: %s", row._type, row.name, name)
+		}
+	}
+
+	db.file.beginStatement()
+	defer func() { err = db.endSchemaStatement(err) }()
+	defer recoverEvalError(&err)
+
+	w, err := newTableWriter(db, def.name)
+	if err != nil {
+		return err
+	}
+	_, rows, err := w.matchingRows(def.name, nil)
+	if err != nil {
+		return err
+	}
+	if err := db.updateSchemaRow(table, table.name, table.tblName, sql); err != nil {
+		return err
+	}
+	if err := db.reloadSchema(); err != nil {
+		return err
+	}
+	if w, err = newTableWriter(db, def.name); err != nil {
+		return err
+	}
+	for _, row := range rows {
+		values := append(append([]interface{}(nil), row.values[:i]...), row.values[i+1:]...)
+		if err := w.storeRecord(values, int64(row.rowid)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,836 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// btreeNode is a decoded b-tree page that is being modified. Pages are
+// always rewritten whole, so they never carry freeblocks or fragments.
+type btreeNode struct {
+	pageNum    int
+	pageType   byte
+	cells      [][]byte // raw cells in key order
+	rightChild int      // interior pages only
+	dirty      bool     // changed since it was read
+}
+
+func (n *btreeNode) isLeaf() bool {
+	return n.pageType == 0x0D || n.pageType == 0x0A
+}
+
+func (n *btreeNode) isIndex() bool {
+	return n.pageType == 0x02 || n.pageType == 0x0A
+}
+
+func (n *btreeNode) headerSize() int {
+	if n.isLeaf() {
+		return 8
+	}
+	return 12
+}
+
+// Bytes the node needs on its page: header, cell pointers and cells
+func (n *btreeNode) size() int {
+	size := int(pageHeaderOffset(n.pageNum)) + n.headerSize()
+	for _, cell := range n.cells {
+		size += 2 + len(cell)
+	}
+	return size
+}
+
+// Child page a cell of an interior page points to
+func cellChild(cell []byte) int {
+	return int(binary.BigEndian.Uint32(cell))
+}
+
+func withCellChild(cell []byte, child int) []byte {
+	out := append([]byte(nil), cell...)
+	binary.BigEndian.PutUint32(out, uint32(child))
+	return out
+}
+
+// Child page followed at position i; len(cells) means the right child
+func (n *btreeNode) child(i int) int {
+	if i == len(n.cells) {
+		return n.rightChild
+	}
+	return cellChild(n.cells[i])
+}
+
+// Key of a table b-tree cell: the rowid of a leaf cell or the divider key
+// of an interior cell
+func tableCellKey(pageType byte, cell []byte) int64 {
+	if pageType == 0x05 {
+		key, _ := decodeVarint(cell[4:])
+		return int64(key)
+	}
+	_, n := decodeVarint(cell)
+	rowid, _ := decodeVarint(cell[n:])
+	return int64(rowid)
+}
+
+func tableInteriorCell(child int, key int64) []byte {
+	cell := binary.BigEndian.AppendUint32(nil, uint32(child))
+	return appendVarint(cell, uint64(key))
+}
+
+func (p *pager) readNode(pageNum int) (*btreeNode, error) {
+	data, err := p.page(pageNum)
+	if err != nil {
+		return nil, err
+	}
+	off := int(pageHeaderOffset(pageNum))
+	node := &btreeNode{pageNum: pageNum, pageType: data[off]}
+	switch node.pageType {
+	case 0x02, 0x05, 0x0A, 0x0D:
+	default:
+		return nil, fmt.Errorf("database disk image is malformed: page %d has type 0x%02X", pageNum, node.pageType)
+	}
+	numCells := int(binary.BigEndian.Uint16(data[off+3:]))
+	if !node.isLeaf() {
+		node.rightChild = int(binary.BigEndian.Uint32(data[off+8:]))
+	}
+	pointers := off + node.headerSize()
+	for i := 0; i < numCells; i++ {
+		start := int(binary.BigEndian.Uint16(data[pointers+2*i:]))
+		size := p.cellSize(data, start, node.pageType)
+		if start < pointers || size <= 0 || start+size > len(data) {
+			return nil, fmt.Errorf("database disk image is malformed: bad cell %d on page %d", i, pageNum)
+		}
+		node.cells = append(node.cells, append([]byte(nil), data[start:start+size]...))
+	}
+	return node, nil
+}
+
+// Length of the cell at offset start, including any overflow page number
+func (p *pager) cellSize(data []byte, start int, pageType byte) int {
+	if start <= 0 || start >= len(data) {
+		return -1
+	}
+	switch pageType {
+	case 0x05:
+		_, n := decodeVarint(data[start+4:])
+		return 4 + n
+	case 0x0D:
+		payload, n1 := decodeVarint(data[start:])
+		_, n2 := decodeVarint(data[start+n1:])
+		local := cellLocalSize(int(payload), p.pageSize, false)
+		if local < int(payload) {
+			local += 4
+		}
+		return n1 + n2 + local
+	case 0x0A, 0x02:
+		prefix := 0
+		if pageType == 0x02 {
+			prefix = 4
+		}
+		payload, n := decodeVarint(data[start+prefix:])
+		local := cellLocalSize(int(payload), p.pageSize, true)
+		if local < int(payload) {
+			local += 4
+		}
+		return prefix + n + local
+	}
+	return -1
+}
+
+// Serialises a node onto its page, packing the cells at the end
+func (p *pager) writeNode(node *btreeNode) error {
+	if node.size() > p.pageSize {
+		return fmt.Errorf("internal error: page %d overfull", node.pageNum)
+	}
+	data, err := p.writablePage(node.pageNum)
+	if err != nil {
+		return err
+	}
+	off := int(pageHeaderOffset(node.pageNum))
+	for i := off; i < len(data); i++ {
+		data[i] = 0
+	}
+
+	content := p.pageSize
+	pointers := off + node.headerSize()
+	for i, cell := range node.cells {
+		content -= len(cell)
+		copy(data[content:], cell)
+		binary.BigEndian.PutUint16(data[pointers+2*i:], uint16(content))
+	}
+	data[off] = node.pageType
+	binary.BigEndian.PutUint16(data[off+3:], uint16(len(node.cells)))
+	binary.BigEndian.PutUint16(data[off+5:], uint16(content)) // 65536 wraps to 0, as SQLite stores it
+	if !node.isLeaf() {
+		binary.BigEndian.PutUint32(data[off+8:], uint32(node.rightChild))
+	}
+	return nil
+}
+
+// Builds a cell from its prefix and payload, moving the part of the
+// payload that does not fit locally onto new overflow pages
+func (p *pager) payloadCell(prefix []byte, payload []byte, isIndex bool) ([]byte, error) {
+	local := cellLocalSize(len(payload), p.pageSize, isIndex)
+	cell := append(prefix, payload[:local]...)
+	if local == len(payload) {
+		return cell, nil
+	}
+
+	rest := payload[local:]
+	chunk := p.pageSize - 4
+	var pages []int
+	for i := 0; i < len(rest); i += chunk {
+		pageNum, err := p.allocatePage()
+		if err != nil {
+			return nil, err
+		}
+		pages = append(pages, pageNum)
+	}
+	for i, pageNum := range pages {
+		data, err := p.writablePage(pageNum)
+		if err != nil {
+			return nil, err
+		}
+		if i+1 < len(pages) {
+			binary.BigEndian.PutUint32(data, uint32(pages[i+1]))
+		}
+		end := (i + 1) * chunk
+		if end > len(rest) {
+			end = len(rest)
+		}
+		copy(data[4:], rest[i*chunk:end])
+	}
+	return binary.BigEndian.AppendUint32(cell, uint32(pages[0])), nil
+}
+
+func (p *pager) tableLeafCell(rowid int64, record []byte) ([]byte, error) {
+	prefix := appendVarint(nil, uint64(len(record)))
+	prefix = appendVarint(prefix, uint64(rowid))
+	return p.payloadCell(prefix, record, false)
+}
+
+func (p *pager) indexLeafCell(record []byte) ([]byte, error) {
+	return p.payloadCell(appendVarint(nil, uint64(len(record))), record, true)
+}
+
+// Decodes the key record of an index b-tree cell
+func (p *pager) indexCellKey(pageType byte, cell []byte) []interface{} {
+	start := 0
+	if pageType == 0x02 {
+		start = 4
+	}
+	payloadSize, n := decodeVarint(cell[start:])
+	payload := readCellPayload(p, cell, start+n, int(payloadSize), p.pageSize, true)
+	values := parserRecordDynamic(bytes.NewReader(payload)).values
+	for i, v := range values {
+		values[i] = normalizeValue(v)
+	}
+	return values
+}
+
+// keyColumn describes how one column of an index key sorts
+type keyColumn struct {
+	collation string
+	desc      bool
+}
+
+// Orders index keys column by column; when one key is a prefix of the
+// other they compare equal
+func compareIndexKeys(a, b []interface{}, columns []keyColumn) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		var col keyColumn
+		if i < len(columns) {
+			col = columns[i]
+		}
+		c := compareSortValues(a[i], b[i], col.collation)
+		if col.desc {
+			c = -c
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+// btreePathStep records which child was followed from an interior node
+type btreePathStep struct {
+	node  *btreeNode
+	child int // position in node.cells; len(node.cells) for the right child
+}
+
+// Descends from root to the leaf where a key belongs. compare reports how
+// the sought key orders against the key of cell i of a node. Returns the
+// path of interior nodes, the leaf, the position in the leaf and whether
+// the cell there holds the key exactly.
+func (p *pager) seek(root int, compare func(node *btreeNode, i int) int) ([]btreePathStep, *btreeNode, int, bool, error) {
+	var path []btreePathStep
+	pageNum := root
+	for depth := 0; ; depth++ {
+		if depth > 64 {
+			return nil, nil, 0, false, fmt.Errorf("database disk image is malformed: b-tree too deep")
+		}
+		node, err := p.readNode(pageNum)
+		if err != nil {
+			return nil, nil, 0, false, err
+		}
+		pos := len(node.cells)
+		exact := false
+		for i := range node.cells {
+			if c := compare(node, i); c <= 0 {
+				pos, exact = i, c == 0
+				break
+			}
+		}
+		if node.isLeaf() {
+			return path, node, pos, exact, nil
+		}
+		path = append(path, btreePathStep{node: node, child: pos})
+		pageNum = node.child(pos)
+	}
+}
+
+func tableKeyCompare(rowid int64) func(node *btreeNode, i int) int {
+	return func(node *btreeNode, i int) int {
+		key := tableCellKey(node.pageType, node.cells[i])
+		switch {
+		case rowid < key:
+			return -1
+		case rowid > key:
+			return 1
+		}
+		return 0
+	}
+}
+
+func (p *pager) indexKeyCompare(key []interface{}, columns []keyColumn) func(node *btreeNode, i int) int {
+	return func(node *btreeNode, i int) int {
+		c := compareIndexKeys(key, p.indexCellKey(node.pageType, node.cells[i]), columns)
+		if c == 0 && !node.isLeaf() {
+			return -1 // an interior cell's own entry sorts after its left subtree
+		}
+		return c
+	}
+}
+
+// Inserts a leaf cell into a table b-tree, replacing the cell with the same
+// rowid if there is one
+func (p *pager) insertTableCell(root int, rowid int64, cell []byte) error {
+	path, leaf, pos, exact, err := p.seek(root, tableKeyCompare(rowid))
+	if err != nil {
+		return err
+	}
+	if exact {
+		if err := p.freeOverflow(leaf.pageType, leaf.cells[pos]); err != nil {
+			return err
+		}
+		leaf.cells[pos] = cell
+	} else {
+		leaf.cells = insertCell(leaf.cells, pos, cell)
+	}
+	return p.rebalance(path, leaf, isAppend(path, leaf, pos))
+}
+
+// Inserts a leaf cell holding key into an index b-tree
+func (p *pager) insertIndexCell(root int, key []interface{}, columns []keyColumn, cell []byte) error {
+	path, leaf, pos, _, err := p.seek(root, p.indexKeyCompare(key, columns))
+	if err != nil {
+		return err
+	}
+	leaf.cells = insertCell(leaf.cells, pos, cell)
+	return p.rebalance(path, leaf, isAppend(path, leaf, pos))
+}
+
+// Removes the row with the given rowid from a table b-tree, reporting
+// whether it was there
+func (p *pager) deleteTableCell(root int, rowid int64) (bool, error) {
+	path, leaf, pos, exact, err := p.seek(root, tableKeyCompare(rowid))
+	if err != nil || !exact {
+		return false, err
+	}
+	if err := p.freeOverflow(leaf.pageType, leaf.cells[pos]); err != nil {
+		return false, err
+	}
+	leaf.cells = append(leaf.cells[:pos], leaf.cells[pos+1:]...)
+	return true, p.rebalance(path, leaf, false)
+}
+
+// Removes the entry with exactly the given key, which ends in the rowid,
+// from an index b-tree. An entry on an interior page is replaced by its
+// predecessor, the last entry of the leaf just before it.
+func (p *pager) deleteIndexCell(root int, key []interface{}, columns []keyColumn) (bool, error) {
+	var path []btreePathStep
+	pageNum := root
+	for depth := 0; ; depth++ {
+		if depth > 64 {
+			return false, fmt.Errorf("database disk image is malformed: b-tree too deep")
+		}
+		node, err := p.readNode(pageNum)
+		if err != nil {
+			return false, err
+		}
+		pos := len(node.cells)
+		exact := false
+		for i, cell := range node.cells {
+			if c := compareIndexKeys(key, p.indexCellKey(node.pageType, cell), columns); c <= 0 {
+				pos, exact = i, c == 0
+				break
+			}
+		}
+		if exact {
+			if err := p.freeOverflow(node.pageType, node.cells[pos]); err != nil {
+				return false, err
+			}
+			if node.isLeaf() {
+				node.cells = append(node.cells[:pos], node.cells[pos+1:]...)
+				return true, p.rebalance(path, node, false)
+			}
+			return true, p.replaceWithPredecessor(path, node, pos)
+		}
+		if node.isLeaf() {
+			return false, nil
+		}
+		path = append(path, btreePathStep{node: node, child: pos})
+		pageNum = node.child(pos)
+	}
+}
+
+func (p *pager) replaceWithPredecessor(path []btreePathStep, node *btreeNode, pos int) error {
+	path = append(path, btreePathStep{node: node, child: pos})
+	pageNum := node.child(pos)
+	for depth := 0; depth <= 64; depth++ {
+		child, err := p.readNode(pageNum)
+		if err != nil {
+			return err
+		}
+		if child.isLeaf() {
+			if len(child.cells) == 0 {
+				return fmt.Errorf("database disk image is malformed: empty page %d", pageNum)
+			}
+			last := child.cells[len(child.cells)-1]
+			child.cells = child.cells[:len(child.cells)-1]
+			node.cells[pos] = append(binary.BigEndian.AppendUint32(nil, uint32(node.child(pos))), last...)
+			node.dirty = true
+			return p.rebalance(path, child, false)
+		}
+		path = append(path, btreePathStep{node: child, child: len(child.cells)})
+		pageNum = child.rightChild
+	}
+	return fmt.Errorf("database disk image is malformed: b-tree too deep")
+}
+
+// Frees the overflow pages a cell's payload continues on
+func (p *pager) freeOverflow(pageType byte, cell []byte) error {
+	start := 0
+	if pageType == 0x02 {
+		start = 4
+	}
+	if pageType == 0x05 {
+		return nil
+	}
+	payloadSize, n := decodeVarint(cell[start:])
+	start += n
+	if pageType == 0x0D {
+		_, n := decodeVarint(cell[start:])
+		start += n
+	}
+	local := cellLocalSize(int(payloadSize), p.pageSize, pageType != 0x0D)
+	if local == int(payloadSize) {
+		return nil
+	}
+	next := int(binary.BigEndian.Uint32(cell[start+local:]))
+	for pages := 0; next != 0; pages++ {
+		if next > p.pageCount || pages > p.pageCount {
+			return fmt.Errorf("database disk image is malformed: bad overflow page %d", next)
+		}
+		data, err := p.page(next)
+		if err != nil {
+			return err
+		}
+		if err := p.freePage(next); err != nil {
+			return err
+		}
+		next = int(binary.BigEndian.Uint32(data))
+	}
+	return nil
+}
+
+// Frees every page of a b-tree, and its overflow pages, except the root,
+// which is left as an empty leaf
+func (p *pager) clearTree(root int) error {
+	node, err := p.readNode(root)
+	if err != nil {
+		return err
+	}
+	if err := p.freeSubtrees(node); err != nil {
+		return err
+	}
+	return p.writeNode(&btreeNode{pageNum: root, pageType: node.pageType | 0x08})
+}
+
+// Frees every page of a b-tree, root included
+func (p *pager) dropTree(root int) error {
+	if err := p.clearTree(root); err != nil {
+		return err
+	}
+	return p.freePage(root)
+}
+
+// Allocates the root page of a new, empty b-tree of the given page type
+func (p *pager) newTree(pageType byte) (int, error) {
+	root, err := p.allocatePage()
+	if err != nil {
+		return 0, err
+	}
+	return root, p.writeNode(&btreeNode{pageNum: root, pageType: pageType})
+}
+
+// Fills an empty b-tree with leaf cells that are already in key order,
+// bottom up: the leaves are packed full, then each level of interior
+// pages is built over the one below until a level fits in the root
+func (p *pager) buildTree(root int, pageType byte, cells [][]byte) error {
+	level := &btreeNode{pageNum: root, pageType: pageType, cells: cells}
+	for level.size() > p.pageSize {
+		groups, separators, err := splitCells(level.cells, p.pageSize-level.headerSize(), level.pageType != 0x0D, true)
+		if err != nil {
+			return err
+		}
+		parent := &btreeNode{pageNum: root, pageType: level.pageType &^ 0x08}
+		for i, group := range groups {
+			pageNum, err := p.allocatePage()
+			if err != nil {
+				return err
+			}
+			node := &btreeNode{pageNum: pageNum, pageType: level.pageType, cells: group, rightChild: level.rightChild}
+			last := i == len(groups)-1
+			if !last && !level.isLeaf() {
+				node.rightChild = cellChild(separators[i])
+			}
+			if err := p.writeNode(node); err != nil {
+				return err
+			}
+			switch {
+			case last:
+				parent.rightChild = pageNum
+			case level.pageType == 0x0D:
+				parent.cells = append(parent.cells, tableInteriorCell(pageNum, tableCellKey(0x0D, group[len(group)-1])))
+			case level.pageType == 0x0A:
+				parent.cells = append(parent.cells, append(binary.BigEndian.AppendUint32(nil, uint32(pageNum)), separators[i]...))
+			default:
+				parent.cells = append(parent.cells, withCellChild(separators[i], pageNum))
+			}
+		}
+		level = parent
+	}
+	return p.writeNode(level)
+}
+
+func (p *pager) freeSubtrees(node *btreeNode) error {
+	for _, cell := range node.cells {
+		if err := p.freeOverflow(node.pageType, cell); err != nil {
+			return err
+		}
+	}
+	if node.isLeaf() {
+		return nil
+	}
+	for i := 0; i <= len(node.cells); i++ {
+		child, err := p.readNode(node.child(i))
+		if err != nil {
+			return err
+		}
+		if err := p.freeSubtrees(child); err != nil {
+			return err
+		}
+		if err := p.freePage(child.pageNum); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func insertCell(cells [][]byte, pos int, cell []byte) [][]byte {
+	cells = append(cells, nil)
+	copy(cells[pos+1:], cells[pos:])
+	cells[pos] = cell
+	return cells
+}
+
+// Reports whether a cell was added at the very end of the tree, as with
+// ascending rowids, so splits can leave the left pages full
+func isAppend(path []btreePathStep, leaf *btreeNode, pos int) bool {
+	if pos != len(leaf.cells)-1 {
+		return false
+	}
+	for _, step := range path {
+		if step.child != len(step.node.cells) {
+			return false
+		}
+	}
+	return true
+}
+
+// A non-root page is rebalanced with its siblings once less than a third
+// of it is in use, as SQLite does
+func (p *pager) underfull(node *btreeNode) bool {
+	return len(node.cells) == 0 || p.pageSize-node.size() > p.pageSize*2/3
+}
+
+// Writes a modified node and the ancestors that change with it. Overfull
+// nodes are split and underfull ones merged with their siblings, which
+// changes the parent's dividers in turn.
+func (p *pager) rebalance(path []btreePathStep, node *btreeNode, packLeft bool) error {
+	node.dirty = true
+	for len(path) > 0 {
+		step := path[len(path)-1]
+		if node.dirty {
+			var err error
+			switch {
+			case node.size() > p.pageSize:
+				err = p.redistribute(step.node, step.child, node, false, packLeft)
+			case p.underfull(node):
+				err = p.redistribute(step.node, step.child, node, true, false)
+			default:
+				err = p.writeNode(node)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		node, path = step.node, path[:len(path)-1]
+	}
+	if node.dirty {
+		return p.storeRoot(node, packLeft)
+	}
+	return nil
+}
+
+// Writes a root node. An overfull root moves its content into a new child
+// which is then split, so the root page number never changes; an interior
+// root left without dividers takes over its only child when that fits.
+func (p *pager) storeRoot(root *btreeNode, packLeft bool) error {
+	for {
+		if root.size() > p.pageSize {
+			childPage, err := p.allocatePage()
+			if err != nil {
+				return err
+			}
+			child := &btreeNode{pageNum: childPage, pageType: root.pageType, cells: root.cells, rightChild: root.rightChild}
+			root = &btreeNode{pageNum: root.pageNum, pageType: root.pageType &^ 0x08, rightChild: childPage}
+			if err := p.redistribute(root, 0, child, false, packLeft); err != nil {
+				return err
+			}
+			continue
+		}
+		if !root.isLeaf() && len(root.cells) == 0 {
+			child, err := p.readNode(root.rightChild)
+			if err != nil {
+				return err
+			}
+			merged := &btreeNode{pageNum: root.pageNum, pageType: child.pageType, cells: child.cells, rightChild: child.rightChild}
+			if merged.size() <= p.pageSize {
+				if err := p.freePage(child.pageNum); err != nil {
+					return err
+				}
+				root = merged
+				continue
+			}
+		}
+		return p.writeNode(root)
+	}
+}
+
+// Rebuilds the children of parent around position idx. A split takes only
+// node, a merge also its neighbours. Their cells, with the dividers between
+// them, are laid out again over as few pages as needed and the new
+// dividers replace the old ones in parent, which is left to be written.
+func (p *pager) redistribute(parent *btreeNode, idx int, node *btreeNode, merge, packLeft bool) error {
+	lo, hi := idx, idx
+	if merge {
+		hi = idx + 1
+		if hi > len(parent.cells) {
+			hi = len(parent.cells)
+		}
+		lo = hi - 2
+		if lo < 0 {
+			lo = 0
+		}
+	}
+
+	var siblings []*btreeNode
+	for i := lo; i <= hi; i++ {
+		sibling := node
+		if i != idx {
+			var err error
+			if sibling, err = p.readNode(parent.child(i)); err != nil {
+				return err
+			}
+			if sibling.pageType != node.pageType {
+				return fmt.Errorf("database disk image is malformed: page %d has the wrong type", sibling.pageNum)
+			}
+		}
+		siblings = append(siblings, sibling)
+	}
+
+	// Flatten the siblings into one run of cells; the parent's dividers
+	// between them become cells too, except on table leaves whose cells
+	// carry their own keys
+	var cells [][]byte
+	for i, sibling := range siblings {
+		cells = append(cells, sibling.cells...)
+		if i == len(siblings)-1 {
+			break
+		}
+		divider := parent.cells[lo+i]
+		switch node.pageType {
+		case 0x05, 0x02:
+			cells = append(cells, withCellChild(divider, sibling.rightChild))
+		case 0x0A:
+			cells = append(cells, divider[4:])
+		}
+	}
+	rightChild := siblings[len(siblings)-1].rightChild
+
+	withSeparators := node.pageType != 0x0D
+	capacity := p.pageSize - node.headerSize()
+	groups := [][][]byte{cells}
+	var separators [][]byte
+	if total := nodeCellsSize(cells); total > capacity {
+		var err error
+		if groups, separators, err = splitCells(cells, capacity, withSeparators, packLeft); err != nil {
+			return err
+		}
+	}
+
+	pages := make([]int, 0, len(groups))
+	for _, sibling := range siblings {
+		pages = append(pages, sibling.pageNum)
+	}
+	for len(pages) < len(groups) {
+		pageNum, err := p.allocatePage()
+		if err != nil {
+			return err
+		}
+		pages = append(pages, pageNum)
+	}
+	for _, pageNum := range pages[len(groups):] {
+		if err := p.freePage(pageNum); err != nil {
+			return err
+		}
+	}
+	pages = pages[:len(groups)]
+
+	var dividers [][]byte
+	for i, group := range groups {
+		sibling := &btreeNode{pageNum: pages[i], pageType: node.pageType, cells: group, rightChild: rightChild}
+		last := i == len(groups)-1
+		if !last && !node.isLeaf() {
+			sibling.rightChild = cellChild(separators[i])
+		}
+		if err := p.writeNode(sibling); err != nil {
+			return err
+		}
+		if last {
+			break
+		}
+		switch node.pageType {
+		case 0x0D:
+			dividers = append(dividers, tableInteriorCell(pages[i], tableCellKey(0x0D, group[len(group)-1])))
+		case 0x05, 0x02:
+			dividers = append(dividers, withCellChild(separators[i], pages[i]))
+		case 0x0A:
+			dividers = append(dividers, append(binary.BigEndian.AppendUint32(nil, uint32(pages[i])), separators[i]...))
+		}
+	}
+
+	updated := make([][]byte, 0, len(parent.cells)-(hi-lo)+len(dividers))
+	updated = append(updated, parent.cells[:lo]...)
+	updated = append(updated, dividers...)
+	updated = append(updated, parent.cells[hi:]...)
+	parent.cells = updated
+	if next := lo + len(dividers); next < len(parent.cells) {
+		parent.cells[next] = withCellChild(parent.cells[next], pages[len(pages)-1])
+	} else {
+		parent.rightChild = pages[len(pages)-1]
+	}
+	parent.dirty = true
+	return nil
+}
+
+// Bytes a run of cells takes on a page, counting their pointers
+func nodeCellsSize(cells [][]byte) int {
+	total := 0
+	for _, cell := range cells {
+		total += len(cell) + 2
+	}
+	return total
+}
+
+// Divides cells into consecutive groups that each fit in capacity bytes.
+// withSeparators takes the cell between two groups out as their divider,
+// as interior and index pages need. packLeft fills the left groups, which
+// suits keys arriving in ascending order; otherwise the groups are evened out.
+func splitCells(cells [][]byte, capacity int, withSeparators, packLeft bool) ([][][]byte, [][]byte, error) {
+	total := nodeCellsSize(cells)
+	for k := 2; k <= len(cells); k++ {
+		target := total / k
+		if packLeft && total > capacity {
+			target = capacity
+		}
+		var groups [][][]byte
+		var separators [][]byte
+		var current [][]byte
+		size := 0
+		for _, cell := range cells {
+			cellSize := len(cell) + 2
+			full := size+cellSize > capacity || (size >= target && len(groups) < k-1)
+			if len(current) > 0 && full {
+				groups = append(groups, current)
+				current, size = nil, 0
+				if withSeparators {
+					separators = append(separators, cell)
+					continue
+				}
+			}
+			current = append(current, cell)
+			size += cellSize
+		}
+
+		// A separator cannot end the cells; borrow the one before it
+		if len(current) == 0 && len(groups) > 0 {
+			last := len(groups) - 1
+			if len(groups[last]) < 2 {
+				continue
+			}
+			current = [][]byte{separators[last]}
+			separators[last] = groups[last][len(groups[last])-1]
+			groups[last] = groups[last][:len(groups[last])-1]
+		}
+		if len(current) == 0 {
+			continue
+		}
+		groups = append(groups, current)
+		if len(groups) >= 2 {
+			return groups, separators, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("internal error: cannot split page of %d cells", len(cells))
+}
+
+// Largest rowid in a table b-tree, found along its rightmost path
+func (p *pager) maxRowid(root int) (int64, bool, error) {
+	pageNum := root
+	for depth := 0; depth <= 64; depth++ {
+		node, err := p.readNode(pageNum)
+		if err != nil {
+			return 0, false, err
+		}
+		if node.isLeaf() {
+			if len(node.cells) == 0 {
+				return 0, false, nil
+			}
+			return tableCellKey(node.pageType, node.cells[len(node.cells)-1]), true, nil
+		}
+		pageNum = node.rightChild
+	}
+	return 0, false, fmt.Errorf("database disk image is malformed: b-tree too deep")
+}
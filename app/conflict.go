@@ -0,0 +1,383 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/xwb1989/sqlparser"
+)
+
+// constraintError is a broken constraint together with the conflict
+// resolution that decides how much is undone: ABORT undoes the statement,
+// FAIL keeps what it changed before the failing row and ROLLBACK undoes
+// the whole transaction
+type constraintError struct {
+	message    string
+	resolution string
+}
+
+func (e *constraintError) Error() string {
+	return e.message
+}
+
+// Picks how a broken constraint is resolved: the statement's OR clause
+// wins over the constraint's own ON CONFLICT clause, and ABORT is the
+// default
+func conflictResolution(statement, constraint string) string {
+	switch {
+	case statement != "":
+		return statement
+	case constraint != "":
+		return constraint
+	}
+	return "ABORT"
+}
+
+// Starts a statement that writes rows. A statement of a trigger program
+// is part of the statement that fired the trigger.
+func (db *database) beginWriteStatement() {
+	if len(db.triggerStack) > 0 {
+		return
+	}
+	db.file.beginStatement()
+	db.fkImmediate = 0
+	db.fkDeferredAtStatement = db.fkDeferred
+}
+
+// Ends a statement that wrote rows, keeping or undoing its changes as the
+// resolution of a constraint error asks. Broken foreign keys fail the
+// statement, or the implicit transaction it ran in when deferred.
+func (db *database) endWriteStatement(err error) error {
+	if len(db.triggerStack) > 0 {
+		return err
+	}
+	if err == nil && (db.fkImmediate > 0 || !db.file.inTransaction && db.fkDeferred > 0) {
+		err = &constraintError{"FOREIGN KEY constraint failed", "ABORT"}
+	}
+	db.fkImmediate = 0
+	var ce *constraintError
+	if !errors.As(err, &ce) {
+		if err != nil {
+			db.fkDeferred = db.fkDeferredAtStatement
+		}
+		err = db.file.endStatement(err)
+		if !db.file.inTransaction {
+			db.fkDeferred = 0
+		}
+		return err
+	}
+	switch ce.resolution {
+	case "FAIL":
+		if commitErr := db.file.endStatement(nil); commitErr != nil {
+			return commitErr
+		}
+	case "ROLLBACK":
+		db.file.endStatement(err)
+		db.fkDeferred = 0
+		if db.file.inTransaction {
+			db.file.rollback()
+			if reloadErr := db.reloadSchema(); reloadErr != nil {
+				return reloadErr
+			}
+		}
+	default:
+		db.fkDeferred = db.fkDeferredAtStatement
+		db.file.endStatement(err)
+	}
+	if !db.file.inTransaction {
+		db.fkDeferred = 0
+	}
+	return err
+}
+
+// Applies the NOT NULL and CHECK constraints to a row about to be written.
+// Returns false when IGNORE skips the row. Under REPLACE a NULL in a NOT
+// NULL column takes the column's default, if it has one.
+func (w *tableWriter) checkRow(values []interface{}, rowid int64, onConflict string) (bool, error) {
+	for i, col := range w.def.columns {
+		if !col.notNull || values[i] != nil {
+			continue
+		}
+		resolution := conflictResolution(onConflict, col.notNullConflict)
+		if resolution == "REPLACE" {
+			if v := insertDefault(col); v != nil {
+				values[i] = applyAffinity(normalizeValue(v), col.affinity)
+				w.computeGenerated(values, rowid)
+				continue
+			}
+			resolution = "ABORT"
+		}
+		if resolution == "IGNORE" {
+			return false, nil
+		}
+		return false, &constraintError{fmt.Sprintf("NOT NULL constraint failed: %s.%s", w.def.name, col.name), resolution}
+	}
+
+	for i, check := range w.checks {
+		v := evaluateCondition(check, w.columnIndex, w.columnNames, "", values, int(rowid))
+		if v == nil || isTrue(v) {
+			continue
+		}
+		resolution := conflictResolution(onConflict, "")
+		if resolution == "IGNORE" {
+			return false, nil
+		}
+		if resolution == "REPLACE" {
+			resolution = "ABORT"
+		}
+		name := w.def.checks[i].name
+		if name == "" {
+			name = w.def.checks[i].expr
+		}
+		return false, &constraintError{"CHECK constraint failed: " + name, resolution}
+	}
+	return true, nil
+}
+
+// uniqueCheck is a uniqueness constraint a written row must keep: the
+// rowid when index is nil, otherwise a unique index
+type uniqueCheck struct {
+	index      *indexWriter
+	resolution string
+	upsert     *upsertClause // the ON CONFLICT clause that handles a conflict
+}
+
+// Lists a statement's uniqueness checks in the order SQLite makes them:
+// those an upsert names first, then the rowid and the unique indexes,
+// newest first, with those resolved by REPLACE, which deletes rows, last
+func (w *tableWriter) uniqueChecks(onConflict string, upserts []*upsertClause) ([]uniqueCheck, error) {
+	all := []uniqueCheck{{resolution: conflictResolution(onConflict, w.def.pkConflict)}}
+	if w.def.rowidColumn() < 0 {
+		all[0].resolution = conflictResolution(onConflict, "")
+	}
+	for i := len(w.indexes) - 1; i >= 0; i-- {
+		if ix := w.indexes[i]; ix.def.unique {
+			all = append(all, uniqueCheck{index: ix, resolution: conflictResolution(onConflict, ix.def.conflict)})
+		}
+	}
+
+	var checks []uniqueCheck
+	for _, u := range upserts {
+		if u.target == nil {
+			continue
+		}
+		matched := false
+		for i := range all {
+			if w.upsertMatches(u, all[i].index) {
+				matched = true
+				if all[i].upsert == nil {
+					all[i].upsert = u
+					checks = append(checks, all[i])
+				}
+			}
+		}
+		if !matched {
+			return nil, fmt.Errorf("ON CONFLICT clause does not match any PRIMARY KEY or UNIQUE constraint")
+		}
+	}
+	for _, replace := range []bool{false, true} {
+		for _, c := range all {
+			if c.upsert != nil || (c.resolution == "REPLACE") != replace {
+				continue
+			}
+			if n := len(upserts); n > 0 && upserts[n-1].target == nil {
+				c.upsert = upserts[n-1]
+			}
+			checks = append(checks, c)
+		}
+	}
+	return checks, nil
+}
+
+// Reports whether an upsert's conflict target names the constraint of ix,
+// or the rowid when ix is nil: the same set of columns, with matching
+// collations where the target gives one
+func (w *tableWriter) upsertMatches(u *upsertClause, ix *indexWriter) bool {
+	if ix == nil {
+		if len(u.target) != 1 {
+			return false
+		}
+		i := w.def.columnIndex(u.target[0].name)
+		return i >= 0 && w.def.columns[i].isRowid || i < 0 && isRowidName(u.target[0].name)
+	}
+	if len(u.target) != len(ix.def.columns) || (ix.def.where != "") != (u.targetWhere != "") {
+		return false
+	}
+	for _, t := range u.target {
+		found := false
+		for j, col := range ix.def.columns {
+			if strings.EqualFold(t.name, col.name) &&
+				(t.collation == "" || strings.EqualFold(t.collation, ix.columns[j].collation) ||
+					ix.columns[j].collation == "" && strings.EqualFold(t.collation, "BINARY")) {
+				found = true
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// Finds a row other than self that already holds what a uniqueness check
+// guards, for a row about to be written under rowid
+func (w *tableWriter) conflictingRow(c uniqueCheck, values []interface{}, rowid int64, self *int64) (int64, bool, error) {
+	isSelf := func(other int64) bool { return self != nil && other == *self }
+	if c.index == nil {
+		if isSelf(rowid) {
+			return 0, false, nil
+		}
+		exists, err := w.rowExists(rowid)
+		return rowid, exists, err
+	}
+	key, ok := w.indexKey(c.index, values, rowid)
+	if !ok {
+		return 0, false, nil
+	}
+	other, found, err := w.db.file.findIndexPrefix(c.index.def.rootPage, key[:len(key)-1], c.index.columns)
+	return other, found && !isSelf(other), err
+}
+
+// Settles the uniqueness conflicts of a row about to be written under
+// rowid; self is its current rowid in an UPDATE and nil in an INSERT.
+// REPLACE deletes the rows in the way. Returns "IGNORE" when the row is
+// to be skipped, or the upsert clause and row that take over from an
+// INSERT.
+func (w *tableWriter) settleConflicts(checks []uniqueCheck, values []interface{}, rowid int64, self *int64) (string, *upsertClause, int64, error) {
+	for _, c := range checks {
+		other, found, err := w.conflictingRow(c, values, rowid, self)
+		if err != nil {
+			return "", nil, 0, err
+		}
+		if !found {
+			continue
+		}
+		if c.upsert != nil {
+			return "", c.upsert, other, nil
+		}
+		switch c.resolution {
+		case "REPLACE":
+			if err := w.replaceRow(other); err != nil {
+				return "", nil, 0, err
+			}
+		case "IGNORE":
+			return "IGNORE", nil, 0, nil
+		default:
+			target := w.rowidTarget()
+			if c.index != nil {
+				target = w.uniqueTarget(c.index)
+			}
+			return "", nil, 0, &constraintError{"UNIQUE constraint failed: " + target, c.resolution}
+		}
+	}
+	return "", nil, 0, nil
+}
+
+// Deletes a row that a REPLACE conflict resolution removes, remembering
+// it so an UPDATE does not go on to change it. Its DELETE triggers only
+// fire when recursive_triggers is on.
+func (w *tableWriter) replaceRow(rowid int64) error {
+	row, found, err := w.loadRow(rowid)
+	if err != nil || !found {
+		return err
+	}
+	if w.replaced == nil {
+		w.replaced = make(map[int64]bool)
+	}
+	w.replaced[rowid] = true
+	if w.db.recursiveTriggers {
+		_, err := w.deleteWithTriggers(row)
+		return err
+	}
+	return w.deleteRow(row.values, rowid)
+}
+
+// Reads one row's values by rowid
+func (w *tableWriter) loadRow(rowid int64) (relationRow, bool, error) {
+	where := &sqlparser.ComparisonExpr{
+		Operator: sqlparser.EqualStr,
+		Left:     &sqlparser.ColName{Name: sqlparser.NewColIdent("rowid")},
+		Right:    sqlparser.NewIntVal([]byte(fmt.Sprint(rowid))),
+	}
+	_, rows, err := w.matchingRows(w.def.name, where)
+	if err != nil || len(rows) == 0 {
+		return relationRow{}, false, err
+	}
+	return rows[0], true, nil
+}
+
+// Runs the DO UPDATE or DO NOTHING of an upsert against the row an INSERT
+// ran into. The SET expressions see that row's columns and, through the
+// "excluded." prefix, the row that was to be inserted. Returns whether
+// the row changed.
+func (w *tableWriter) upsert(u *upsertClause, rowid int64, excluded []interface{}) (bool, error) {
+	if u.doNothing {
+		return false, nil
+	}
+	row, found, err := w.loadRow(rowid)
+	if err != nil || !found {
+		return false, err
+	}
+	assignments, err := w.assignments(u.assignments)
+	if err != nil {
+		return false, err
+	}
+	index, names := w.upsertColumns()
+	for _, a := range assignments {
+		if err := checkColumns(a.expr, index); err != nil {
+			return false, err
+		}
+	}
+	if err := checkColumns(u.where, index); err != nil {
+		return false, err
+	}
+	values := append(append([]interface{}(nil), row.values...), excluded...)
+
+	// Subqueries see both rows, as the expressions around them do
+	rel := w.upsertRelation()
+	both := relationRow{values: values, rowid: row.rowid}
+	where := u.where
+	if containsSubquery(where) {
+		if where, err = w.db.bindOuterRow(where, rel, both); err != nil {
+			return false, err
+		}
+	}
+	if where != nil && !evaluateWhereClause(where, index, names, "", values, row.rowid) {
+		return false, nil
+	}
+	if assignments, err = w.bindAssignments(assignments, rel, both); err != nil {
+		return false, err
+	}
+	checks, err := w.uniqueChecks("", nil)
+	if err != nil {
+		return false, err
+	}
+	return w.updateWith(row, assignments, index, names, values, "", checks)
+}
+
+// The columns of upsertColumns as a relation: the table's, then those of
+// the excluded row
+func (w *tableWriter) upsertRelation() *relation {
+	rel := &relation{}
+	for _, table := range []string{w.def.name, "excluded"} {
+		for _, col := range w.def.columns {
+			rel.columns = append(rel.columns, relationColumn{table: table, name: col.name, collation: col.collation})
+		}
+	}
+	return rel
+}
+
+// The columns an upsert's expressions can refer to: the table's, then
+// the same again as excluded.<column>
+func (w *tableWriter) upsertColumns() (map[string]int, []string) {
+	index := make(map[string]int, 2*len(w.columnIndex))
+	for name, i := range w.columnIndex {
+		index[name] = i
+	}
+	n := len(w.def.columns)
+	for i, col := range w.def.columns {
+		index["excluded."+strings.ToLower(col.name)] = n + i
+	}
+	return index, append(append([]string(nil), w.columnNames...), w.columnNames...)
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/xwb1989/sqlparser"
+)
+
+// Runs CREATE TABLE, CREATE [UNIQUE] INDEX, CREATE VIEW and CREATE
+// TRIGGER. The statement
+// is stored in sqlite_schema the way SQLite stores it: from the object's
+// name onwards, behind a canonical "CREATE <kind>" prefix.
+func executeCreate(db *database, sql string) error {
+	s, err := newTokenStream(sql)
+	if err != nil {
+		return err
+	}
+	if err := s.expectKeyword("CREATE"); err != nil {
+		return err
+	}
+	if s.atKeyword("TEMP", "TEMPORARY") {
+		return fmt.Errorf("temporary objects are not supported")
+	}
+	unique := s.acceptKeyword("UNIQUE")
+	kind := strings.ToUpper(s.peek().text)
+	switch {
+	case kind == "INDEX", !unique && (kind == "TABLE" || kind == "VIEW" || kind == "TRIGGER"):
+		s.next()
+	default:
+		return s.syntaxError()
+	}
+	ifNotExists := s.atKeyword("IF")
+	if err := acceptIfNotExists(s); err != nil {
+		return err
+	}
+	nameStart := s.peek().pos
+	if _, err := s.expectName(); err != nil {
+		return err
+	}
+	if s.acceptPunct(".") {
+		nameStart = s.peek().pos
+	}
+	prefix := "CREATE " + kind + " "
+	if unique {
+		prefix = "CREATE UNIQUE INDEX "
+	}
+	stored := prefix + trimStatement(sql[nameStart:])
+
+	switch kind {
+	case "TABLE":
+		def, err := parseCreateTable(sql)
+		if err != nil {
+			return err
+		}
+		if exists, err := checkNewName(db, "table", def.name); exists && ifNotExists {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		return createTable(db, def, stored)
+	case "INDEX":
+		def, err := parseCreateIndex(sql)
+		if err != nil {
+			return err
+		}
+		if exists, err := checkNewName(db, "index", def.name); exists && ifNotExists {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		return createIndex(db, def, stored)
+	case "TRIGGER":
+		def, err := parseCreateTrigger(sql)
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(strings.ToLower(def.name), "sqlite_") {
+			return fmt.Errorf("object name reserved for internal use: %s", def.name)
+		}
+		if db.findSchemaRow("trigger", def.name) != nil {
+			if ifNotExists {
+				return nil
+			}
+			return fmt.Errorf("trigger %s already exists", def.name)
+		}
+		return createTrigger(db, def, stored)
+	default:
+		def, err := parseCreateView(sql)
+		if err != nil {
+			return err
+		}
+		if exists, err := checkNewName(db, "view", def.name); exists && ifNotExists {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		return createView(db, def, stored)
+	}
+}
+
+// Checks that a new object's name is free. Reports whether an object of
+// the same kind already has it, which IF NOT EXISTS tolerates.
+func checkNewName(db *database, kind, name string) (bool, error) {
+	if strings.HasPrefix(strings.ToLower(name), "sqlite_") || isSchemaTableName(name) {
+		return false, fmt.Errorf("object name reserved for internal use: %s", name)
+	}
+	for _, row := range db.schema {
+		if !strings.EqualFold(row.name, name) || row._type == "trigger" {
+			continue
+		}
+		switch {
+		case kind == "index" && row._type == "index":
+			return true, fmt.Errorf("index %s already exists", name)
+		case kind == "index":
+			return false, fmt.Errorf("there is already a table named %s", name)
+		case row._type == "index":
+			return false, fmt.Errorf("there is already an index named %s", name)
+		default:
+			return true, fmt.Errorf("%s %s already exists", row._type, name)
+		}
+	}
+	return false, nil
+}
+
+// Creates an empty table with the indexes its PRIMARY KEY and UNIQUE
+// constraints need, and sqlite_sequence for its first AUTOINCREMENT table
+func createTable(db *database, def *tableDef, stored string) (err error) {
+	if def.asSelect != "" {
+		return fmt.Errorf("CREATE TABLE ... AS SELECT is not supported")
+	}
+	seen := make(map[string]bool)
+	for _, col := range def.columns {
+		if seen[strings.ToLower(col.name)] {
+			return fmt.Errorf("duplicate column name: %s", col.name)
+		}
+		seen[strings.ToLower(col.name)] = true
+		if col.autoincrement && def.withoutRowid {
+			return fmt.Errorf("AUTOINCREMENT not allowed on WITHOUT ROWID tables")
+		}
+		if col.autoincrement && !col.isRowid {
+			return fmt.Errorf("AUTOINCREMENT is only allowed on an INTEGER PRIMARY KEY")
+		}
+	}
+
+	db.file.beginStatement()
+	defer func() { err = db.endSchemaStatement(err) }()
+
+	// A WITHOUT ROWID table is stored as an index b-tree keyed by its
+	// primary key, which then needs no index of its own
+	pageType := byte(0x0D)
+	if def.withoutRowid {
+		pageType = 0x0A
+	}
+	root, err := db.file.newTree(pageType)
+	if err != nil {
+		return err
+	}
+	if err := db.insertSchemaRow("table", def.name, def.name, root, stored); err != nil {
+		return err
+	}
+	for i, auto := range def.autoIndexes() {
+		if def.withoutRowid && auto.origin == "pk" {
+			continue
+		}
+		root, err := db.file.newTree(0x0A)
+		if err != nil {
+			return err
+		}
+		name := fmt.Sprintf("sqlite_autoindex_%s_%d", def.name, i+1)
+		if err := db.insertSchemaRow("index", name, def.name, root, ""); err != nil {
+			return err
+		}
+	}
+	if def.hasAutoincrement() && db.findSchemaRow("table", "sqlite_sequence") == nil {
+		root, err := db.file.newTree(0x0D)
+		if err != nil {
+			return err
+		}
+		return db.insertSchemaRow("table", "sqlite_sequence", "sqlite_sequence", root, "CREATE TABLE sqlite_sequence(name,seq)")
+	}
+	return nil
+}
+
+// Creates an index and fills it from the table's rows, which are sorted
+// by key so the b-tree can be built bottom up
+func createIndex(db *database, def *indexDef, stored string) (err error) {
+	switch {
+	case isSchemaTableName(def.table):
+		return fmt.Errorf("table %s may not be indexed", def.table)
+	case db.findSchemaRow("view", def.table) != nil:
+		return fmt.Errorf("views may not be indexed")
+	}
+	tableRow := db.findSchemaRow("table", def.table)
+	if tableRow == nil {
+		return fmt.Errorf("no such table: main.%s", def.table)
+	}
+	if strings.HasPrefix(strings.ToLower(tableRow.name), "sqlite_") {
+		return fmt.Errorf("table %s may not be indexed", tableRow.name)
+	}
+
+	db.file.beginStatement()
+	defer func() { err = db.endSchemaStatement(err) }()
+	defer recoverEvalError(&err)
+
+	root, err := db.file.newTree(0x0A)
+	if err != nil {
+		return err
+	}
+	if err := db.insertSchemaRow("index", def.name, tableRow.name, root, stored); err != nil {
+		return err
+	}
+	if err := db.reloadSchema(); err != nil {
+		return err
+	}
+	w, err := newTableWriter(db, tableRow.name)
+	if err != nil {
+		return err
+	}
+	var ix *indexWriter
+	for _, candidate := range w.indexes {
+		if strings.EqualFold(candidate.def.name, def.name) {
+			ix = candidate
+		}
+	}
+	if ix == nil {
+		return fmt.Errorf("malformed index definition: %s", def.name)
+	}
+	for _, expr := range ix.exprs {
+		if err := checkColumns(expr, w.columnIndex); err != nil {
+			return err
+		}
+	}
+	if err := checkColumns(ix.where, w.columnIndex); err != nil {
+		return err
+	}
+
+	_, rows, err := w.matchingRows(w.def.name, nil)
+	if err != nil {
+		return err
+	}
+	var keys [][]interface{}
+	for _, row := range rows {
+		if key, ok := w.indexKey(ix, row.values, int64(row.rowid)); ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.SliceStable(keys, func(i, j int) bool {
+		return compareIndexKeys(keys[i], keys[j], ix.columns) < 0
+	})
+
+	cells := make([][]byte, 0, len(keys))
+	for i, key := range keys {
+		if ix.def.unique && i > 0 && !hasNull(key[:len(key)-1]) &&
+			compareIndexKeys(key[:len(key)-1], keys[i-1][:len(key)-1], ix.columns) == 0 {
+			return fmt.Errorf("UNIQUE constraint failed: %s", w.uniqueTarget(ix))
+		}
+		cell, err := db.file.indexLeafCell(serializeRecord(key))
+		if err != nil {
+			return err
+		}
+		cells = append(cells, cell)
+	}
+	return db.file.buildTree(root, 0x0A, cells)
+}
+
+// Creates a view once its query is known to parse
+func createView(db *database, def *viewDef, stored string) (err error) {
+	if _, err := sqlparser.Parse(prepareSQL(def.selectSQL)); err != nil {
+		return fmt.Errorf("failed to parse SQL: %v", err)
+	}
+	db.file.beginStatement()
+	defer func() { err = db.endSchemaStatement(err) }()
+	return db.insertSchemaRow("view", def.name, def.name, 0, stored)
+}
+
+// Creates a trigger on a table, or an INSTEAD OF trigger on a view. Its
+// program is only checked when the trigger fires.
+func createTrigger(db *database, def *triggerDef, stored string) (err error) {
+	target := db.findSchemaRow("table", def.table)
+	if target == nil {
+		target = db.findSchemaRow("view", def.table)
+	}
+	switch {
+	case target == nil && isSchemaTableName(def.table),
+		target != nil && strings.HasPrefix(strings.ToLower(target.name), "sqlite_"):
+		return fmt.Errorf("cannot create trigger on system table")
+	case target == nil:
+		return fmt.Errorf("no such table: main.%s", def.table)
+	case target._type == "view" && def.timing != "INSTEAD OF":
+		return fmt.Errorf("cannot create %s trigger on view: %s", def.timing, target.name)
+	case target._type == "table" && def.timing == "INSTEAD OF":
+		return fmt.Errorf("cannot create INSTEAD OF trigger on table: %s", target.name)
+	}
+	db.file.beginStatement()
+	defer func() { err = db.endSchemaStatement(err) }()
+	return db.insertSchemaRow("trigger", def.name, target.name, 0, stored)
+}
+
+func hasNull(values []interface{}) bool {
+	for _, v := range values {
+		if v == nil {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/binary"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// database is an open database file together with its parsed schema
+type database struct {
+	file      *pager
+	pageSize  int
+	schema    []SQLiteSchemaRow
+	schemaErr error // why sqlite_schema could not be read when opened
+
+	expandingViews map[string]bool // views being expanded, to detect cycles
+
+	// PRAGMA foreign_keys, and the number of rows breaking foreign keys
+	// that the current statement (immediate constraints) or transaction
+	// (deferred ones) must resolve before it ends
+	foreignKeys           bool
+	fkImmediate           int
+	fkDeferred            int
+	fkDeferredAtStatement int
+
+	// PRAGMA recursive_triggers, and the triggers whose programs are
+	// running, innermost last
+	recursiveTriggers bool
+	triggerStack      []string
+
+	// The rows of the queries whose correlated subqueries are running,
+	// innermost last
+	outerRows []outerRow
+
+	interrupted atomic.Bool // set by Ctrl-C to stop the running statement
+}
+
+func openDatabase(path string) (*database, error) {
+	file, err := openPager(path)
+	if err != nil {
+		return nil, err
+	}
+	db := &database{
+		file:           file,
+		pageSize:       file.pageSize,
+		expandingViews: make(map[string]bool),
+	}
+	// A damaged schema leaves the database open with no tables, for
+	// PRAGMA integrity_check and .recover to look at
+	db.schemaErr = db.reloadSchema()
+	return db, nil
+}
+
+// Fails the running statement once Ctrl-C asked for it to stop
+func (db *database) checkInterrupt() {
+	if db.interrupted.Load() {
+		raiseEvalError("interrupted")
+	}
+}
+
+// Closes the database, checkpointing and removing the log in WAL mode
+func (db *database) close() error {
+	return db.file.close()
+}
+
+// Takes the lock a statement reads under. When another connection has
+// committed since this one last held it, the schema is read again.
+func (db *database) beginRead() error {
+	changed, err := db.file.beginRead()
+	if err == nil && changed {
+		db.schemaErr = db.reloadSchema()
+	}
+	return err
+}
+
+// Re-reads sqlite_schema, after a statement changed it
+func (db *database) reloadSchema() error {
+	schema, err := readSchemaTable(db.file)
+	if err != nil {
+		return err
+	}
+	db.schema = schema
+	return nil
+}
+
+// Ends a statement that changed sqlite_schema, bumping the schema cookie
+// once for it. The schema is read again whether the statement's changes
+// were kept or undone.
+func (db *database) endSchemaStatement(err error) error {
+	if err == nil {
+		err = db.changeSchemaCookie()
+	}
+	err = db.file.endStatement(err)
+	if reloadErr := db.reloadSchema(); err == nil {
+		err = reloadErr
+	}
+	return err
+}
+
+// Adds an entry to sqlite_schema after the existing ones. Automatic
+// indexes have no SQL, which is stored as NULL.
+func (db *database) insertSchemaRow(_type, name, tblName string, rootPage int, sql string) error {
+	rowid, _, err := db.file.maxRowid(1)
+	if err != nil {
+		return err
+	}
+	var sqlValue interface{}
+	if sql != "" {
+		sqlValue = sql
+	}
+	record := serializeRecord([]interface{}{_type, name, tblName, int64(rootPage), sqlValue})
+	cell, err := db.file.tableLeafCell(rowid+1, record)
+	if err != nil {
+		return err
+	}
+	return db.file.insertTableCell(1, rowid+1, cell)
+}
+
+// Rewrites an entry of sqlite_schema in place
+func (db *database) updateSchemaRow(row *SQLiteSchemaRow, name, tblName, sql string) error {
+	var sqlValue interface{}
+	if sql != "" {
+		sqlValue = sql
+	}
+	record := serializeRecord([]interface{}{row._type, name, tblName, int64(row.rootPage), sqlValue})
+	cell, err := db.file.tableLeafCell(int64(row.rowid), record)
+	if err != nil {
+		return err
+	}
+	return db.file.insertTableCell(1, int64(row.rowid), cell)
+}
+
+func (db *database) deleteSchemaRow(row *SQLiteSchemaRow) error {
+	_, err := db.file.deleteTableCell(1, int64(row.rowid))
+	return err
+}
+
+// Increments the schema cookie in the header, which tells other
+// connections that their cached schema is stale
+func (db *database) changeSchemaCookie() error {
+	header, err := db.file.writablePage(1)
+	if err != nil {
+		return err
+	}
+	binary.BigEndian.PutUint32(header[40:44], binary.BigEndian.Uint32(header[40:44])+1)
+	return nil
+}
+
+// Looks up a schema entry of the given type by name, case-insensitively
+func (db *database) findSchemaRow(_type, name string) *SQLiteSchemaRow {
+	for i := range db.schema {
+		if db.schema[i]._type == _type && strings.EqualFold(db.schema[i].name, name) {
+			return &db.schema[i]
+		}
+	}
+	return nil
+}
+
+// Returns the indexes on a table, including those created automatically
+// for PRIMARY KEY and UNIQUE constraints
+func (db *database) tableIndexes(tableName string) []*indexDef {
+	var indexes []*indexDef
+	for _, row := range db.schema {
+		if row._type != "index" || !strings.EqualFold(row.tblName, tableName) {
+			continue
+		}
+		if _, def, _ := db.lookupIndex(row.name); def != nil {
+			indexes = append(indexes, def)
+		}
+	}
+	return indexes
+}
+
+// Resolves an index name to its table and columns; automatic indexes have
+// no SQL and are found through the table's constraints
+func (db *database) lookupIndex(name string) (*tableDef, *indexDef, string) {
+	row := db.findSchemaRow("index", name)
+	if row == nil {
+		return nil, nil, ""
+	}
+	tableRow := db.findSchemaRow("table", row.tblName)
+	if tableRow == nil {
+		return nil, nil, ""
+	}
+	table, err := parseCreateTable(tableRow.sql)
+	if err != nil {
+		return nil, nil, ""
+	}
+	if row.sql != "" {
+		def, err := parseCreateIndex(row.sql)
+		if err != nil {
+			return nil, nil, ""
+		}
+		def.rootPage = row.rootPage
+		return table, def, "c"
+	}
+
+	n, err := strconv.Atoi(row.name[strings.LastIndexByte(row.name, '_')+1:])
+	autos := table.autoIndexes()
+	if err != nil || n < 1 || n > len(autos) {
+		return nil, nil, ""
+	}
+	auto := autos[n-1]
+	return table, &indexDef{name: row.name, table: table.name, unique: true, columns: auto.columns, rootPage: row.rootPage, conflict: auto.conflict}, auto.origin
+}
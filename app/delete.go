@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/xwb1989/sqlparser"
+)
+
+// Runs a DELETE statement, returning the number of rows removed
+func executeDelete(db *database, stmt *sqlparser.Delete) (n int, err error) {
+	db.beginWriteStatement()
+	defer func() { err = db.endWriteStatement(err) }()
+	defer recoverEvalError(&err)
+
+	name, alias, err := writeTarget(stmt.Targets, stmt.TableExprs)
+	if err != nil {
+		return 0, err
+	}
+	if len(stmt.OrderBy) > 0 || stmt.Limit != nil {
+		return 0, fmt.Errorf("ORDER BY and LIMIT are not supported on DELETE")
+	}
+	var where sqlparser.Expr
+	if stmt.Where != nil {
+		where = stmt.Where.Expr
+	}
+	if view := db.findSchemaRow("view", name); view != nil {
+		return deleteFromView(db, view, alias, where)
+	}
+	w, err := newTableWriter(db, name)
+	if err != nil {
+		return 0, err
+	}
+	if err := w.checkReferringKeys(nil); err != nil {
+		return 0, err
+	}
+
+	_, rows, err := w.matchingRows(alias, where)
+	if err != nil {
+		return 0, err
+	}
+
+	// Without a WHERE clause the table and its indexes are emptied whole,
+	// unless foreign keys or triggers need to see each row go
+	if where == nil && len(w.references) == 0 && len(w.referencedBy) == 0 && !hasTriggers(w.triggers, "BEFORE", "DELETE") && !hasTriggers(w.triggers, "AFTER", "DELETE") {
+		if err := w.truncate(); err != nil {
+			return 0, err
+		}
+		return len(rows), nil
+	}
+	for _, row := range rows {
+		if len(w.triggers) > 0 {
+			// Triggers may have changed or removed the row since it was read
+			current, found, err := w.loadRow(int64(row.rowid))
+			if err != nil {
+				return n, err
+			}
+			if !found {
+				continue
+			}
+			row = current
+		}
+		if deleted, err := w.deleteWithTriggers(row); err != nil {
+			return n, err
+		} else if deleted {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// Removes every row of the table and every entry of its indexes
+func (w *tableWriter) truncate() error {
+	if err := w.db.file.clearTree(w.root); err != nil {
+		return err
+	}
+	for _, ix := range w.indexes {
+		if err := w.db.file.clearTree(ix.def.rootPage); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Names the single table an UPDATE or DELETE changes and the alias its
+// columns go by
+func writeTarget(targets sqlparser.TableNames, tableExprs sqlparser.TableExprs) (string, string, error) {
+	if len(targets) > 0 || len(tableExprs) != 1 {
+		return "", "", fmt.Errorf("only one table can be changed at a time")
+	}
+	aliased, ok := tableExprs[0].(*sqlparser.AliasedTableExpr)
+	if !ok {
+		return "", "", fmt.Errorf("only one table can be changed at a time")
+	}
+	table, ok := aliased.Expr.(sqlparser.TableName)
+	if !ok {
+		return "", "", fmt.Errorf("only one table can be changed at a time")
+	}
+	name := table.Name.String()
+	alias := name
+	if !aliased.As.IsEmpty() {
+		alias = aliased.As.String()
+	}
+	return name, alias, nil
+}
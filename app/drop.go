@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Runs DROP TABLE, DROP INDEX, DROP VIEW and DROP TRIGGER. Every page of
+// a dropped b-tree goes on the freelist.
+func executeDrop(db *database, sql string) (err error) {
+	s, err := newTokenStream(sql)
+	if err != nil {
+		return err
+	}
+	if err := s.expectKeyword("DROP"); err != nil {
+		return err
+	}
+	kind := strings.ToLower(s.peek().text)
+	switch kind {
+	case "table", "index", "view", "trigger":
+		s.next()
+	default:
+		return s.syntaxError()
+	}
+	ifExists := s.acceptKeyword("IF")
+	if ifExists {
+		if err := s.expectKeyword("EXISTS"); err != nil {
+			return err
+		}
+	}
+	name, err := s.expectQualifiedName()
+	if err != nil {
+		return err
+	}
+	s.acceptPunct(";")
+	if !s.atEnd() {
+		return s.syntaxError()
+	}
+
+	row := db.findSchemaRow(kind, name)
+	if row == nil {
+		switch {
+		case kind == "table" && isSchemaTableName(name):
+			return fmt.Errorf("table %s may not be dropped", name)
+		case kind == "table" && db.findSchemaRow("view", name) != nil:
+			return fmt.Errorf("use DROP VIEW to delete view %s", name)
+		case kind == "view" && db.findSchemaRow("table", name) != nil:
+			return fmt.Errorf("use DROP TABLE to delete table %s", name)
+		case ifExists:
+			return nil
+		}
+		return fmt.Errorf("no such %s: %s", kind, name)
+	}
+	switch {
+	case kind == "table" && strings.HasPrefix(strings.ToLower(row.name), "sqlite_") &&
+		!strings.HasPrefix(strings.ToLower(row.name), "sqlite_stat"):
+		return fmt.Errorf("table %s may not be dropped", row.name)
+	case kind == "index" && row.sql == "":
+		return fmt.Errorf("index associated with UNIQUE or PRIMARY KEY constraint cannot be dropped")
+	}
+
+	db.file.beginStatement()
+	defer func() { err = db.endSchemaStatement(err) }()
+	if kind == "table" && db.foreignKeys {
+		if err := db.deleteBeforeDrop(row); err != nil {
+			return err
+		}
+	}
+
+	// A table or view takes its indexes and triggers with it
+	for i := range db.schema {
+		other := &db.schema[i]
+		if other.rowid != row.rowid && (kind == "index" || kind == "trigger" || !strings.EqualFold(other.tblName, row.name)) {
+			continue
+		}
+		if other._type == "table" || other._type == "index" {
+			if err := db.file.dropTree(other.rootPage); err != nil {
+				return err
+			}
+		}
+		if err := db.deleteSchemaRow(other); err != nil {
+			return err
+		}
+	}
+	if kind == "table" {
+		return db.deleteSequence(row.name)
+	}
+	return nil
+}
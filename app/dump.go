@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Prints the database as SQL text that recreates it: the tables with
+// INSERT statements for their rows, then the views, triggers and indexes,
+// all in one transaction. With LIKE patterns only the objects whose names
+// match one are dumped.
+func (sh *shell) dump(args []string) error {
+	patterns := args[1:]
+	matches := func(name string) bool {
+		if len(patterns) == 0 {
+			return true
+		}
+		for _, pattern := range patterns {
+			if likeMatch(pattern, name, 0) {
+				return true
+			}
+		}
+		return false
+	}
+
+	var tables, others []SQLiteSchemaRow
+	for _, row := range sh.db.schema {
+		if row.sql == "" || !matches(row.name) {
+			continue
+		}
+		if row._type == "table" {
+			tables = append(tables, row)
+		} else {
+			others = append(others, row)
+		}
+	}
+	// sqlite_sequence comes after the tables whose AUTOINCREMENT it
+	// records; then views, triggers and indexes, in that order
+	sort.SliceStable(tables, func(i, j int) bool {
+		return tables[i].name != "sqlite_sequence" && tables[j].name == "sqlite_sequence"
+	})
+	sort.SliceStable(others, func(i, j int) bool {
+		return others[i]._type > others[j]._type
+	})
+
+	w := bufio.NewWriter(os.Stdout)
+	defer w.Flush()
+	w.WriteString("PRAGMA foreign_keys=OFF;\n")
+	w.WriteString("BEGIN TRANSACTION;\n")
+	for _, row := range tables {
+		switch {
+		case row.name == "sqlite_sequence":
+		case strings.HasPrefix(row.name, "sqlite_stat"):
+			// ANALYZE creates the statistics tables
+			w.WriteString("ANALYZE sqlite_schema;\n")
+		case isSystemName(row.name):
+			continue
+		case strings.HasPrefix(row.sql, `CREATE TABLE "`) || strings.HasPrefix(row.sql, "CREATE TABLE '"):
+			// Like sqlite3, so that restoring into a database that has the
+			// table already goes on
+			fmt.Fprintf(w, "CREATE TABLE IF NOT EXISTS %s;\n", row.sql[len("CREATE TABLE "):])
+		default:
+			fmt.Fprintf(w, "%s;\n", row.sql)
+		}
+		sh.dumpRows(w, row)
+	}
+	for _, row := range others {
+		fmt.Fprintf(w, "%s;\n", row.sql)
+	}
+	w.WriteString("COMMIT;\n")
+	return nil
+}
+
+// Prints the rows of a table as INSERT statements. Generated columns are
+// left out, since they cannot be inserted.
+func (sh *shell) dumpRows(w *bufio.Writer, row SQLiteSchemaRow) {
+	def, err := parseCreateTable(row.sql)
+	if err != nil {
+		fmt.Fprintf(w, "/**** ERROR: %v *****/\n", err)
+		return
+	}
+	var columns []string
+	for _, col := range def.columns {
+		if col.generated == "" {
+			columns = append(columns, quoteIdentifier(col.name))
+		}
+	}
+	rs, err := executeStatement(sh.db, fmt.Sprintf("SELECT %s FROM %s", strings.Join(columns, ","), quoteIdentifier(row.name)))
+	if err != nil {
+		fmt.Fprintf(w, "/**** ERROR: %v *****/\n", err)
+		return
+	}
+	table := row.name
+	if !isPlainIdentifier(table) {
+		table = quoteIdentifier(table)
+	}
+	for _, values := range rs.rows {
+		fmt.Fprintf(w, "INSERT INTO %s VALUES(", table)
+		writeLiterals(w, values)
+		w.WriteString(");\n")
+	}
+}
@@ -0,0 +1,597 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// foreignKeyLink is a foreign key resolved against the schema: which
+// columns of the child table hold the key of which parent row, and how
+// the parent's rows are found by it
+type foreignKeyLink struct {
+	fk         foreignKeyDef
+	id         int // as PRAGMA foreign_key_list numbers it
+	child      *tableDef
+	parent     *tableDef // nil when the parent table does not exist
+	parentRoot int
+	childCols  []int
+	parentCols []int
+	affinities []string    // parent column affinity of each key column
+	columns    []keyColumn // how each key column compares
+	index      *indexDef   // the parent's unique index on the key; nil when the key is the rowid
+	indexOrder []int       // key column of each index column
+
+	// Why a foreign key referring to the table being written is broken,
+	// which only fails statements that could orphan its child rows
+	err error
+}
+
+// Resolves the id-th foreign key of a table as PRAGMA foreign_key_list
+// numbers them, counting from the last one declared. The parent key must
+// be the parent's rowid, or have a unique index.
+func resolveForeignKey(db *database, child *tableDef, id int) (*foreignKeyLink, error) {
+	fk := child.foreignKeys[len(child.foreignKeys)-1-id]
+	link := &foreignKeyLink{fk: fk, id: id, child: child}
+	for _, name := range fk.columns {
+		i := child.columnIndex(name)
+		if i < 0 {
+			return nil, fmt.Errorf("unknown column \"%s\" in foreign key definition", name)
+		}
+		link.childCols = append(link.childCols, i)
+	}
+	parentRow := db.findSchemaRow("table", fk.table)
+	if parentRow == nil {
+		return link, nil
+	}
+	parent, err := parseCreateTable(parentRow.sql)
+	if err != nil {
+		return nil, err
+	}
+	link.parent, link.parentRoot = parent, parentRow.rootPage
+
+	mismatch := fmt.Errorf("foreign key mismatch - \"%s\" referencing \"%s\"", child.name, parent.name)
+	names := fk.parentColumnNames(parent)
+	if len(names) == 0 || len(names) != len(link.childCols) {
+		return nil, mismatch
+	}
+	for _, name := range names {
+		i := parent.columnIndex(name)
+		if i < 0 {
+			return nil, mismatch
+		}
+		col := parent.columns[i]
+		link.parentCols = append(link.parentCols, i)
+		link.affinities = append(link.affinities, col.affinity)
+		link.columns = append(link.columns, keyColumn{collation: col.collation})
+	}
+	if len(names) == 1 && parent.columns[link.parentCols[0]].isRowid {
+		link.affinities[0] = "INTEGER"
+		return link, nil
+	}
+
+	// Any unique index on exactly the key columns will do, as long as it
+	// compares them the way the columns do. The b-tree of a WITHOUT ROWID
+	// table is one on its primary key.
+	indexes := db.tableIndexes(parent.name)
+	if parent.withoutRowid {
+		indexes = append(indexes, &indexDef{name: parent.name, table: parent.name, unique: true, columns: parent.primaryKey, rootPage: parentRow.rootPage})
+	}
+	for _, idx := range indexes {
+		if !idx.unique || idx.where != "" || len(idx.columns) != len(names) {
+			continue
+		}
+		order := make([]int, len(idx.columns))
+		for j, col := range idx.columns {
+			order[j] = -1
+			for k, name := range names {
+				if strings.EqualFold(col.name, name) && (col.collation == "" || strings.EqualFold(col.collation, collationOrBinary(link.columns[k].collation))) {
+					order[j] = k
+				}
+			}
+			if order[j] < 0 {
+				break
+			}
+		}
+		if order[len(order)-1] >= 0 {
+			link.index, link.indexOrder = idx, order
+			return link, nil
+		}
+	}
+	return nil, mismatch
+}
+
+// The parent columns a foreign key refers to: those it names, or else the
+// parent's primary key
+func (fk foreignKeyDef) parentColumnNames(parent *tableDef) []string {
+	if len(fk.parentCols) > 0 {
+		return fk.parentCols
+	}
+	var names []string
+	for _, pk := range parent.primaryKey {
+		names = append(names, pk.name)
+	}
+	return names
+}
+
+func collationOrBinary(collation string) string {
+	if collation == "" {
+		return "BINARY"
+	}
+	return collation
+}
+
+// Resolves the foreign keys a table has and those that refer to it,
+// which writes to the table must keep
+func (w *tableWriter) resolveForeignKeys() error {
+	for _, row := range w.db.schema {
+		if row._type != "table" {
+			continue
+		}
+		child := w.def
+		if !strings.EqualFold(row.name, w.def.name) {
+			var err error
+			if child, err = parseCreateTable(row.sql); err != nil {
+				continue
+			}
+		}
+		for id := range child.foreignKeys {
+			fk := child.foreignKeys[len(child.foreignKeys)-1-id]
+			isChild := child == w.def
+			isParent := strings.EqualFold(fk.table, w.def.name)
+			if !isChild && !isParent {
+				continue
+			}
+			link, err := resolveForeignKey(w.db, child, id)
+			if err != nil && !isChild {
+				link = &foreignKeyLink{fk: fk, id: id, child: child, err: err}
+			} else if err != nil {
+				return err
+			}
+			if isChild && link.parent == nil {
+				return fmt.Errorf("no such table: main.%s", fk.table)
+			}
+			if isChild {
+				w.references = append(w.references, link)
+			}
+			if isParent {
+				w.referencedBy = append(w.referencedBy, link)
+			}
+		}
+	}
+	return nil
+}
+
+// Fails a statement that deletes rows of the table, or changes the given
+// columns of its rows when columns is not nil, if that needs a broken
+// foreign key referring to the table
+func (w *tableWriter) checkReferringKeys(columns []int) error {
+	for _, link := range w.referencedBy {
+		if link.err == nil {
+			continue
+		}
+		if columns == nil {
+			return link.err
+		}
+		for _, name := range link.fk.parentColumnNames(w.def) {
+			for _, i := range columns {
+				if i >= 0 && strings.EqualFold(w.def.columns[i].name, name) {
+					return link.err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// The parent key a child row refers to, with the parent's affinities, or
+// nil when part of it is NULL and the row refers to nothing
+func (link *foreignKeyLink) childKey(values []interface{}) []interface{} {
+	key := make([]interface{}, len(link.childCols))
+	for k, i := range link.childCols {
+		if values[i] == nil {
+			return nil
+		}
+		key[k] = applyAffinity(normalizeValue(values[i]), link.affinities[k])
+	}
+	return key
+}
+
+// The key a parent row is referred to by, or nil when part of it is NULL
+func (link *foreignKeyLink) parentKey(values []interface{}) []interface{} {
+	key := make([]interface{}, len(link.parentCols))
+	for k, i := range link.parentCols {
+		if values[i] == nil {
+			return nil
+		}
+		key[k] = normalizeValue(values[i])
+	}
+	return key
+}
+
+// Reports whether the parent table has a row with the given key
+func (db *database) parentExists(link *foreignKeyLink, key []interface{}) (bool, error) {
+	if link.parent == nil {
+		return false, nil
+	}
+	if link.index == nil {
+		rowid, ok := key[0].(int64)
+		if !ok {
+			return false, nil
+		}
+		_, _, _, exact, err := db.file.seek(link.parentRoot, tableKeyCompare(rowid))
+		return exact, err
+	}
+	probe := make([]interface{}, len(key))
+	columns := make([]keyColumn, len(key))
+	for j, k := range link.indexOrder {
+		probe[j], columns[j] = key[k], link.columns[k]
+		columns[j].desc = link.index.columns[j].desc
+	}
+	_, found, err := db.file.findIndexPrefix(link.index.rootPage, probe, columns)
+	return found, err
+}
+
+// Returns the rows of a child table that refer to the given parent key
+func (link *foreignKeyLink) childRows(cw *tableWriter, key []interface{}) ([]relationRow, error) {
+	_, rows, err := cw.matchingRows(cw.def.name, nil)
+	if err != nil {
+		return nil, err
+	}
+	var children []relationRow
+	for _, row := range rows {
+		if childKey := link.childKey(row.values); childKey != nil && compareIndexKeys(childKey, key, link.columns) == 0 {
+			children = append(children, row)
+		}
+	}
+	return children, nil
+}
+
+// Returns the writer for a table that foreign key actions change
+func (w *tableWriter) writerFor(table string) (*tableWriter, error) {
+	if strings.EqualFold(table, w.def.name) {
+		return w, nil
+	}
+	if cw, ok := w.related[strings.ToLower(table)]; ok {
+		return cw, nil
+	}
+	cw, err := newTableWriter(w.db, table)
+	if err != nil {
+		return nil, err
+	}
+	if w.related == nil {
+		w.related = make(map[string]*tableWriter)
+	}
+	w.related[strings.ToLower(table)] = cw
+	return cw, nil
+}
+
+// Adds n to the number of rows that break a foreign key: the statement's
+// count for immediate constraints, the transaction's for deferred ones.
+// A negative n counts violations that were resolved.
+func (db *database) countViolations(link *foreignKeyLink, n int) {
+	if link.fk.deferred {
+		db.fkDeferred += n
+	} else {
+		db.fkImmediate += n
+	}
+}
+
+func (db *database) hasViolations(link *foreignKeyLink) bool {
+	if link.fk.deferred {
+		return db.fkDeferred > 0
+	}
+	return db.fkImmediate > 0
+}
+
+// Checks a new row's references to parent rows, and counts the
+// references from child rows it resolves
+func (w *tableWriter) foreignKeysAfterInsert(values []interface{}) error {
+	for _, link := range w.references {
+		if err := w.checkParent(link, values, 1); err != nil {
+			return err
+		}
+	}
+	for _, link := range w.referencedBy {
+		if link.err != nil {
+			continue
+		}
+		if err := w.countChildren(link, values, -1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Uncounts a removed row's broken references, and applies the ON DELETE
+// action of each foreign key that refers to it
+func (w *tableWriter) foreignKeysAfterDelete(values []interface{}) error {
+	for _, link := range w.references {
+		if err := w.checkParent(link, values, -1); err != nil {
+			return err
+		}
+	}
+	for _, link := range w.referencedBy {
+		if link.err != nil {
+			return link.err
+		}
+		if err := w.applyParentAction(link, link.fk.onDelete, values, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Rechecks the references of a changed row where its key columns
+// changed, and applies the ON UPDATE action of each foreign key that
+// refers to a changed parent key
+func (w *tableWriter) foreignKeysAfterUpdate(oldValues, values []interface{}) error {
+	for _, link := range w.references {
+		if sameKey(link.childKey(oldValues), link.childKey(values), link.columns) {
+			continue
+		}
+		if err := w.checkParent(link, oldValues, -1); err != nil {
+			return err
+		}
+		if err := w.checkParent(link, values, 1); err != nil {
+			return err
+		}
+	}
+	for _, link := range w.referencedBy {
+		if link.err != nil {
+			continue
+		}
+		if sameKey(link.parentKey(oldValues), link.parentKey(values), link.columns) {
+			continue
+		}
+		if err := w.applyParentAction(link, link.fk.onUpdate, oldValues, values); err != nil {
+			return err
+		}
+		if err := w.countChildren(link, values, -1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sameKey(a, b []interface{}, columns []keyColumn) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return compareIndexKeys(a, b, columns) == 0
+}
+
+// Counts a child row that refers to a missing parent row, adding n. A
+// removed row is only uncounted while violations are outstanding, since
+// it may have been written while foreign keys were not enforced.
+func (w *tableWriter) checkParent(link *foreignKeyLink, values []interface{}, n int) error {
+	key := link.childKey(values)
+	if key == nil || n < 0 && !w.db.hasViolations(link) {
+		return nil
+	}
+	found, err := w.db.parentExists(link, key)
+	if err == nil && !found {
+		w.db.countViolations(link, n)
+	}
+	return err
+}
+
+// Counts the child rows that refer to a parent row's key, adding n for
+// each, while violations are outstanding
+func (w *tableWriter) countChildren(link *foreignKeyLink, values []interface{}, n int) error {
+	key := link.parentKey(values)
+	if key == nil || !w.db.hasViolations(link) {
+		return nil
+	}
+	cw, err := w.writerFor(link.child.name)
+	if err != nil {
+		return err
+	}
+	children, err := link.childRows(cw, key)
+	if err == nil {
+		w.db.countViolations(link, n*len(children))
+	}
+	return err
+}
+
+// Applies a foreign key action to the child rows that refer to a parent
+// row whose key is deleted, or changed to that in newValues
+func (w *tableWriter) applyParentAction(link *foreignKeyLink, action string, oldValues, newValues []interface{}) error {
+	key := link.parentKey(oldValues)
+	if key == nil {
+		return nil
+	}
+	cw, err := w.writerFor(link.child.name)
+	if err != nil {
+		return err
+	}
+	children, err := link.childRows(cw, key)
+	if err != nil || len(children) == 0 {
+		return err
+	}
+
+	switch action {
+	case "RESTRICT":
+		return &constraintError{"FOREIGN KEY constraint failed", "ABORT"}
+	case "NO ACTION":
+		w.db.countViolations(link, len(children))
+		return nil
+	case "CASCADE":
+		if newValues == nil {
+			for _, child := range children {
+				if err := cw.deleteRow(child.values, int64(child.rowid)); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+	for _, child := range children {
+		values := append([]interface{}(nil), child.values...)
+		for k, i := range link.childCols {
+			col := link.child.columns[i]
+			switch action {
+			case "CASCADE":
+				values[i] = applyAffinity(normalizeValue(newValues[link.parentCols[k]]), col.affinity)
+			case "SET NULL":
+				values[i] = nil
+			case "SET DEFAULT":
+				values[i] = applyAffinity(normalizeValue(insertDefault(col)), col.affinity)
+			}
+		}
+		rowid := int64(child.rowid)
+		if i := link.child.rowidColumn(); i >= 0 {
+			if values[i] == nil {
+				return fmt.Errorf("datatype mismatch")
+			}
+			if rowid, err = cw.resolveRowid(values[i]); err != nil {
+				return err
+			}
+			values[i] = rowid
+		}
+		cw.computeGenerated(values, rowid)
+		if _, err := cw.checkRow(values, rowid, "ABORT"); err != nil {
+			return err
+		}
+		if err := cw.updateRow(child.values, int64(child.rowid), values, rowid); err != nil {
+			return err
+		}
+		// A key the action left as it was still refers to the old parent key
+		if sameKey(link.childKey(child.values), link.childKey(values), link.columns) {
+			if err := cw.checkParent(link, values, 1); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Deletes every row of a table about to be dropped while foreign keys are
+// enforced, as SQLite does, so that the foreign keys referring to it act
+// on their child rows. The drop fails if that leaves child rows broken.
+// A table nothing refers to is only emptied to settle the deferred
+// violations of its own rows.
+func (db *database) deleteBeforeDrop(row *SQLiteSchemaRow) error {
+	def, err := parseCreateTable(row.sql)
+	if err != nil {
+		return err
+	}
+	needed := false
+	for _, other := range db.schema {
+		if other._type != "table" {
+			continue
+		}
+		if child, err := parseCreateTable(other.sql); err == nil {
+			for _, fk := range child.foreignKeys {
+				needed = needed || strings.EqualFold(fk.table, def.name)
+			}
+		}
+	}
+	for _, fk := range def.foreignKeys {
+		needed = needed || fk.deferred && db.fkDeferred > 0
+	}
+	if !needed {
+		return nil
+	}
+
+	deferred := db.fkDeferred
+	db.fkImmediate = 0
+	err = func() error {
+		w, err := newTableWriter(db, def.name)
+		if err != nil {
+			return err
+		}
+		// Broken foreign keys do not stop a drop; they just do nothing
+		var links []*foreignKeyLink
+		for _, link := range w.referencedBy {
+			if link.err == nil {
+				links = append(links, link)
+			}
+		}
+		w.referencedBy = links
+		_, rows, err := w.matchingRows(def.name, nil)
+		if err != nil {
+			return err
+		}
+		for _, r := range rows {
+			if err := w.deleteRow(r.values, int64(r.rowid)); err != nil {
+				return err
+			}
+		}
+		if db.fkImmediate > 0 {
+			return fmt.Errorf("FOREIGN KEY constraint failed")
+		}
+		return nil
+	}()
+	db.fkImmediate = 0
+	if err != nil {
+		db.fkDeferred = deferred
+	}
+	return err
+}
+
+// Reports the rows whose foreign keys refer to missing parent rows, in
+// one table or all of them
+func pragmaForeignKeyCheck(db *database, args []interface{}) (*resultSet, error) {
+	rs := &resultSet{columns: []string{"table", "rowid", "parent", "fkid"}}
+	var tables []*SQLiteSchemaRow
+	if len(args) > 0 && args[0] != nil {
+		name := formatValue(args[0])
+		row := db.findSchemaRow("table", name)
+		if row == nil {
+			return nil, fmt.Errorf("no such table: %s", name)
+		}
+		tables = append(tables, row)
+	} else {
+		for i := range db.schema {
+			if db.schema[i]._type == "table" {
+				tables = append(tables, &db.schema[i])
+			}
+		}
+	}
+
+	for _, row := range tables {
+		def, err := parseCreateTable(row.sql)
+		if err != nil || len(def.foreignKeys) == 0 {
+			continue
+		}
+		var links []*foreignKeyLink
+		for id := range def.foreignKeys {
+			link, err := resolveForeignKey(db, def, id)
+			if err != nil {
+				return nil, err
+			}
+			links = append(links, link)
+		}
+		rel, err := loadTableRelation(db, row, def.name, nil)
+		if err != nil {
+			return nil, err
+		}
+		for _, tableRow := range rel.rows {
+			for _, link := range links {
+				key := link.childKey(tableRow.values)
+				if key == nil {
+					continue
+				}
+				if found, err := db.parentExists(link, key); err != nil {
+					return nil, err
+				} else if !found {
+					rs.rows = append(rs.rows, []interface{}{def.name, int64(tableRow.rowid), link.fk.table, int64(link.id)})
+				}
+			}
+		}
+	}
+	return rs, nil
+}
+
+// Reports whether foreign keys are enforced, first turning enforcement on
+// or off if a value is given. The setting cannot change inside a
+// transaction.
+func pragmaForeignKeys(db *database, args []interface{}) (*resultSet, error) {
+	if len(args) == 0 {
+		return &resultSet{columns: []string{"foreign_keys"}, rows: [][]interface{}{{boolValue(db.foreignKeys)}}}, nil
+	}
+	if !db.file.inTransaction {
+		db.foreignKeys = pragmaFlag(args[0])
+	}
+	return &resultSet{}, nil
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const importUsage = "Usage: .import [--csv] [--skip N] FILE TABLE"
+
+// Imports CSV into a table, as .import [--csv] [--skip N] FILE TABLE. A
+// table that does not exist is created with the first row as its column
+// names. Values are read as text and take the affinity of their column.
+// Rows with the wrong number of fields are padded with NULLs or cut short,
+// and rows that break a constraint are left out, with a warning for each.
+func (sh *shell) importFile(args []string) error {
+	colSep, rowSep := sh.settings.colSep, sh.settings.rowSep
+	skip := 0
+	var operands []string
+	for i := 1; i < len(args); i++ {
+		switch args[i] {
+		case "--csv":
+			colSep, rowSep = ",", "\n"
+		case "--skip":
+			if i+1 == len(args) {
+				return errors.New(importUsage)
+			}
+			i++
+			n, err := strconv.Atoi(args[i])
+			if err != nil || n < 0 {
+				return fmt.Errorf("invalid --skip count: %s", args[i])
+			}
+			skip = n
+		default:
+			if strings.HasPrefix(args[i], "-") {
+				return fmt.Errorf("unknown option: %s", args[i])
+			}
+			operands = append(operands, args[i])
+		}
+	}
+	if len(operands) != 2 {
+		return errors.New(importUsage)
+	}
+	fileName, table := operands[0], operands[1]
+	if rowSep == "\r\n" {
+		rowSep = "\n"
+	}
+	if len(colSep) != 1 || len(rowSep) != 1 {
+		return errors.New("multi-character separators not allowed for import")
+	}
+
+	f, err := os.Open(fileName)
+	if err != nil {
+		return fmt.Errorf("cannot open \"%s\"", fileName)
+	}
+	defer f.Close()
+	in := &csvReader{r: bufio.NewReader(f), file: fileName, colSep: colSep[0], rowSep: rowSep[0], line: 1}
+	for ; skip > 0; skip-- {
+		if _, _, err := in.readRecord(); err == io.EOF {
+			return nil
+		}
+	}
+
+	if sh.db.findSchemaRow("table", table) == nil && sh.db.findSchemaRow("view", table) == nil {
+		header, _, err := in.readRecord()
+		if err == io.EOF {
+			return nil
+		}
+		if err := createImportTable(sh.db, table, header); err != nil {
+			return err
+		}
+	}
+	w, err := newTableWriter(sh.db, table)
+	if err != nil {
+		return err
+	}
+	if w.bulkLoadable() {
+		return w.bulkLoad(in)
+	}
+	return insertImportRows(sh.db, w, in)
+}
+
+// Creates the table an import fills, with a TEXT column for each field of
+// the header row, as sqlite3 does
+func createImportTable(db *database, table string, header []string) error {
+	columns := make([]string, len(header))
+	for i, name := range header {
+		columns[i] = quoteIdentifier(name) + " TEXT"
+	}
+	createSQL := fmt.Sprintf("CREATE TABLE %s(\n%s)", quoteIdentifier(table), strings.Join(columns, ", "))
+	_, err := executeStatement(db, createSQL)
+	return err
+}
+
+// Reads the next record for an import into a table of the given number
+// of columns, padding or cutting its fields to fit with a warning
+func readImportRow(in *csvReader, width int) ([]string, []bool, error) {
+	fields, line, err := in.readRecord()
+	if err != nil {
+		return nil, nil, err
+	}
+	present := make([]bool, width)
+	for i := range present {
+		present[i] = i < len(fields)
+	}
+	switch {
+	case len(fields) < width:
+		fmt.Fprintf(os.Stderr, "%s:%d: expected %d columns but found %d - filling the rest with NULL\n", in.file, line, width, len(fields))
+		fields = append(fields, make([]string, width-len(fields))...)
+	case len(fields) > width:
+		fmt.Fprintf(os.Stderr, "%s:%d: expected %d columns but found %d - extras ignored\n", in.file, line, width, len(fields))
+		fields = fields[:width]
+	}
+	return fields, present, nil
+}
+
+// Reports whether a table can be filled by building its b-tree from the
+// imported rows directly: it is empty, and nothing else needs to see each
+// row as it goes in, such as an index, trigger or foreign key, or a rowid
+// alias that could repeat.
+func (w *tableWriter) bulkLoadable() bool {
+	if len(w.indexes) > 0 || len(w.triggers) > 0 || len(w.references) > 0 || len(w.referencedBy) > 0 || w.def.rowidColumn() >= 0 {
+		return false
+	}
+	root, err := w.db.file.readNode(w.root)
+	return err == nil && root.isLeaf() && len(root.cells) == 0
+}
+
+// Imports the rows into an empty table by building its b-tree bottom up,
+// with rowids counting from 1 in file order
+func (w *tableWriter) bulkLoad(in *csvReader) (err error) {
+	db := w.db
+	db.beginWriteStatement()
+	defer func() { err = db.endWriteStatement(err) }()
+	defer recoverEvalError(&err)
+
+	targets, _, err := w.insertTargets(nil)
+	if err != nil {
+		return err
+	}
+	var cells [][]byte
+	rowid := int64(0)
+	for {
+		fields, present, err := readImportRow(in, len(targets))
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		values := make([]interface{}, len(w.def.columns))
+		for i, target := range targets {
+			if present[i] {
+				values[target] = applyAffinity(fields[i], w.def.columns[target].affinity)
+			}
+		}
+		w.computeGenerated(values, rowid+1)
+		if ok, err := w.checkRow(values, rowid+1, ""); !ok {
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s:%d: INSERT failed: %v\n", in.file, in.recordLine, err)
+			}
+			continue
+		}
+		rowid++
+		cell, err := db.file.tableLeafCell(rowid, w.record(values))
+		if err != nil {
+			return err
+		}
+		cells = append(cells, cell)
+	}
+	return db.file.buildTree(w.root, 0x0D, cells)
+}
+
+// Imports the rows one INSERT at a time, in a transaction of their own
+// unless one is open, so that indexes, triggers and constraints all see
+// them. A transaction of its own that cannot commit is rolled back.
+func insertImportRows(db *database, w *tableWriter, in *csvReader) (err error) {
+	targets, _, err := w.insertTargets(nil)
+	if err != nil {
+		return err
+	}
+	if !db.file.inTransaction {
+		if _, err := executeStatement(db, "BEGIN"); err != nil {
+			return err
+		}
+		defer func() {
+			_, commitErr := executeStatement(db, "COMMIT")
+			if commitErr != nil && db.file.inTransaction {
+				executeStatement(db, "ROLLBACK")
+			}
+			if err == nil {
+				err = commitErr
+			}
+		}()
+	}
+	table := quoteIdentifier(w.def.name)
+	for {
+		fields, present, err := readImportRow(in, len(targets))
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		literals := make([]string, len(fields))
+		for i, field := range fields {
+			literals[i] = "NULL"
+			if present[i] {
+				literals[i] = sqlLiteral(field)
+			}
+		}
+		insertSQL := fmt.Sprintf("INSERT INTO %s VALUES(%s)", table, strings.Join(literals, ","))
+		if _, err := executeStatement(db, insertSQL); err != nil {
+			fmt.Fprintf(os.Stderr, "%s:%d: INSERT failed: %v\n", in.file, in.recordLine, err)
+		}
+	}
+}
+
+// csvReader splits text into records of fields, the way sqlite3 reads CSV
+// for .import: a field in double quotes may hold separators, newlines and
+// doubled quotes, and a carriage return before a newline is dropped.
+type csvReader struct {
+	r              *bufio.Reader
+	file           string
+	colSep, rowSep byte
+	line           int // the line being read, counting from 1
+	recordLine     int // the line the last record started on
+}
+
+// Reads the next record and the line it starts on, or io.EOF at the end
+func (c *csvReader) readRecord() ([]string, int, error) {
+	c.recordLine = c.line
+	if _, err := c.r.Peek(1); err != nil {
+		return nil, 0, err
+	}
+	var fields []string
+	for {
+		field, last, err := c.readField()
+		if err != nil {
+			return nil, 0, err
+		}
+		fields = append(fields, field)
+		if last {
+			return fields, c.recordLine, nil
+		}
+	}
+}
+
+// Reads one field and reports whether it ended its record
+func (c *csvReader) readField() (string, bool, error) {
+	var field []byte
+	quoted := false
+	b, err := c.r.ReadByte()
+	if err == io.EOF {
+		return "", true, nil
+	} else if err != nil {
+		return "", false, err
+	}
+	if b == '"' {
+		quoted = true
+		for {
+			b, err := c.r.ReadByte()
+			if err == io.EOF {
+				fmt.Fprintf(os.Stderr, "%s:%d: unterminated \"-quoted field\n", c.file, c.recordLine)
+				return string(field), true, nil
+			} else if err != nil {
+				return "", false, err
+			}
+			if b == '\n' {
+				c.line++
+			}
+			if b != '"' {
+				field = append(field, b)
+				continue
+			}
+			if next, err := c.r.Peek(1); err == nil && next[0] == '"' {
+				c.r.ReadByte()
+				field = append(field, '"')
+				continue
+			}
+			break
+		}
+		b, err = c.r.ReadByte()
+		if err == io.EOF {
+			return string(field), true, nil
+		} else if err != nil {
+			return "", false, err
+		}
+		if b != c.colSep && b != c.rowSep && b != '\r' {
+			fmt.Fprintf(os.Stderr, "%s:%d: unescaped \" character\n", c.file, c.line)
+			field = append(field, '"')
+		}
+	}
+
+	// The rest of the field runs to the next separator
+	for {
+		switch {
+		case b == c.colSep:
+			return string(field), false, nil
+		case b == c.rowSep:
+			if b == '\n' {
+				c.line++
+				if n := len(field); n > 0 && field[n-1] == '\r' && !quoted {
+					field = field[:n-1]
+				}
+			}
+			return string(field), true, nil
+		}
+		if !(quoted && b == '\r') {
+			field = append(field, b)
+		}
+		b, err = c.r.ReadByte()
+		if err == io.EOF {
+			return string(field), true, nil
+		} else if err != nil {
+			return "", false, err
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/xwb1989/sqlparser"
+)
+
+// Runs an INSERT statement, returning the number of rows added or changed
+// by an upsert. onConflict is the resolution from INSERT OR <resolution>
+// and upserts are its ON CONFLICT clauses.
+func executeInsert(db *database, stmt *sqlparser.Insert, sqlText string, onConflict string, upserts []*upsertClause) (n int, err error) {
+	db.beginWriteStatement()
+	defer func() { err = db.endWriteStatement(err) }()
+	defer recoverEvalError(&err)
+
+	if stmt.Action == sqlparser.ReplaceStr || stmt.Ignore != "" || len(stmt.OnDup) > 0 {
+		return 0, fmt.Errorf("MySQL conflict clauses are not supported")
+	}
+	if view := db.findSchemaRow("view", stmt.Table.Name.String()); view != nil {
+		return insertIntoView(db, view, stmt, sqlText, upserts)
+	}
+	w, err := newTableWriter(db, stmt.Table.Name.String())
+	if err != nil {
+		return 0, err
+	}
+	checks, err := w.uniqueChecks(onConflict, upserts)
+	if err != nil {
+		return 0, err
+	}
+	targets, rowidTarget, err := w.insertTargets(stmt.Columns)
+	if err != nil {
+		return 0, err
+	}
+
+	rows, err := insertSourceRows(db, stmt.Rows, sqlText)
+	if err != nil {
+		return 0, err
+	}
+	width := len(targets)
+	if rowidTarget >= 0 {
+		width++
+	}
+	for _, row := range rows {
+		if len(row) != width {
+			if len(stmt.Columns) == 0 {
+				return 0, fmt.Errorf("table %s has %d columns but %d values were supplied", w.def.name, width, len(row))
+			}
+			return 0, fmt.Errorf("%d values for %d columns", len(row), width)
+		}
+	}
+
+	autoincrement := w.def.hasAutoincrement()
+	for _, row := range rows {
+		values := make([]interface{}, len(w.def.columns))
+		given := make([]bool, len(w.def.columns))
+		var rowidValue interface{}
+		for i, v := range row {
+			switch {
+			case i == rowidTarget:
+				rowidValue = v
+			case i > rowidTarget && rowidTarget >= 0:
+				values[targets[i-1]], given[targets[i-1]] = v, true
+			default:
+				values[targets[i]], given[targets[i]] = v, true
+			}
+		}
+		for i, col := range w.def.columns {
+			if !given[i] && col.generated == "" {
+				values[i] = insertDefault(col)
+			}
+		}
+
+		for i, col := range w.def.columns {
+			if col.generated == "" && !col.isRowid {
+				values[i] = applyAffinity(normalizeValue(values[i]), col.affinity)
+			}
+		}
+
+		// An INTEGER PRIMARY KEY is the rowid itself
+		if i := w.def.rowidColumn(); i >= 0 {
+			rowidValue = values[i]
+		}
+		if hasTriggers(w.triggers, "BEFORE", "INSERT") {
+			if err := w.beforeInsert(values, rowidValue); err == errIgnoreRow {
+				continue
+			} else if err != nil {
+				return n, err
+			}
+		}
+		rowid, err := w.resolveRowid(rowidValue)
+		if err != nil {
+			return n, err
+		}
+		if i := w.def.rowidColumn(); i >= 0 {
+			values[i] = rowid
+		}
+		w.computeGenerated(values, rowid)
+
+		if ok, err := w.checkRow(values, rowid, onConflict); !ok {
+			if err != nil {
+				return n, err
+			}
+			continue
+		}
+		action, upsert, other, err := w.settleConflicts(checks, values, rowid, nil)
+		switch {
+		case err != nil:
+			return n, err
+		case action == "IGNORE":
+			continue
+		case upsert != nil:
+			if changed, err := w.upsert(upsert, other, values); err != nil {
+				return n, err
+			} else if changed {
+				n++
+			}
+			continue
+		}
+		if err := w.insertRow(values, rowid); err != nil {
+			return n, err
+		}
+		if autoincrement {
+			if err := db.updateSequence(w.def.name, rowid); err != nil {
+				return n, err
+			}
+		}
+		n++
+		err = db.fireTriggers(w.triggers, "AFTER", "INSERT", nil, nil, w.triggerRow(values, rowid))
+		if err != nil && err != errIgnoreRow {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// Runs the BEFORE INSERT triggers of a row about to be inserted. A rowid
+// still to be chosen shows as -1, as in SQLite.
+func (w *tableWriter) beforeInsert(values []interface{}, rowidValue interface{}) error {
+	newValues := append([]interface{}(nil), values...)
+	var rowid interface{} = int64(-1)
+	if rowidValue != nil {
+		rowid = applyAffinity(normalizeValue(rowidValue), "INTEGER")
+	}
+	if i := w.def.rowidColumn(); i >= 0 {
+		newValues[i] = rowid
+	}
+	return w.db.fireTriggers(w.triggers, "BEFORE", "INSERT", nil, nil, w.triggerRow(newValues, rowid))
+}
+
+// Maps an INSERT column list to table columns. Without a list every
+// non-generated column is filled in order. The position of a rowid alias
+// in the list is returned separately, or -1.
+func (w *tableWriter) insertTargets(columns sqlparser.Columns) ([]int, int, error) {
+	rowidTarget := -1
+	var targets []int
+	if len(columns) == 0 {
+		for i, col := range w.def.columns {
+			if col.generated == "" {
+				targets = append(targets, i)
+			}
+		}
+		return targets, rowidTarget, nil
+	}
+	for pos, column := range columns {
+		name := column.String()
+		i := w.def.columnIndex(name)
+		switch {
+		case i < 0 && isRowidName(name):
+			if ri := w.def.rowidColumn(); ri >= 0 {
+				targets = append(targets, ri)
+			} else {
+				rowidTarget = pos
+			}
+		case i < 0:
+			return nil, 0, fmt.Errorf("table %s has no column named %s", w.def.name, name)
+		case w.def.columns[i].generated != "":
+			return nil, 0, fmt.Errorf("cannot INSERT into generated column \"%s\"", w.def.columns[i].name)
+		default:
+			targets = append(targets, i)
+		}
+	}
+	return targets, rowidTarget, nil
+}
+
+// Evaluates the rows an INSERT adds, either a VALUES list or the result
+// of a SELECT, which is read in full before anything is written
+func insertSourceRows(db *database, source sqlparser.InsertRows, sqlText string) ([][]interface{}, error) {
+	switch source := source.(type) {
+	case sqlparser.Values:
+		var rows [][]interface{}
+		for _, tuple := range source {
+			row := make([]interface{}, len(tuple))
+			for i, expr := range tuple {
+				expr, err := resolveExprSubqueries(db, expr)
+				if err != nil {
+					return nil, err
+				}
+				row[i] = getExprValue(expr, nil, nil, "", nil, 0)
+			}
+			rows = append(rows, row)
+		}
+		return rows, nil
+	case sqlparser.SelectStatement:
+		rs, err := executeSelect(db, source, sqlText)
+		if err != nil {
+			return nil, err
+		}
+		return rs.rows, nil
+	}
+	return nil, fmt.Errorf("unsupported INSERT source")
+}
+
+// Turns the value given for the rowid into the rowid to use, choosing
+// the next free one for NULL
+func (w *tableWriter) resolveRowid(v interface{}) (int64, error) {
+	if v == nil {
+		return w.nextRowid()
+	}
+	rowid, ok := applyAffinity(normalizeValue(v), "INTEGER").(int64)
+	if !ok {
+		return 0, fmt.Errorf("datatype mismatch")
+	}
+	return rowid, nil
+}
+
+// The value a column takes when an INSERT does not mention it
+func insertDefault(col columnDef) interface{} {
+	if !col.hasDefault {
+		return nil
+	}
+	now := time.Now().UTC()
+	switch strings.ToUpper(strings.TrimSpace(col.defaultExpr)) {
+	case "CURRENT_TIMESTAMP":
+		return now.Format("2006-01-02 15:04:05")
+	case "CURRENT_DATE":
+		return now.Format("2006-01-02")
+	case "CURRENT_TIME":
+		return now.Format("15:04:05")
+	}
+
+	return col.defaultValue()
+}
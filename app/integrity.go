@@ -0,0 +1,531 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// integrityChecker walks the b-trees of a database the way SQLite's
+// PRAGMA integrity_check does. Every offset and page number is checked
+// before it is followed, so damage is reported rather than read.
+type integrityChecker struct {
+	db        *database
+	p         *pager
+	pageCount int
+	used      []bool       // pages referenced so far, by page number
+	entries   map[int]int  // entries found in each index b-tree, by root page
+	damaged   map[int]bool // trees with problems, by root page
+	remaining int          // problems that may still be reported
+	problems  []string     // b-tree problems, reported together in one row
+	messages  []string     // problems with rows, one row each
+	root      int          // root of the tree being checked
+	prefix    string       // context of the next problem
+}
+
+func pragmaIntegrityCheck(db *database, args []interface{}) (*resultSet, error) {
+	return integrityCheck(db, args, false)
+}
+
+func pragmaQuickCheck(db *database, args []interface{}) (*resultSet, error) {
+	return integrityCheck(db, args, true)
+}
+
+// Checks the database, or one table and its indexes, reporting up to 100
+// problems or as many as a numeric argument asks for. The quick check
+// leaves out looking up each row in the indexes of its table.
+func integrityCheck(db *database, args []interface{}, quick bool) (*resultSet, error) {
+	column := "integrity_check"
+	if quick {
+		column = "quick_check"
+	}
+	c := &integrityChecker{
+		db:        db,
+		p:         db.file,
+		pageCount: db.file.pageCount,
+		entries:   make(map[int]int),
+		damaged:   make(map[int]bool),
+		remaining: 100,
+	}
+	var table *SQLiteSchemaRow
+	if len(args) > 0 && args[0] != nil {
+		if n, ok := normalizeValue(args[0]).(int64); ok {
+			if n > 0 {
+				c.remaining = int(min(n, math.MaxInt32))
+			}
+		} else if name := formatValue(args[0]); !strings.EqualFold(name, "main") {
+			if table = db.findSchemaRow("table", name); table == nil {
+				return nil, fmt.Errorf("no such table: %s", name)
+			}
+		}
+	}
+
+	// A table on its own says nothing about which pages should be free
+	whole := table == nil
+	if whole {
+		c.checkPageCount()
+	}
+	c.used = make([]bool, c.pageCount+1)
+	if pending := c.p.pendingBytePage(); pending <= c.pageCount {
+		c.used[pending] = true
+	}
+	if whole {
+		page1, err := c.p.page(1)
+		if err != nil {
+			return nil, err
+		}
+		c.prefix = "Freelist: "
+		c.checkList(true, int(binary.BigEndian.Uint32(page1[32:])), int(binary.BigEndian.Uint32(page1[36:])))
+		c.checkTree(1, false)
+		// The walk only looks at the b-tree; a schema row may be unreadable
+		// in a sound page too
+		if db.schemaErr != nil && !c.damaged[1] {
+			c.root, c.prefix = 1, ""
+			c.problem("Tree 1: %v", db.schemaErr)
+		}
+	}
+	for i := range db.schema {
+		row := &db.schema[i]
+		if row.rootPage <= 0 || table != nil && !strings.EqualFold(row.tblName, table.tblName) {
+			continue
+		}
+		c.checkTree(row.rootPage, isIndexTree(row))
+	}
+	if whole {
+		c.root, c.prefix = 0, ""
+		for pageNum := 1; pageNum <= c.pageCount && c.remaining > 0; pageNum++ {
+			if !c.used[pageNum] {
+				c.problem("Page %d: never used", pageNum)
+			}
+		}
+	}
+
+	for i := range db.schema {
+		row := &db.schema[i]
+		if row._type != "table" || table != nil && row != table || c.damaged[row.rootPage] {
+			continue
+		}
+		if err := c.checkRows(row, quick); err != nil {
+			return nil, err
+		}
+	}
+
+	rs := &resultSet{columns: []string{column}}
+	if len(c.problems) > 0 {
+		report := "*** in database main ***\n" + strings.Join(c.problems, "\n")
+		rs.rows = append(rs.rows, []interface{}{report})
+	}
+	for _, message := range c.messages {
+		rs.rows = append(rs.rows, []interface{}{message})
+	}
+	if len(rs.rows) == 0 {
+		rs.rows = append(rs.rows, []interface{}{"ok"})
+	}
+	return rs, nil
+}
+
+// Whether a schema object is stored as an index b-tree, as indexes and
+// WITHOUT ROWID tables are
+func isIndexTree(row *SQLiteSchemaRow) bool {
+	if row._type == "index" {
+		return true
+	}
+	def, err := parseCreateTable(row.sql)
+	return err == nil && def.withoutRowid
+}
+
+func (c *integrityChecker) problem(format string, args ...interface{}) {
+	if c.remaining == 0 {
+		return
+	}
+	c.remaining--
+	c.damaged[c.root] = true
+	c.problems = append(c.problems, c.prefix+fmt.Sprintf(format, args...))
+}
+
+func (c *integrityChecker) message(format string, args ...interface{}) {
+	if c.remaining == 0 {
+		return
+	}
+	c.remaining--
+	c.messages = append(c.messages, fmt.Sprintf(format, args...))
+}
+
+// Compares the size of the database with that of its file. Pages the
+// header claims past the end of the file are left out of the check.
+func (c *integrityChecker) checkPageCount() {
+	if c.p.wal != nil && len(c.p.wal.frames) > 0 || c.p.filePageCount == 0 {
+		return
+	}
+	info, err := c.p.file.Stat()
+	if err != nil {
+		return
+	}
+	if filePages := int(info.Size() / int64(c.p.pageSize)); filePages < c.p.filePageCount {
+		c.problem("Database header reports %d pages but the file holds %d", c.p.filePageCount, filePages)
+		if c.pageCount == c.p.filePageCount {
+			c.pageCount = filePages
+		}
+	}
+}
+
+// Marks a page as used, reporting a page number out of range or a page
+// that was used already. Returns true for such a page.
+func (c *integrityChecker) checkRef(pageNum int) bool {
+	if pageNum < 1 || pageNum > c.pageCount {
+		c.problem("invalid page number %d", pageNum)
+		return true
+	}
+	if c.used[pageNum] {
+		c.problem("2nd reference to page %d", pageNum)
+		return true
+	}
+	c.used[pageNum] = true
+	return false
+}
+
+// Follows a chain of overflow pages, or of freelist trunk pages and the
+// leaves they list, checking that it has the expected number of pages
+func (c *integrityChecker) checkList(freelist bool, pageNum int, expected int) {
+	n := expected
+	problems := len(c.problems)
+	for pageNum != 0 && c.remaining > 0 {
+		if c.checkRef(pageNum) {
+			break
+		}
+		n--
+		data, err := c.p.page(pageNum)
+		if err != nil {
+			c.problem("failed to get page %d", pageNum)
+			break
+		}
+		if freelist {
+			leaves := int(binary.BigEndian.Uint32(data[4:]))
+			if leaves > c.p.pageSize/4-2 {
+				c.problem("freelist leaf count too big on page %d", pageNum)
+				n--
+			} else {
+				for i := 0; i < leaves; i++ {
+					c.checkRef(int(binary.BigEndian.Uint32(data[8+4*i:])))
+				}
+				n -= leaves
+			}
+		}
+		pageNum = int(binary.BigEndian.Uint32(data))
+	}
+	if n != 0 && problems == len(c.problems) {
+		what := "overflow list length"
+		if freelist {
+			what = "size"
+		}
+		c.problem("%s is %d but should be %d", what, expected-n, expected)
+	}
+}
+
+func (c *integrityChecker) checkTree(root int, index bool) {
+	c.root = root
+	c.prefix = ""
+	c.checkTreePage(root, index, math.MaxInt64)
+}
+
+// Checks a page of a b-tree and the pages below it. Rowids must be below
+// maxKey, or at most equal to it for the last one. Cells are looked at
+// from the last to the first, so each key bounds the ones before it.
+// Returns the depth of the subtree and its smallest rowid.
+func (c *integrityChecker) checkTreePage(pageNum int, index bool, maxKey int64) (int, int64) {
+	if c.checkRef(pageNum) {
+		return 0, maxKey
+	}
+	saved := c.prefix
+	defer func() { c.prefix = saved }()
+	c.prefix = fmt.Sprintf("Tree %d page %d: ", c.root, pageNum)
+	data, err := c.p.page(pageNum)
+	if err != nil {
+		c.problem("unable to get the page. error code=%d", 11)
+		return 0, maxKey
+	}
+	hdr := int(pageHeaderOffset(pageNum))
+	pageType := data[hdr]
+	leaf := pageType == 0x0A || pageType == 0x0D
+	numCells := int(binary.BigEndian.Uint16(data[hdr+3:]))
+	validType := pageType == 0x0D || pageType == 0x05
+	if index {
+		validType = pageType == 0x0A || pageType == 0x02
+	}
+	if !validType || numCells > (c.p.pageSize-8)/6 {
+		c.problem("btreeInitPage() returns error code %d", 11)
+		return 0, maxKey
+	}
+	cellStart := hdr + 12
+	if leaf {
+		cellStart = hdr + 8
+	}
+	contentOffset := int(binary.BigEndian.Uint16(data[hdr+5:]))
+	if contentOffset == 0 {
+		contentOffset = 65536
+	}
+	if !c.freeSpaceValid(data, hdr, cellStart+2*numCells, contentOffset) {
+		c.problem("free space corruption")
+		return 0, maxKey
+	}
+
+	usable := c.p.pageSize
+	depth := 0
+	keyCanBeEqual := true
+	if !leaf {
+		c.prefix = fmt.Sprintf("Tree %d page %d right child: ", c.root, pageNum)
+		depth, maxKey = c.checkTreePage(int(binary.BigEndian.Uint32(data[hdr+8:])), index, maxKey)
+		keyCanBeEqual = false
+	}
+	if index {
+		c.entries[c.root] += numCells
+	}
+
+	var spans [][2]int // bytes taken by cells and freeblocks, first and last
+	coverage := true
+	for i := numCells - 1; i >= 0 && c.remaining > 0; i-- {
+		c.prefix = fmt.Sprintf("Tree %d page %d cell %d: ", c.root, pageNum, i)
+		pc := int(binary.BigEndian.Uint16(data[cellStart+2*i:]))
+		if pc < contentOffset || pc > usable-4 {
+			c.problem("Offset %d out of range %d..%d", pc, contentOffset, usable-4)
+			coverage = false
+			continue
+		}
+		size := c.p.cellSize(data, pc, pageType)
+		if size <= 0 || pc+size > usable {
+			c.problem("Extends off end of page")
+			coverage = false
+			continue
+		}
+		spans = append(spans, [2]int{pc, pc + size - 1})
+
+		if !index {
+			key := tableCellKey(pageType, data[pc:])
+			if key > maxKey || key == maxKey && !keyCanBeEqual {
+				c.problem("Rowid %d out of order", key)
+			}
+			maxKey = key
+			keyCanBeEqual = false
+		}
+		if pageType != 0x05 {
+			prefix := 0
+			if pageType == 0x02 {
+				prefix = 4
+			}
+			payloadSize, n := decodeVarint(data[pc+prefix:])
+			start := pc + prefix + n
+			if !index {
+				_, m := decodeVarint(data[start:])
+				start += m
+			}
+			local := cellLocalSize(int(payloadSize), c.p.pageSize, index)
+			problems := len(c.problems)
+			if local < int(payloadSize) {
+				pages := (int(payloadSize) - local + usable - 5) / (usable - 4)
+				c.checkList(false, int(binary.BigEndian.Uint32(data[pc+size-4:])), pages)
+			}
+			// The rows are read again to check them against the schema, so
+			// their records must decode
+			if len(c.problems) == problems && c.remaining > 0 && !recordValid(readCellPayload(c.p, data, start, int(payloadSize), c.p.pageSize, index)) {
+				c.problem("malformed record")
+			}
+		}
+		if !leaf {
+			var childDepth int
+			childDepth, maxKey = c.checkTreePage(int(binary.BigEndian.Uint32(data[pc:])), index, maxKey)
+			keyCanBeEqual = false
+			// A child that could not be checked has no depth to compare
+			if childDepth != depth && childDepth > 0 {
+				if depth > 0 {
+					c.problem("Child page depth differs")
+				}
+				depth = childDepth
+			}
+		}
+	}
+
+	// The cells and freeblocks must not overlap, and the gaps between them
+	// must add up to the fragmented bytes the header records
+	if coverage && c.remaining > 0 {
+		c.prefix = ""
+		for free := int(binary.BigEndian.Uint16(data[hdr+1:])); free > 0; {
+			size := int(binary.BigEndian.Uint16(data[free+2:]))
+			spans = append(spans, [2]int{free, free + size - 1})
+			free = int(binary.BigEndian.Uint16(data[free:]))
+		}
+		sort.Slice(spans, func(i, j int) bool { return spans[i][0] < spans[j][0] })
+		fragmented := 0
+		prev := contentOffset - 1
+		checked := 0
+		for _, span := range spans {
+			checked++
+			if prev >= span[0] {
+				c.problem("Multiple uses for byte %d of page %d", span[0], pageNum)
+				break
+			}
+			fragmented += span[0] - prev - 1
+			prev = span[1]
+		}
+		fragmented += usable - prev - 1
+		if checked == len(spans) && fragmented != int(data[hdr+7]) {
+			c.problem("Fragmentation of %d bytes reported as %d on page %d", fragmented, data[hdr+7], pageNum)
+		}
+	}
+	return depth + 1, maxKey
+}
+
+// Reports whether a record's header decodes and the values it lists fill
+// the rest of the record exactly
+func recordValid(payload []byte) bool {
+	headerSize, n := decodeVarint(payload)
+	if n == 0 || headerSize < uint64(n) || headerSize > uint64(len(payload)) {
+		return false
+	}
+	header := payload[:headerSize]
+	body := int(headerSize)
+	for pos := n; pos < len(header); {
+		serialType, k := decodeVarint(header[pos:])
+		if k < 9 && header[pos+k-1]&0x80 != 0 {
+			return false // the varint runs past the header
+		}
+		pos += k
+		size, ok := serialTypeSize(serialType)
+		if !ok {
+			return false
+		}
+		body += size
+	}
+	return body == len(payload)
+}
+
+// Checks the chain of freeblocks on a page: each within the page and past
+// the previous one, and the free bytes in total no more than the page has
+func (c *integrityChecker) freeSpaceValid(data []byte, hdr, cellEnd, contentOffset int) bool {
+	usable := c.p.pageSize
+	free := int(data[hdr+7]) + contentOffset
+	pc := int(binary.BigEndian.Uint16(data[hdr+1:]))
+	if pc > 0 {
+		if pc < contentOffset {
+			return false
+		}
+		var next, size int
+		for {
+			if pc > usable-4 {
+				return false
+			}
+			next = int(binary.BigEndian.Uint16(data[pc:]))
+			size = int(binary.BigEndian.Uint16(data[pc+2:]))
+			free += size
+			if next <= pc+size+3 {
+				break
+			}
+			pc = next
+		}
+		if next > 0 || pc+size > usable {
+			return false
+		}
+	}
+	return free <= usable && free >= cellEnd
+}
+
+// Checks the rows of a table whose b-tree is sound: that NOT NULL columns
+// hold values, that each index has as many entries as the rows call for
+// and, unless the check is quick, that it has exactly those entries
+func (c *integrityChecker) checkRows(row *SQLiteSchemaRow, quick bool) error {
+	w, err := newTableWriter(c.db, row.name)
+	if err != nil {
+		return nil // not a table whose rows can be read
+	}
+	rel, err := loadTableRelation(c.db, row, "", nil)
+	if err != nil {
+		return err
+	}
+	var indexes []*indexWriter
+	for _, ix := range w.indexes {
+		if !c.damaged[ix.def.rootPage] {
+			indexes = append(indexes, ix)
+		}
+	}
+	// An index that covers every row must have as many entries as there
+	// are rows; the entries of a partial one are counted as the rows are
+	for _, ix := range indexes {
+		if ix.where == nil && c.entries[ix.def.rootPage] != len(rel.rows) {
+			c.message("wrong # of entries in index %s", ix.def.name)
+		}
+	}
+	counts := make([]int, len(indexes))
+	for n, r := range rel.rows {
+		if c.remaining == 0 {
+			return nil
+		}
+		c.db.checkInterrupt()
+		for i, col := range w.def.columns {
+			if col.notNull && !col.isRowid && r.values[i] == nil {
+				c.message("NULL value in %s.%s", w.def.name, col.name)
+			}
+		}
+		if quick {
+			continue
+		}
+		rowid := int64(r.rowid)
+		for i, ix := range indexes {
+			key, ok := w.indexKey(ix, r.values, rowid)
+			if !ok {
+				continue
+			}
+			counts[i]++
+			found, err := c.p.indexContains(ix.def.rootPage, key, ix.columns)
+			if err != nil {
+				return err
+			}
+			if !found {
+				c.message("row %d missing from index %s", n+1, ix.def.name)
+				continue
+			}
+			if ix.def.unique {
+				other, dup, err := c.p.findIndexPrefix(ix.def.rootPage, key[:len(key)-1], ix.columns)
+				if err != nil {
+					return err
+				}
+				if dup && other != rowid {
+					c.message("non-unique entry in index %s", ix.def.name)
+				}
+			}
+		}
+	}
+	for i, ix := range indexes {
+		if !quick && ix.where != nil && counts[i] != c.entries[ix.def.rootPage] {
+			c.message("wrong # of entries in index %s", ix.def.name)
+		}
+	}
+	return nil
+}
+
+// Reports whether an index holds exactly the given entry, rowid included
+func (p *pager) indexContains(root int, key []interface{}, columns []keyColumn) (bool, error) {
+	pageNum := root
+	for depth := 0; depth <= 64; depth++ {
+		node, err := p.readNode(pageNum)
+		if err != nil {
+			return false, err
+		}
+		next := len(node.cells)
+		for i, cell := range node.cells {
+			c := compareIndexKeys(key, p.indexCellKey(node.pageType, cell), columns)
+			if c == 0 {
+				return true, nil
+			}
+			if c < 0 {
+				next = i
+				break
+			}
+		}
+		if node.isLeaf() {
+			return false, nil
+		}
+		pageNum = node.child(next)
+	}
+	return false, fmt.Errorf("database disk image is malformed: b-tree too deep")
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Rollback journal format: a header padded to a sector, then one record
+// per saved page holding the page number, the original page content and
+// a checksum. The database is only written once the journal is synced,
+// so a crash midway leaves a hot journal that restores the old pages.
+var journalMagic = []byte{0xd9, 0xd5, 0x05, 0xf9, 0x20, 0xa1, 0x63, 0xd7}
+
+const journalSectorSize = 512
+
+// Journal modes for rollback journals; WAL is handled separately
+var journalModes = []string{"delete", "truncate", "persist", "memory", "off"}
+
+func journalPath(dbPath string) string {
+	return dbPath + "-journal"
+}
+
+// Checksum of a journal record: the nonce plus every 200th byte of the
+// page, counting down from the end
+func journalChecksum(nonce uint32, data []byte) uint32 {
+	sum := nonce
+	for i := len(data) - 200; i > 0; i -= 200 {
+		sum += uint32(data[i])
+	}
+	return sum
+}
+
+// Writes the original content of every page the transaction changes to
+// the journal file and syncs it
+func (p *pager) writeJournal(pageNums []int) error {
+	var nonceBytes [4]byte
+	if _, err := rand.Read(nonceBytes[:]); err != nil {
+		return err
+	}
+	nonce := binary.BigEndian.Uint32(nonceBytes[:])
+
+	var records []byte
+	count := 0
+	original := make([]byte, p.pageSize)
+	for _, pageNum := range pageNums {
+		if pageNum > p.filePageCount {
+			continue // new pages need no restoring; truncating drops them
+		}
+		if _, err := p.file.ReadAt(original, int64(pageNum-1)*int64(p.pageSize)); err != nil && err != io.EOF {
+			return err
+		}
+		records = binary.BigEndian.AppendUint32(records, uint32(pageNum))
+		records = append(records, original...)
+		records = binary.BigEndian.AppendUint32(records, journalChecksum(nonce, original))
+		count++
+	}
+
+	header := make([]byte, journalSectorSize)
+	copy(header, journalMagic)
+	binary.BigEndian.PutUint32(header[8:], uint32(count))
+	binary.BigEndian.PutUint32(header[12:], nonce)
+	binary.BigEndian.PutUint32(header[16:], uint32(p.filePageCount))
+	binary.BigEndian.PutUint32(header[20:], journalSectorSize)
+	binary.BigEndian.PutUint32(header[24:], uint32(p.pageSize))
+
+	journal, err := os.OpenFile(journalPath(p.path), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("unable to open database file")
+	}
+	defer journal.Close()
+	if _, err := journal.Write(append(header, records...)); err != nil {
+		return err
+	}
+	if err := journal.Sync(); err != nil {
+		return err
+	}
+	return syncDir(journal.Name())
+}
+
+// Syncs the directory holding a file, so that a crash cannot lose the
+// file's creation or removal, as SQLite does for its journals
+func syncDir(path string) error {
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// Ends a committed transaction's journal as the journal mode says:
+// deleting it, truncating it to nothing or zeroing its header
+func (p *pager) finishJournal() error {
+	path := journalPath(p.path)
+	switch p.journalMode {
+	case "delete":
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		return syncDir(path)
+	case "truncate":
+		return os.Truncate(path, 0)
+	case "persist":
+		journal, err := os.OpenFile(path, os.O_RDWR, 0)
+		if err != nil {
+			return err
+		}
+		defer journal.Close()
+		if _, err := journal.WriteAt(make([]byte, 28), 0); err != nil {
+			return err
+		}
+		return journal.Sync()
+	}
+	return nil
+}
+
+// Reports whether a journal file holds a transaction, rather than being
+// missing, empty or zeroed
+func journalHoldsTransaction(path string) bool {
+	journal, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer journal.Close()
+	header := make([]byte, 28)
+	_, err = io.ReadFull(journal, header)
+	return err == nil && string(header[:8]) == string(journalMagic)
+}
+
+// Plays back a hot journal left by an interrupted commit, restoring the
+// database to its state before that transaction. The journal of a
+// connection that holds the reserved lock is not hot, as it is still
+// being written. Called with the shared lock held.
+func (p *pager) recoverJournal() error {
+	path := journalPath(p.path)
+	if !journalHoldsTransaction(path) {
+		return nil
+	}
+	if reserved, err := rangeLocked(p.file, reservedByte, 1); err != nil || reserved {
+		return err
+	}
+	if p.readOnly {
+		return fmt.Errorf("attempt to write a readonly database")
+	}
+	// Another connection may get to the journal first, so it is only read
+	// once the exclusive lock is held
+	if err := p.lock(lockExclusive); err != nil {
+		return err
+	}
+	defer p.unlock(lockShared)
+	if !journalHoldsTransaction(path) {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	file := p.file
+
+	var originalCount uint32
+	var originalSize int64
+	offset := 0
+	for offset+28 <= len(data) && string(data[offset:offset+8]) == string(journalMagic) {
+		header := data[offset:]
+		records := binary.BigEndian.Uint32(header[8:])
+		nonce := binary.BigEndian.Uint32(header[12:])
+		sectorSize := int(binary.BigEndian.Uint32(header[20:]))
+		pageSize := int(binary.BigEndian.Uint32(header[24:]))
+		if sectorSize < 32 || pageSize < 512 || pageSize > 65536 {
+			break
+		}
+		if offset == 0 {
+			originalCount = binary.BigEndian.Uint32(header[16:])
+			originalSize = int64(originalCount) * int64(pageSize)
+		}
+		offset += sectorSize
+		recordSize := 8 + pageSize
+		if records == 0xffffffff {
+			records = uint32((len(data) - offset) / recordSize)
+		}
+		valid := true
+		for i := uint32(0); i < records; i++ {
+			if offset+recordSize > len(data) {
+				valid = false
+				break
+			}
+			pageNum := binary.BigEndian.Uint32(data[offset:])
+			page := data[offset+4 : offset+4+pageSize]
+			if journalChecksum(nonce, page) != binary.BigEndian.Uint32(data[offset+4+pageSize:]) {
+				valid = false
+				break
+			}
+			if pageNum > 0 && pageNum <= originalCount {
+				if _, err := file.WriteAt(page, int64(pageNum-1)*int64(pageSize)); err != nil {
+					return err
+				}
+			}
+			offset += recordSize
+		}
+		if !valid {
+			break
+		}
+		// A further segment, if any, starts at the next sector boundary
+		if rem := offset % sectorSize; rem != 0 {
+			offset += sectorSize - rem
+		}
+	}
+	if originalSize > 0 {
+		if err := file.Truncate(originalSize); err != nil {
+			return err
+		}
+	}
+	if err := file.Sync(); err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	return syncDir(path)
+}
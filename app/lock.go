@@ -0,0 +1,97 @@
+package main
+
+import "errors"
+
+// Connections share a database file by the locks SQLite takes on it: POSIX
+// advisory locks on bytes of the page at the 1GB offset, which is never
+// used for data. A reader holds a read lock on the shared range. A writer
+// takes the reserved byte before it starts its journal, keeping other
+// writers out, then the pending byte, which keeps new readers out, and
+// finally a write lock on the shared range once the readers are gone.
+const (
+	pendingByte  = 0x40000000
+	reservedByte = pendingByte + 1
+	sharedFirst  = pendingByte + 2
+	sharedSize   = 510
+)
+
+// Lock levels, each allowing what the ones below it do
+const (
+	lockNone = iota
+	lockShared
+	lockReserved
+	lockPending
+	lockExclusive
+)
+
+// Kinds of byte-range lock
+const (
+	rangeUnlock = iota
+	rangeRead
+	rangeWrite
+)
+
+var errLocked = errors.New("database is locked")
+
+// Raises this connection's lock on the database file to level, without
+// waiting for other connections to let go of theirs
+func (p *pager) lock(level int) error {
+	if p.file == nil || p.lockLevel >= level {
+		return nil
+	}
+	if p.lockLevel == lockNone {
+		// Readers only start while the pending byte is free, so that a
+		// writer waiting for the readers to finish gets its turn
+		if err := rangeLock(p.file, rangeRead, pendingByte, 1); err != nil {
+			return err
+		}
+		err := rangeLock(p.file, rangeRead, sharedFirst, sharedSize)
+		rangeLock(p.file, rangeUnlock, pendingByte, 1)
+		if err != nil {
+			return err
+		}
+		p.lockLevel = lockShared
+	}
+	if level >= lockReserved && p.lockLevel < lockReserved {
+		if err := rangeLock(p.file, rangeWrite, reservedByte, 1); err != nil {
+			return err
+		}
+		p.lockLevel = lockReserved
+	}
+	if level >= lockPending && p.lockLevel < lockPending {
+		if err := rangeLock(p.file, rangeWrite, pendingByte, 1); err != nil {
+			return err
+		}
+		p.lockLevel = lockPending
+	}
+	if level == lockExclusive && p.lockLevel < lockExclusive {
+		if err := rangeLock(p.file, rangeWrite, sharedFirst, sharedSize); err != nil {
+			return err
+		}
+		p.lockLevel = lockExclusive
+	}
+	return nil
+}
+
+// Lowers this connection's lock on the database file to lockReserved,
+// lockShared or lockNone
+func (p *pager) unlock(level int) error {
+	if p.file == nil || p.lockLevel <= level {
+		return nil
+	}
+	if level == lockNone {
+		p.lockLevel = lockNone
+		return rangeLock(p.file, rangeUnlock, 0, 0)
+	}
+	if p.lockLevel == lockExclusive {
+		if err := rangeLock(p.file, rangeRead, sharedFirst, sharedSize); err != nil {
+			return err
+		}
+	}
+	if level == lockReserved {
+		p.lockLevel = lockReserved
+		return rangeLock(p.file, rangeUnlock, pendingByte, 1)
+	}
+	p.lockLevel = lockShared
+	return rangeLock(p.file, rangeUnlock, pendingByte, 2)
+}
@@ -0,0 +1,40 @@
+//go:build unix
+
+package main
+
+import (
+	"io"
+	"os"
+	"syscall"
+)
+
+// Takes or releases a lock on length bytes of the file from start, or on
+// all of it past start when length is 0. Fails with errLocked when another
+// process holds a lock in the way.
+func rangeLock(file *os.File, kind int, start, length int64) error {
+	lk := syscall.Flock_t{Type: flockType(kind), Whence: io.SeekStart, Start: start, Len: length}
+	err := syscall.FcntlFlock(file.Fd(), syscall.F_SETLK, &lk)
+	if err == syscall.EAGAIN || err == syscall.EACCES {
+		return errLocked
+	}
+	return err
+}
+
+// Reports whether another process holds any lock on the byte range
+func rangeLocked(file *os.File, start, length int64) (bool, error) {
+	lk := syscall.Flock_t{Type: syscall.F_WRLCK, Whence: io.SeekStart, Start: start, Len: length}
+	if err := syscall.FcntlFlock(file.Fd(), syscall.F_GETLK, &lk); err != nil {
+		return false, err
+	}
+	return lk.Type != syscall.F_UNLCK, nil
+}
+
+func flockType(kind int) int16 {
+	switch kind {
+	case rangeRead:
+		return syscall.F_RDLCK
+	case rangeWrite:
+		return syscall.F_WRLCK
+	}
+	return syscall.F_UNLCK
+}
@@ -2,12 +2,13 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
-	"io"
 	"log"
 	"os"
 	"strings"
 
+	"github.com/chzyer/readline"
 	"github.com/xwb1989/sqlparser"
 )
 
@@ -17,49 +18,84 @@ type SQLiteSchemaRow struct {
 	tblName  string
 	rootPage int
 	sql      string
+	rowid    int // position in sqlite_schema, for changing the row
 }
 
-// Reads the schema table and returns all rows and the page size
-func readSchemaTable(databaseFile *os.File) ([]SQLiteSchemaRow, int, error) {
-	header := make([]byte, 100)
-	_, err := databaseFile.ReadAt(header, 0)
-	if err != nil {
-		return nil, 0, err
-	}
-	pageSize := int(header[16])<<8 | int(header[17])
-	_, _ = databaseFile.Seek(100, io.SeekStart)
-
-	pageHeader := parserHeader(databaseFile)
-	cellPointers := make([]uint16, pageHeader.numCells)
-	for i := 0; i < int(pageHeader.numCells); i++ {
-		cellPointers[i] = parseUInt16(databaseFile)
-	}
-
+// Reads the rows of the schema table. Damage to its pages or records is
+// returned as an error rather than ending the program, so that a broken
+// database can still be opened to be checked or recovered.
+func readSchemaTable(p *pager) ([]SQLiteSchemaRow, error) {
+	// The schema is an ordinary table b-tree rooted at page 1
 	var sqliteSchemaRows []SQLiteSchemaRow
-	for _, cellPointer := range cellPointers {
-		_, _ = databaseFile.Seek(int64(cellPointer), io.SeekStart)
-		parseVarint(databaseFile)
-		parseVarint(databaseFile)
-		record := parserRecord(databaseFile, 5)
+	err := p.walkPayloads(1, func(rowid int64, payload []byte) error {
+		if !recordValid(payload) {
+			return fmt.Errorf("database disk image is malformed: bad schema record %d", rowid)
+		}
+		record := parserRecordDynamic(bytes.NewReader(payload))
+		if len(record.values) < 5 {
+			return fmt.Errorf("malformed schema row %d", rowid)
+		}
+		rootPage, _ := normalizeValue(record.values[3]).(int64)
+		switch formatValue(record.values[0]) {
+		case "table", "index":
+			// Virtual tables have no b-tree and a root page of 0
+			if rootPage != 0 && (rootPage < 2 || rootPage > int64(p.pageCount)) {
+				return fmt.Errorf("malformed database schema (%s) - invalid rootpage", formatValue(record.values[1]))
+			}
+		}
 		sqliteSchemaRows = append(sqliteSchemaRows, SQLiteSchemaRow{
-			_type:    string(record.values[0].([]byte)),
-			name:     string(record.values[1].([]byte)),
-			tblName:  string(record.values[2].([]byte)),
-			rootPage: toInt(record.values[3]),
-			sql:      string(record.values[4].([]byte)),
+			_type:    formatValue(record.values[0]),
+			name:     formatValue(record.values[1]),
+			tblName:  formatValue(record.values[2]),
+			rootPage: int(rootPage),
+			sql:      formatValue(record.values[4]),
+			rowid:    int(rowid),
 		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-	return sqliteSchemaRows, pageSize, nil
+	return sqliteSchemaRows, nil
 }
 
-// Collects all rows from a table by traversing the B-tree
-func collectAllTableRows(databaseFile *os.File, rootPageNum int, pageSize int) []TableRow {
-	var allRows []TableRow
+// Reads every row of a table b-tree in rowid order
+func (p *pager) tableRows(root int) ([]TableRow, error) {
+	var rows []TableRow
+	err := p.walkPayloads(root, func(rowid int64, payload []byte) error {
+		rec, err := decodeRecord(payload)
+		if err != nil {
+			return err
+		}
+		rows = append(rows, TableRow{rowid: int(rowid), record: rec})
+		return nil
+	})
+	return rows, err
+}
 
-	// Start traversal from the root page
-	traverseTableBTree(databaseFile, rootPageNum, pageSize, &allRows)
+// Looks up the row of a table b-tree with the given rowid
+func (p *pager) tableRow(root int, rowid int64) (Record, bool, error) {
+	_, leaf, pos, exact, err := p.seek(root, tableKeyCompare(rowid))
+	if err != nil || !exact {
+		return Record{}, false, err
+	}
+	cell := leaf.cells[pos]
+	payloadSize, n1 := decodeVarint(cell)
+	_, n2 := decodeVarint(cell[n1:])
+	payload, err := p.cellPayload(cell, n1+n2, int(payloadSize), false)
+	if err != nil {
+		return Record{}, false, err
+	}
+	rec, err := decodeRecord(payload)
+	return rec, err == nil, err
+}
 
-	return allRows
+// Decodes a record, checking first that its header and values fit
+func decodeRecord(payload []byte) (Record, error) {
+	if !recordValid(payload) {
+		return Record{}, fmt.Errorf("database disk image is malformed")
+	}
+	return parserRecordDynamic(bytes.NewReader(payload)), nil
 }
 
 type TableRow struct {
@@ -93,614 +129,257 @@ func toInt(v interface{}) int {
 	}
 }
 
-// Recursively traverses the B-tree to collect all table rows
-func traverseTableBTree(databaseFile *os.File, pageNum int, pageSize int, allRows *[]TableRow) {
-	// Calculate page start position
-	pageStart := int64((pageNum - 1) * pageSize)
-
-	// Read the entire page into memory for safer access
-	pageData := make([]byte, pageSize)
-	n, err := databaseFile.ReadAt(pageData, pageStart)
-	if err != nil && err != io.EOF {
-		log.Fatalf("Error reading page %d: %v", pageNum, err)
-	}
-	if n < 12 { // Need at least 12 bytes for interior page
-		log.Fatalf("Page %d too small: only %d bytes", pageNum, n)
-	}
-
-	// Create a reader for this page
-	pageReader := bytes.NewReader(pageData)
-
-	// Read the page header (8 bytes)
-	pageHeader := parserHeader(pageReader)
-
-	// fmt.Printf("Page %d: type=0x%02X, cells=%d\n", pageNum, pageHeader.pageType, pageHeader.numCells)
-
-	switch pageHeader.pageType {
-	case 0x05: // Interior table b-tree page
-		// Interior page structure:
-		// Bytes 0-7:   Page header
-		// Bytes 8-11:  Rightmost child page number (4 bytes)
-		// Bytes 12+:   Cell pointer array (2 bytes per cell)
-
-		// Read the rightmost child page number (immediately after 8-byte header)
-		rightmostChild := parseUInt32(pageReader)
-		// fmt.Printf("Interior page %d: rightmost child = %d\n", pageNum, rightmostChild)
-
-		// Validate rightmost child page number
-		if rightmostChild == 0 || rightmostChild > 1000000 {
-			log.Fatalf("Invalid rightmost child page number: %d", rightmostChild)
-		}
-
-		// Read cell pointer array
-		cellPointers := make([]uint16, pageHeader.numCells)
-		for i := 0; i < int(pageHeader.numCells); i++ {
-			cellPointers[i] = parseUInt16(pageReader)
-		}
-
-		// Process each cell in the interior page
-		for i, cellPtr := range cellPointers {
-			if int(cellPtr) >= len(pageData) || cellPtr < 12 {
-				log.Fatalf("Invalid cell pointer %d in page %d (page size %d)", cellPtr, pageNum, len(pageData))
-			}
-
-			// Seek to the cell
-			pageReader.Seek(int64(cellPtr), io.SeekStart)
-
-			// Each interior cell contains:
-			// - 4 bytes: left child page number
-			// - varint: key (rowid for table b-trees)
-			leftChild := parseUInt32(pageReader)
-			_ = parseVarint(pageReader) // key (rowid)
-
-			// fmt.Printf("Interior cell %d: left child = %d, key = %d\n", i, leftChild, key)
-
-			// Validate left child page number
-			if leftChild == 0 || leftChild > 1000000 {
-				log.Fatalf("Invalid left child page number: %d in cell %d", leftChild, i)
-			}
-
-			// Recursively traverse the left child
-			traverseTableBTree(databaseFile, int(leftChild), pageSize, allRows)
-		}
-
-		// Finally, traverse the rightmost child
-		traverseTableBTree(databaseFile, int(rightmostChild), pageSize, allRows)
-
-	case 0x0D: // Leaf table b-tree page
-		// Leaf page structure:
-		// Bytes 0-7:   Page header
-		// Bytes 8+:    Cell pointer array (2 bytes per cell)
-
-		// Read cell pointer array (comes right after the 8-byte header)
-		cellPointers := make([]uint16, pageHeader.numCells)
-		for i := 0; i < int(pageHeader.numCells); i++ {
-			cellPointers[i] = parseUInt16(pageReader)
-		}
-
-		// fmt.Printf("Leaf page %d: %d cells\n", pageNum, len(cellPointers))
-
-		// Process each cell in the leaf page
-		for _, cellPtr := range cellPointers {
-			if int(cellPtr) >= len(pageData) || cellPtr < 8 {
-				log.Fatalf("Invalid cell pointer %d in page %d (page size %d)", cellPtr, pageNum, len(pageData))
-			}
-
-			pageReader.Seek(int64(cellPtr), io.SeekStart)
-
-			// Each leaf cell contains:
-			// - varint: payload size (total size of the payload)
-			// - varint: rowid
-			// - payload: the actual record data
-			payloadSize := parseVarint(pageReader)
-			rowid := parseVarint(pageReader)
-
-			// fmt.Printf("Leaf cell %d: payload size = %d, rowid = %d\n", i, payloadSize, rowid)
-
-			// Check if we have enough data for the payload
-			currentPos, _ := pageReader.Seek(0, io.SeekCurrent)
-			remainingBytes := int64(len(pageData)) - currentPos
-			if remainingBytes < int64(payloadSize) {
-				log.Fatalf("Not enough data for payload: need %d bytes, have %d", payloadSize, remainingBytes)
-			}
-
-			rec := parserRecordDynamic(pageReader)
-
-			// Add this row to our collection
-			*allRows = append(*allRows, TableRow{
-				rowid:  rowid,
-				record: rec,
-			})
-		}
-
-	default:
-		log.Fatalf("Unsupported page type for table traversal: 0x%02X", pageHeader.pageType)
-	}
-}
-
-func countTableRows(databaseFile *os.File, rootPage int, pageSize int, whereExpr sqlparser.Expr, payloadCols []string, payloadIndex map[string]int, rowidColName string) int {
-	count := 0
-	countTableRowsRecursive(databaseFile, rootPage, pageSize, whereExpr, payloadCols, payloadIndex, rowidColName, &count)
-	return count
-}
-
-func countTableRowsRecursive(databaseFile *os.File, pageNum int, pageSize int, whereExpr sqlparser.Expr, payloadCols []string, payloadIndex map[string]int, rowidColName string, count *int) {
-	pageStart := int64((pageNum - 1) * pageSize)
-
-	// Read the entire page into memory for safer access
-	pageData := make([]byte, pageSize)
-	n, err := databaseFile.ReadAt(pageData, pageStart)
-	if err != nil && err != io.EOF {
-		log.Fatalf("Error reading page %d: %v", pageNum, err)
-	}
-	if n < 8 {
-		log.Fatalf("Page %d too small: only %d bytes", pageNum, n)
-	}
-
-	// Create a reader for this page
-	pageReader := bytes.NewReader(pageData)
-	pageHeader := parserHeader(pageReader)
-
-	switch pageHeader.pageType {
-	case 0x05: // Interior table b-tree page
-		// Read rightmost child first (immediately after 8-byte header)
-		rightmostChild := parseUInt32(pageReader)
-
-		// Read cell pointer array
-		cellPointers := make([]uint16, pageHeader.numCells)
-		for i := 0; i < int(pageHeader.numCells); i++ {
-			cellPointers[i] = parseUInt16(pageReader)
-		}
-
-		// Process each cell
-		for _, cellPtr := range cellPointers {
-			pageReader.Seek(int64(cellPtr), io.SeekStart)
-			leftChild := parseUInt32(pageReader)
-			_ = parseVarint(pageReader) // key
-
-			countTableRowsRecursive(databaseFile, int(leftChild), pageSize, whereExpr, payloadCols, payloadIndex, rowidColName, count)
-		}
-
-		countTableRowsRecursive(databaseFile, int(rightmostChild), pageSize, whereExpr, payloadCols, payloadIndex, rowidColName, count)
-
-	case 0x0D: // Leaf table b-tree page
-		// Read cell pointer array
-		cellPointers := make([]uint16, pageHeader.numCells)
-		for i := 0; i < int(pageHeader.numCells); i++ {
-			cellPointers[i] = parseUInt16(pageReader)
-		}
-
-		for _, cellPtr := range cellPointers {
-			pageReader.Seek(int64(cellPtr), io.SeekStart)
-			_ = parseVarint(pageReader)      // payload size
-			rowid := parseVarint(pageReader) // rowid
-			rec := parserRecordDynamic(pageReader)
-
-			if whereExpr == nil || evaluateWhereClause(whereExpr, payloadIndex, payloadCols, rowidColName, rec.values, rowid) {
-				*count++
-			}
-		}
-	}
-}
-
-func extractRowValues(rec Record, rowid int, colIndices []int, isRowidCols []bool) []string {
-	values := make([]string, 0, len(colIndices))
-	for i, colIndex := range colIndices {
-		if isRowidCols[i] {
-			values = append(values, fmt.Sprintf("%d", rowid))
-			continue
-		}
-		if colIndex >= len(rec.values) {
-			values = append(values, "")
-			continue
-		}
-		v := rec.values[colIndex]
-		switch vv := v.(type) {
-		case nil:
-			values = append(values, "")
-		case []byte:
-			values = append(values, string(vv))
-		default:
-			values = append(values, fmt.Sprintf("%v", vv))
-		}
-	}
-	return values
-}
-
-func extractEqualityValue(expr sqlparser.Expr, column string) (string, bool) {
+// Finds a "column = constant" term among the AND-ed terms of a WHERE
+// clause and returns the constant's value
+func extractEqualityValue(expr sqlparser.Expr, column string) (interface{}, bool) {
 	switch e := expr.(type) {
 	case *sqlparser.ComparisonExpr:
 		if e.Operator != sqlparser.EqualStr {
-			return "", false
+			return nil, false
 		}
 		if col, ok := e.Left.(*sqlparser.ColName); ok && strings.EqualFold(col.Name.String(), column) {
-			return literalToString(e.Right)
+			return literalValue(e.Right)
 		}
 		if col, ok := e.Right.(*sqlparser.ColName); ok && strings.EqualFold(col.Name.String(), column) {
-			return literalToString(e.Left)
+			return literalValue(e.Left)
 		}
+	case *sqlparser.ParenExpr:
+		return extractEqualityValue(e.Expr, column)
 	case *sqlparser.AndExpr:
 		if v, ok := extractEqualityValue(e.Left, column); ok {
 			return v, true
 		}
 		return extractEqualityValue(e.Right, column)
 	}
-	return "", false
+	return nil, false
 }
 
-func literalToString(expr sqlparser.Expr) (string, bool) {
+func literalValue(expr sqlparser.Expr) (interface{}, bool) {
 	switch v := expr.(type) {
 	case *sqlparser.SQLVal:
 		switch v.Type {
-		case sqlparser.StrVal, sqlparser.IntVal:
-			return string(v.Val), true
+		case sqlparser.StrVal, sqlparser.IntVal, sqlparser.FloatVal:
+			return getExprValue(v, nil, nil, "", nil, 0), true
 		}
 	}
-	return "", false
-}
-
-func searchIndexForValue(databaseFile *os.File, indexRoot int, pageSize int, target string) []int {
-	var rowids []int
-	traverseIndexBTree(databaseFile, indexRoot, pageSize, target, &rowids)
-	return rowids
+	return nil, false
 }
 
-func traverseIndexBTree(databaseFile *os.File, pageNum int, pageSize int, target string, rowids *[]int) {
-	pageStart := int64((pageNum - 1) * pageSize)
-	pageData := make([]byte, pageSize)
-	n, err := databaseFile.ReadAt(pageData, pageStart)
-	if err != nil && err != io.EOF {
-		log.Fatalf("Error reading index page %d: %v", pageNum, err)
-	}
-	if n < 8 {
-		log.Fatalf("Index page %d too small: only %d bytes", pageNum, n)
-	}
-
-	reader := bytes.NewReader(pageData)
-	header := parserHeader(reader)
-
-	switch header.pageType {
-	case 0x02: // Interior index page
-		rightmostChild := parseUInt32(reader)
-		cellPointers := make([]uint16, header.numCells)
-		for i := 0; i < int(header.numCells); i++ {
-			cellPointers[i] = parseUInt16(reader)
+// Returns the rowids of the index entries whose first key equals target,
+// walking the index in key order and only into subtrees that can hold it
+func (p *pager) indexRowids(root int, target interface{}, collation string) ([]int64, error) {
+	var rowids []int64
+	var walk func(pageNum, depth int) (bool, error)
+	walk = func(pageNum, depth int) (bool, error) {
+		if depth > 64 {
+			return false, fmt.Errorf("database disk image is malformed: b-tree at page %d is too deep", root)
 		}
-
-		for _, cellPtr := range cellPointers {
-			reader.Seek(int64(cellPtr), io.SeekStart)
-			leftChild := parseUInt32(reader)
-			payloadSize := parseVarint(reader)
-			rec := parserRecordDynamic(io.LimitReader(reader, int64(payloadSize)))
-			if len(rec.values) == 0 {
-				continue
-			}
-			keyVal := valueToString(rec.values[0])
-			_ = keyVal
-			traverseIndexBTree(databaseFile, int(leftChild), pageSize, target, rowids)
+		node, err := p.readNode(pageNum)
+		if err != nil {
+			return false, err
 		}
-		traverseIndexBTree(databaseFile, int(rightmostChild), pageSize, target, rowids)
-	case 0x0A: // Leaf index page
-		cellPointers := make([]uint16, header.numCells)
-		for i := 0; i < int(header.numCells); i++ {
-			cellPointers[i] = parseUInt16(reader)
+		if !node.isIndex() {
+			return false, fmt.Errorf("database disk image is malformed: page %d is not an index page", pageNum)
 		}
-		for _, cellPtr := range cellPointers {
-			reader.Seek(int64(cellPtr), io.SeekStart)
-			payloadSize := parseVarint(reader) // payload size
-			rec := parserRecordDynamic(io.LimitReader(reader, int64(payloadSize)))
+		for i, cell := range node.cells {
+			start := 0
+			if !node.isLeaf() {
+				start = 4
+			}
+			payloadSize, n := decodeVarint(cell[start:])
+			payload, err := p.cellPayload(cell, start+n, int(payloadSize), true)
+			if err != nil {
+				return false, err
+			}
+			rec, err := decodeRecord(payload)
+			if err != nil {
+				return false, err
+			}
 			if len(rec.values) == 0 {
 				continue
 			}
-			keyVal := valueToString(rec.values[0])
-			if keyVal == target {
-				rowidVal := rec.values[len(rec.values)-1]
-				*rowids = append(*rowids, toInt(rowidVal))
-			} else if strings.Compare(keyVal, target) > 0 {
-				break
+			// Interior cells are entries too, after their left subtree
+			c := compareSortValues(rec.values[0], target, collation)
+			if !node.isLeaf() && c >= 0 {
+				if more, err := walk(node.child(i), depth+1); !more || err != nil {
+					return false, err
+				}
+			}
+			if c > 0 {
+				return false, nil
+			}
+			if c == 0 {
+				rowid, _, _ := toNumber(rec.values[len(rec.values)-1])
+				rowids = append(rowids, rowid)
 			}
 		}
-	default:
-		log.Fatalf("Unsupported index page type: 0x%02X", header.pageType)
+		if node.isLeaf() {
+			return true, nil
+		}
+		return walk(node.rightChild, depth+1)
 	}
+	_, err := walk(root, 0)
+	return rowids, err
 }
 
-func fetchTableRowByRowid(databaseFile *os.File, pageNum int, pageSize int, targetRowid int) (Record, bool) {
-	pageStart := int64((pageNum - 1) * pageSize)
-	pageData := make([]byte, pageSize)
-	n, err := databaseFile.ReadAt(pageData, pageStart)
-	if err != nil && err != io.EOF {
-		log.Fatalf("Error reading table page %d: %v", pageNum, err)
-	}
-	if n < 8 {
-		return Record{}, false
-	}
-
-	reader := bytes.NewReader(pageData)
-	header := parserHeader(reader)
-
-	switch header.pageType {
-	case 0x05: // Interior table page
-		rightmostChild := parseUInt32(reader)
-		cellPointers := make([]uint16, header.numCells)
-		for i := 0; i < int(header.numCells); i++ {
-			cellPointers[i] = parseUInt16(reader)
-		}
-
-		for _, cellPtr := range cellPointers {
-			reader.Seek(int64(cellPtr), io.SeekStart)
-			leftChild := parseUInt32(reader)
-			key := parseVarint(reader)
-			if targetRowid <= key {
-				return fetchTableRowByRowid(databaseFile, int(leftChild), pageSize, targetRowid)
+// Usage: your_program.sh [-bail] sample.db [.dbinfo | SQL]. Without a
+// command the interactive shell starts, or a script piped to stdin runs.
+func main() {
+	sh := newShell()
+	args := os.Args[1:]
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") {
+		switch args[0] {
+		case "-bail", "--bail":
+			sh.bail = true
+		case "-header", "--header":
+			sh.setHeaders(true)
+		case "-noheader", "--noheader":
+			sh.setHeaders(false)
+		case "-mode", "--mode", "-nullvalue", "--nullvalue", "-separator", "--separator":
+			if len(args) < 2 {
+				fmt.Fprintf(os.Stderr, "Error: missing argument to %s\n", args[0])
+				os.Exit(1)
 			}
-		}
-		return fetchTableRowByRowid(databaseFile, int(rightmostChild), pageSize, targetRowid)
-
-	case 0x0D: // Leaf table page
-		cellPointers := make([]uint16, header.numCells)
-		for i := 0; i < int(header.numCells); i++ {
-			cellPointers[i] = parseUInt16(reader)
-		}
-		for _, cellPtr := range cellPointers {
-			reader.Seek(int64(cellPtr), io.SeekStart)
-			_ = parseVarint(reader)      // payload size
-			rowid := parseVarint(reader) // rowid
-			if rowid == targetRowid {
-				rec := parserRecordDynamic(reader)
-				return rec, true
+			// The same as the dot-command of that name
+			if err := sh.runDotArgs([]string{"." + strings.TrimLeft(args[0], "-"), args[1]}); err != nil {
+				fmt.Fprintln(os.Stderr, "Error:", err)
+				os.Exit(1)
 			}
-			if rowid > targetRowid {
+			args = args[1:]
+		default:
+			// -csv, -json and the like name a mode directly
+			if _, ok := outputModes[strings.TrimLeft(args[0], "-")]; ok {
+				sh.setMode([]string{strings.TrimLeft(args[0], "-")})
 				break
 			}
+			fmt.Fprintf(os.Stderr, "Error: unknown option: %s\n", args[0])
+			os.Exit(1)
 		}
-		return Record{}, false
-	default:
-		return Record{}, false
+		args = args[1:]
 	}
-}
-
-// Usage: your_program.sh sample.db .dbinfo
-func main() {
-	databaseFilePath := os.Args[1]
-	command := os.Args[2]
-
-	databaseFile, err := os.Open(databaseFilePath)
+	if len(args) < 1 {
+		fmt.Fprintln(os.Stderr, "Usage: your_program.sh [-bail] DATABASE [COMMAND]")
+		os.Exit(1)
+	}
+	db, err := openDatabase(args[0])
 	if err != nil {
 		log.Fatal(err)
 	}
+	sh.db = db
+	os.Exit(runMain(sh, args[1:]))
+}
 
-	sqliteSchemaRows, pageSize, err := readSchemaTable(databaseFile)
+// Runs the commands, script or interactive shell main asked for and
+// returns the exit code
+func runMain(sh *shell, args []string) int {
+	defer sh.db.close()
+	var err error
+	switch {
+	case len(args) == 0 && readline.IsTerminal(int(os.Stdin.Fd())):
+		err = sh.runInteractive()
+	case len(args) == 0:
+		err = sh.runScript(os.Stdin)
+	default:
+		err = sh.runCommands(args)
+	}
+	if exit, ok := err.(*exitRequest); ok {
+		return exit.code
+	}
 	if err != nil {
-		log.Fatal(err)
+		return 1
 	}
+	return 0
+}
 
-	//Check if metacommand ( starts with . )
-	if strings.HasPrefix(command, ".") {
-		switch command {
-
-		case ".dbinfo":
-			fmt.Println("database page size: ", pageSize)
-			fmt.Printf("number of tables: %v\n", len(sqliteSchemaRows))
-		case ".tables":
-			var tableNames []string
-			for _, row := range sqliteSchemaRows {
-				tableNames = append(tableNames, row.tblName)
-			}
-			fmt.Println(strings.Join(tableNames, " "))
-		default:
-			fmt.Println("Unknown command", command)
-			os.Exit(1)
-		}
-	} else {
-		// Otherwise, SQL command
-		stmt, err := sqlparser.Parse(command)
-		if err != nil {
-			fmt.Println("Failed to parse SQL:", err)
-			os.Exit(1)
-		}
-
-		switch stmt := stmt.(type) {
-		case *sqlparser.Select:
-			// Handle SELECT statements
-			if len(stmt.From) != 1 {
-				fmt.Println("Only single table SELECT statements are supported")
-				os.Exit(1)
-			}
-			tableExpr := stmt.From[0]
-			tableName := sqlparser.String(tableExpr.(*sqlparser.AliasedTableExpr).Expr)
-
-			// Handle COUNT(*) special case
-			if len(stmt.SelectExprs) == 1 {
-				if aliasedExpr, ok := stmt.SelectExprs[0].(*sqlparser.AliasedExpr); ok && strings.ToUpper(sqlparser.String(aliasedExpr.Expr)) == "COUNT(*)" {
-					var rootPage int
-					for _, row := range sqliteSchemaRows {
-						if row._type == "table" && row.name == tableName {
-							rootPage = row.rootPage
-							break
-						}
-					}
-					if rootPage == 0 {
-						fmt.Printf("table not found: %s\n", tableName)
-						os.Exit(1)
-					}
-
-					// Get table schema for WHERE evaluation
-					var createSQL string
-					for _, row := range sqliteSchemaRows {
-						if row._type == "table" && row.name == tableName {
-							createSQL = row.sql
-							break
-						}
-					}
-					defs := parseCreateTableColumns(createSQL)
-					var (
-						payloadCols  []string
-						rowidColName string
-						payloadIndex map[string]int
-					)
-					payloadIndex = make(map[string]int)
-					recordIndex := 0
-					for _, def := range defs {
-						if def.isRowid {
-							rowidColName = def.name
-							recordIndex++
-						} else {
-							payloadCols = append(payloadCols, def.name)
-							payloadIndex[strings.ToLower(def.name)] = recordIndex
-							recordIndex++
-						}
-					}
-
-					// Count rows using B-tree traversal
-					var whereExpr sqlparser.Expr
-					if stmt.Where != nil {
-						whereExpr = stmt.Where.Expr
-					}
-					count := countTableRows(databaseFile, rootPage, pageSize, whereExpr, payloadCols, payloadIndex, rowidColName)
-					fmt.Println(count)
-					return
-				}
-			}
-
-			// Parse requested columns
-			var requestedCols []string
-			for _, selectExpr := range stmt.SelectExprs {
-				switch expr := selectExpr.(type) {
-				case *sqlparser.AliasedExpr:
-					colName := sqlparser.String(expr.Expr)
-					requestedCols = append(requestedCols, colName)
-				case *sqlparser.StarExpr:
-					// Handle SELECT * - add all columns
-					requestedCols = []string{"*"}
-				default:
-					fmt.Println("Unsupported SELECT expression type")
-					os.Exit(1)
-				}
-			}
-
-			var (
-				rootPage  int
-				createSQL string
-			)
-
-			for _, row := range sqliteSchemaRows {
-				if row._type == "table" && row.name == tableName {
-					rootPage = row.rootPage
-					createSQL = row.sql
-					break
-				}
-			}
-			if rootPage == 0 {
-				fmt.Printf("table not found: %s\n", tableName)
-				os.Exit(1)
-			}
-
-			defs := parseCreateTableColumns(createSQL)
-
-			// Build the list of payload columns (exclude rowid columns) and track rowid column name
-			var payloadCols []string
-			var rowidColName string
-			payloadIndex := make(map[string]int)
-			recordIndex := 0
-			for _, def := range defs {
-				if def.isRowid {
-					rowidColName = def.name // Remember the name of the rowid column
-					recordIndex++
-				} else {
-					payloadCols = append(payloadCols, def.name)
-					payloadIndex[strings.ToLower(def.name)] = recordIndex
-					recordIndex++
-				}
-			}
-
-			// Optional: find index on country and country value from WHERE clause
-			var indexRoot int
-			for _, row := range sqliteSchemaRows {
-				if row._type == "index" && row.tblName == tableName && row.name == "idx_companies_country" {
-					indexRoot = row.rootPage
-					break
-				}
-			}
-			var countryValue string
-			var hasCountryFilter bool
-			if stmt.Where != nil {
-				countryValue, hasCountryFilter = extractEqualityValue(stmt.Where.Expr, "country")
-			}
-
-			// Handle SELECT *
-			if len(requestedCols) == 1 && requestedCols[0] == "*" {
-				requestedCols = make([]string, 0)
-				// Add rowid column first if it exists
-				if rowidColName != "" {
-					requestedCols = append(requestedCols, rowidColName)
-				}
-				// Add all payload columns
-				requestedCols = append(requestedCols, payloadCols...)
-			}
-
-			// Find column indices
-			var colIndices []int
-			var isRowidCols []bool
-			for _, colName := range requestedCols {
-				// Check if this is a rowid column (either explicit "rowid" or the detected rowid column name)
-				if strings.ToLower(colName) == "rowid" || (rowidColName != "" && strings.EqualFold(colName, rowidColName)) {
-					colIndices = append(colIndices, -1) // Special marker for rowid
-					isRowidCols = append(isRowidCols, true)
-				} else {
-					colIndex, ok := payloadIndex[strings.ToLower(colName)]
-					if !ok {
-						fmt.Printf("no such column: %s\n", colName)
-						fmt.Printf("Available payload columns: %v\n", payloadCols)
-						fmt.Printf("Rowid column: %s\n", rowidColName)
-						os.Exit(1)
-					}
-					colIndices = append(colIndices, colIndex)
-					isRowidCols = append(isRowidCols, false)
+// Runs the commands given after the database in turn, stopping at the
+// first that fails
+func (sh *shell) runCommands(commands []string) error {
+	for _, command := range commands {
+		if strings.HasPrefix(command, ".") {
+			// A dot-command
+			err := sh.runDotCommand(command)
+			if err != nil && err != errScriptFailed {
+				if _, ok := err.(*exitRequest); !ok {
+					fmt.Println(err)
 				}
 			}
-
-			if indexRoot != 0 && hasCountryFilter {
-				rowids := searchIndexForValue(databaseFile, indexRoot, pageSize, countryValue)
-				seen := make(map[int]bool)
-				for _, rowid := range rowids {
-					if seen[rowid] {
-						continue
-					}
-					seen[rowid] = true
-
-					rec, ok := fetchTableRowByRowid(databaseFile, rootPage, pageSize, rowid)
-					if !ok {
-						continue
-					}
-					values := extractRowValues(rec, rowid, colIndices, isRowidCols)
-					fmt.Println(strings.Join(values, "|"))
-				}
-				return
+			if err != nil {
+				return err
 			}
+			continue
+		}
+		// SQL: one or more statements separated by semicolons
+		if err := sh.runSQL(command); err != nil {
+			fmt.Println("Error:", err)
+			return err
+		}
+	}
+	return nil
+}
 
-			// Collect all rows using B-tree traversal
-			allRows := collectAllTableRows(databaseFile, rootPage, pageSize)
-
-			// Filter and print rows
-			for _, row := range allRows {
-				// Check WHERE clause if present
-				if stmt.Where != nil {
-					match := evaluateWhereClause(stmt.Where.Expr, payloadIndex, payloadCols, rowidColName, row.record.values, row.rowid)
-					if !match {
-						continue // Skip this row
-					}
-				}
-
-				values := extractRowValues(row.record, row.rowid, colIndices, isRowidCols)
-				fmt.Println(strings.Join(values, "|"))
+// Runs one SQL statement, returning its result rows if it has any.
+// Statements the MySQL grammar does not know are parsed by hand.
+func executeStatement(db *database, sql string) (rs *resultSet, err error) {
+	if len(db.triggerStack) == 0 {
+		defer func() {
+			var re *raiseError
+			if errors.As(err, &re) {
+				err = fmt.Errorf("RAISE() may only be used within a trigger-program")
 			}
+		}()
+	}
+	if len(db.triggerStack) == 0 {
+		if err := db.beginRead(); err != nil {
+			return nil, err
+		}
+		defer db.file.endRead()
+	}
+	if db.schemaErr != nil && statementKeyword(sql) != "PRAGMA" {
+		return nil, db.schemaErr
+	}
+	switch statementKeyword(sql) {
+	case "PRAGMA":
+		return executePragma(db, sql)
+	case "BEGIN", "COMMIT", "END", "ROLLBACK":
+		return nil, executeTransaction(db, sql)
+	case "CREATE":
+		return nil, executeCreate(db, sql)
+	case "DROP":
+		return nil, executeDrop(db, sql)
+	case "ALTER":
+		return nil, executeAlter(db, sql)
+	case "VACUUM":
+		return nil, executeVacuum(db, sql)
+	}
 
-			return
-
-		default:
-			fmt.Println("Unsupported SQL statement type")
-			os.Exit(1)
+	// OR <resolution> and ON CONFLICT are SQLite syntax, taken out before
+	// the rest is parsed
+	onConflict := ""
+	var upserts []*upsertClause
+	switch statementKeyword(sql) {
+	case "INSERT", "REPLACE", "UPDATE":
+		var err error
+		if sql, onConflict, upserts, err = splitConflictClauses(sql); err != nil {
+			return nil, err
 		}
 	}
+
+	stmt, err := sqlparser.Parse(prepareSQL(sql))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse SQL: %v", err)
+	}
+	switch stmt := stmt.(type) {
+	case sqlparser.SelectStatement:
+		return executeSelect(db, stmt, sql)
+	case *sqlparser.Insert:
+		_, err := executeInsert(db, stmt, sql, onConflict, upserts)
+		return nil, err
+	case *sqlparser.Update:
+		_, err := executeUpdate(db, stmt, onConflict)
+		return nil, err
+	case *sqlparser.Delete:
+		_, err := executeDelete(db, stmt)
+		return nil, err
+	}
+	return nil, fmt.Errorf("unsupported SQL statement type")
 }
@@ -0,0 +1,490 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// resultWriter prints the rows of a statement in one of the output modes
+// of .mode
+type resultWriter interface {
+	writeResult(w *bufio.Writer, rs *resultSet, s *outputSettings)
+}
+
+// The settings of .headers, .nullvalue and .separator, which the output
+// modes share
+type outputSettings struct {
+	headers   bool
+	nullValue string // the text of NULL
+	colSep    string // between the values of a row in list and csv modes
+	rowSep    string // after each row in list and csv modes
+}
+
+// Renders a value as text, NULL as the .nullvalue text
+func (s *outputSettings) text(v interface{}) string {
+	if v == nil {
+		return s.nullValue
+	}
+	return formatValue(v)
+}
+
+// The output modes and what they need from .mode's arguments
+var outputModes = map[string]func(args []string) resultWriter{
+	"box":      func([]string) resultWriter { return &gridWriter{style: boxStyle} },
+	"column":   func([]string) resultWriter { return &columnWriter{} },
+	"csv":      func([]string) resultWriter { return &csvWriter{} },
+	"insert":   newInsertWriter,
+	"json":     func([]string) resultWriter { return &jsonWriter{} },
+	"line":     func([]string) resultWriter { return &lineWriter{} },
+	"list":     func([]string) resultWriter { return &listWriter{} },
+	"markdown": func([]string) resultWriter { return &gridWriter{style: markdownStyle} },
+	"quote":    func([]string) resultWriter { return &quoteWriter{} },
+	"table":    func([]string) resultWriter { return &gridWriter{style: tableStyle} },
+	"tabs":     func([]string) resultWriter { return &listWriter{} },
+}
+
+// Looks up an output mode by name, as .mode and -mode name them
+func newResultWriter(mode string, args []string) (resultWriter, error) {
+	newWriter, ok := outputModes[strings.ToLower(mode)]
+	if !ok {
+		return nil, fmt.Errorf("mode should be one of: %s", strings.Join(outputModeNames(), " "))
+	}
+	return newWriter(args), nil
+}
+
+func outputModeNames() []string {
+	var names []string
+	for name := range outputModes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Prints a result set to out in the given output mode
+func writeResultSet(out io.Writer, rw resultWriter, rs *resultSet, s *outputSettings) {
+	w := bufio.NewWriter(out)
+	rw.writeResult(w, rs, s)
+	w.Flush()
+}
+
+// Calls write for the header of the list-like modes when .headers is on
+// and there are rows to head
+func writeHeader(rs *resultSet, s *outputSettings, write func(row []interface{})) {
+	if !s.headers || len(rs.rows) == 0 {
+		return
+	}
+	header := make([]interface{}, len(rs.columns))
+	for i, name := range rs.columns {
+		header[i] = name
+	}
+	write(header)
+}
+
+// listWriter prints each row on a line, its values joined by the column
+// separator: "|" in list mode and a tab in tabs mode
+type listWriter struct{}
+
+func (lw *listWriter) writeResult(w *bufio.Writer, rs *resultSet, s *outputSettings) {
+	write := func(row []interface{}) {
+		for i, v := range row {
+			if i > 0 {
+				w.WriteString(s.colSep)
+			}
+			w.WriteString(s.text(v))
+		}
+		w.WriteString(s.rowSep)
+	}
+	writeHeader(rs, s, write)
+	for _, row := range rs.rows {
+		write(row)
+	}
+}
+
+// csvWriter prints rows as RFC 4180 CSV. Like sqlite3 it quotes any text
+// that is empty or holds the separator, a quote, space, control character
+// or non-ASCII byte, and never numbers or NULL.
+type csvWriter struct{}
+
+func (cw *csvWriter) writeResult(w *bufio.Writer, rs *resultSet, s *outputSettings) {
+	write := func(row []interface{}) {
+		for i, v := range row {
+			if i > 0 {
+				w.WriteString(s.colSep)
+			}
+			switch n := normalizeValue(v).(type) {
+			case string:
+				w.WriteString(csvField(n, s.colSep))
+			case []byte:
+				w.WriteString(csvField(string(n), s.colSep))
+			default:
+				w.WriteString(s.text(n))
+			}
+		}
+		w.WriteString(s.rowSep)
+	}
+	writeHeader(rs, s, write)
+	for _, row := range rs.rows {
+		write(row)
+	}
+}
+
+func csvField(s, separator string) string {
+	quote := s == "" || strings.Contains(s, separator)
+	for i := 0; i < len(s) && !quote; i++ {
+		c := s[i]
+		quote = c <= ' ' || c >= 0x7f || c == '"' || c == '\''
+	}
+	if !quote {
+		return s
+	}
+	return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
+}
+
+// jsonWriter prints the rows as a JSON array of objects keyed by column
+// name, one object per line
+type jsonWriter struct{}
+
+func (jw *jsonWriter) writeResult(w *bufio.Writer, rs *resultSet, s *outputSettings) {
+	for r, row := range rs.rows {
+		if r == 0 {
+			w.WriteString("[{")
+		} else {
+			w.WriteString(",\n{")
+		}
+		for i, v := range row {
+			if i > 0 {
+				w.WriteString(",")
+			}
+			w.WriteString(jsonString(rs.columns[i]))
+			w.WriteString(":")
+			w.WriteString(jsonValue(v))
+		}
+		w.WriteString("}")
+	}
+	if len(rs.rows) > 0 {
+		w.WriteString("]\n")
+	}
+}
+
+// Renders a value as JSON: numbers as numbers, NULL as null and text and
+// blobs as strings
+func jsonValue(v interface{}) string {
+	switch n := normalizeValue(v).(type) {
+	case nil:
+		return "null"
+	case int64:
+		return formatValue(n)
+	case float64:
+		if math.IsNaN(n) {
+			return "null"
+		}
+		return sqlLiteral(n)
+	case []byte:
+		return jsonString(string(n))
+	}
+	return jsonString(formatValue(v))
+}
+
+func jsonString(s string) string {
+	var sb strings.Builder
+	sb.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"':
+			sb.WriteString(`\"`)
+		case '\\':
+			sb.WriteString(`\\`)
+		case '\b':
+			sb.WriteString(`\b`)
+		case '\f':
+			sb.WriteString(`\f`)
+		case '\n':
+			sb.WriteString(`\n`)
+		case '\r':
+			sb.WriteString(`\r`)
+		case '\t':
+			sb.WriteString(`\t`)
+		default:
+			if r < 0x20 {
+				fmt.Fprintf(&sb, `\u%04x`, r)
+			} else {
+				sb.WriteRune(r)
+			}
+		}
+	}
+	sb.WriteByte('"')
+	return sb.String()
+}
+
+// lineWriter prints each value on a line of its own after its column
+// name, with a blank line between rows
+type lineWriter struct{}
+
+func (lw *lineWriter) writeResult(w *bufio.Writer, rs *resultSet, s *outputSettings) {
+	width := 5
+	for _, name := range rs.columns {
+		width = max(width, utf8.RuneCountInString(name))
+	}
+	for r, row := range rs.rows {
+		if r > 0 {
+			w.WriteString("\n")
+		}
+		for i, v := range row {
+			fmt.Fprintf(w, "%s = %s\n", padLeft(rs.columns[i], width), s.text(v))
+		}
+	}
+}
+
+// insertWriter prints each row as an INSERT statement into a table named
+// by .mode's argument, listing the columns when .headers is on
+type insertWriter struct {
+	table string
+}
+
+func newInsertWriter(args []string) resultWriter {
+	table := "table"
+	if len(args) > 0 {
+		table = args[0]
+	}
+	return &insertWriter{table: table}
+}
+
+func (iw *insertWriter) writeResult(w *bufio.Writer, rs *resultSet, s *outputSettings) {
+	table := iw.table
+	if !isPlainIdentifier(table) {
+		table = quoteIdentifier(table)
+	}
+	if s.headers {
+		names := make([]string, len(rs.columns))
+		for i, name := range rs.columns {
+			names[i] = name
+			if !isPlainIdentifier(name) {
+				names[i] = quoteIdentifier(name)
+			}
+		}
+		table += "(" + strings.Join(names, ",") + ")"
+	}
+	for _, row := range rs.rows {
+		fmt.Fprintf(w, "INSERT INTO %s VALUES(", table)
+		writeLiterals(w, row)
+		w.WriteString(");\n")
+	}
+}
+
+// quoteWriter prints each row as comma-separated SQL literals
+type quoteWriter struct{}
+
+func (qw *quoteWriter) writeResult(w *bufio.Writer, rs *resultSet, s *outputSettings) {
+	write := func(row []interface{}) {
+		writeLiterals(w, row)
+		w.WriteString("\n")
+	}
+	writeHeader(rs, s, write)
+	for _, row := range rs.rows {
+		write(row)
+	}
+}
+
+// Writes a row as SQL literals, as .dump and the insert and quote modes
+// do: like quote(), except that blobs are in lowercase hex
+func writeLiterals(w *bufio.Writer, row []interface{}) {
+	for i, v := range row {
+		if i > 0 {
+			w.WriteString(",")
+		}
+		if b, ok := normalizeValue(v).([]byte); ok {
+			w.WriteString("X'" + hex.EncodeToString(b) + "'")
+			continue
+		}
+		w.WriteString(sqlLiteral(v))
+	}
+}
+
+// Reports whether a name can be written without quotes: letters, digits
+// and underscores, not starting with a digit, and not a keyword
+func isPlainIdentifier(name string) bool {
+	if name == "" || name[0] >= '0' && name[0] <= '9' || sqlReservedWords[strings.ToUpper(name)] {
+		return false
+	}
+	for _, c := range name {
+		if !(c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// The cells of a result laid out for the aligned modes: the text of each
+// value split into lines, and the width of each column
+type resultGrid struct {
+	header    [][]string
+	rows      [][][]string
+	widths    []int
+	multiLine bool // some row takes more than one line
+}
+
+func newResultGrid(rs *resultSet, s *outputSettings) *resultGrid {
+	g := &resultGrid{widths: make([]int, len(rs.columns))}
+	split := func(values []string) [][]string {
+		cells := make([][]string, len(values))
+		for i, s := range values {
+			cells[i] = strings.Split(s, "\n")
+			if len(cells[i]) > 1 {
+				g.multiLine = true
+			}
+			for _, line := range cells[i] {
+				g.widths[i] = max(g.widths[i], utf8.RuneCountInString(line))
+			}
+		}
+		return cells
+	}
+	g.header = split(rs.columns)
+	g.multiLine = false
+	for _, row := range rs.rows {
+		values := make([]string, len(row))
+		for i, v := range row {
+			values[i] = s.text(v)
+		}
+		g.rows = append(g.rows, split(values))
+	}
+	return g
+}
+
+// Calls line with the text of each line a row of cells takes, padded to
+// the column widths
+func (g *resultGrid) eachLine(cells [][]string, centered bool, line func(texts []string)) {
+	height := 1
+	for _, cell := range cells {
+		height = max(height, len(cell))
+	}
+	for l := 0; l < height; l++ {
+		texts := make([]string, len(cells))
+		for i, cell := range cells {
+			text := ""
+			if l < len(cell) {
+				text = cell[l]
+			}
+			if centered {
+				texts[i] = padCenter(text, g.widths[i])
+			} else {
+				texts[i] = padRight(text, g.widths[i])
+			}
+		}
+		line(texts)
+	}
+}
+
+// The characters that draw a table, box or markdown grid
+type gridStyle struct {
+	horizontal, vertical string
+	top, middle, bottom  [3]string // left, junction and right of each rule
+	hasTop, hasBottom    bool
+}
+
+var (
+	tableStyle = gridStyle{
+		horizontal: "-", vertical: "|",
+		top: [3]string{"+", "+", "+"}, middle: [3]string{"+", "+", "+"}, bottom: [3]string{"+", "+", "+"},
+		hasTop: true, hasBottom: true,
+	}
+	boxStyle = gridStyle{
+		horizontal: "─", vertical: "│",
+		top: [3]string{"┌", "┬", "┐"}, middle: [3]string{"├", "┼", "┤"}, bottom: [3]string{"└", "┴", "┘"},
+		hasTop: true, hasBottom: true,
+	}
+	markdownStyle = gridStyle{
+		horizontal: "-", vertical: "|",
+		middle: [3]string{"|", "|", "|"},
+	}
+)
+
+// gridWriter prints the table, box and markdown modes: the rows in a grid
+// under centered column names, shown whatever .headers says
+type gridWriter struct {
+	style gridStyle
+}
+
+func (gw *gridWriter) writeResult(w *bufio.Writer, rs *resultSet, settings *outputSettings) {
+	if len(rs.rows) == 0 {
+		return
+	}
+	g := newResultGrid(rs, settings)
+	s := gw.style
+	rule := func(ends [3]string) {
+		w.WriteString(ends[0])
+		for i, width := range g.widths {
+			if i > 0 {
+				w.WriteString(ends[1])
+			}
+			w.WriteString(strings.Repeat(s.horizontal, width+2))
+		}
+		w.WriteString(ends[2] + "\n")
+	}
+	line := func(texts []string) {
+		w.WriteString(s.vertical + " " + strings.Join(texts, " "+s.vertical+" ") + " " + s.vertical + "\n")
+	}
+
+	if s.hasTop {
+		rule(s.top)
+	}
+	g.eachLine(g.header, true, line)
+	rule(s.middle)
+	for r, row := range g.rows {
+		// Like sqlite3, rows taking several lines get rules between them
+		if r > 0 && g.multiLine && s.hasTop {
+			rule(s.middle)
+		}
+		g.eachLine(row, false, line)
+	}
+	if s.hasBottom {
+		rule(s.bottom)
+	}
+}
+
+// columnWriter prints the rows in aligned columns, with the column names
+// underlined with dashes above them when .headers is on
+type columnWriter struct{}
+
+func (cw *columnWriter) writeResult(w *bufio.Writer, rs *resultSet, s *outputSettings) {
+	if len(rs.rows) == 0 {
+		return
+	}
+	g := newResultGrid(rs, s)
+	line := func(texts []string) {
+		w.WriteString(strings.Join(texts, "  ") + "\n")
+	}
+	if s.headers {
+		g.eachLine(g.header, false, line)
+		dashes := make([]string, len(g.widths))
+		for i, width := range g.widths {
+			dashes[i] = strings.Repeat("-", width)
+		}
+		line(dashes)
+	}
+	for r, row := range g.rows {
+		if r > 0 && g.multiLine {
+			w.WriteString("\n")
+		}
+		g.eachLine(row, false, line)
+	}
+}
+
+func padRight(s string, width int) string {
+	return s + strings.Repeat(" ", max(0, width-utf8.RuneCountInString(s)))
+}
+
+func padLeft(s string, width int) string {
+	return strings.Repeat(" ", max(0, width-utf8.RuneCountInString(s))) + s
+}
+
+func padCenter(s string, width int) string {
+	space := max(0, width-utf8.RuneCountInString(s))
+	return strings.Repeat(" ", space/2) + s + strings.Repeat(" ", space-space/2)
+}
@@ -0,0 +1,605 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+const defaultPageSize = 4096
+
+// pager reads database pages and buffers modified pages in memory until
+// commit. It implements io.ReaderAt, so the b-tree readers see pending
+// changes of the current transaction.
+type pager struct {
+	file          *os.File
+	path          string
+	readOnly      bool
+	pageSize      int
+	pageCount     int
+	filePageCount int            // page count of the committed database
+	pages         map[int][]byte // pages modified in the current transaction
+	journalMode   string
+	wal           *walLog // the write-ahead log, in WAL mode
+	lockLevel     int     // lock held on the file, lockNone to lockExclusive
+	changeCounter uint32  // file change counter when the header was last read
+
+	// An explicit transaction started with BEGIN spans statements; without
+	// one each statement commits on its own
+	inTransaction bool
+
+	// Content of pages as they were before the current statement, nil for
+	// pages it first modified, so a failing statement can be undone alone
+	statementPages     map[int][]byte
+	statementPageCount int
+}
+
+func openPager(path string) (*pager, error) {
+	readOnly := false
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		if file, err = os.Open(path); err != nil {
+			return nil, err
+		}
+		readOnly = true
+	}
+	if info, err := file.Stat(); err == nil && info.Size() == 0 {
+		p := &pager{file: file, path: path, readOnly: readOnly, pageSize: defaultPageSize, journalMode: "delete"}
+		p.startEmpty()
+		return p, nil
+	}
+
+	header := make([]byte, 100)
+	if _, err := file.ReadAt(header, 0); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("file is not a database")
+	}
+	if string(header[:16]) != "SQLite format 3\x00" {
+		file.Close()
+		return nil, fmt.Errorf("file is not a database")
+	}
+	pageSize := int(binary.BigEndian.Uint16(header[16:18]))
+	if pageSize == 1 {
+		pageSize = 65536 // stored as 1 since it does not fit in two bytes
+	}
+
+	p := &pager{
+		file:        file,
+		path:        path,
+		readOnly:    readOnly,
+		pageSize:    pageSize,
+		pages:       make(map[int][]byte),
+		journalMode: "delete",
+	}
+	if err := p.lock(lockShared); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if err := p.recoverJournal(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if _, err := p.readHeader(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if _, err := file.ReadAt(header, 0); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	// File format versions of 2 mark a database in WAL mode, whose latest
+	// pages may be in the log rather than the file
+	if header[18] == 2 && header[19] == 2 {
+		if p.wal, err = openWAL(path, pageSize, readOnly); err != nil {
+			file.Close()
+			return nil, err
+		}
+		p.journalMode = "wal"
+		if len(p.wal.frames) > 0 {
+			p.pageCount = p.wal.dbSize
+		}
+		p.filePageCount = p.pageCount
+		return p, nil
+	}
+	// Each statement takes the shared lock again for its reads
+	if err := p.unlock(lockNone); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+// Reads the database size and change counter from the file header, and
+// reports whether another connection committed since they were last read
+func (p *pager) readHeader() (bool, error) {
+	info, err := p.file.Stat()
+	if err != nil || info.Size() == 0 {
+		return false, err
+	}
+	header := make([]byte, 100)
+	if _, err := p.file.ReadAt(header, 0); err != nil {
+		return false, err
+	}
+	counter := binary.BigEndian.Uint32(header[24:28])
+	pageCount := databasePageCount(header, info.Size(), p.pageSize)
+	changed := counter != p.changeCounter || pageCount != p.filePageCount
+	if p.filePageCount == 0 {
+		// The file was empty, so page 1 is the one made up by startEmpty
+		p.pages = make(map[int][]byte)
+	}
+	p.changeCounter = counter
+	p.pageCount = pageCount
+	p.filePageCount = pageCount
+	return changed, nil
+}
+
+// Takes the shared lock a statement reads under, first playing back any
+// journal left by a writer that crashed, or in WAL mode a read mark on the
+// log. Reports whether the database changed since this connection last
+// read it.
+func (p *pager) beginRead() (bool, error) {
+	if p.wal != nil {
+		changed, err := p.wal.beginRead()
+		if err != nil || !changed {
+			return false, err
+		}
+		if len(p.wal.frames) == 0 {
+			_, err = p.readHeader()
+			return true, err
+		}
+		p.pageCount = p.wal.dbSize
+		p.filePageCount = p.pageCount
+		return true, nil
+	}
+	if p.file == nil || p.lockLevel > lockNone {
+		return false, nil
+	}
+	if err := p.lock(lockShared); err != nil {
+		return false, err
+	}
+	if err := p.recoverJournal(); err != nil {
+		p.unlock(lockNone)
+		return false, err
+	}
+	changed, err := p.readHeader()
+	if err != nil {
+		p.unlock(lockNone)
+	}
+	return changed, err
+}
+
+// Lets go of the lock between statements when no transaction needs it. In
+// WAL mode the shared lock is held for as long as the database is open,
+// and the read mark and write lock on the log are let go instead.
+func (p *pager) endRead() {
+	if p.inTransaction || len(p.pages) > 0 {
+		return
+	}
+	if p.wal != nil {
+		p.wal.endWrite()
+		p.wal.endRead()
+		return
+	}
+	p.unlock(lockNone)
+}
+
+// Sets up a new database in an empty file. Its first page, holding the
+// header and an empty schema table, exists only in memory until the first
+// commit writes it.
+func (p *pager) startEmpty() {
+	page := make([]byte, p.pageSize)
+	copy(page, "SQLite format 3\x00")
+	binary.BigEndian.PutUint16(page[16:18], uint16(p.pageSize))
+	page[18], page[19] = 1, 1 // rollback journal file format
+	page[21], page[22], page[23] = 64, 32, 32
+	binary.BigEndian.PutUint32(page[44:48], 4) // schema format
+	binary.BigEndian.PutUint32(page[56:60], 1) // UTF-8
+	page[100] = 0x0D
+	binary.BigEndian.PutUint16(page[105:107], uint16(p.pageSize))
+	p.pages = map[int][]byte{1: page}
+	p.pageCount = 1
+	p.filePageCount = 0
+}
+
+// The in-header database size is only trusted when written by a version
+// that maintains it, which it marks by matching the change counter
+func databasePageCount(header []byte, fileSize int64, pageSize int) int {
+	if headerCount := int(binary.BigEndian.Uint32(header[28:32])); headerCount > 0 &&
+		binary.BigEndian.Uint32(header[24:28]) == binary.BigEndian.Uint32(header[92:96]) {
+		return headerCount
+	}
+	return int(fileSize / int64(pageSize))
+}
+
+// Reads through the buffered pages, falling back to the file
+func (p *pager) ReadAt(b []byte, off int64) (int, error) {
+	n := 0
+	for n < len(b) {
+		pos := off + int64(n)
+		pageNum := int(pos/int64(p.pageSize)) + 1
+		inPage := int(pos % int64(p.pageSize))
+		chunk := b[n:]
+		if len(chunk) > p.pageSize-inPage {
+			chunk = chunk[:p.pageSize-inPage]
+		}
+		if page, ok := p.pages[pageNum]; ok {
+			copy(chunk, page[inPage:])
+		} else if found, err := p.wal.readPage(pageNum, chunk, inPage); found {
+			if err != nil {
+				return n, err
+			}
+		} else {
+			if pageNum > p.pageCount {
+				return n, io.EOF
+			}
+			read, err := p.file.ReadAt(chunk, pos)
+			if err != nil && !(err == io.EOF && read == len(chunk)) {
+				return n + read, err
+			}
+		}
+		n += len(chunk)
+	}
+	return n, nil
+}
+
+// Returns a copy of a page's current contents
+func (p *pager) page(pageNum int) ([]byte, error) {
+	if pageNum < 1 || pageNum > p.pageCount {
+		return nil, fmt.Errorf("database disk image is malformed: page %d out of range", pageNum)
+	}
+	data := make([]byte, p.pageSize)
+	if _, err := p.ReadAt(data, int64(pageNum-1)*int64(p.pageSize)); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Returns the buffer for a page that is about to be modified
+func (p *pager) writablePage(pageNum int) ([]byte, error) {
+	if p.readOnly {
+		return nil, fmt.Errorf("attempt to write a readonly database")
+	}
+	// Only one connection at a time may have changes pending
+	if p.wal == nil {
+		if err := p.lock(lockReserved); err != nil {
+			return nil, err
+		}
+	} else if err := p.wal.beginWrite(); err != nil {
+		return nil, err
+	}
+	p.saveForStatement(pageNum)
+	if page, ok := p.pages[pageNum]; ok {
+		return page, nil
+	}
+	page, err := p.page(pageNum)
+	if err != nil {
+		return nil, err
+	}
+	p.pages[pageNum] = page
+	return page, nil
+}
+
+// Remembers a page's content before the current statement first changes it
+func (p *pager) saveForStatement(pageNum int) {
+	if p.statementPages == nil {
+		return
+	}
+	if _, saved := p.statementPages[pageNum]; saved {
+		return
+	}
+	var original []byte
+	if page, ok := p.pages[pageNum]; ok {
+		original = append([]byte(nil), page...)
+	}
+	p.statementPages[pageNum] = original
+}
+
+// The page holding the 512 bytes at offset 2^30, which SQLite leaves unused
+// for file locking on some platforms
+func (p *pager) pendingBytePage() int {
+	return 1<<30/p.pageSize + 1
+}
+
+// Returns a zeroed page for new content, reusing a page from the freelist
+// when there is one and otherwise growing the file
+func (p *pager) allocatePage() (int, error) {
+	if p.readOnly {
+		return 0, fmt.Errorf("attempt to write a readonly database")
+	}
+	pageNum, err := p.takeFreePage()
+	if err != nil || pageNum != 0 {
+		return pageNum, err
+	}
+	p.pageCount++
+	if p.pageCount == p.pendingBytePage() {
+		p.pageCount++
+	}
+	p.saveForStatement(p.pageCount)
+	p.pages[p.pageCount] = make([]byte, p.pageSize)
+	return p.pageCount, nil
+}
+
+// Number of leaf page numbers a freelist trunk page holds. SQLite reads
+// up to usable/4-2 but writes at most usable/4-8 for older readers.
+func (p *pager) trunkCapacity() int {
+	return p.pageSize/4 - 8
+}
+
+// Takes a page off the freelist, or returns 0 when it is empty. The last
+// leaf of the first trunk is used, or the trunk itself once it is empty.
+func (p *pager) takeFreePage() (int, error) {
+	header, err := p.writablePage(1)
+	if err != nil {
+		return 0, err
+	}
+	trunkNum := int(binary.BigEndian.Uint32(header[32:36]))
+	if trunkNum == 0 {
+		return 0, nil
+	}
+	if trunkNum > p.pageCount {
+		return 0, fmt.Errorf("database disk image is malformed: freelist trunk %d out of range", trunkNum)
+	}
+	trunk, err := p.writablePage(trunkNum)
+	if err != nil {
+		return 0, err
+	}
+	pageNum := trunkNum
+	if leaves := int(binary.BigEndian.Uint32(trunk[4:8])); leaves > 0 {
+		if leaves > p.pageSize/4-2 {
+			return 0, fmt.Errorf("database disk image is malformed: freelist trunk %d has %d leaves", trunkNum, leaves)
+		}
+		pageNum = int(binary.BigEndian.Uint32(trunk[4+4*leaves:]))
+		binary.BigEndian.PutUint32(trunk[4:8], uint32(leaves-1))
+		if pageNum < 2 || pageNum > p.pageCount {
+			return 0, fmt.Errorf("database disk image is malformed: free page %d out of range", pageNum)
+		}
+	} else {
+		copy(header[32:36], trunk[0:4])
+	}
+	binary.BigEndian.PutUint32(header[36:40], binary.BigEndian.Uint32(header[36:40])-1)
+
+	data, err := p.writablePage(pageNum)
+	if err != nil {
+		return 0, err
+	}
+	for i := range data {
+		data[i] = 0
+	}
+	return pageNum, nil
+}
+
+// Puts a page that is no longer used on the freelist: as a leaf of the
+// first trunk if it has room, otherwise as a new first trunk
+func (p *pager) freePage(pageNum int) error {
+	header, err := p.writablePage(1)
+	if err != nil {
+		return err
+	}
+	trunkNum := int(binary.BigEndian.Uint32(header[32:36]))
+	binary.BigEndian.PutUint32(header[36:40], binary.BigEndian.Uint32(header[36:40])+1)
+	if trunkNum != 0 {
+		trunk, err := p.writablePage(trunkNum)
+		if err != nil {
+			return err
+		}
+		if leaves := int(binary.BigEndian.Uint32(trunk[4:8])); leaves < p.trunkCapacity() {
+			binary.BigEndian.PutUint32(trunk[8+4*leaves:], uint32(pageNum))
+			binary.BigEndian.PutUint32(trunk[4:8], uint32(leaves+1))
+			return nil
+		}
+	}
+	data, err := p.writablePage(pageNum)
+	if err != nil {
+		return err
+	}
+	for i := range data {
+		data[i] = 0
+	}
+	binary.BigEndian.PutUint32(data[0:4], uint32(trunkNum))
+	binary.BigEndian.PutUint32(header[32:36], uint32(pageNum))
+	return nil
+}
+
+// Starts a statement. Without an explicit transaction it is also the
+// start of an implicit one.
+func (p *pager) beginStatement() {
+	p.statementPages = make(map[int][]byte)
+	p.statementPageCount = p.pageCount
+}
+
+// Ends a statement: a failed one is undone, and a successful one commits
+// unless an explicit transaction is open. Returns the statement's error,
+// or the commit's.
+func (p *pager) endStatement(err error) error {
+	if err != nil {
+		for pageNum, original := range p.statementPages {
+			if original == nil {
+				delete(p.pages, pageNum)
+			} else {
+				p.pages[pageNum] = original
+			}
+		}
+		p.pageCount = p.statementPageCount
+	}
+	p.statementPages = nil
+	if err == nil && !p.inTransaction {
+		err = p.commit()
+	}
+	return err
+}
+
+// Drops all changes made since the last commit
+func (p *pager) rollback() {
+	p.pages = make(map[int][]byte)
+	p.pageCount = p.filePageCount
+	p.statementPages = nil
+	p.inTransaction = false
+	if p.filePageCount == 0 {
+		p.startEmpty()
+	}
+	p.unlock(lockShared)
+}
+
+// Makes the transaction's changes durable. The original content of the
+// changed pages goes to the journal first, so a crash while the database
+// is written can be undone; the header's change counter and page count
+// are updated along the way.
+func (p *pager) commit() error {
+	explicit := p.inTransaction
+	p.inTransaction = false
+	if len(p.pages) == 0 {
+		return nil
+	}
+	// In WAL mode page 1 is only rewritten when it changed anyway or the
+	// database size in its header is out of date
+	_, headerChanged := p.pages[1]
+	if p.wal != nil && !headerChanged && p.pageCount == p.filePageCount {
+		return p.commitWAL(explicit)
+	}
+	// A commit that has to wait for another connection leaves page 1 as
+	// it was, for the next attempt to update the header again
+	var savedHeader []byte
+	if headerChanged {
+		savedHeader = append([]byte(nil), p.pages[1][:100]...)
+	}
+	restoreHeader := func() {
+		if savedHeader == nil {
+			delete(p.pages, 1)
+		} else {
+			copy(p.pages[1], savedHeader)
+		}
+	}
+	header, err := p.writablePage(1)
+	if err != nil {
+		return p.abortCommit(explicit, err)
+	}
+	counter := binary.BigEndian.Uint32(header[24:28]) + 1
+	binary.BigEndian.PutUint32(header[24:28], counter)
+	binary.BigEndian.PutUint32(header[28:32], uint32(p.pageCount))
+	binary.BigEndian.PutUint32(header[92:96], counter)
+	binary.BigEndian.PutUint32(header[96:100], sqliteVersionNumber)
+
+	pageNums := make([]int, 0, len(p.pages))
+	for pageNum := range p.pages {
+		pageNums = append(pageNums, pageNum)
+	}
+	sort.Ints(pageNums)
+
+	if p.wal != nil {
+		err := p.commitWAL(explicit)
+		if err == errLocked && explicit {
+			restoreHeader()
+		}
+		return err
+	}
+
+	// The reserved lock keeps other writers out while the journal is
+	// written, the exclusive one keeps readers out of the file
+	if err := p.lock(lockReserved); err != nil {
+		restoreHeader()
+		return p.abortCommit(explicit, err)
+	}
+	journaled := p.journalMode != "off" && p.journalMode != "memory"
+	if journaled {
+		if err := p.writeJournal(pageNums); err != nil {
+			os.Remove(journalPath(p.path))
+			return p.abortCommit(explicit, err)
+		}
+	}
+	if err := p.lock(lockExclusive); err != nil {
+		if journaled {
+			os.Remove(journalPath(p.path))
+		}
+		restoreHeader()
+		return p.abortCommit(explicit, err)
+	}
+	if err := p.writePages(pageNums, journaled); err != nil {
+		// The journal puts back whatever part of the transaction reached
+		// the file; if it cannot, it is left for the next reader to
+		if journaled {
+			p.recoverJournal()
+		}
+		p.rollback()
+		p.unlock(lockNone)
+		return err
+	}
+	p.pages = make(map[int][]byte)
+	p.filePageCount = p.pageCount
+	p.changeCounter = counter
+	return p.unlock(lockShared)
+}
+
+// Writes the transaction's pages into the database file, syncs it and
+// ends the journal
+func (p *pager) writePages(pageNums []int, journaled bool) error {
+	for _, pageNum := range pageNums {
+		if _, err := p.file.WriteAt(p.pages[pageNum], int64(pageNum-1)*int64(p.pageSize)); err != nil {
+			return err
+		}
+	}
+	if p.pageCount < p.filePageCount {
+		if err := p.file.Truncate(int64(p.pageCount) * int64(p.pageSize)); err != nil {
+			return err
+		}
+	}
+	if err := p.file.Sync(); err != nil {
+		return err
+	}
+	if journaled {
+		return p.finishJournal()
+	}
+	return nil
+}
+
+// Ends a commit that could not be made. One kept out by another
+// connection's lock leaves an explicit transaction open, so that COMMIT
+// can be tried again as in SQLite; otherwise the changes are dropped.
+func (p *pager) abortCommit(explicit bool, err error) error {
+	if explicit && err == errLocked {
+		p.inTransaction = true
+		p.unlock(lockReserved)
+		return err
+	}
+	p.rollback()
+	return err
+}
+
+// Commits by appending the changed pages to the log, checkpointing once
+// it grows long. The read mark goes with the write lock: what is left of
+// the statement reads what it just committed.
+func (p *pager) commitWAL(explicit bool) error {
+	if err := p.wal.beginWrite(); err != nil {
+		return p.abortCommit(explicit, err)
+	}
+	if err := p.wal.appendCommit(p.pages, p.pageCount); err != nil {
+		p.rollback()
+		return err
+	}
+	p.wal.endWrite()
+	p.wal.endRead()
+	p.pages = make(map[int][]byte)
+	p.filePageCount = p.pageCount
+	if len(p.wal.frames) >= walAutoCheckpoint {
+		// Readers still using the log may keep it from being copied in full
+		if err := p.wal.checkpoint(p.file, false); err != errLocked {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *pager) close() error {
+	if p.wal != nil {
+		// The last connection, which alone can lock the database
+		// exclusively, removes the log
+		last := !p.readOnly && p.lock(lockExclusive) == nil
+		if err := p.wal.close(p.file, last); err != nil {
+			p.file.Close()
+			return err
+		}
+	}
+	return p.file.Close()
+}
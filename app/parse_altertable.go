@@ -0,0 +1,379 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// sqlEdit replaces the source text between two byte offsets
+type sqlEdit struct {
+	start, end int
+	text       string
+}
+
+// Applies non-overlapping edits to sql
+func applySQLEdits(sql string, edits []sqlEdit) string {
+	sort.Slice(edits, func(i, j int) bool { return edits[i].start < edits[j].start })
+	var sb strings.Builder
+	last := 0
+	for _, e := range edits {
+		sb.WriteString(sql[last:e.start])
+		sb.WriteString(e.text)
+		last = e.end
+	}
+	sb.WriteString(sql[last:])
+	return sb.String()
+}
+
+func quoteIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// sqlReferences locates the names of tables and columns in a stored
+// statement, for ALTER TABLE to rewrite. It works on tokens rather than a
+// full parse: a column belongs to the table its qualifier names, and an
+// unqualified one to any table the statement reads.
+type sqlReferences struct {
+	tokens     []sqlToken
+	kind       string            // TABLE, INDEX, VIEW or TRIGGER
+	tables     map[int]bool      // tokens naming a table
+	target     int               // token naming the table a CREATE TABLE, INDEX or TRIGGER is about, -1 if none
+	aliases    map[string]string // lower-cased alias to lower-cased table name
+	columns    []int             // tokens naming a column
+	qualifiers map[int]int       // column token to the token qualifying it
+	parents    map[int]int       // column token in REFERENCES t(...) to the token naming t
+}
+
+// Words that cannot be identifiers unless quoted, along with the other
+// keywords that can appear where a column name might
+var sqlReservedWords = map[string]bool{
+	"ABORT": true, "ACTION": true, "AFTER": true, "ALL": true, "ALWAYS": true, "AND": true, "AS": true,
+	"ASC": true, "AUTOINCREMENT": true, "BEFORE": true, "BEGIN": true, "BETWEEN": true, "BY": true,
+	"CASCADE": true, "CASE": true, "CAST": true, "CHECK": true, "COLLATE": true, "CONFLICT": true,
+	"CONSTRAINT": true, "CREATE": true, "CROSS": true, "CURRENT_DATE": true, "CURRENT_TIME": true,
+	"CURRENT_TIMESTAMP": true, "DEFAULT": true, "DEFERRABLE": true, "DEFERRED": true, "DELETE": true,
+	"DESC": true, "DISTINCT": true, "EACH": true, "ELSE": true, "END": true, "ESCAPE": true,
+	"EXCEPT": true, "EXISTS": true, "FAIL": true, "FILTER": true, "FOR": true, "FOREIGN": true,
+	"FROM": true, "GENERATED": true, "GLOB": true, "GROUP": true, "HAVING": true, "IGNORE": true,
+	"IMMEDIATE": true, "IN": true, "INDEX": true, "INITIALLY": true, "INNER": true, "INSERT": true,
+	"INSTEAD": true, "INTERSECT": true, "INTO": true, "IS": true, "ISNULL": true, "JOIN": true,
+	"LEFT": true, "LIKE": true, "LIMIT": true, "MATCH": true, "NATURAL": true, "NO": true,
+	"NOT": true, "NOTNULL": true, "NULL": true, "OF": true, "OFFSET": true, "ON": true, "OR": true,
+	"ORDER": true, "OUTER": true, "OVER": true, "PRIMARY": true, "RAISE": true, "REFERENCES": true,
+	"REGEXP": true, "REPLACE": true, "RESTRICT": true, "RETURNING": true, "RIGHT": true,
+	"ROLLBACK": true, "ROW": true, "SELECT": true, "SET": true, "STORED": true, "TABLE": true,
+	"THEN": true, "TRIGGER": true, "UNION": true, "UNIQUE": true, "UPDATE": true, "USING": true,
+	"VALUES": true, "VIEW": true, "VIRTUAL": true, "WHEN": true, "WHERE": true, "WINDOW": true,
+	"WITH": true, "WITHOUT": true,
+}
+
+// Keywords that end the table list of a FROM clause
+var fromClauseEnd = map[string]bool{
+	"WHERE": true, "GROUP": true, "ORDER": true, "HAVING": true, "LIMIT": true, "WINDOW": true,
+	"UNION": true, "EXCEPT": true, "INTERSECT": true, "SELECT": true, "VALUES": true, "SET": true,
+	"RETURNING": true, "END": true,
+}
+
+func (t sqlToken) isReserved() bool {
+	return t.kind == tokIdent && !t.quoted && sqlReservedWords[strings.ToUpper(t.text)]
+}
+
+// Reports whether a token ends an operand, so that a name right after it
+// is an alias or type name rather than a column
+func (t sqlToken) endsOperand() bool {
+	switch t.kind {
+	case tokString, tokNumber, tokBlob, tokVariable:
+		return true
+	case tokIdent:
+		return !t.isReserved()
+	}
+	return t.text == ")"
+}
+
+func scanReferences(sql string) (*sqlReferences, error) {
+	tokens, err := tokenizeSQL(sql)
+	if err != nil {
+		return nil, err
+	}
+	r := &sqlReferences{
+		tokens:     tokens,
+		tables:     make(map[int]bool),
+		target:     -1,
+		aliases:    make(map[string]string),
+		qualifiers: make(map[int]int),
+		parents:    make(map[int]int),
+	}
+	at := func(i int, keyword string) bool {
+		return i < len(tokens) && tokens[i].isKeyword(keyword)
+	}
+	atPunct := func(i int, p string) bool {
+		return i < len(tokens) && tokens[i].kind == tokPunct && tokens[i].text == p
+	}
+	// Marks the table name at token i, skipping a schema qualifier, and
+	// returns the position of the name
+	markTable := func(i int) int {
+		if i >= len(tokens) || tokens[i].kind != tokIdent || tokens[i].isReserved() {
+			return i - 1
+		}
+		if atPunct(i+1, ".") && i+2 < len(tokens) && tokens[i+2].kind == tokIdent {
+			i += 2
+		}
+		r.tables[i] = true
+		return i
+	}
+	aliasTokens := make(map[int]bool)
+	// Records the alias after the table name at token i and returns the
+	// position of the last token used
+	markAlias := func(i int) int {
+		j := i + 1
+		if at(j, "AS") {
+			j++
+		}
+		if j < len(tokens) && tokens[j].kind == tokIdent && !tokens[j].isReserved() && !atPunct(j+1, "(") {
+			aliasTokens[j] = true
+			r.aliases[strings.ToLower(tokens[j].value)] = strings.ToLower(tokens[i].value)
+			return j
+		}
+		return i
+	}
+
+	for i := 0; i < len(tokens) && i < 4; i++ {
+		if tokens[i].isKeyword("TABLE") || tokens[i].isKeyword("INDEX") || tokens[i].isKeyword("VIEW") || tokens[i].isKeyword("TRIGGER") {
+			r.kind = strings.ToUpper(tokens[i].text)
+			break
+		}
+	}
+	onTarget := r.kind == "INDEX" || r.kind == "TRIGGER"
+
+	depth := 0
+	fromDepth := -1 // depth of the FROM clause being read, -1 outside one
+	expectTable := false
+	for i := 0; i < len(tokens); i++ {
+		t := tokens[i]
+		if t.kind == tokPunct {
+			switch t.text {
+			case "(":
+				depth++
+			case ")":
+				depth--
+				if fromDepth > depth {
+					fromDepth = -1
+				}
+			case ",":
+				if depth == fromDepth {
+					expectTable = true
+					continue
+				}
+			case ";":
+				fromDepth = -1
+			}
+			expectTable = false
+			continue
+		}
+		if t.kind != tokIdent {
+			expectTable = false
+			continue
+		}
+		if expectTable {
+			expectTable = false
+			if !t.isReserved() && !atPunct(i+1, "(") {
+				i = markAlias(markTable(i))
+				continue
+			}
+		}
+		if t.quoted {
+			continue
+		}
+		switch word := strings.ToUpper(t.text); {
+		case word == "FROM":
+			fromDepth = depth
+			expectTable = true
+		case word == "JOIN":
+			expectTable = true
+		case word == "TABLE" || word == "INTO":
+			i = markTable(i + 1)
+			if word == "TABLE" && r.kind == "TABLE" && r.target < 0 {
+				r.target = i
+			}
+		case word == "REFERENCES":
+			parent := markTable(i + 1)
+			i = parent
+			if atPunct(parent+1, "(") {
+				for i = parent + 2; i < len(tokens) && !atPunct(i, ")"); i++ {
+					if tokens[i].kind == tokIdent {
+						r.parents[i] = parent
+						r.columns = append(r.columns, i)
+					}
+				}
+			}
+		case word == "UPDATE":
+			j := i + 1
+			if at(j, "OR") {
+				j += 2
+			}
+			if !at(j, "OF") && !at(j, "ON") {
+				i = markAlias(markTable(j))
+			}
+		case word == "ON" && onTarget && depth == 0:
+			onTarget = false
+			i = markTable(i + 1)
+			r.target = i
+		case fromClauseEnd[word] && depth == fromDepth:
+			fromDepth = -1
+		}
+	}
+
+	for i, t := range tokens {
+		if t.kind != tokIdent || t.isReserved() || r.tables[i] || aliasTokens[i] {
+			continue
+		}
+		if _, ok := r.parents[i]; ok || atPunct(i+1, "(") || atPunct(i+1, ".") {
+			continue
+		}
+		if i > 0 {
+			prev := tokens[i-1]
+			if prev.kind == tokPunct && prev.text == "." {
+				if i >= 2 && tokens[i-2].kind == tokIdent {
+					r.qualifiers[i] = i - 2
+					r.columns = append(r.columns, i)
+				}
+				continue
+			}
+			if prev.endsOperand() {
+				continue // an alias, or a type name after a column name
+			}
+			switch {
+			case prev.isKeyword("AS"), prev.isKeyword("COLLATE"), prev.isKeyword("CONSTRAINT"),
+				prev.isKeyword("PRIMARY"), prev.isKeyword("FOREIGN"), prev.isKeyword("INDEX"),
+				prev.isKeyword("VIEW"), prev.isKeyword("TRIGGER"):
+				continue
+			}
+		}
+		r.columns = append(r.columns, i)
+	}
+	sort.Ints(r.columns)
+	return r, nil
+}
+
+// Reports whether the statement reads from table. The table a trigger is
+// on does not count: unqualified names in its body belong to the tables
+// its statements use.
+func (r *sqlReferences) mentions(table string) bool {
+	for i := range r.tables {
+		if (r.kind != "TRIGGER" || i != r.target) && strings.EqualFold(r.tokens[i].value, table) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the table a column token belongs to, or false when it is
+// unqualified and could belong to any table the statement reads
+func (r *sqlReferences) columnTable(i int) (string, bool) {
+	if parent, ok := r.parents[i]; ok {
+		return r.tokens[parent].value, true
+	}
+	if q, ok := r.qualifiers[i]; ok {
+		name := strings.ToLower(r.tokens[q].value)
+		if table, ok := r.aliases[name]; ok {
+			return table, true
+		}
+		if r.kind == "TRIGGER" && r.target >= 0 && (name == "new" || name == "old") {
+			return r.tokens[r.target].value, true
+		}
+		return name, true
+	}
+	if r.kind == "TABLE" && r.target >= 0 {
+		return r.tokens[r.target].value, true
+	}
+	return "", false
+}
+
+// Tokens naming a column of table
+func (r *sqlReferences) columnRefs(table, column string) []int {
+	var refs []int
+	for _, i := range r.columns {
+		if !strings.EqualFold(r.tokens[i].value, column) {
+			continue
+		}
+		if owner, ok := r.columnTable(i); ok && strings.EqualFold(owner, table) || !ok && r.mentions(table) {
+			refs = append(refs, i)
+		}
+	}
+	return refs
+}
+
+// Tokens naming table, either where a table is expected or as the
+// qualifier of a column
+func (r *sqlReferences) tableRefs(table string) []int {
+	var refs []int
+	for i := range r.tables {
+		if strings.EqualFold(r.tokens[i].value, table) {
+			refs = append(refs, i)
+		}
+	}
+	for _, q := range r.qualifiers {
+		name := r.tokens[q].value
+		if _, isAlias := r.aliases[strings.ToLower(name)]; !isAlias && strings.EqualFold(name, table) {
+			refs = append(refs, q)
+		}
+	}
+	sort.Ints(refs)
+	return dedupeInts(refs)
+}
+
+// Reports whether token i is in the column list of a FOREIGN KEY clause
+func (r *sqlReferences) inForeignKey(i int) bool {
+	j := i
+	for j > 0 && !(r.tokens[j].kind == tokPunct && r.tokens[j].text == "(") {
+		j--
+	}
+	return j >= 2 && r.tokens[j-1].isKeyword("KEY") && r.tokens[j-2].isKeyword("FOREIGN")
+}
+
+func dedupeInts(values []int) []int {
+	var out []int
+	for i, v := range values {
+		if i == 0 || v != values[i-1] {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// tableBody locates the parts of a CREATE TABLE statement that ADD COLUMN
+// and DROP COLUMN edit
+type tableBody struct {
+	columns [][2]int // byte span of each column definition
+	end     int      // where a new column goes: at the comma before the table constraints, or the closing parenthesis
+}
+
+func scanTableBody(sql string) (*tableBody, error) {
+	s, err := newTokenStream(sql)
+	if err != nil {
+		return nil, err
+	}
+	for !s.atEnd() && !s.atPunct("(") {
+		s.next()
+	}
+	if err := s.expectPunct("("); err != nil {
+		return nil, err
+	}
+	body := &tableBody{}
+	for {
+		if s.atKeyword("CONSTRAINT", "PRIMARY", "UNIQUE", "CHECK", "FOREIGN") {
+			body.end = s.tokens[s.pos-1].pos
+			return body, nil
+		}
+		start := s.peek().pos
+		s.textUntil(func(s *tokenStream) bool { return s.atPunct(",") || s.atPunct(")") })
+		body.columns = append(body.columns, [2]int{start, s.tokens[s.pos-1].end})
+		if s.atPunct(")") {
+			body.end = s.peek().pos
+			return body, nil
+		}
+		if err := s.expectPunct(","); err != nil {
+			return nil, err
+		}
+	}
+}
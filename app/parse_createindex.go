@@ -0,0 +1,49 @@
+package main
+
+type indexDef struct {
+	name    string
+	table   string
+	unique  bool
+	columns []indexedColumn
+	where   string // condition of a partial index
+
+	// ON CONFLICT resolution of the PRIMARY KEY or UNIQUE constraint
+	// behind an automatic index
+	conflict string
+
+	rootPage int // set when loaded from the schema
+}
+
+// Parses CREATE [UNIQUE] INDEX [IF NOT EXISTS] name ON table (columns) [WHERE expr]
+func parseCreateIndex(createSQL string) (*indexDef, error) {
+	s, err := newTokenStream(createSQL)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.expectKeyword("CREATE"); err != nil {
+		return nil, err
+	}
+	def := &indexDef{unique: s.acceptKeyword("UNIQUE")}
+	if err := s.expectKeyword("INDEX"); err != nil {
+		return nil, err
+	}
+	if err := acceptIfNotExists(s); err != nil {
+		return nil, err
+	}
+	if def.name, err = s.expectQualifiedName(); err != nil {
+		return nil, err
+	}
+	if err := s.expectKeyword("ON"); err != nil {
+		return nil, err
+	}
+	if def.table, err = s.expectName(); err != nil {
+		return nil, err
+	}
+	if def.columns, err = parseIndexedColumns(s); err != nil {
+		return nil, err
+	}
+	if s.acceptKeyword("WHERE") {
+		def.where = trimStatement(s.rest())
+	}
+	return def, nil
+}
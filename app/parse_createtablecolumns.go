@@ -1,75 +1,558 @@
 package main
 
 import (
+	"fmt"
 	"strings"
 )
 
 type columnDef struct {
-	name    string
-	isRowid bool
+	name            string
+	declType        string // declared type as written, e.g. "VARCHAR(10)"
+	affinity        string // INTEGER, TEXT, BLOB, REAL or NUMERIC
+	notNull         bool
+	notNullConflict string
+	hasDefault      bool
+	defaultExpr     string // SQL text of the DEFAULT value
+	collation       string
+	primaryKey      bool
+	pkDesc          bool
+	pkConflict      string
+	autoincrement   bool
+	unique          bool
+	uniqueConflict  string
+	checks          []string
+	references      *foreignKeyDef
+	generated       string // SQL text of a GENERATED ALWAYS AS expression
+	generatedStored bool
+	isRowid         bool
 }
 
-func parseCreateTableColumns(createSQL string) []columnDef {
-	//fmt.Printf("Parsing CREATE SQL: %s\n", createSQL)
+// indexedColumn is one entry of a PRIMARY KEY, UNIQUE or CREATE INDEX list
+type indexedColumn struct {
+	name      string // column name, or expression text for expression indexes
+	collation string
+	desc      bool
+}
+
+type foreignKeyDef struct {
+	columns    []string // child columns
+	table      string   // parent table
+	parentCols []string // empty means the parent's primary key
+	onDelete   string   // NO ACTION, RESTRICT, SET NULL, SET DEFAULT or CASCADE
+	onUpdate   string
+	deferred   bool
+}
+
+// checkConstraint is a CHECK expression, named in errors by its
+// CONSTRAINT name when it has one and otherwise by its text
+type checkConstraint struct {
+	name string
+	expr string
+}
+
+type uniqueConstraint struct {
+	columns  []indexedColumn
+	conflict string
+}
+
+type tableDef struct {
+	name         string
+	columns      []columnDef
+	primaryKey   []indexedColumn
+	pkConflict   string
+	pkPosition   int // number of UNIQUE constraints declared before the PRIMARY KEY
+	uniques      []uniqueConstraint
+	checks       []checkConstraint
+	foreignKeys  []foreignKeyDef
+	withoutRowid bool
+	strict       bool
+	asSelect     string // CREATE TABLE ... AS SELECT
+}
 
-	start := strings.Index(createSQL, "(")
-	end := strings.LastIndex(createSQL, ")")
-	if start < 0 || end < 0 || end <= start {
-		return nil
+// Returns the index of the INTEGER PRIMARY KEY column, or -1 if the table
+// stores its rowid separately
+func (t *tableDef) rowidColumn() int {
+	for i, col := range t.columns {
+		if col.isRowid {
+			return i
+		}
 	}
-	inside := createSQL[start+1 : end]
-	parts := strings.Split(inside, ",")
-	var cols []columnDef
+	return -1
+}
 
-	for _, p := range parts {
-		p = strings.TrimSpace(p)
-		if p == "" {
-			continue
+func (t *tableDef) columnIndex(name string) int {
+	for i, col := range t.columns {
+		if strings.EqualFold(col.name, name) {
+			return i
 		}
-		//fmt.Printf("Processing column definition %d: '%s'\n", i, p)
+	}
+	return -1
+}
+
+// Virtual generated columns are computed on read and have no slot in the record
+func (c columnDef) isVirtual() bool {
+	return c.generated != "" && !c.generatedStored
+}
 
-		// First token is the column name (may be quoted)
-		tokens := strings.Fields(p)
-		if len(tokens) == 0 {
-			continue
+// Parses a CREATE TABLE statement following SQLite's grammar
+func parseCreateTable(createSQL string) (*tableDef, error) {
+	s, err := newTokenStream(createSQL)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.expectKeyword("CREATE"); err != nil {
+		return nil, err
+	}
+	if !s.acceptKeyword("TEMP") {
+		s.acceptKeyword("TEMPORARY")
+	}
+	if err := s.expectKeyword("TABLE"); err != nil {
+		return nil, err
+	}
+	if err := acceptIfNotExists(s); err != nil {
+		return nil, err
+	}
+	name, err := s.expectQualifiedName()
+	if err != nil {
+		return nil, err
+	}
+	def := &tableDef{name: name}
+
+	if s.acceptKeyword("AS") {
+		def.asSelect = s.rest()
+		return def, nil
+	}
+	if err := s.expectPunct("("); err != nil {
+		return nil, err
+	}
+	for {
+		if s.atKeyword("CONSTRAINT", "PRIMARY", "UNIQUE", "CHECK", "FOREIGN") {
+			if err := parseTableConstraint(s, def); err != nil {
+				return nil, err
+			}
+		} else {
+			col, err := parseColumnDef(s, def)
+			if err != nil {
+				return nil, err
+			}
+			def.columns = append(def.columns, col)
+		}
+		if s.acceptPunct(")") {
+			break
+		}
+		if err := s.expectPunct(","); err != nil {
+			return nil, err
+		}
+	}
+	for !s.atEnd() && !s.atPunct(";") {
+		switch {
+		case s.acceptKeyword("WITHOUT"):
+			if err := s.expectKeyword("ROWID"); err != nil {
+				return nil, err
+			}
+			def.withoutRowid = true
+		case s.acceptKeyword("STRICT"):
+			def.strict = true
+		case s.acceptPunct(","):
+		default:
+			return nil, s.syntaxError()
 		}
-		rawName := tokens[0]
-		name := strings.Trim(rawName, "`\"[]") // strip common quotes
-		up := strings.ToUpper(p)
+	}
+
+	resolveRowidAlias(def)
+	return def, nil
+}
 
-		// Check if this is an integer primary key column
-		isRowid := false
+func parseColumnDef(s *tokenStream, def *tableDef) (columnDef, error) {
+	name, err := s.expectName()
+	if err != nil {
+		return columnDef{}, err
+	}
+	col := columnDef{name: name}
 
-		// Pattern 1: INTEGER PRIMARY KEY
-		if strings.Contains(up, "INTEGER") && strings.Contains(up, "PRIMARY") && strings.Contains(up, "KEY") {
-			isRowid = true
-			//fmt.Printf("  -> Detected as INTEGER PRIMARY KEY\n")
+	// The type name is every token up to the first constraint keyword
+	typeStart, typeEnd := s.peek().pos, s.peek().pos
+	for !s.atEnd() && !s.atPunct(",") && !s.atPunct(")") && !atColumnConstraint(s) {
+		if s.atPunct("(") {
+			if _, err := s.parenthesized(); err != nil {
+				return columnDef{}, err
+			}
+		} else {
+			s.next()
 		}
+		typeEnd = s.tokens[s.pos-1].end
+	}
+	col.declType = s.src[typeStart:typeEnd]
+	col.affinity = columnAffinity(col.declType)
 
-		// Pattern 2: INT PRIMARY KEY (but not POINT, JOINT, etc.)
-		if !isRowid && strings.Contains(up, "INT") && strings.Contains(up, "PRIMARY") && strings.Contains(up, "KEY") {
-			// Make sure it's "INT" and not part of another word
-			words := strings.Fields(up)
-			for _, word := range words {
-				if word == "INT" {
-					isRowid = true
-					//fmt.Printf("  -> Detected as INT PRIMARY KEY\n")
-					break
+	for atColumnConstraint(s) {
+		constraintName := ""
+		if s.acceptKeyword("CONSTRAINT") {
+			if constraintName, err = s.expectName(); err != nil {
+				return columnDef{}, err
+			}
+		}
+		switch {
+		case s.acceptKeyword("PRIMARY"):
+			if err := s.expectKeyword("KEY"); err != nil {
+				return columnDef{}, err
+			}
+			col.primaryKey = true
+			if s.acceptKeyword("DESC") {
+				col.pkDesc = true
+			} else {
+				s.acceptKeyword("ASC")
+			}
+			if col.pkConflict, err = parseConflictClause(s); err != nil {
+				return columnDef{}, err
+			}
+			if s.acceptKeyword("AUTOINCREMENT") {
+				col.autoincrement = true
+			}
+			if def.primaryKey != nil {
+				return columnDef{}, fmt.Errorf("table \"%s\" has more than one primary key", def.name)
+			}
+			def.primaryKey = []indexedColumn{{name: col.name, collation: col.collation, desc: col.pkDesc}}
+			def.pkPosition = len(def.uniques)
+			def.pkConflict = col.pkConflict
+		case s.acceptKeyword("NOT"):
+			if err := s.expectKeyword("NULL"); err != nil {
+				return columnDef{}, err
+			}
+			col.notNull = true
+			if col.notNullConflict, err = parseConflictClause(s); err != nil {
+				return columnDef{}, err
+			}
+		case s.acceptKeyword("NULL"):
+			if _, err := parseConflictClause(s); err != nil {
+				return columnDef{}, err
+			}
+		case s.acceptKeyword("UNIQUE"):
+			col.unique = true
+			if col.uniqueConflict, err = parseConflictClause(s); err != nil {
+				return columnDef{}, err
+			}
+			def.uniques = append(def.uniques, uniqueConstraint{
+				columns:  []indexedColumn{{name: col.name}},
+				conflict: col.uniqueConflict,
+			})
+		case s.acceptKeyword("CHECK"):
+			text, err := s.parenthesized()
+			if err != nil {
+				return columnDef{}, err
+			}
+			col.checks = append(col.checks, text)
+			def.checks = append(def.checks, checkConstraint{name: constraintName, expr: text})
+		case s.acceptKeyword("DEFAULT"):
+			text, err := parseDefaultValue(s)
+			if err != nil {
+				return columnDef{}, err
+			}
+			col.hasDefault = true
+			col.defaultExpr = text
+		case s.acceptKeyword("COLLATE"):
+			if col.collation, err = s.expectName(); err != nil {
+				return columnDef{}, err
+			}
+		case s.atKeyword("REFERENCES"):
+			fk, err := parseForeignKeyClause(s)
+			if err != nil {
+				return columnDef{}, err
+			}
+			fk.columns = []string{col.name}
+			col.references = fk
+			def.foreignKeys = append(def.foreignKeys, *fk)
+		case s.atKeyword("GENERATED", "AS"):
+			if s.acceptKeyword("GENERATED") {
+				if err := s.expectKeyword("ALWAYS"); err != nil {
+					return columnDef{}, err
 				}
 			}
+			if err := s.expectKeyword("AS"); err != nil {
+				return columnDef{}, err
+			}
+			if col.generated, err = s.parenthesized(); err != nil {
+				return columnDef{}, err
+			}
+			if s.acceptKeyword("STORED") {
+				col.generatedStored = true
+			} else {
+				s.acceptKeyword("VIRTUAL")
+			}
+		default:
+			return columnDef{}, s.syntaxError()
+		}
+	}
+	return col, nil
+}
+
+func atColumnConstraint(s *tokenStream) bool {
+	return s.atKeyword("CONSTRAINT", "PRIMARY", "NOT", "NULL", "UNIQUE", "CHECK",
+		"DEFAULT", "COLLATE", "REFERENCES", "GENERATED", "AS")
+}
+
+func parseTableConstraint(s *tokenStream, def *tableDef) error {
+	constraintName := ""
+	if s.acceptKeyword("CONSTRAINT") {
+		var err error
+		if constraintName, err = s.expectName(); err != nil {
+			return err
+		}
+	}
+	switch {
+	case s.acceptKeyword("PRIMARY"):
+		if err := s.expectKeyword("KEY"); err != nil {
+			return err
+		}
+		cols, err := parseIndexedColumns(s)
+		if err != nil {
+			return err
+		}
+		if def.primaryKey != nil {
+			return fmt.Errorf("table \"%s\" has more than one primary key", def.name)
+		}
+		def.primaryKey = cols
+		def.pkPosition = len(def.uniques)
+		if def.pkConflict, err = parseConflictClause(s); err != nil {
+			return err
+		}
+		s.acceptKeyword("AUTOINCREMENT")
+		for _, pk := range cols {
+			if i := def.columnIndex(pk.name); i >= 0 {
+				def.columns[i].primaryKey = true
+			}
+		}
+	case s.acceptKeyword("UNIQUE"):
+		cols, err := parseIndexedColumns(s)
+		if err != nil {
+			return err
 		}
+		conflict, err := parseConflictClause(s)
+		if err != nil {
+			return err
+		}
+		def.uniques = append(def.uniques, uniqueConstraint{columns: cols, conflict: conflict})
+	case s.acceptKeyword("CHECK"):
+		text, err := s.parenthesized()
+		if err != nil {
+			return err
+		}
+		def.checks = append(def.checks, checkConstraint{name: constraintName, expr: text})
+	case s.acceptKeyword("FOREIGN"):
+		if err := s.expectKeyword("KEY"); err != nil {
+			return err
+		}
+		cols, err := parseNameList(s)
+		if err != nil {
+			return err
+		}
+		fk, err := parseForeignKeyClause(s)
+		if err != nil {
+			return err
+		}
+		fk.columns = cols
+		def.foreignKeys = append(def.foreignKeys, *fk)
+	default:
+		return s.syntaxError()
+	}
+	return nil
+}
 
-		// Pattern 3: Just PRIMARY KEY on what looks like an ID column
-		if !isRowid && strings.Contains(up, "PRIMARY") && strings.Contains(up, "KEY") {
-			lowerName := strings.ToLower(name)
-			if lowerName == "id" || lowerName == "rowid" || strings.HasSuffix(lowerName, "_id") {
-				isRowid = true
-				//fmt.Printf("  -> Detected as PRIMARY KEY on ID-like column\n")
+// Parses "( column [COLLATE name] [ASC|DESC], ... )"
+func parseIndexedColumns(s *tokenStream) ([]indexedColumn, error) {
+	if err := s.expectPunct("("); err != nil {
+		return nil, err
+	}
+	var cols []indexedColumn
+	for {
+		var col indexedColumn
+		text := s.textUntil(func(s *tokenStream) bool {
+			return s.atPunct(",") || s.atPunct(")") || s.atKeyword("COLLATE", "ASC", "DESC")
+		})
+		if tokens, err := tokenizeSQL(text); err == nil && len(tokens) == 1 && tokens[0].kind != tokNumber {
+			col.name = tokens[0].value
+		} else {
+			col.name = text
+		}
+		if s.acceptKeyword("COLLATE") {
+			name, err := s.expectName()
+			if err != nil {
+				return nil, err
 			}
+			col.collation = name
+		}
+		if s.acceptKeyword("DESC") {
+			col.desc = true
+		} else {
+			s.acceptKeyword("ASC")
+		}
+		cols = append(cols, col)
+		if s.acceptPunct(")") {
+			return cols, nil
+		}
+		if err := s.expectPunct(","); err != nil {
+			return nil, err
 		}
+	}
+}
 
-		cols = append(cols, columnDef{name: name, isRowid: isRowid})
-		//fmt.Printf("  -> Column: %s, isRowid: %v\n", name, isRowid)
+// Parses "( name, name, ... )"
+func parseNameList(s *tokenStream) ([]string, error) {
+	if err := s.expectPunct("("); err != nil {
+		return nil, err
+	}
+	var names []string
+	for {
+		name, err := s.expectName()
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+		if s.acceptPunct(")") {
+			return names, nil
+		}
+		if err := s.expectPunct(","); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Parses an optional "ON CONFLICT <resolution>" clause
+func parseConflictClause(s *tokenStream) (string, error) {
+	if !s.atKeyword("ON") || s.pos+1 >= len(s.tokens) || !strings.EqualFold(s.tokens[s.pos+1].text, "CONFLICT") {
+		return "", nil
+	}
+	s.pos += 2
+	if !s.atKeyword("ROLLBACK", "ABORT", "FAIL", "IGNORE", "REPLACE") {
+		return "", s.syntaxError()
+	}
+	return strings.ToUpper(s.next().text), nil
+}
+
+func parseDefaultValue(s *tokenStream) (string, error) {
+	if s.atPunct("(") {
+		text, err := s.parenthesized()
+		if err != nil {
+			return "", err
+		}
+		return "(" + text + ")", nil
+	}
+	start := s.peek()
+	if s.atPunct("+") || s.atPunct("-") {
+		s.next()
+		if s.peek().kind != tokNumber {
+			return "", s.syntaxError()
+		}
+	}
+	t := s.next()
+	switch t.kind {
+	case tokNumber, tokString, tokBlob, tokIdent:
+		return s.src[start.pos:t.end], nil
+	}
+	return "", s.syntaxError()
+}
+
+func parseForeignKeyClause(s *tokenStream) (*foreignKeyDef, error) {
+	if err := s.expectKeyword("REFERENCES"); err != nil {
+		return nil, err
+	}
+	table, err := s.expectName()
+	if err != nil {
+		return nil, err
+	}
+	fk := &foreignKeyDef{table: table, onDelete: "NO ACTION", onUpdate: "NO ACTION"}
+	if s.atPunct("(") {
+		if fk.parentCols, err = parseNameList(s); err != nil {
+			return nil, err
+		}
+	}
+	for {
+		switch {
+		case s.acceptKeyword("ON"):
+			var target *string
+			switch {
+			case s.acceptKeyword("DELETE"):
+				target = &fk.onDelete
+			case s.acceptKeyword("UPDATE"):
+				target = &fk.onUpdate
+			default:
+				return nil, s.syntaxError()
+			}
+			switch {
+			case s.acceptKeyword("SET"):
+				if s.acceptKeyword("NULL") {
+					*target = "SET NULL"
+				} else if s.acceptKeyword("DEFAULT") {
+					*target = "SET DEFAULT"
+				} else {
+					return nil, s.syntaxError()
+				}
+			case s.acceptKeyword("CASCADE"):
+				*target = "CASCADE"
+			case s.acceptKeyword("RESTRICT"):
+				*target = "RESTRICT"
+			case s.acceptKeyword("NO"):
+				if err := s.expectKeyword("ACTION"); err != nil {
+					return nil, err
+				}
+				*target = "NO ACTION"
+			default:
+				return nil, s.syntaxError()
+			}
+		case s.acceptKeyword("MATCH"):
+			if _, err := s.expectName(); err != nil {
+				return nil, err
+			}
+		case s.atKeyword("NOT") && s.pos+1 < len(s.tokens) && strings.EqualFold(s.tokens[s.pos+1].text, "DEFERRABLE"):
+			s.pos += 2
+			parseDeferrable(s)
+		case s.acceptKeyword("DEFERRABLE"):
+			fk.deferred = parseDeferrable(s)
+		default:
+			return fk, nil
+		}
+	}
+}
+
+// Parses the optional INITIALLY part after DEFERRABLE and reports whether
+// the constraint is deferred
+func parseDeferrable(s *tokenStream) bool {
+	if s.acceptKeyword("INITIALLY") {
+		if s.acceptKeyword("DEFERRED") {
+			return true
+		}
+		s.acceptKeyword("IMMEDIATE")
+	}
+	return false
+}
+
+// Determines column affinity from the declared type (SQLite rules 1-5)
+func columnAffinity(declType string) string {
+	up := strings.ToUpper(declType)
+	switch {
+	case strings.Contains(up, "INT"):
+		return "INTEGER"
+	case strings.Contains(up, "CHAR"), strings.Contains(up, "CLOB"), strings.Contains(up, "TEXT"):
+		return "TEXT"
+	case up == "" || strings.Contains(up, "BLOB"):
+		return "BLOB"
+	case strings.Contains(up, "REAL"), strings.Contains(up, "FLOA"), strings.Contains(up, "DOUB"):
+		return "REAL"
+	default:
+		return "NUMERIC"
+	}
+}
+
+// A column aliases the rowid when it is the table's only PRIMARY KEY column
+// and its declared type is exactly INTEGER. A column-level "PRIMARY KEY DESC"
+// is the historical exception and stays a separate column.
+func resolveRowidAlias(def *tableDef) {
+	if def.withoutRowid || len(def.primaryKey) != 1 {
+		return
+	}
+	i := def.columnIndex(def.primaryKey[0].name)
+	if i < 0 || !strings.EqualFold(def.columns[i].declType, "INTEGER") || def.columns[i].pkDesc {
+		return
 	}
-	return cols
+	def.columns[i].isRowid = true
 }
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"strings"
+)
+
+type triggerDef struct {
+	name    string
+	timing  string   // BEFORE, AFTER or INSTEAD OF
+	event   string   // INSERT, UPDATE or DELETE
+	columns []string // the columns of UPDATE OF; empty for any UPDATE
+	table   string
+	when    string   // condition of the WHEN clause, empty if there is none
+	body    []string // the statements between BEGIN and END
+}
+
+// Parses CREATE [TEMP] TRIGGER [IF NOT EXISTS] name [BEFORE | AFTER |
+// INSTEAD OF] {DELETE | INSERT | UPDATE [OF columns]} ON table
+// [FOR EACH ROW] [WHEN expr] BEGIN statement; ... END
+func parseCreateTrigger(createSQL string) (*triggerDef, error) {
+	s, err := newTokenStream(createSQL)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.expectKeyword("CREATE"); err != nil {
+		return nil, err
+	}
+	if !s.acceptKeyword("TEMP") {
+		s.acceptKeyword("TEMPORARY")
+	}
+	if err := s.expectKeyword("TRIGGER"); err != nil {
+		return nil, err
+	}
+	if err := acceptIfNotExists(s); err != nil {
+		return nil, err
+	}
+	name, err := s.expectQualifiedName()
+	if err != nil {
+		return nil, err
+	}
+	def := &triggerDef{name: name, timing: "BEFORE"}
+
+	switch {
+	case s.acceptKeyword("BEFORE"):
+	case s.acceptKeyword("AFTER"):
+		def.timing = "AFTER"
+	case s.acceptKeyword("INSTEAD"):
+		if err := s.expectKeyword("OF"); err != nil {
+			return nil, err
+		}
+		def.timing = "INSTEAD OF"
+	}
+	if !s.atKeyword("DELETE", "INSERT", "UPDATE") {
+		return nil, s.syntaxError()
+	}
+	def.event = strings.ToUpper(s.next().text)
+	if def.event == "UPDATE" && s.acceptKeyword("OF") {
+		for {
+			column, err := s.expectName()
+			if err != nil {
+				return nil, err
+			}
+			def.columns = append(def.columns, column)
+			if !s.acceptPunct(",") {
+				break
+			}
+		}
+	}
+	if err := s.expectKeyword("ON"); err != nil {
+		return nil, err
+	}
+	if def.table, err = s.expectQualifiedName(); err != nil {
+		return nil, err
+	}
+	if s.acceptKeyword("FOR") {
+		for _, keyword := range []string{"EACH", "ROW"} {
+			if err := s.expectKeyword(keyword); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if s.acceptKeyword("WHEN") {
+		def.when = s.textUntil(func(s *tokenStream) bool { return s.atKeyword("BEGIN") })
+	}
+	if err := s.expectKeyword("BEGIN"); err != nil {
+		return nil, err
+	}
+
+	// Each statement of the body ends with a semicolon, and END follows
+	// the last one
+	for !s.atKeyword("END") {
+		if !s.atKeyword("INSERT", "REPLACE", "UPDATE", "DELETE", "SELECT", "WITH") {
+			return nil, s.syntaxError()
+		}
+		stmt := s.textUntil(func(s *tokenStream) bool { return s.atPunct(";") })
+		if err := s.expectPunct(";"); err != nil {
+			return nil, err
+		}
+		def.body = append(def.body, stmt)
+	}
+	if len(def.body) == 0 {
+		return nil, s.syntaxError()
+	}
+	s.next()
+	s.acceptPunct(";")
+	if !s.atEnd() {
+		return nil, s.syntaxError()
+	}
+	return def, nil
+}
+
+// Reports whether an UPDATE that assigns the given columns fires the
+// trigger
+func (t *triggerDef) firesFor(changed []string) bool {
+	if len(t.columns) == 0 {
+		return true
+	}
+	for _, column := range t.columns {
+		for _, name := range changed {
+			if strings.EqualFold(column, name) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,53 @@
+package main
+
+type viewDef struct {
+	name      string
+	columns   []string // explicit column names from CREATE VIEW v(a, b)
+	selectSQL string
+}
+
+// Parses CREATE VIEW [IF NOT EXISTS] name [(columns)] AS select-stmt
+func parseCreateView(createSQL string) (*viewDef, error) {
+	s, err := newTokenStream(createSQL)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.expectKeyword("CREATE"); err != nil {
+		return nil, err
+	}
+	if !s.acceptKeyword("TEMP") {
+		s.acceptKeyword("TEMPORARY")
+	}
+	if err := s.expectKeyword("VIEW"); err != nil {
+		return nil, err
+	}
+	if err := acceptIfNotExists(s); err != nil {
+		return nil, err
+	}
+	name, err := s.expectQualifiedName()
+	if err != nil {
+		return nil, err
+	}
+	def := &viewDef{name: name}
+	if s.atPunct("(") {
+		if def.columns, err = parseNameList(s); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.expectKeyword("AS"); err != nil {
+		return nil, err
+	}
+	def.selectSQL = trimStatement(s.rest())
+	return def, nil
+}
+
+// Skips an optional IF NOT EXISTS clause
+func acceptIfNotExists(s *tokenStream) error {
+	if !s.acceptKeyword("IF") {
+		return nil
+	}
+	if err := s.expectKeyword("NOT"); err != nil {
+		return err
+	}
+	return s.expectKeyword("EXISTS")
+}
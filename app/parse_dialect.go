@@ -0,0 +1,299 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// Rewrites SQLite syntax that sqlparser (a MySQL grammar) reads differently:
+// "quoted" identifiers become `quoted`, || becomes ^ (evaluated as string
+// concatenation), == becomes =, subqueries in FROM get the alias MySQL
+// requires, table-valued function calls become quoted names and the
+// action of RAISE(action, message) becomes a string
+func prepareSQL(sql string) string {
+	tokens, err := tokenizeSQL(sql)
+	if err != nil {
+		return sql
+	}
+	aliases := subqueryAliasPositions(tokens)
+	functions := tableFunctionSpans(tokens)
+
+	var sb strings.Builder
+	last := 0
+	for i := 0; i < len(tokens); i++ {
+		t := tokens[i]
+		var replacement string
+		switch end, isFunction := functions[i]; {
+		case isFunction:
+			// Passed through as a quoted table name that the executor
+			// recognises as a call
+			replacement = "`" + strings.ReplaceAll(sql[t.pos:tokens[end].end], "`", "``") + "`"
+			i = end
+			t.end = tokens[end].end
+		case t.kind == tokIdent && strings.HasPrefix(t.text, "\""), t.kind == tokIdent && strings.HasPrefix(t.text, "["):
+			replacement = "`" + strings.ReplaceAll(t.value, "`", "``") + "`"
+		case t.kind == tokPunct && t.text == "||":
+			replacement = "^"
+		case t.kind == tokPunct && t.text == "==":
+			replacement = "="
+		case i >= 2 && t.kind == tokIdent && !t.quoted && tokens[i-1].text == "(" && tokens[i-2].isKeyword("RAISE"):
+			replacement = "'" + strings.ToUpper(t.text) + "'"
+		case i >= 1 && t.kind == tokIdent && !t.quoted && tokens[i-1].isKeyword("COLLATE"):
+			// BINARY is a keyword to the parser
+			replacement = "`" + t.text + "`"
+		case aliases[i]:
+			replacement = t.text + " as `subquery_" + strconv.Itoa(i) + "`"
+		default:
+			continue
+		}
+		sb.WriteString(sql[last:t.pos])
+		sb.WriteString(replacement)
+		last = t.end
+	}
+	sb.WriteString(sql[last:])
+	return trimStatement(sb.String())
+}
+
+// Finds the closing parentheses of subqueries in FROM clauses that have
+// no alias
+func subqueryAliasPositions(tokens []sqlToken) map[int]bool {
+	positions := make(map[int]bool)
+	type frame struct {
+		subquery bool // the parenthesis opens a FROM subquery
+		inFrom   bool // a FROM clause is being read at this nesting level
+	}
+	stack := []frame{{}}
+	for i, t := range tokens {
+		top := &stack[len(stack)-1]
+		switch {
+		case t.isKeyword("FROM"):
+			top.inFrom = true
+		case t.isKeyword("SELECT"), t.kind == tokIdent && !t.quoted && isSelectClauseKeyword(t.text):
+			top.inFrom = false
+		case t.kind == tokPunct && t.text == "(":
+			isSubquery := top.inFrom && i > 0 && i+1 < len(tokens) &&
+				(tokens[i-1].isKeyword("FROM") || tokens[i-1].isKeyword("JOIN") || tokens[i-1].text == ",") &&
+				tokens[i+1].isKeyword("SELECT")
+			stack = append(stack, frame{subquery: isSubquery})
+		case t.kind == tokPunct && t.text == ")":
+			if len(stack) == 1 {
+				continue
+			}
+			closed := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if !closed.subquery {
+				continue
+			}
+			if i+1 < len(tokens) {
+				next := tokens[i+1]
+				if next.kind == tokIdent && (next.quoted || !isSubqueryFollowKeyword(next.text)) {
+					continue
+				}
+			}
+			positions[i] = true
+		}
+	}
+	return positions
+}
+
+// Finds table-valued function calls such as FROM pragma_table_info('t'),
+// which the MySQL grammar cannot parse, mapping the name token to the
+// closing parenthesis
+func tableFunctionSpans(tokens []sqlToken) map[int]int {
+	spans := make(map[int]int)
+	for i := 1; i+1 < len(tokens); i++ {
+		t := tokens[i]
+		if t.kind != tokIdent || !strings.HasPrefix(strings.ToLower(t.value), "pragma_") || tokens[i+1].text != "(" {
+			continue
+		}
+		prev := tokens[i-1]
+		if !prev.isKeyword("FROM") && !prev.isKeyword("JOIN") && prev.text != "," {
+			continue
+		}
+		depth := 0
+		for j := i + 1; j < len(tokens); j++ {
+			if tokens[j].kind != tokPunct {
+				continue
+			}
+			if tokens[j].text == "(" {
+				depth++
+			} else if tokens[j].text == ")" {
+				depth--
+				if depth == 0 {
+					spans[i] = j
+					break
+				}
+			}
+		}
+	}
+	return spans
+}
+
+// Keywords that may directly follow a FROM item, so are not an alias
+func isSubqueryFollowKeyword(word string) bool {
+	switch strings.ToUpper(word) {
+	case "WHERE", "GROUP", "HAVING", "ORDER", "LIMIT", "UNION", "EXCEPT", "INTERSECT", "WINDOW",
+		"JOIN", "INNER", "LEFT", "RIGHT", "FULL", "CROSS", "NATURAL", "ON", "USING", "OFFSET":
+		return true
+	}
+	return false
+}
+
+// Returns the first keyword of a statement, upper-cased
+func statementKeyword(sql string) string {
+	tokens, err := tokenizeSQL(sql)
+	if err != nil || len(tokens) == 0 || tokens[0].kind != tokIdent || tokens[0].quoted {
+		return ""
+	}
+	return strings.ToUpper(tokens[0].text)
+}
+
+// Returns the source text of each item in the first SELECT's result list,
+// used to name result columns the way sqlite3 does
+func selectListSpans(sql string) []string {
+	tokens, err := tokenizeSQL(sql)
+	if err != nil {
+		return nil
+	}
+	start := -1
+	for i, t := range tokens {
+		if t.kind == tokIdent && !t.quoted && strings.EqualFold(t.text, "SELECT") {
+			start = i + 1
+			break
+		}
+	}
+	if start < 0 {
+		return nil
+	}
+	if start < len(tokens) && tokens[start].kind == tokIdent && !tokens[start].quoted {
+		switch strings.ToUpper(tokens[start].text) {
+		case "DISTINCT", "ALL":
+			start++
+		}
+	}
+
+	var spans []string
+	depth := 0
+	itemStart := start
+	for i := start; i <= len(tokens); i++ {
+		end := i == len(tokens)
+		if !end {
+			t := tokens[i]
+			switch {
+			case t.kind == tokPunct && t.text == "(":
+				depth++
+				continue
+			case t.kind == tokPunct && t.text == ")":
+				if depth == 0 {
+					end = true
+				}
+				depth--
+			case depth == 0 && t.kind == tokPunct && t.text == ";":
+				end = true
+			case depth == 0 && t.kind == tokIdent && !t.quoted && isSelectClauseKeyword(t.text):
+				end = true
+			}
+			if !end && !(depth == 0 && t.kind == tokPunct && t.text == ",") {
+				continue
+			}
+		}
+		if itemStart < i {
+			spans = append(spans, sql[tokens[itemStart].pos:tokens[i-1].end])
+		}
+		if end {
+			break
+		}
+		itemStart = i + 1
+	}
+	return spans
+}
+
+func isSelectClauseKeyword(word string) bool {
+	switch strings.ToUpper(word) {
+	case "FROM", "WHERE", "GROUP", "HAVING", "ORDER", "LIMIT", "UNION", "EXCEPT", "INTERSECT", "WINDOW":
+		return true
+	}
+	return false
+}
+
+// A statement split from SQL text, with the line it starts on
+type sqlStatement struct {
+	text string
+	line int // counting from 0
+}
+
+// Splits SQL text into its statements at top-level semicolons
+func splitStatements(sql string) []string {
+	var statements []string
+	for _, stmt := range splitStatementLines(sql) {
+		statements = append(statements, stmt.text)
+	}
+	return statements
+}
+
+// Splits SQL text into its statements at top-level semicolons, dropping
+// empty ones and the comments around them. The semicolons inside a CREATE
+// TRIGGER's BEGIN ... END only end statements of the trigger program, so a
+// semicolon ends CREATE TRIGGER only right after END, as sqlite3_complete()
+// decides.
+func splitStatementLines(sql string) []sqlStatement {
+	tokens, err := tokenizeSQL(sql)
+	if err != nil {
+		// Running the statement reports the bad token
+		text := strings.TrimSpace(sql)
+		line := strings.Count(sql[:strings.Index(sql, text)], "\n")
+		return []sqlStatement{{text, line}}
+	}
+	var statements []sqlStatement
+	add := func(stmt []sqlToken) {
+		if len(stmt) > 0 {
+			text := sql[stmt[0].pos:stmt[len(stmt)-1].end]
+			line := strings.Count(sql[:stmt[0].pos], "\n")
+			statements = append(statements, sqlStatement{text, line})
+		}
+	}
+	first := 0 // index of the current statement's first token
+	for i, t := range tokens {
+		if t.kind == tokPunct && t.text == ";" {
+			if isCreateTrigger(tokens[first:i]) && !tokens[i-1].isKeyword("END") {
+				continue
+			}
+			add(tokens[first:i])
+			first = i + 1
+		}
+	}
+	add(tokens[first:])
+	return statements
+}
+
+// Reports whether SQL text ends with a complete statement, the way the
+// sqlite3 shell decides when to stop reading more lines
+func sqlComplete(sql string) bool {
+	tokens, err := tokenizeSQL(sql)
+	var unterminated *unterminatedError
+	if errors.As(err, &unterminated) || len(tokens) == 0 && err == nil {
+		return false
+	}
+	if err != nil {
+		// Running the statement reports the bad token
+		return strings.HasSuffix(strings.TrimSpace(sql), ";")
+	}
+	first := 0
+	for i, t := range tokens {
+		if t.kind == tokPunct && t.text == ";" && (!isCreateTrigger(tokens[first:i]) || tokens[i-1].isKeyword("END")) {
+			first = i + 1
+		}
+	}
+	return first == len(tokens)
+}
+
+func isCreateTrigger(tokens []sqlToken) bool {
+	if len(tokens) < 2 || !tokens[0].isKeyword("CREATE") {
+		return false
+	}
+	if tokens[1].isKeyword("TEMP") || tokens[1].isKeyword("TEMPORARY") {
+		tokens = tokens[1:]
+	}
+	return len(tokens) > 1 && tokens[1].isKeyword("TRIGGER")
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+type tokenKind int
+
+const (
+	tokIdent    tokenKind = iota // bare or quoted identifier (also keywords)
+	tokString                    // 'string literal'
+	tokNumber                    // 123, 1.5e3, 0x1F
+	tokBlob                      // x'0A0B'
+	tokPunct                     // ( ) , ; . = <> || etc.
+	tokVariable                  // ?, ?1, :name, @name, $name
+)
+
+type sqlToken struct {
+	kind   tokenKind
+	text   string // raw text as written in the source
+	value  string // identifier or string contents with quoting removed
+	quoted bool   // identifier was quoted, so it can never be a keyword
+	pos    int    // byte offset of the token in the source
+	end    int    // byte offset just past the token
+}
+
+// Splits SQL text into tokens following SQLite's lexical rules, dropping
+// whitespace and comments
+func tokenizeSQL(sql string) ([]sqlToken, error) {
+	var tokens []sqlToken
+	i := 0
+	for i < len(sql) {
+		c := sql[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' || c == '\v':
+			i++
+		case c == '-' && i+1 < len(sql) && sql[i+1] == '-':
+			for i < len(sql) && sql[i] != '\n' {
+				i++
+			}
+		case c == '/' && i+1 < len(sql) && sql[i+1] == '*':
+			end := strings.Index(sql[i+2:], "*/")
+			if end < 0 {
+				i = len(sql)
+			} else {
+				i += end + 4
+			}
+		case c == '\'':
+			value, end, err := scanQuoted(sql, i, '\'')
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, sqlToken{kind: tokString, text: sql[i:end], value: value, pos: i, end: end})
+			i = end
+		case c == '"' || c == '`':
+			value, end, err := scanQuoted(sql, i, c)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, sqlToken{kind: tokIdent, text: sql[i:end], value: value, quoted: true, pos: i, end: end})
+			i = end
+		case c == '[':
+			end := strings.IndexByte(sql[i:], ']')
+			if end < 0 {
+				return nil, &unterminatedError{sql[i:]}
+			}
+			end += i + 1
+			tokens = append(tokens, sqlToken{kind: tokIdent, text: sql[i:end], value: sql[i+1 : end-1], quoted: true, pos: i, end: end})
+			i = end
+		case (c == 'x' || c == 'X') && i+1 < len(sql) && sql[i+1] == '\'':
+			value, end, err := scanQuoted(sql, i+1, '\'')
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, sqlToken{kind: tokBlob, text: sql[i:end], value: value, pos: i, end: end})
+			i = end
+		case isDigit(c) || (c == '.' && i+1 < len(sql) && isDigit(sql[i+1])):
+			end := scanNumber(sql, i)
+			tokens = append(tokens, sqlToken{kind: tokNumber, text: sql[i:end], value: sql[i:end], pos: i, end: end})
+			i = end
+		case isIdentStart(c):
+			end := i + 1
+			for end < len(sql) && isIdentChar(sql[end]) {
+				end++
+			}
+			tokens = append(tokens, sqlToken{kind: tokIdent, text: sql[i:end], value: sql[i:end], pos: i, end: end})
+			i = end
+		case c == '?' || c == ':' || c == '@' || c == '$':
+			end := i + 1
+			for end < len(sql) && isIdentChar(sql[end]) {
+				end++
+			}
+			tokens = append(tokens, sqlToken{kind: tokVariable, text: sql[i:end], value: sql[i:end], pos: i, end: end})
+			i = end
+		default:
+			end := i + 1
+			if i+1 < len(sql) {
+				switch sql[i : i+2] {
+				case "<>", "<=", ">=", "==", "!=", "||", "<<", ">>", "->":
+					end = i + 2
+					if sql[i:i+2] == "->" && i+2 < len(sql) && sql[i+2] == '>' {
+						end = i + 3
+					}
+				}
+			}
+			if !strings.ContainsRune("(),;.=<>+-*/%&|~!", rune(c)) {
+				return nil, fmt.Errorf("unrecognized token: \"%c\"", c)
+			}
+			tokens = append(tokens, sqlToken{kind: tokPunct, text: sql[i:end], value: sql[i:end], pos: i, end: end})
+			i = end
+		}
+	}
+	return tokens, nil
+}
+
+// Scans a quoted token starting at sql[start], where a doubled quote
+// character stands for one literal quote
+func scanQuoted(sql string, start int, quote byte) (string, int, error) {
+	var sb strings.Builder
+	i := start + 1
+	for i < len(sql) {
+		if sql[i] == quote {
+			if i+1 < len(sql) && sql[i+1] == quote {
+				sb.WriteByte(quote)
+				i += 2
+				continue
+			}
+			return sb.String(), i + 1, nil
+		}
+		sb.WriteByte(sql[i])
+		i++
+	}
+	return "", 0, &unterminatedError{sql[start:]}
+}
+
+// unterminatedError is a quoted token that runs to the end of the text
+type unterminatedError struct {
+	text string
+}
+
+func (e *unterminatedError) Error() string {
+	return fmt.Sprintf("unrecognized token: \"%s\"", e.text)
+}
+
+func scanNumber(sql string, i int) int {
+	if sql[i] == '0' && i+1 < len(sql) && (sql[i+1] == 'x' || sql[i+1] == 'X') {
+		i += 2
+		for i < len(sql) && strings.IndexByte("0123456789abcdefABCDEF", sql[i]) >= 0 {
+			i++
+		}
+		return i
+	}
+	for i < len(sql) && isDigit(sql[i]) {
+		i++
+	}
+	if i < len(sql) && sql[i] == '.' {
+		i++
+		for i < len(sql) && isDigit(sql[i]) {
+			i++
+		}
+	}
+	if i < len(sql) && (sql[i] == 'e' || sql[i] == 'E') {
+		j := i + 1
+		if j < len(sql) && (sql[j] == '+' || sql[j] == '-') {
+			j++
+		}
+		if j < len(sql) && isDigit(sql[j]) {
+			i = j
+			for i < len(sql) && isDigit(sql[i]) {
+				i++
+			}
+		}
+	}
+	return i
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c >= 0x80
+}
+
+func isIdentChar(c byte) bool {
+	return isIdentStart(c) || isDigit(c) || c == '$'
+}
+
+// tokenStream is a cursor over tokens used by the hand-written parsers
+type tokenStream struct {
+	src    string
+	tokens []sqlToken
+	pos    int
+}
+
+func newTokenStream(sql string) (*tokenStream, error) {
+	tokens, err := tokenizeSQL(sql)
+	if err != nil {
+		return nil, err
+	}
+	return &tokenStream{src: sql, tokens: tokens}, nil
+}
+
+func (s *tokenStream) atEnd() bool {
+	return s.pos >= len(s.tokens)
+}
+
+func (s *tokenStream) peek() sqlToken {
+	if s.atEnd() {
+		return sqlToken{kind: tokPunct, pos: len(s.src), end: len(s.src)}
+	}
+	return s.tokens[s.pos]
+}
+
+func (s *tokenStream) next() sqlToken {
+	t := s.peek()
+	if !s.atEnd() {
+		s.pos++
+	}
+	return t
+}
+
+// Reports whether the token is the given unquoted keyword
+func (t sqlToken) isKeyword(keyword string) bool {
+	return t.kind == tokIdent && !t.quoted && strings.EqualFold(t.text, keyword)
+}
+
+// Reports whether the next token is the given keyword (case-insensitive)
+func (s *tokenStream) atKeyword(keywords ...string) bool {
+	t := s.peek()
+	for _, kw := range keywords {
+		if t.isKeyword(kw) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *tokenStream) acceptKeyword(keyword string) bool {
+	if s.atKeyword(keyword) {
+		s.pos++
+		return true
+	}
+	return false
+}
+
+func (s *tokenStream) expectKeyword(keyword string) error {
+	if !s.acceptKeyword(keyword) {
+		return s.syntaxError()
+	}
+	return nil
+}
+
+func (s *tokenStream) atPunct(p string) bool {
+	t := s.peek()
+	return t.kind == tokPunct && t.text == p
+}
+
+func (s *tokenStream) acceptPunct(p string) bool {
+	if s.atPunct(p) {
+		s.pos++
+		return true
+	}
+	return false
+}
+
+func (s *tokenStream) expectPunct(p string) error {
+	if !s.acceptPunct(p) {
+		return s.syntaxError()
+	}
+	return nil
+}
+
+// Reads an identifier, quoted or bare, and returns its unquoted value
+func (s *tokenStream) expectName() (string, error) {
+	t := s.peek()
+	if t.kind != tokIdent && t.kind != tokString {
+		return "", s.syntaxError()
+	}
+	s.pos++
+	return t.value, nil
+}
+
+// Reads a possibly schema-qualified name and returns the object name
+func (s *tokenStream) expectQualifiedName() (string, error) {
+	name, err := s.expectName()
+	if err != nil {
+		return "", err
+	}
+	if s.acceptPunct(".") {
+		return s.expectName()
+	}
+	return name, nil
+}
+
+// Consumes tokens up to (not including) the next top-level token matching
+// stop, and returns the covered source text
+func (s *tokenStream) textUntil(stop func(s *tokenStream) bool) string {
+	start := s.peek().pos
+	end := start
+	depth := 0
+	for !s.atEnd() {
+		if depth == 0 && stop(s) {
+			break
+		}
+		t := s.next()
+		if t.kind == tokPunct {
+			switch t.text {
+			case "(":
+				depth++
+			case ")":
+				depth--
+			}
+		}
+		end = t.end
+	}
+	return s.src[start:end]
+}
+
+// Consumes a parenthesised group and returns the text between the parens
+func (s *tokenStream) parenthesized() (string, error) {
+	if err := s.expectPunct("("); err != nil {
+		return "", err
+	}
+	text := s.textUntil(func(s *tokenStream) bool { return s.atPunct(")") })
+	if err := s.expectPunct(")"); err != nil {
+		return "", err
+	}
+	return text, nil
+}
+
+// Remaining source text from the current token onwards
+func (s *tokenStream) rest() string {
+	return s.src[s.peek().pos:]
+}
+
+func (s *tokenStream) syntaxError() error {
+	if s.atEnd() {
+		return fmt.Errorf("incomplete input")
+	}
+	return fmt.Errorf("near \"%s\": syntax error", s.peek().text)
+}
+
+// Strips surrounding whitespace and a trailing semicolon from a statement
+func trimStatement(sql string) string {
+	sql = strings.TrimSpace(sql)
+	for strings.HasSuffix(sql, ";") {
+		sql = strings.TrimSpace(strings.TrimSuffix(sql, ";"))
+	}
+	return sql
+}
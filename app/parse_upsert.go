@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/xwb1989/sqlparser"
+)
+
+// upsertClause is one ON CONFLICT clause of an INSERT
+type upsertClause struct {
+	target      []indexedColumn // empty matches any uniqueness constraint
+	targetWhere string          // WHERE of the target, naming a partial index
+	doNothing   bool
+	assignments sqlparser.UpdateExprs // SET list of DO UPDATE
+	where       sqlparser.Expr        // WHERE of DO UPDATE
+}
+
+// Takes the parts of an INSERT, REPLACE or UPDATE statement that the
+// MySQL grammar cannot parse out of it: the OR <resolution> after INSERT
+// or UPDATE and the ON CONFLICT clauses of an upsert. REPLACE is read as
+// INSERT OR REPLACE.
+func splitConflictClauses(sql string) (string, string, []*upsertClause, error) {
+	tokens, err := tokenizeSQL(sql)
+	if err != nil || len(tokens) < 2 {
+		return sql, "", nil, err
+	}
+	onConflict := ""
+	var edits []sqlEdit
+	switch {
+	case tokens[0].isKeyword("REPLACE"):
+		onConflict = "REPLACE"
+		edits = append(edits, sqlEdit{tokens[0].pos, tokens[0].end, "INSERT"})
+	case tokens[1].isKeyword("OR"):
+		if len(tokens) < 3 {
+			return "", "", nil, fmt.Errorf("incomplete input")
+		}
+		switch strings.ToUpper(tokens[2].text) {
+		case "ROLLBACK", "ABORT", "FAIL", "IGNORE", "REPLACE":
+		default:
+			return "", "", nil, fmt.Errorf("near \"%s\": syntax error", tokens[2].text)
+		}
+		onConflict = strings.ToUpper(tokens[2].text)
+		edits = append(edits, sqlEdit{tokens[1].pos, tokens[2].end, ""})
+	}
+
+	var upserts []*upsertClause
+	if !tokens[0].isKeyword("UPDATE") {
+		depth := 0
+		for i, t := range tokens {
+			if t.kind == tokPunct && t.text == "(" {
+				depth++
+			} else if t.kind == tokPunct && t.text == ")" {
+				depth--
+			}
+			if depth == 0 && i+1 < len(tokens) && t.isKeyword("ON") && tokens[i+1].isKeyword("CONFLICT") {
+				if upserts, err = parseUpsertClauses(sql[t.pos:]); err != nil {
+					return "", "", nil, err
+				}
+				edits = append(edits, sqlEdit{t.pos, len(sql), ""})
+				break
+			}
+		}
+	}
+	return applySQLEdits(sql, edits), onConflict, upserts, nil
+}
+
+// Parses the ON CONFLICT clauses that end an INSERT. Only the last one
+// may leave out the conflict target.
+func parseUpsertClauses(sql string) ([]*upsertClause, error) {
+	s, err := newTokenStream(sql)
+	if err != nil {
+		return nil, err
+	}
+	atNextClause := func(s *tokenStream) bool {
+		return s.atPunct(";") || s.atKeyword("ON") && s.pos+1 < len(s.tokens) && s.tokens[s.pos+1].isKeyword("CONFLICT")
+	}
+
+	var clauses []*upsertClause
+	for !s.atEnd() && !s.atPunct(";") {
+		if n := len(clauses); n > 0 && clauses[n-1].target == nil {
+			return nil, s.syntaxError()
+		}
+		if err := s.expectKeyword("ON"); err != nil {
+			return nil, err
+		}
+		if err := s.expectKeyword("CONFLICT"); err != nil {
+			return nil, err
+		}
+		u := &upsertClause{}
+		if s.atPunct("(") {
+			if u.target, err = parseIndexedColumns(s); err != nil {
+				return nil, err
+			}
+			if s.acceptKeyword("WHERE") {
+				u.targetWhere = s.textUntil(func(s *tokenStream) bool { return s.atKeyword("DO") })
+			}
+		}
+		if err := s.expectKeyword("DO"); err != nil {
+			return nil, err
+		}
+		if s.acceptKeyword("NOTHING") {
+			u.doNothing = true
+		} else {
+			if err := s.expectKeyword("UPDATE"); err != nil {
+				return nil, err
+			}
+			if err := s.expectKeyword("SET"); err != nil {
+				return nil, err
+			}
+			set := s.textUntil(atNextClause)
+			stmt, err := sqlparser.Parse(prepareSQL("UPDATE excluded SET " + set))
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse SQL: %v", err)
+			}
+			update, ok := stmt.(*sqlparser.Update)
+			if !ok {
+				return nil, fmt.Errorf("near \"%s\": syntax error", set)
+			}
+			u.assignments = update.Exprs
+			if update.Where != nil {
+				u.where = update.Where.Expr
+			}
+		}
+		clauses = append(clauses, u)
+	}
+	return clauses, nil
+}
@@ -2,87 +2,269 @@ package main
 
 import (
 	"fmt"
-	"log"
+	"math"
 	"strconv"
 	"strings"
 
 	"github.com/xwb1989/sqlparser"
 )
 
+// evalError aborts expression evaluation; query entry points recover it
+// with recoverEvalError and return it as an ordinary error
+type evalError struct {
+	err error
+}
+
+func raiseEvalError(format string, args ...interface{}) {
+	panic(evalError{fmt.Errorf(format, args...)})
+}
+
+func recoverEvalError(err *error) {
+	if r := recover(); r != nil {
+		if e, ok := r.(evalError); ok {
+			*err = e.err
+			return
+		}
+		panic(r)
+	}
+}
+
 func evaluateWhereClause(expr sqlparser.Expr, columnIndex map[string]int, columnNames []string, rowidColName string, values []interface{}, rowid int) bool {
+	return isTrue(evaluateCondition(expr, columnIndex, columnNames, rowidColName, values, rowid))
+}
+
+// Evaluates a boolean expression with SQL's three-valued logic, returning
+// 1, 0 or nil (NULL)
+func evaluateCondition(expr sqlparser.Expr, columnIndex map[string]int, columnNames []string, rowidColName string, values []interface{}, rowid int) interface{} {
 	switch e := expr.(type) {
 	case *sqlparser.ComparisonExpr:
 		return evaluateComparison(e, columnIndex, columnNames, rowidColName, values, rowid)
 	case *sqlparser.AndExpr:
-		return evaluateWhereClause(e.Left, columnIndex, columnNames, rowidColName, values, rowid) &&
-			evaluateWhereClause(e.Right, columnIndex, columnNames, rowidColName, values, rowid)
+		left := evaluateCondition(e.Left, columnIndex, columnNames, rowidColName, values, rowid)
+		if left != nil && !isTrue(left) {
+			return boolValue(false)
+		}
+		right := evaluateCondition(e.Right, columnIndex, columnNames, rowidColName, values, rowid)
+		if right != nil && !isTrue(right) {
+			return boolValue(false)
+		}
+		if left == nil || right == nil {
+			return nil
+		}
+		return boolValue(true)
 	case *sqlparser.OrExpr:
-		return evaluateWhereClause(e.Left, columnIndex, columnNames, rowidColName, values, rowid) ||
-			evaluateWhereClause(e.Right, columnIndex, columnNames, rowidColName, values, rowid)
+		left := evaluateCondition(e.Left, columnIndex, columnNames, rowidColName, values, rowid)
+		if isTrue(left) {
+			return boolValue(true)
+		}
+		right := evaluateCondition(e.Right, columnIndex, columnNames, rowidColName, values, rowid)
+		if isTrue(right) {
+			return boolValue(true)
+		}
+		if left == nil || right == nil {
+			return nil
+		}
+		return boolValue(false)
+	case *sqlparser.NotExpr:
+		v := evaluateCondition(e.Expr, columnIndex, columnNames, rowidColName, values, rowid)
+		if v == nil {
+			return nil
+		}
+		return boolValue(!isTrue(v))
 	case *sqlparser.ParenExpr:
-		return evaluateWhereClause(e.Expr, columnIndex, columnNames, rowidColName, values, rowid)
+		return evaluateCondition(e.Expr, columnIndex, columnNames, rowidColName, values, rowid)
+	case *sqlparser.IsExpr:
+		v := getExprValue(e.Expr, columnIndex, columnNames, rowidColName, values, rowid)
+		switch e.Operator {
+		case sqlparser.IsNullStr:
+			return boolValue(v == nil)
+		case sqlparser.IsNotNullStr:
+			return boolValue(v != nil)
+		case sqlparser.IsTrueStr:
+			return boolValue(isTrue(v))
+		case sqlparser.IsNotTrueStr:
+			return boolValue(!isTrue(v))
+		case sqlparser.IsFalseStr:
+			return boolValue(v != nil && !isTrue(v))
+		case sqlparser.IsNotFalseStr:
+			return boolValue(v == nil || isTrue(v))
+		}
+		raiseEvalError("Unsupported IS operator: %s", e.Operator)
+		return nil
+	case *sqlparser.RangeCond:
+		v := getExprValue(e.Left, columnIndex, columnNames, rowidColName, values, rowid)
+		from := getExprValue(e.From, columnIndex, columnNames, rowidColName, values, rowid)
+		to := getExprValue(e.To, columnIndex, columnNames, rowidColName, values, rowid)
+		if v == nil || from == nil || to == nil {
+			return nil
+		}
+		between := compareCollated(v, from, comparisonCollation(e.Left, e.From)) >= 0 &&
+			compareCollated(v, to, comparisonCollation(e.Left, e.To)) <= 0
+		if e.Operator == sqlparser.NotBetweenStr {
+			return boolValue(!between)
+		}
+		return boolValue(between)
 	default:
-		log.Fatalf("Unsupported WHERE expression type: %T", expr)
-		return false
+		return getExprValue(expr, columnIndex, columnNames, rowidColName, values, rowid)
 	}
 }
 
-func evaluateComparison(expr *sqlparser.ComparisonExpr, columnIndex map[string]int, columnNames []string, rowidColName string, values []interface{}, rowid int) bool {
+func evaluateComparison(expr *sqlparser.ComparisonExpr, columnIndex map[string]int, columnNames []string, rowidColName string, values []interface{}, rowid int) interface{} {
 	// Get left operand value
 	leftVal := getExprValue(expr.Left, columnIndex, columnNames, rowidColName, values, rowid)
-	rightVal := getExprValue(expr.Right, columnIndex, columnNames, rowidColName, values, rowid)
 
-	//fmt.Printf("    Comparing: %v (%T) %s %v (%T)\n", leftVal, leftVal, expr.Operator, rightVal, rightVal)
+	switch expr.Operator {
+	case sqlparser.InStr, sqlparser.NotInStr:
+		return evaluateIn(expr, leftVal, columnIndex, columnNames, rowidColName, values, rowid)
+	}
+
+	rightVal := getExprValue(expr.Right, columnIndex, columnNames, rowidColName, values, rowid)
+	collation := comparisonCollation(expr.Left, expr.Right)
+	if expr.Operator == sqlparser.NullSafeEqualStr {
+		return boolValue(compareCollated(leftVal, rightVal, collation) == 0)
+	}
+	if leftVal == nil || rightVal == nil {
+		return nil
+	}
 
 	switch expr.Operator {
 	case sqlparser.EqualStr:
-		result := compareValues(leftVal, rightVal) == 0
-		//fmt.Printf("    Comparison result: %v\n", result)
-		return result
+		return boolValue(compareCollated(leftVal, rightVal, collation) == 0)
 	case sqlparser.NotEqualStr:
-		return compareValues(leftVal, rightVal) != 0
+		return boolValue(compareCollated(leftVal, rightVal, collation) != 0)
 	case sqlparser.LessThanStr:
-		return compareValues(leftVal, rightVal) < 0
+		return boolValue(compareCollated(leftVal, rightVal, collation) < 0)
 	case sqlparser.LessEqualStr:
-		return compareValues(leftVal, rightVal) <= 0
+		return boolValue(compareCollated(leftVal, rightVal, collation) <= 0)
 	case sqlparser.GreaterThanStr:
-		return compareValues(leftVal, rightVal) > 0
+		return boolValue(compareCollated(leftVal, rightVal, collation) > 0)
 	case sqlparser.GreaterEqualStr:
-		return compareValues(leftVal, rightVal) >= 0
+		return boolValue(compareCollated(leftVal, rightVal, collation) >= 0)
+	case sqlparser.LikeStr, sqlparser.NotLikeStr:
+		escape := byte(0)
+		if expr.Escape != nil {
+			if esc := valueToString(getExprValue(expr.Escape, columnIndex, columnNames, rowidColName, values, rowid)); len(esc) == 1 {
+				escape = esc[0]
+			}
+		}
+		match := likeMatch(valueToString(rightVal), valueToString(leftVal), escape)
+		return boolValue(match == (expr.Operator == sqlparser.LikeStr))
 	default:
-		log.Fatalf("Unsupported comparison operator: %s", expr.Operator)
-		return false
+		raiseEvalError("Unsupported comparison operator: %s", expr.Operator)
+		return nil
 	}
 }
 
+func evaluateIn(expr *sqlparser.ComparisonExpr, leftVal interface{}, columnIndex map[string]int, columnNames []string, rowidColName string, values []interface{}, rowid int) interface{} {
+	tuple, ok := expr.Right.(sqlparser.ValTuple)
+	if !ok {
+		raiseEvalError("Unsupported IN operand: %T", expr.Right)
+	}
+	notIn := expr.Operator == sqlparser.NotInStr
+	if len(tuple) == 0 {
+		return boolValue(notIn)
+	}
+	if leftVal == nil {
+		return nil
+	}
+	// The left operand alone decides the collation
+	collation := comparisonCollation(expr.Left, nil)
+	sawNull := false
+	for _, item := range tuple {
+		v := getExprValue(item, columnIndex, columnNames, rowidColName, values, rowid)
+		if v == nil {
+			sawNull = true
+			continue
+		}
+		if compareCollated(leftVal, v, collation) == 0 {
+			return boolValue(!notIn)
+		}
+	}
+	if sawNull {
+		return nil
+	}
+	return boolValue(notIn)
+}
+
+// Matches text against a LIKE pattern, case-insensitively for ASCII letters
+func likeMatch(pattern, text string, escape byte) bool {
+	p, t := []byte(asciiLower(pattern)), []byte(asciiLower(text))
+	var match func(pi, ti int) bool
+	match = func(pi, ti int) bool {
+		for pi < len(p) {
+			c := p[pi]
+			switch {
+			case escape != 0 && c == escape && pi+1 < len(p):
+				if ti >= len(t) || t[ti] != p[pi+1] {
+					return false
+				}
+				pi += 2
+				ti++
+			case c == '%':
+				for pi < len(p) && p[pi] == '%' {
+					pi++
+				}
+				if pi == len(p) {
+					return true
+				}
+				for k := ti; k <= len(t); k++ {
+					if match(pi, k) {
+						return true
+					}
+				}
+				return false
+			case c == '_':
+				if ti >= len(t) {
+					return false
+				}
+				pi++
+				ti++
+			default:
+				if ti >= len(t) || t[ti] != c {
+					return false
+				}
+				pi++
+				ti++
+			}
+		}
+		return ti == len(t)
+	}
+	return match(0, 0)
+}
+
 func getExprValue(expr sqlparser.Expr, columnIndex map[string]int, columnNames []string, rowidColName string, values []interface{}, rowid int) interface{} {
 	switch e := expr.(type) {
 	case *sqlparser.ColName:
 		colName := e.Name.String()
-
-		// Handle rowid or INTEGER PRIMARY KEY column
-		if strings.EqualFold(colName, "rowid") || (rowidColName != "" && strings.EqualFold(colName, rowidColName)) {
-			return rowid
+		key := strings.ToLower(colName)
+		if !e.Qualifier.IsEmpty() {
+			key = strings.ToLower(e.Qualifier.Name.String()) + "." + key
 		}
-		if idx, ok := columnIndex[strings.ToLower(colName)]; ok {
+
+		if idx, ok := columnIndex[key]; ok {
 			if idx < len(values) {
-				return values[idx]
+				return normalizeValue(values[idx])
 			}
 			return nil
 		}
-		// If column not found in payload, it might be a rowid column
-		log.Fatalf("Column not found: %s (available: %v)", colName, columnNames)
+		// Handle rowid or INTEGER PRIMARY KEY column
+		if isRowidName(colName) || (rowidColName != "" && strings.EqualFold(colName, rowidColName)) {
+			return int64(rowid)
+		}
+		raiseEvalError("no such column: %s", colName)
 		return nil
 	case *sqlparser.SQLVal:
 		switch e.Type {
 		case sqlparser.StrVal:
 			result := string(e.Val)
-			//fmt.Printf("    String literal: %s\n", result)
 			return result
 		case sqlparser.IntVal:
 			// Parse integer
 			val := string(e.Val)
-			if num, err := strconv.Atoi(val); err == nil {
+			if num, err := strconv.ParseInt(val, 10, 64); err == nil {
+				return num
+			}
+			if num, err := strconv.ParseFloat(val, 64); err == nil {
 				return num
 			}
 			return val
@@ -93,13 +275,259 @@ func getExprValue(expr sqlparser.Expr, columnIndex map[string]int, columnNames [
 				return num
 			}
 			return val
+		case sqlparser.HexVal:
+			return []byte(decodeHexLiteral(string(e.Val)))
+		case sqlparser.HexNum:
+			if num, err := strconv.ParseInt(string(e.Val[2:]), 16, 64); err == nil {
+				return num
+			}
+			return string(e.Val)
 		default:
 			return string(e.Val)
 		}
+	case *sqlparser.NullVal:
+		return nil
+	case sqlparser.BoolVal:
+		return boolValue(bool(e))
+	case *sqlparser.ParenExpr:
+		return getExprValue(e.Expr, columnIndex, columnNames, rowidColName, values, rowid)
+	case *sqlparser.CollateExpr:
+		return getExprValue(e.Expr, columnIndex, columnNames, rowidColName, values, rowid)
+	case *columnCollation:
+		return getExprValue(e.Expr, columnIndex, columnNames, rowidColName, values, rowid)
+	case *sqlparser.ComparisonExpr, *sqlparser.AndExpr, *sqlparser.OrExpr, *sqlparser.NotExpr, *sqlparser.IsExpr, *sqlparser.RangeCond:
+		return evaluateCondition(e, columnIndex, columnNames, rowidColName, values, rowid)
+	case *sqlparser.UnaryExpr:
+		v := getExprValue(e.Expr, columnIndex, columnNames, rowidColName, values, rowid)
+		switch e.Operator {
+		case sqlparser.UPlusStr:
+			return v
+		case sqlparser.UMinusStr:
+			if v == nil {
+				return nil
+			}
+			i, f, isInt := toNumber(v)
+			if isInt && i != math.MinInt64 {
+				return -i
+			}
+			return -f
+		case sqlparser.TildaStr:
+			if v == nil {
+				return nil
+			}
+			i, _, _ := toNumber(v)
+			return ^i
+		case sqlparser.BangStr:
+			if v == nil {
+				return nil
+			}
+			return boolValue(!isTrue(v))
+		}
+		raiseEvalError("Unsupported unary operator: %s", e.Operator)
+		return nil
+	case *sqlparser.BinaryExpr:
+		left := getExprValue(e.Left, columnIndex, columnNames, rowidColName, values, rowid)
+		right := getExprValue(e.Right, columnIndex, columnNames, rowidColName, values, rowid)
+		return evaluateBinary(e.Operator, left, right)
+	case *sqlparser.CaseExpr:
+		var base interface{}
+		if e.Expr != nil {
+			base = getExprValue(e.Expr, columnIndex, columnNames, rowidColName, values, rowid)
+		}
+		for _, when := range e.Whens {
+			if e.Expr != nil {
+				v := getExprValue(when.Cond, columnIndex, columnNames, rowidColName, values, rowid)
+				if base != nil && v != nil && compareValues(base, v) == 0 {
+					return getExprValue(when.Val, columnIndex, columnNames, rowidColName, values, rowid)
+				}
+			} else if isTrue(evaluateCondition(when.Cond, columnIndex, columnNames, rowidColName, values, rowid)) {
+				return getExprValue(when.Val, columnIndex, columnNames, rowidColName, values, rowid)
+			}
+		}
+		if e.Else != nil {
+			return getExprValue(e.Else, columnIndex, columnNames, rowidColName, values, rowid)
+		}
+		return nil
+	case *sqlparser.FuncExpr:
+		args := make([]interface{}, 0, len(e.Exprs))
+		for _, arg := range e.Exprs {
+			aliased, ok := arg.(*sqlparser.AliasedExpr)
+			if !ok {
+				raiseEvalError("Unsupported argument to %s()", e.Name.String())
+			}
+			args = append(args, getExprValue(aliased.Expr, columnIndex, columnNames, rowidColName, values, rowid))
+		}
+		v, err := callScalarFunction(e.Name.Lowered(), args)
+		if err != nil {
+			panic(evalError{err})
+		}
+		return v
+	case *sqlparser.SubstrExpr:
+		args := []interface{}{
+			getExprValue(e.Name, columnIndex, columnNames, rowidColName, values, rowid),
+			getExprValue(e.From, columnIndex, columnNames, rowidColName, values, rowid),
+		}
+		if e.To != nil {
+			args = append(args, getExprValue(e.To, columnIndex, columnNames, rowidColName, values, rowid))
+		}
+		v, _ := callScalarFunction("substr", args)
+		return v
+	case *sqlparser.ConvertExpr:
+		v := getExprValue(e.Expr, columnIndex, columnNames, rowidColName, values, rowid)
+		return castValue(v, e.Type.Type)
 	default:
-		log.Fatalf("Unsupported expression type in WHERE: %T", expr)
+		raiseEvalError("Unsupported expression type in WHERE: %T", expr)
+		return nil
+	}
+}
+
+// The names SQLite accepts for a table's implicit rowid column
+func isRowidName(name string) bool {
+	switch strings.ToLower(name) {
+	case "rowid", "oid", "_rowid_":
+		return true
+	}
+	return false
+}
+
+// Applies an arithmetic, bitwise or concatenation operator. "^" stands for
+// SQLite's || after prepareSQL rewrites it for the parser.
+func evaluateBinary(operator string, left, right interface{}) interface{} {
+	if left == nil || right == nil {
+		return nil
+	}
+	if operator == sqlparser.BitXorStr {
+		return formatValue(left) + formatValue(right)
+	}
+	li, lf, lInt := toNumber(left)
+	ri, rf, rInt := toNumber(right)
+	switch operator {
+	case sqlparser.BitAndStr:
+		return li & ri
+	case sqlparser.BitOrStr:
+		return li | ri
+	case sqlparser.ShiftLeftStr:
+		return li << uint64(ri)
+	case sqlparser.ShiftRightStr:
+		return li >> uint64(ri)
+	}
+	if lInt && rInt {
+		switch operator {
+		case sqlparser.PlusStr:
+			if sum := li + ri; (sum > li) == (ri > 0) {
+				return sum
+			}
+		case sqlparser.MinusStr:
+			if diff := li - ri; (diff < li) == (ri > 0) {
+				return diff
+			}
+		case sqlparser.MultStr:
+			if li == 0 || ri == 0 {
+				return int64(0)
+			}
+			if product := li * ri; product/ri == li && !(li == -1 && ri == math.MinInt64) {
+				return product
+			}
+		case sqlparser.DivStr, sqlparser.IntDivStr:
+			if ri == 0 {
+				return nil
+			}
+			return li / ri
+		case sqlparser.ModStr:
+			if ri == 0 {
+				return nil
+			}
+			return li % ri
+		}
+	}
+	switch operator {
+	case sqlparser.PlusStr:
+		return lf + rf
+	case sqlparser.MinusStr:
+		return lf - rf
+	case sqlparser.MultStr:
+		return lf * rf
+	case sqlparser.DivStr, sqlparser.IntDivStr:
+		if rf == 0 {
+			return nil
+		}
+		return lf / rf
+	case sqlparser.ModStr:
+		if int64(rf) == 0 {
+			return nil
+		}
+		return float64(int64(lf) % int64(rf))
+	}
+	raiseEvalError("Unsupported operator: %s", operator)
+	return nil
+}
+
+// Converts a value for CAST, mapping the MySQL type names the parser
+// accepts onto SQLite storage classes
+func castValue(v interface{}, typeName string) interface{} {
+	if v == nil {
 		return nil
 	}
+	switch strings.ToLower(typeName) {
+	case "signed", "unsigned", "signed integer", "unsigned integer":
+		i, f, isInt := toNumber(v)
+		if !isInt {
+			return int64(f)
+		}
+		return i
+	case "char", "nchar":
+		return formatValue(v)
+	case "binary":
+		return []byte(formatValue(v))
+	default:
+		i, f, isInt := toNumber(v)
+		if isInt {
+			return i
+		}
+		return f
+	}
+}
+
+// columnCollation marks a column reference with the collation its table
+// declares for it. Unlike a COLLATE clause it yields to the collation of
+// the other operand when that one has a COLLATE clause.
+type columnCollation struct {
+	*sqlparser.CollateExpr
+}
+
+// The collation a comparison uses: a COLLATE clause on the left operand,
+// else one on the right, else that of a column on the left, then the right
+func comparisonCollation(left, right sqlparser.Expr) string {
+	for _, explicit := range []bool{true, false} {
+		for _, operand := range []sqlparser.Expr{left, right} {
+			if collation, ok := operandCollation(operand, explicit); ok {
+				return collation
+			}
+		}
+	}
+	return ""
+}
+
+func operandCollation(expr sqlparser.Expr, explicit bool) (string, bool) {
+	switch e := expr.(type) {
+	case *sqlparser.ParenExpr:
+		return operandCollation(e.Expr, explicit)
+	case *sqlparser.CollateExpr:
+		return e.Charset, explicit
+	case *columnCollation:
+		return e.Charset, !explicit
+	}
+	return "", false
+}
+
+// Compares two values, text against text by the given collation
+func compareCollated(left, right interface{}, collation string) int {
+	if l, ok := left.(string); ok {
+		if r, ok := right.(string); ok {
+			return compareText(l, r, collation)
+		}
+	}
+	return compareValues(left, right)
 }
 
 func compareValues(left, right interface{}) int {
@@ -114,12 +542,17 @@ func compareValues(left, right interface{}) int {
 		return 1
 	}
 
+	// Two text values always compare as text, even when they look numeric
+	if l, ok := left.(string); ok {
+		if r, ok := right.(string); ok {
+			return strings.Compare(l, r)
+		}
+	}
+
 	// Convert both values to strings for comparison
 	leftStr := valueToString(left)
 	rightStr := valueToString(right)
 
-	//fmt.Printf("    String comparison: '%s' vs '%s'\n", leftStr, rightStr)
-
 	// Try numeric comparison first
 	if leftNum, leftErr := strconv.ParseFloat(leftStr, 64); leftErr == nil {
 		if rightNum, rightErr := strconv.ParseFloat(rightStr, 64); rightErr == nil {
@@ -135,7 +568,6 @@ func compareValues(left, right interface{}) int {
 
 	// Fall back to string comparison
 	result := strings.Compare(leftStr, rightStr)
-	//fmt.Printf("    Final string comparison result: %d\n", result)
 	return result
 }
 
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+)
+
+// Number of payload bytes a cell keeps on its own page; the rest goes to a
+// chain of overflow pages. Index cells keep less so several fit per page.
+func cellLocalSize(payloadSize int, pageSize int, isIndex bool) int {
+	usable := pageSize
+	maxLocal := usable - 35
+	if isIndex {
+		maxLocal = (usable-12)*64/255 - 23
+	}
+	if payloadSize <= maxLocal {
+		return payloadSize
+	}
+	minLocal := (usable-12)*32/255 - 23
+	local := minLocal + (payloadSize-minLocal)%(usable-4)
+	if local > maxLocal {
+		local = minLocal
+	}
+	return local
+}
+
+// Reads a cell's payload that starts at offset in pageData, following the
+// overflow chain for the part that does not fit on the page
+func readCellPayload(databaseFile io.ReaderAt, pageData []byte, offset int, payloadSize int, pageSize int, isIndex bool) []byte {
+	local := cellLocalSize(payloadSize, pageSize, isIndex)
+	if offset+local > len(pageData) {
+		log.Fatalf("Cell payload runs past the end of the page: need %d bytes at offset %d", local, offset)
+	}
+	payload := make([]byte, 0, payloadSize)
+	payload = append(payload, pageData[offset:offset+local]...)
+	if local == payloadSize {
+		return payload
+	}
+
+	// Each overflow page starts with the number of the next one
+	next := binary.BigEndian.Uint32(pageData[offset+local:])
+	overflowPage := make([]byte, pageSize)
+	for next != 0 && len(payload) < payloadSize {
+		if _, err := databaseFile.ReadAt(overflowPage, int64(next-1)*int64(pageSize)); err != nil {
+			log.Fatalf("Error reading overflow page %d: %v", next, err)
+		}
+		chunk := overflowPage[4:]
+		if remaining := payloadSize - len(payload); remaining < len(chunk) {
+			chunk = chunk[:remaining]
+		}
+		payload = append(payload, chunk...)
+		next = binary.BigEndian.Uint32(overflowPage)
+	}
+	if len(payload) < payloadSize {
+		log.Fatalf("Overflow chain ended early: read %d of %d payload bytes", len(payload), payloadSize)
+	}
+	return payload
+}
+
+// Like readCellPayload for a cell read with readNode, but returns an error
+// for an overflow chain that leaves the file or ends early
+func (p *pager) cellPayload(cell []byte, offset int, payloadSize int, isIndex bool) ([]byte, error) {
+	local := cellLocalSize(payloadSize, p.pageSize, isIndex)
+	payload := make([]byte, 0, payloadSize)
+	payload = append(payload, cell[offset:offset+local]...)
+	if local == payloadSize {
+		return payload, nil
+	}
+	next := int(binary.BigEndian.Uint32(cell[offset+local:]))
+	for len(payload) < payloadSize {
+		if next < 2 || next > p.pageCount {
+			return nil, fmt.Errorf("database disk image is malformed: overflow page %d out of range", next)
+		}
+		data, err := p.page(next)
+		if err != nil {
+			return nil, err
+		}
+		chunk := data[4:]
+		if remaining := payloadSize - len(payload); remaining < len(chunk) {
+			chunk = chunk[:remaining]
+		}
+		payload = append(payload, chunk...)
+		next = int(binary.BigEndian.Uint32(data))
+	}
+	return payload, nil
+}
+
+// Offset of the b-tree page header; page 1 starts with the file header
+func pageHeaderOffset(pageNum int) int64 {
+	if pageNum == 1 {
+		return 100
+	}
+	return 0
+}
@@ -9,21 +9,6 @@ type Record struct {
 	values []interface{}
 }
 
-func parserRecord(stream io.Reader, valuesCount int) Record {
-	parseVarint(stream)
-
-	serialTypes := make([]int, valuesCount)
-	for i := 0; i < valuesCount; i++ {
-		serialTypes[i] = parseVarint(stream)
-	}
-
-	values := make([]interface{}, valuesCount)
-	for i, serialType := range serialTypes {
-		values[i] = parseRecordValue(stream, serialType)
-	}
-	return Record{values: values}
-}
-
 func parserRecordDynamic(stream io.Reader) Record {
 	headerLen, consumed := parseVarintWithLen(stream)
 
@@ -86,7 +71,7 @@ func parseRecordValue(stream io.Reader, serialType int) interface{} {
 			bytesCount := (serialType - 13) / 2
 			value := make([]byte, bytesCount)
 			_, _ = stream.Read(value)
-			return value
+			return string(value)
 		} else {
 			log.Fatalf("Unsupported serial type: %d", serialType)
 			return nil
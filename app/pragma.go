@@ -0,0 +1,352 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// pragmaFunc computes the rows of a pragma for its argument values
+type pragmaFunc func(db *database, args []interface{}) (*resultSet, error)
+
+// Returns the pragma that produces rows under the given name; each is
+// also available as the table-valued function pragma_<name>(...) in FROM
+func lookupPragma(name string) (pragmaFunc, bool) {
+	switch strings.ToLower(name) {
+	case "table_info", "table_xinfo":
+		extended := strings.EqualFold(name, "table_xinfo")
+		return func(db *database, args []interface{}) (*resultSet, error) {
+			return pragmaTableInfo(db, args, extended)
+		}, true
+	case "index_list":
+		return pragmaIndexList, true
+	case "index_info", "index_xinfo":
+		extended := strings.EqualFold(name, "index_xinfo")
+		return func(db *database, args []interface{}) (*resultSet, error) {
+			return pragmaIndexInfo(db, args, extended)
+		}, true
+	case "foreign_key_list":
+		return pragmaForeignKeyList, true
+	case "foreign_key_check":
+		return pragmaForeignKeyCheck, true
+	case "foreign_keys":
+		return pragmaForeignKeys, true
+	case "recursive_triggers":
+		return pragmaRecursiveTriggers, true
+	case "journal_mode":
+		return pragmaJournalMode, true
+	case "wal_checkpoint":
+		return pragmaWalCheckpoint, true
+	case "integrity_check":
+		return pragmaIntegrityCheck, true
+	case "quick_check":
+		return pragmaQuickCheck, true
+	}
+	return nil, false
+}
+
+// Runs PRAGMA [schema.]name, PRAGMA name = value or PRAGMA name(value).
+// Unknown pragmas are ignored, as SQLite does.
+func executePragma(db *database, sql string) (*resultSet, error) {
+	s, err := newTokenStream(sql)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.expectKeyword("PRAGMA"); err != nil {
+		return nil, err
+	}
+	name, err := s.expectQualifiedName()
+	if err != nil {
+		return nil, err
+	}
+
+	var args []interface{}
+	switch {
+	case s.acceptPunct("="):
+		v, err := pragmaValue(s)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, v)
+	case s.acceptPunct("("):
+		v, err := pragmaValue(s)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, v)
+		if err := s.expectPunct(")"); err != nil {
+			return nil, err
+		}
+	}
+	s.acceptPunct(";")
+	if !s.atEnd() {
+		return nil, s.syntaxError()
+	}
+
+	fn, ok := lookupPragma(name)
+	if !ok {
+		return &resultSet{}, nil
+	}
+	return fn(db, args)
+}
+
+// Reads a pragma argument: a name, string or optionally signed number
+func pragmaValue(s *tokenStream) (interface{}, error) {
+	sign := ""
+	if s.atPunct("-") || s.atPunct("+") {
+		sign = s.next().text
+	}
+	t := s.next()
+	switch t.kind {
+	case tokNumber:
+		return numericLiteral(t.text, sign == "-"), nil
+	case tokIdent, tokString:
+		if sign == "" {
+			return t.value, nil
+		}
+	}
+	return nil, fmt.Errorf("near \"%s\": syntax error", t.text)
+}
+
+// Name of the table-valued function form, e.g. "table_info" for
+// "pragma_table_info"
+func pragmaFunctionName(name string) (string, bool) {
+	lower := strings.ToLower(name)
+	if !strings.HasPrefix(lower, "pragma_") {
+		return "", false
+	}
+	_, ok := lookupPragma(lower[len("pragma_"):])
+	return lower[len("pragma_"):], ok
+}
+
+// Looks up the CREATE TABLE of a table named by a pragma argument
+func pragmaTableDef(db *database, args []interface{}) *tableDef {
+	if len(args) == 0 || args[0] == nil {
+		return nil
+	}
+	row := db.findSchemaRow("table", formatValue(args[0]))
+	if row == nil {
+		return nil
+	}
+	def, err := parseCreateTable(row.sql)
+	if err != nil {
+		return nil
+	}
+	return def
+}
+
+func pragmaTableInfo(db *database, args []interface{}, extended bool) (*resultSet, error) {
+	rs := &resultSet{columns: []string{"cid", "name", "type", "notnull", "dflt_value", "pk"}}
+	if extended {
+		rs.columns = append(rs.columns, "hidden")
+	}
+	if len(args) > 0 && args[0] != nil {
+		if row := db.findSchemaRow("view", formatValue(args[0])); row != nil {
+			return viewTableInfo(db, row, rs, extended)
+		}
+	}
+	def := pragmaTableDef(db, args)
+	if def == nil {
+		return rs, nil
+	}
+
+	for _, col := range def.columns {
+		hidden := int64(0)
+		if col.generated != "" {
+			hidden = 2
+			if col.generatedStored {
+				hidden = 3
+			}
+		}
+		if hidden != 0 && !extended {
+			continue
+		}
+		var dflt interface{}
+		if col.hasDefault {
+			dflt = col.defaultExpr
+		}
+		pk := int64(0)
+		for i, key := range def.primaryKey {
+			if strings.EqualFold(key.name, col.name) {
+				pk = int64(i + 1)
+			}
+		}
+		// SQLite upper-cases the type names that STRICT tables allow
+		declType := col.declType
+		switch strings.ToUpper(declType) {
+		case "INT", "INTEGER", "REAL", "TEXT", "BLOB", "ANY":
+			declType = strings.ToUpper(declType)
+		}
+		row := []interface{}{int64(len(rs.rows)), col.name, declType, boolValue(col.notNull), dflt, pk}
+		if extended {
+			row = append(row, hidden)
+		}
+		rs.rows = append(rs.rows, row)
+	}
+	return rs, nil
+}
+
+// A view's columns are the names its SELECT produces
+func viewTableInfo(db *database, row *SQLiteSchemaRow, rs *resultSet, extended bool) (*resultSet, error) {
+	rel, err := loadViewRelation(db, row, row.name)
+	if err != nil {
+		return nil, err
+	}
+	for _, col := range rel.columns {
+		info := []interface{}{int64(len(rs.rows)), col.name, "", int64(0), nil, int64(0)}
+		if extended {
+			info = append(info, int64(0))
+		}
+		rs.rows = append(rs.rows, info)
+	}
+	return rs, nil
+}
+
+// autoIndex is an index SQLite creates for a PRIMARY KEY or UNIQUE constraint
+type autoIndex struct {
+	origin   string // "pk" or "u"
+	columns  []indexedColumn
+	conflict string // the constraint's ON CONFLICT resolution
+}
+
+// Returns the constraint indexes in declaration order, which is the order
+// of their sqlite_autoindex_<table>_<N> names
+func (t *tableDef) autoIndexes() []autoIndex {
+	var indexes []autoIndex
+	for i := 0; i <= len(t.uniques); i++ {
+		if i == t.pkPosition && t.primaryKey != nil && t.rowidColumn() < 0 {
+			indexes = append(indexes, autoIndex{origin: "pk", columns: t.primaryKey, conflict: t.pkConflict})
+		}
+		if i < len(t.uniques) {
+			indexes = append(indexes, autoIndex{origin: "u", columns: t.uniques[i].columns, conflict: t.uniques[i].conflict})
+		}
+	}
+	return indexes
+}
+
+func pragmaIndexList(db *database, args []interface{}) (*resultSet, error) {
+	rs := &resultSet{columns: []string{"seq", "name", "unique", "origin", "partial"}}
+	if len(args) == 0 || args[0] == nil {
+		return rs, nil
+	}
+	tableName := formatValue(args[0])
+
+	// Most recently created first
+	for i := len(db.schema) - 1; i >= 0; i-- {
+		row := db.schema[i]
+		if row._type != "index" || !strings.EqualFold(row.tblName, tableName) {
+			continue
+		}
+		_, def, origin := db.lookupIndex(row.name)
+		if def == nil {
+			continue
+		}
+		rs.rows = append(rs.rows, []interface{}{int64(len(rs.rows)), row.name, boolValue(def.unique), origin, boolValue(def.where != "")})
+	}
+	return rs, nil
+}
+
+func pragmaIndexInfo(db *database, args []interface{}, extended bool) (*resultSet, error) {
+	rs := &resultSet{columns: []string{"seqno", "cid", "name"}}
+	if extended {
+		rs.columns = append(rs.columns, "desc", "coll", "key")
+	}
+	if len(args) == 0 || args[0] == nil {
+		return rs, nil
+	}
+	table, def, _ := db.lookupIndex(formatValue(args[0]))
+	if def == nil {
+		return rs, nil
+	}
+
+	for _, col := range def.columns {
+		var cid int64 = -2 // expression
+		var name interface{}
+		collation := col.collation
+		if i := table.columnIndex(col.name); i >= 0 {
+			cid, name = int64(i), table.columns[i].name
+			if collation == "" {
+				collation = table.columns[i].collation
+			}
+		} else if isRowidName(col.name) {
+			cid = -1
+		}
+		if collation == "" {
+			collation = "BINARY"
+		}
+		row := []interface{}{int64(len(rs.rows)), cid, name}
+		if extended {
+			row = append(row, boolValue(col.desc), collation, int64(1))
+		}
+		rs.rows = append(rs.rows, row)
+	}
+	if extended {
+		rs.rows = append(rs.rows, []interface{}{int64(len(rs.rows)), int64(-1), nil, int64(0), "BINARY", int64(0)})
+	}
+	return rs, nil
+}
+
+func pragmaForeignKeyList(db *database, args []interface{}) (*resultSet, error) {
+	rs := &resultSet{columns: []string{"id", "seq", "table", "from", "to", "on_update", "on_delete", "match"}}
+	def := pragmaTableDef(db, args)
+	if def == nil {
+		return rs, nil
+	}
+
+	// Constraints are numbered from the last one declared
+	for id := 0; id < len(def.foreignKeys); id++ {
+		fk := def.foreignKeys[len(def.foreignKeys)-1-id]
+		for seq, from := range fk.columns {
+			var to interface{}
+			if seq < len(fk.parentCols) {
+				to = fk.parentCols[seq]
+			}
+			rs.rows = append(rs.rows, []interface{}{int64(id), int64(seq), fk.table, from, to, fk.onUpdate, fk.onDelete, "NONE"})
+		}
+	}
+	return rs, nil
+}
+
+// Reports the journal mode, first switching to the given one if it is
+// known. Unknown modes leave it unchanged.
+func pragmaJournalMode(db *database, args []interface{}) (*resultSet, error) {
+	if len(args) > 0 {
+		mode := strings.ToLower(formatValue(args[0]))
+		for _, known := range append(journalModes, "wal") {
+			if mode == known {
+				if err := db.file.setJournalMode(mode); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return &resultSet{columns: []string{"journal_mode"}, rows: [][]interface{}{{db.file.journalMode}}}, nil
+}
+
+// Checkpoints the write-ahead log in PASSIVE, FULL, RESTART or TRUNCATE
+// mode. Nothing waits for other connections: busy reports a checkpoint
+// they kept from finishing.
+func pragmaWalCheckpoint(db *database, args []interface{}) (*resultSet, error) {
+	mode := "PASSIVE"
+	if len(args) > 0 {
+		mode = strings.ToUpper(formatValue(args[0]))
+	}
+	busy, frames, backfilled, err := db.file.checkpoint(mode)
+	if err != nil {
+		return nil, err
+	}
+	return &resultSet{
+		columns: []string{"busy", "log", "checkpointed"},
+		rows:    [][]interface{}{{boolValue(busy), int64(frames), int64(backfilled)}},
+	}, nil
+}
+
+// Reads the value of a pragma that is on or off
+func pragmaFlag(v interface{}) bool {
+	switch strings.ToLower(formatValue(v)) {
+	case "on", "yes", "true":
+		return true
+	case "off", "no", "false":
+		return false
+	}
+	return isTrue(v)
+}
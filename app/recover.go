@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A row salvaged from a table b-tree leaf page, with as many of its fields
+// as could be decoded
+type recoveredRow struct {
+	page   int
+	rowid  int64
+	values []interface{}
+}
+
+// recovery reads what it can of a damaged database. Every page is looked
+// at on its own, so a bad pointer or page only loses the rows it holds:
+// interior table pages tell which page hangs below which, so each leaf
+// can be traced up to the root of its table, and the cells of the leaves
+// are decoded with every offset and length checked.
+type recovery struct {
+	p      *pager
+	parent map[int]int // page to the interior page pointing at it
+	leaves map[int][]recoveredRow
+}
+
+// Prints the SQL text of a new database holding all the rows that can be
+// read from this one. Rows of leaf pages that lead to no known table go to
+// a lost_and_found table, with the page, field count and rowid of each.
+func (sh *shell) recover(args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("Usage: .recover")
+	}
+	r := &recovery{p: sh.db.file, parent: make(map[int]int), leaves: make(map[int][]recoveredRow)}
+	for pageNum := 1; pageNum <= r.p.pageCount; pageNum++ {
+		r.scanPage(pageNum)
+	}
+
+	schema := r.schema()
+	if len(schema) == 0 {
+		schema = sh.db.schema
+	}
+	tables := make(map[int]*SQLiteSchemaRow)
+	for i := range schema {
+		row := &schema[i]
+		if row._type == "table" && row.rootPage > 1 {
+			tables[row.rootPage] = row
+		}
+	}
+
+	// Gather the rows of each table, and those of pages no table claims
+	rows := make(map[int][]recoveredRow)
+	var lost []recoveredRow
+	pages := make([]int, 0, len(r.leaves))
+	for pageNum := range r.leaves {
+		pages = append(pages, pageNum)
+	}
+	sort.Ints(pages)
+	for _, pageNum := range pages {
+		root := r.root(pageNum)
+		switch {
+		case root == 1:
+		case tables[root] != nil:
+			rows[root] = append(rows[root], r.leaves[pageNum]...)
+		default:
+			lost = append(lost, r.leaves[pageNum]...)
+		}
+	}
+
+	w := bufio.NewWriter(os.Stdout)
+	defer w.Flush()
+	w.WriteString("BEGIN;\n")
+	for _, row := range schema {
+		if row._type == "table" && row.sql != "" && !isSystemName(row.name) {
+			fmt.Fprintf(w, "%s;\n", row.sql)
+		}
+	}
+	for _, row := range schema {
+		if row._type != "table" || row.sql == "" || strings.HasPrefix(row.name, "sqlite_stat") {
+			continue
+		}
+		tableRows := rows[row.rootPage]
+		sort.SliceStable(tableRows, func(i, j int) bool { return tableRows[i].rowid < tableRows[j].rowid })
+		for _, tableRow := range tableRows {
+			if stmt, ok := recoveredInsert(row, tableRow); ok {
+				fmt.Fprintf(w, "%s;\n", stmt)
+			} else {
+				lost = append(lost, tableRow)
+			}
+		}
+	}
+	for _, row := range schema {
+		if row._type != "table" && row.sql != "" {
+			fmt.Fprintf(w, "%s;\n", row.sql)
+		}
+	}
+	writeLostAndFound(w, schema, lost, r)
+	w.WriteString("COMMIT;\n")
+	return nil
+}
+
+// Notes what a page holds: the children of an interior table page, or the
+// rows of a table leaf page. Any other page is passed over.
+func (r *recovery) scanPage(pageNum int) {
+	data, err := r.p.page(pageNum)
+	if err != nil {
+		return
+	}
+	h := int(pageHeaderOffset(pageNum))
+	if len(data) < h+12 {
+		return
+	}
+	pointers := r.cellPointers(data, h)
+	switch data[h] {
+	case 0x05:
+		children := []int{int(binary.BigEndian.Uint32(data[h+8:]))}
+		for _, ptr := range pointers {
+			if ptr+4 <= len(data) {
+				children = append(children, int(binary.BigEndian.Uint32(data[ptr:])))
+			}
+		}
+		for _, child := range children {
+			if child > 1 && child <= r.p.pageCount && child != pageNum {
+				if _, ok := r.parent[child]; !ok {
+					r.parent[child] = pageNum
+				}
+			}
+		}
+	case 0x0D:
+		for _, ptr := range pointers {
+			if row, ok := r.leafCell(data, ptr); ok {
+				row.page = pageNum
+				r.leaves[pageNum] = append(r.leaves[pageNum], row)
+			}
+		}
+	}
+}
+
+// The cell offsets of a page that point inside it, past its header
+func (r *recovery) cellPointers(data []byte, h int) []int {
+	headerSize := 8
+	if data[h] == 0x05 || data[h] == 0x02 {
+		headerSize = 12
+	}
+	count := int(binary.BigEndian.Uint16(data[h+3:]))
+	start := h + headerSize
+	count = min(count, (len(data)-start)/2)
+	var pointers []int
+	for i := 0; i < count; i++ {
+		ptr := int(binary.BigEndian.Uint16(data[start+2*i:]))
+		if ptr >= start+2*count && ptr < len(data) {
+			pointers = append(pointers, ptr)
+		}
+	}
+	return pointers
+}
+
+// Decodes a table leaf cell, reading as much of an overflowing payload as
+// its chain of overflow pages still gives
+func (r *recovery) leafCell(data []byte, ptr int) (recoveredRow, bool) {
+	payloadSize, n := decodeVarint(data[ptr:])
+	rowid, m := decodeVarint(data[ptr+n:])
+	start := ptr + n + m
+	if payloadSize > uint64(r.p.pageCount)*uint64(r.p.pageSize) || start > len(data) {
+		return recoveredRow{}, false
+	}
+	size := int(payloadSize)
+	local := cellLocalSize(size, r.p.pageSize, false)
+	payload := append([]byte(nil), data[start:min(start+local, len(data))]...)
+	if local < size && start+local+4 <= len(data) {
+		next := int(binary.BigEndian.Uint32(data[start+local:]))
+		seen := make(map[int]bool)
+		for next > 1 && next <= r.p.pageCount && !seen[next] && len(payload) < size {
+			seen[next] = true
+			overflow, err := r.p.page(next)
+			if err != nil || len(overflow) < 4 {
+				break
+			}
+			payload = append(payload, overflow[4:min(len(overflow), 4+size-len(payload))]...)
+			next = int(binary.BigEndian.Uint32(overflow))
+		}
+	}
+	values := decodeRecoveredRecord(payload)
+	if len(values) == 0 {
+		return recoveredRow{}, false
+	}
+	return recoveredRow{rowid: int64(rowid), values: values}, true
+}
+
+// Decodes the fields of a record up to the first that is cut off or has
+// a serial type that cannot be
+func decodeRecoveredRecord(payload []byte) []interface{} {
+	headerSize, n := decodeVarint(payload)
+	if headerSize > uint64(len(payload)) || int(headerSize) < n {
+		return nil
+	}
+	var values []interface{}
+	body := int(headerSize)
+	for pos := n; pos < int(headerSize); {
+		serialType, k := decodeVarint(payload[pos:int(headerSize)])
+		pos += k
+		size, ok := serialTypeSize(serialType)
+		if !ok || body+size > len(payload) {
+			break
+		}
+		values = append(values, parseRecordValue(bytes.NewReader(payload[body:body+size]), int(serialType)))
+		body += size
+	}
+	return values
+}
+
+// The number of body bytes a serial type takes, or false for the types
+// that are not used
+func serialTypeSize(serialType uint64) (int, bool) {
+	switch {
+	case serialType <= 4:
+		return int(serialType), true
+	case serialType == 5:
+		return 6, true
+	case serialType == 6 || serialType == 7:
+		return 8, true
+	case serialType == 8 || serialType == 9:
+		return 0, true
+	case serialType >= 12 && serialType < 1<<31:
+		return int(serialType-12) / 2, true
+	}
+	return 0, false
+}
+
+// Follows the interior pages above a page up to the top one, the root of
+// its b-tree as far as can be told
+func (r *recovery) root(pageNum int) int {
+	seen := map[int]bool{pageNum: true}
+	for {
+		parent, ok := r.parent[pageNum]
+		if !ok || seen[parent] {
+			return pageNum
+		}
+		seen[parent] = true
+		pageNum = parent
+	}
+}
+
+// The schema rows found on the pages of sqlite_schema, in rowid order
+func (r *recovery) schema() []SQLiteSchemaRow {
+	var found []recoveredRow
+	for pageNum, rows := range r.leaves {
+		if r.root(pageNum) == 1 {
+			found = append(found, rows...)
+		}
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].rowid < found[j].rowid })
+	var schema []SQLiteSchemaRow
+	for _, row := range found {
+		if len(row.values) != 5 {
+			continue
+		}
+		kind, _ := row.values[0].(string)
+		name, _ := row.values[1].(string)
+		tblName, _ := row.values[2].(string)
+		rootPage, _ := normalizeValue(row.values[3]).(int64)
+		sql, _ := row.values[4].(string)
+		switch kind {
+		case "table", "index", "view", "trigger":
+			schema = append(schema, SQLiteSchemaRow{_type: kind, name: name, tblName: tblName, rootPage: int(rootPage), sql: sql, rowid: int(row.rowid)})
+		}
+	}
+	return schema
+}
+
+// Renders a salvaged row as an INSERT into its table, keeping its rowid.
+// A row with more fields than the table has columns does not belong to it.
+func recoveredInsert(table SQLiteSchemaRow, row recoveredRow) (string, bool) {
+	def, err := parseCreateTable(table.sql)
+	if err != nil || def.withoutRowid {
+		return "", false
+	}
+	var stored []columnDef
+	for _, col := range def.columns {
+		if !col.isVirtual() {
+			stored = append(stored, col)
+		}
+	}
+	if len(row.values) > len(stored) {
+		return "", false
+	}
+
+	names := []string{"rowid"}
+	literals := []string{strconv.FormatInt(row.rowid, 10)}
+	for i, col := range stored {
+		if col.generated != "" {
+			continue
+		}
+		if col.isRowid {
+			names[0] = quoteIdentifier(col.name)
+			continue
+		}
+		names = append(names, quoteIdentifier(col.name))
+		if i < len(row.values) {
+			literals = append(literals, sqlLiteral(row.values[i]))
+		} else {
+			literals = append(literals, sqlLiteral(col.defaultValue()))
+		}
+	}
+	return fmt.Sprintf("INSERT OR IGNORE INTO %s(%s) VALUES(%s)", quoteIdentifier(table.name), strings.Join(names, ", "), strings.Join(literals, ", ")), true
+}
+
+// Prints the rows that belong to no table into a table named
+// lost_and_found, or lost_and_found_N if that name is taken
+func writeLostAndFound(w *bufio.Writer, schema []SQLiteSchemaRow, lost []recoveredRow, r *recovery) {
+	if len(lost) == 0 {
+		return
+	}
+	taken := make(map[string]bool)
+	for _, row := range schema {
+		taken[strings.ToLower(row.name)] = true
+	}
+	name := "lost_and_found"
+	for i := 0; taken[name]; i++ {
+		name = fmt.Sprintf("lost_and_found_%d", i)
+	}
+
+	width := 0
+	for _, row := range lost {
+		width = max(width, len(row.values))
+	}
+	columns := []string{"rootpgno INTEGER", "pgno INTEGER", "nfield INTEGER", "id INTEGER"}
+	for i := 0; i < width; i++ {
+		columns = append(columns, fmt.Sprintf("c%d", i))
+	}
+	fmt.Fprintf(w, "CREATE TABLE %s(%s);\n", name, strings.Join(columns, ", "))
+	for _, row := range lost {
+		literals := []string{strconv.Itoa(r.root(row.page)), strconv.Itoa(row.page), strconv.Itoa(len(row.values)), strconv.FormatInt(row.rowid, 10)}
+		for i := 0; i < width; i++ {
+			var v interface{}
+			if i < len(row.values) {
+				v = row.values[i]
+			}
+			literals = append(literals, sqlLiteral(v))
+		}
+		fmt.Fprintf(w, "INSERT INTO %s VALUES(%s);\n", name, strings.Join(literals, ", "))
+	}
+}
@@ -0,0 +1,1523 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/xwb1989/sqlparser"
+)
+
+// resultSet holds the column names and rows produced by a query
+type resultSet struct {
+	columns    []string
+	rows       [][]interface{}
+	collations []string // of the columns that have one, when known
+}
+
+// The collation values of the i-th column compare with
+func (rs *resultSet) collation(i int) string {
+	if i < len(rs.collations) {
+		return rs.collations[i]
+	}
+	return ""
+}
+
+// relation is an intermediate set of rows while evaluating FROM and WHERE
+type relation struct {
+	columns []relationColumn
+	rows    []relationRow
+}
+
+type relationColumn struct {
+	table     string // table name or alias qualifying the column
+	name      string
+	hidden    bool   // right-hand column of a USING join, left out of SELECT *
+	collation string // declared with COLLATE, empty for BINARY
+	outer     bool   // of the enclosing query's row, seen by a correlated subquery
+}
+
+type relationRow struct {
+	values []interface{}
+	rowid  int
+}
+
+// Maps lower-cased "column" and "table.column" names to value positions
+func (r *relation) columnIndex() map[string]int {
+	index := make(map[string]int)
+	for i, col := range r.columns {
+		name := strings.ToLower(col.name)
+		if _, ok := index[name]; !ok {
+			index[name] = i
+		}
+		if col.table != "" {
+			if _, ok := index[strings.ToLower(col.table)+"."+name]; !ok {
+				index[strings.ToLower(col.table)+"."+name] = i
+			}
+		}
+	}
+	return index
+}
+
+// The collation SQLite gives an expression: that of its COLLATE clause,
+// else the declared one of the column it names
+func (r *relation) collationOf(expr sqlparser.Expr) string {
+	switch e := expr.(type) {
+	case *sqlparser.CollateExpr:
+		return e.Charset
+	case *sqlparser.ParenExpr:
+		return r.collationOf(e.Expr)
+	case *sqlparser.ColName:
+		if i, ok := r.columnIndex()[columnKey(e)]; ok {
+			return r.columns[i].collation
+		}
+	}
+	return ""
+}
+
+// Marks the column references of a condition that have a collation, so
+// comparisons with them use it
+func (r *relation) withCollations(expr sqlparser.Expr) sqlparser.Expr {
+	if expr == nil {
+		return nil
+	}
+	var columns []*sqlparser.ColName
+	_ = sqlparser.Walk(func(node sqlparser.SQLNode) (bool, error) {
+		switch n := node.(type) {
+		case *sqlparser.Subquery, *columnCollation:
+			return false, nil
+		case *sqlparser.ColName:
+			if r.collationOf(n) != "" {
+				columns = append(columns, n)
+			}
+		}
+		return true, nil
+	}, expr)
+	for _, col := range columns {
+		marked := &columnCollation{&sqlparser.CollateExpr{Expr: col, Charset: r.collationOf(col)}}
+		expr = sqlparser.ReplaceExpr(expr, col, marked)
+	}
+	return expr
+}
+
+func (r *relation) columnNames() []string {
+	names := make([]string, len(r.columns))
+	for i, col := range r.columns {
+		names[i] = col.name
+	}
+	return names
+}
+
+// Parses and runs a SELECT statement given as SQL text
+func executeQuery(db *database, sql string) (*resultSet, error) {
+	stmt, err := sqlparser.Parse(prepareSQL(sql))
+	if err != nil {
+		return nil, err
+	}
+	sel, ok := stmt.(sqlparser.SelectStatement)
+	if !ok {
+		return nil, fmt.Errorf("not a SELECT statement")
+	}
+	return executeSelect(db, sel, sql)
+}
+
+// Runs a SELECT, UNION or parenthesised select. sqlText is the original
+// statement text, used only to name result columns.
+func executeSelect(db *database, stmt sqlparser.SelectStatement, sqlText string) (rs *resultSet, err error) {
+	defer recoverEvalError(&err)
+
+	switch s := stmt.(type) {
+	case *sqlparser.Select:
+		return executeSimpleSelect(db, s, selectListSpans(sqlText))
+	case *sqlparser.ParenSelect:
+		return executeSelect(db, s.Select, sqlText)
+	case *sqlparser.Union:
+		return executeUnion(db, s, sqlText)
+	}
+	return nil, fmt.Errorf("unsupported SELECT statement")
+}
+
+func executeUnion(db *database, u *sqlparser.Union, sqlText string) (*resultSet, error) {
+	left, err := executeSelect(db, u.Left, sqlText)
+	if err != nil {
+		return nil, err
+	}
+	right, err := executeSelect(db, u.Right, "")
+	if err != nil {
+		return nil, err
+	}
+	if len(left.columns) != len(right.columns) {
+		return nil, fmt.Errorf("SELECTs to the left and right of UNION do not have the same number of result columns")
+	}
+	rs := &resultSet{columns: left.columns, rows: append(left.rows, right.rows...)}
+	// Each column compares with the collation of the left-hand one, else
+	// that of the right-hand one
+	for i := range rs.columns {
+		collation := left.collation(i)
+		if collation == "" {
+			collation = right.collation(i)
+		}
+		rs.collations = append(rs.collations, collation)
+	}
+	if u.Type != sqlparser.UnionAllStr {
+		rs.rows = distinctRows(rs.rows, rs.collations)
+		sortRows(rs.rows, allColumnsOrder(rs))
+	}
+
+	if len(u.OrderBy) > 0 {
+		keys := make([]sortKey, 0, len(u.OrderBy))
+		for _, order := range u.OrderBy {
+			col, ok := outputColumnRef(order.Expr, rs.columns)
+			if !ok {
+				return nil, fmt.Errorf("1st ORDER BY term does not match any column in the result set")
+			}
+			collation := orderCollation(order.Expr)
+			if collation == "" {
+				collation = rs.collation(col)
+			}
+			keys = append(keys, sortKey{column: col, desc: order.Direction == sqlparser.DescScr, collation: collation})
+		}
+		sortRows(rs.rows, keys)
+	}
+	rs.rows, err = applyLimit(rs.rows, u.Limit)
+	return rs, err
+}
+
+// projection is one output column of a SELECT
+type projection struct {
+	name   string
+	expr   sqlparser.Expr // nil when column is set
+	column int            // relation column copied by a * expansion
+}
+
+func executeSimpleSelect(db *database, sel *sqlparser.Select, spans []string) (*resultSet, error) {
+	if err := resolveSubqueries(db, sel); err != nil {
+		return nil, err
+	}
+
+	var where sqlparser.Expr
+	if sel.Where != nil {
+		where = sel.Where.Expr
+	}
+	rel, err := buildFromRelation(db, sel.From, where)
+	if err != nil {
+		return nil, err
+	}
+	rel = db.withOuterColumns(rel)
+	index := rel.columnIndex()
+	names := rel.columnNames()
+
+	// Aggregate calls become references to per-group columns
+	aggregates := collectAggregates(sel)
+	projections, err := selectProjections(sel, rel, spans)
+	if err != nil {
+		return nil, err
+	}
+	where = resolveAliasRefs(where, projections, index)
+	if sel.Having != nil {
+		sel.Having.Expr = resolveAliasRefs(sel.Having.Expr, projections, index)
+	}
+	if err := checkColumns(where, index); err != nil {
+		return nil, err
+	}
+	for _, p := range projections {
+		if err := checkColumns(p.expr, index); err != nil {
+			return nil, err
+		}
+	}
+	correlated := containsSubquery(where)
+	unbound := where
+	where = rel.withCollations(where)
+
+	// Filter rows with WHERE
+	rows := rel.rows
+	if where != nil {
+		filtered := make([]relationRow, 0, len(rows))
+		for _, row := range rows {
+			db.checkInterrupt()
+			cond := where
+			if correlated {
+				if cond, err = db.bindOuterRow(unbound, rel, row); err != nil {
+					return nil, err
+				}
+				cond = rel.withCollations(cond)
+			}
+			if evaluateWhereClause(cond, index, names, "", row.values, row.rowid) {
+				filtered = append(filtered, row)
+			}
+		}
+		rows = filtered
+	}
+
+	// Aggregate queries evaluate against one synthetic row per group
+	if len(aggregates) > 0 || len(sel.GroupBy) > 0 {
+		rows, err = groupRows(sel, rel, rows, index, names, projections, aggregates)
+		if err != nil {
+			return nil, err
+		}
+		for i := range aggregates {
+			index[aggregateColumnName(i)] = len(rel.columns) + i
+		}
+		if sel.Having != nil {
+			correlated := containsSubquery(sel.Having.Expr)
+			unbound := sel.Having.Expr
+			having := rel.withCollations(sel.Having.Expr)
+			filtered := rows[:0]
+			for _, row := range rows {
+				cond := having
+				if correlated {
+					if cond, err = db.bindOuterRow(unbound, rel, row); err != nil {
+						return nil, err
+					}
+					cond = rel.withCollations(cond)
+				}
+				if evaluateWhereClause(cond, index, names, "", row.values, row.rowid) {
+					filtered = append(filtered, row)
+				}
+			}
+			rows = filtered
+		}
+	} else if sel.Having != nil {
+		return nil, fmt.Errorf("a GROUP BY clause is required before HAVING")
+	}
+
+	rs := &resultSet{}
+	for _, p := range projections {
+		rs.columns = append(rs.columns, p.name)
+		if p.expr == nil {
+			rs.collations = append(rs.collations, rel.columns[p.column].collation)
+		} else {
+			rs.collations = append(rs.collations, rel.collationOf(p.expr))
+		}
+	}
+	correlatedColumns := make([]bool, len(projections))
+	for i, p := range projections {
+		correlatedColumns[i] = containsSubquery(p.expr)
+	}
+	for _, row := range rows {
+		out := make([]interface{}, len(projections))
+		for i, p := range projections {
+			expr := p.expr
+			if correlatedColumns[i] {
+				if expr, err = db.bindOuterRow(expr, rel, row); err != nil {
+					return nil, err
+				}
+			}
+			if expr == nil {
+				out[i] = normalizeValue(row.values[p.column])
+			} else {
+				out[i] = getExprValue(expr, index, names, "", row.values, row.rowid)
+			}
+		}
+		rs.rows = append(rs.rows, out)
+	}
+
+	if len(sel.OrderBy) > 0 {
+		if err := orderResult(sel.OrderBy, rs, rows, rel, index, names); err != nil {
+			return nil, err
+		}
+	}
+	if sel.Distinct != "" {
+		rs.rows = distinctRows(rs.rows, rs.collations)
+	}
+	rs.rows, err = applyLimit(rs.rows, sel.Limit)
+	return rs, err
+}
+
+// Expands the select list into output columns named like sqlite3 names them:
+// the alias, else the column name, else the expression as written
+func selectProjections(sel *sqlparser.Select, rel *relation, spans []string) ([]projection, error) {
+	var projections []projection
+	for i, selectExpr := range sel.SelectExprs {
+		switch expr := selectExpr.(type) {
+		case *sqlparser.StarExpr:
+			qualifier := expr.TableName.Name.String()
+			matched := false
+			for c, col := range rel.columns {
+				if col.outer {
+					continue
+				}
+				if (qualifier == "" && !col.hidden) || strings.EqualFold(col.table, qualifier) {
+					projections = append(projections, projection{name: col.name, column: c})
+					matched = true
+				}
+			}
+			if qualifier != "" && !matched {
+				return nil, fmt.Errorf("no such table: %s", qualifier)
+			}
+			if qualifier == "" && !matched {
+				return nil, fmt.Errorf("no tables specified")
+			}
+		case *sqlparser.AliasedExpr:
+			p := projection{expr: expr.Expr}
+			switch {
+			case !expr.As.IsEmpty():
+				p.name = expr.As.String()
+			case isColName(expr.Expr) && !strings.HasPrefix(expr.Expr.(*sqlparser.ColName).Name.String(), aggregateColumnPrefix):
+				col := expr.Expr.(*sqlparser.ColName)
+				p.name = col.Name.String()
+				if c, ok := rel.columnIndex()[columnKey(col)]; ok {
+					p.name = rel.columns[c].name
+				}
+			case i < len(spans):
+				p.name = spans[i]
+			default:
+				p.name = sqlparser.String(expr.Expr)
+			}
+			projections = append(projections, p)
+		default:
+			return nil, fmt.Errorf("unsupported SELECT expression: %s", sqlparser.String(selectExpr))
+		}
+	}
+	return projections, nil
+}
+
+// Replaces references to result column aliases, which SQLite allows in
+// WHERE and HAVING when no source column has that name
+func resolveAliasRefs(expr sqlparser.Expr, projections []projection, index map[string]int) sqlparser.Expr {
+	if expr == nil {
+		return nil
+	}
+	type replacement struct{ from, to sqlparser.Expr }
+	var replacements []replacement
+	_ = sqlparser.Walk(func(node sqlparser.SQLNode) (bool, error) {
+		switch n := node.(type) {
+		case *sqlparser.Subquery:
+			return false, nil
+		case *sqlparser.ColName:
+			if !n.Qualifier.IsEmpty() || isRowidName(n.Name.String()) {
+				return false, nil
+			}
+			if _, ok := index[columnKey(n)]; ok {
+				return false, nil
+			}
+			for _, p := range projections {
+				if p.expr != nil && strings.EqualFold(p.name, n.Name.String()) {
+					replacements = append(replacements, replacement{n, p.expr})
+					break
+				}
+			}
+		}
+		return true, nil
+	}, expr)
+	for _, r := range replacements {
+		expr = sqlparser.ReplaceExpr(expr, r.from, r.to)
+	}
+	return expr
+}
+
+func isColName(expr sqlparser.Expr) bool {
+	_, ok := expr.(*sqlparser.ColName)
+	return ok
+}
+
+// The columnIndex key for a column reference
+func columnKey(col *sqlparser.ColName) string {
+	key := strings.ToLower(col.Name.String())
+	if !col.Qualifier.IsEmpty() {
+		key = strings.ToLower(col.Qualifier.Name.String()) + "." + key
+	}
+	return key
+}
+
+// Reports references to columns the relation does not have
+func checkColumns(expr sqlparser.Expr, index map[string]int) error {
+	if expr == nil {
+		return nil
+	}
+	return sqlparser.Walk(func(node sqlparser.SQLNode) (bool, error) {
+		switch n := node.(type) {
+		case *sqlparser.Subquery:
+			return false, nil
+		case *sqlparser.ColName:
+			if _, ok := index[columnKey(n)]; ok || isRowidName(n.Name.String()) {
+				return false, nil
+			}
+			if strings.HasPrefix(n.Name.String(), aggregateColumnPrefix) {
+				return false, nil
+			}
+			if !n.Qualifier.IsEmpty() {
+				return false, fmt.Errorf("no such column: %s.%s", n.Qualifier.Name.String(), n.Name.String())
+			}
+			return false, fmt.Errorf("no such column: %s", n.Name.String())
+		}
+		return true, nil
+	}, expr)
+}
+
+// Builds the relation for a FROM clause; comma-separated tables are joined
+// as a cross product
+func buildFromRelation(db *database, from sqlparser.TableExprs, where sqlparser.Expr) (*relation, error) {
+	var result *relation
+	for _, tableExpr := range from {
+		if fn := tableFunctionCall(tableExpr); fn != nil && result != nil {
+			// Arguments may refer to the tables to its left
+			rel, err := fn.lateralJoin(db, result, nil, false)
+			if err != nil {
+				return nil, err
+			}
+			result = rel
+			continue
+		}
+		var hint sqlparser.Expr
+		if len(from) == 1 {
+			hint = where
+		}
+		rel, err := tableExprRelation(db, tableExpr, hint)
+		if err != nil {
+			return nil, err
+		}
+		if result == nil {
+			result = rel
+		} else {
+			result = joinRelations(result, rel, nil, false)
+		}
+	}
+	return result, nil
+}
+
+// Produces the rows of one FROM item. where, when given, may be used to
+// narrow a table scan through an index; it is still applied afterwards.
+func tableExprRelation(db *database, tableExpr sqlparser.TableExpr, where sqlparser.Expr) (*relation, error) {
+	switch te := tableExpr.(type) {
+	case *sqlparser.AliasedTableExpr:
+		alias := te.As.String()
+		switch source := te.Expr.(type) {
+		case sqlparser.TableName:
+			if fn := tableFunctionCall(te); fn != nil {
+				return fn.relation(db, nil, nil, nil, 0)
+			}
+			name := source.Name.String()
+			if alias == "" {
+				alias = name
+			}
+			return namedRelation(db, name, alias, where)
+		case *sqlparser.Subquery:
+			rs, err := executeSelect(db, source.Select, sqlparser.String(source.Select))
+			if err != nil {
+				return nil, err
+			}
+			return resultRelation(rs, alias, nil), nil
+		}
+	case *sqlparser.ParenTableExpr:
+		return buildFromRelation(db, te.Exprs, nil)
+	case *sqlparser.JoinTableExpr:
+		return joinTableRelation(db, te)
+	}
+	return nil, fmt.Errorf("unsupported FROM clause: %s", sqlparser.String(tableExpr))
+}
+
+// Resolves a name in FROM to a table or view
+func namedRelation(db *database, name, alias string, where sqlparser.Expr) (*relation, error) {
+	if row := db.findSchemaRow("table", name); row != nil {
+		return loadTableRelation(db, row, alias, where)
+	}
+	if row := db.findSchemaRow("view", name); row != nil {
+		return loadViewRelation(db, row, alias)
+	}
+	if isSchemaTableName(name) {
+		return loadSchemaRelation(db, name, alias)
+	}
+	if strings.EqualFold(name, "dual") {
+		return &relation{rows: []relationRow{{}}}, nil
+	}
+	return nil, fmt.Errorf("no such table: %s", name)
+}
+
+// Reads a table's rows with values in declared column order; the rowid
+// alias column carries the rowid and virtual columns are computed
+func loadTableRelation(db *database, row *SQLiteSchemaRow, alias string, where sqlparser.Expr) (*relation, error) {
+	def, err := parseCreateTable(row.sql)
+	if err != nil {
+		return nil, err
+	}
+	if def.withoutRowid {
+		return nil, fmt.Errorf("WITHOUT ROWID table %s is not supported", def.name)
+	}
+	layout := newTableLayout(def.columns)
+
+	rel := &relation{}
+	for _, col := range def.columns {
+		rel.columns = append(rel.columns, relationColumn{table: alias, name: col.name, collation: col.collation})
+	}
+	index := rel.columnIndex()
+	names := rel.columnNames()
+
+	var generated []sqlparser.Expr
+	for _, col := range def.columns {
+		var expr sqlparser.Expr
+		if col.generated != "" {
+			if expr, err = parseExpression(col.generated); err != nil {
+				return nil, err
+			}
+		}
+		generated = append(generated, expr)
+	}
+
+	tableRows, err := scanTableRows(db, row, def, where)
+	if err != nil {
+		return nil, err
+	}
+	for _, tableRow := range tableRows {
+		db.checkInterrupt()
+		rec := layout.applyDefaults(tableRow.record)
+		values := make([]interface{}, len(def.columns))
+		slot := 0
+		for i, col := range def.columns {
+			if col.isVirtual() {
+				continue
+			}
+			switch {
+			case col.isRowid:
+				values[i] = int64(tableRow.rowid)
+			case slot < len(rec.values):
+				values[i] = normalizeValue(rec.values[slot])
+				// Whole numbers in REAL columns are stored as integers
+				if n, ok := values[i].(int64); ok && col.affinity == "REAL" {
+					values[i] = float64(n)
+				}
+			}
+			slot++
+		}
+		for i, expr := range generated {
+			if expr != nil && def.columns[i].isVirtual() {
+				values[i] = getExprValue(expr, index, names, "", values, tableRow.rowid)
+			}
+		}
+		rel.rows = append(rel.rows, relationRow{values: values, rowid: tableRow.rowid})
+	}
+	return rel, nil
+}
+
+// Returns a table's rows, looking them up by rowid or through an index
+// when the WHERE clause pins a key column to a constant
+func scanTableRows(db *database, row *SQLiteSchemaRow, def *tableDef, where sqlparser.Expr) ([]TableRow, error) {
+	if where != nil {
+		rowidNames := []string{"rowid", "oid", "_rowid_"}
+		if i := def.rowidColumn(); i >= 0 {
+			rowidNames = append(rowidNames, def.columns[i].name)
+		}
+		for _, name := range rowidNames {
+			if v, ok := extractEqualityValue(where, name); ok {
+				if rowid, ok := applyAffinity(v, "INTEGER").(int64); ok {
+					rec, found, err := db.file.tableRow(row.rootPage, rowid)
+					if !found {
+						return nil, err
+					}
+					return []TableRow{{rowid: int(rowid), record: rec}}, nil
+				}
+				return nil, nil
+			}
+		}
+
+		for _, idx := range db.tableIndexes(def.name) {
+			// The search walks keys in ascending order
+			if idx.where != "" || len(idx.columns) == 0 || idx.columns[0].desc {
+				continue
+			}
+			col := def.columnIndex(idx.columns[0].name)
+			if col < 0 {
+				continue
+			}
+			v, ok := extractEqualityValue(where, def.columns[col].name)
+			if !ok {
+				continue
+			}
+			// A bare column compares with its own collation, so only an
+			// index sorted the same way can answer it
+			collation := idx.columns[0].collation
+			if collation == "" {
+				collation = def.columns[col].collation
+			}
+			if !strings.EqualFold(collationOrBinary(collation), collationOrBinary(def.columns[col].collation)) {
+				continue
+			}
+			target := applyAffinity(v, def.columns[col].affinity)
+			rowids, err := db.file.indexRowids(idx.rootPage, target, collation)
+			if err != nil {
+				return nil, err
+			}
+			var rows []TableRow
+			seen := make(map[int64]bool)
+			for _, rowid := range rowids {
+				if seen[rowid] {
+					continue
+				}
+				seen[rowid] = true
+				rec, found, err := db.file.tableRow(row.rootPage, rowid)
+				if err != nil {
+					return nil, err
+				}
+				if found {
+					rows = append(rows, TableRow{rowid: int(rowid), record: rec})
+				}
+			}
+			return rows, nil
+		}
+	}
+	return db.file.tableRows(row.rootPage)
+}
+
+// Names under which the schema table can be queried
+func isSchemaTableName(name string) bool {
+	switch strings.ToLower(name) {
+	case "sqlite_schema", "sqlite_master", "sqlite_temp_schema", "sqlite_temp_master":
+		return true
+	}
+	return false
+}
+
+// Reads the schema table rooted at page 1. The temp schema lives in a
+// separate in-memory database, so here it is always empty.
+func loadSchemaRelation(db *database, name, alias string) (*relation, error) {
+	rel := &relation{}
+	for _, col := range []string{"type", "name", "tbl_name", "rootpage", "sql"} {
+		rel.columns = append(rel.columns, relationColumn{table: alias, name: col})
+	}
+	if strings.Contains(strings.ToLower(name), "temp") {
+		return rel, nil
+	}
+	rows, err := db.file.tableRows(1)
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		values := make([]interface{}, len(rel.columns))
+		for i := range values {
+			if i < len(row.record.values) {
+				values[i] = normalizeValue(row.record.values[i])
+			}
+		}
+		rel.rows = append(rel.rows, relationRow{values: values, rowid: row.rowid})
+	}
+	return rel, nil
+}
+
+// Expands a view by running its stored SELECT
+func loadViewRelation(db *database, row *SQLiteSchemaRow, alias string) (*relation, error) {
+	def, err := parseCreateView(row.sql)
+	if err != nil {
+		return nil, err
+	}
+	key := strings.ToLower(def.name)
+	if db.expandingViews[key] {
+		return nil, fmt.Errorf("view %s is circularly defined", def.name)
+	}
+	db.expandingViews[key] = true
+	defer delete(db.expandingViews, key)
+
+	rs, err := executeQuery(db, def.selectSQL)
+	if err != nil {
+		return nil, err
+	}
+	if def.columns != nil && len(def.columns) != len(rs.columns) {
+		return nil, fmt.Errorf("expected %d columns for '%s' but got %d", len(def.columns), def.name, len(rs.columns))
+	}
+	return resultRelation(rs, alias, def.columns), nil
+}
+
+// Wraps a query result as a relation, making duplicate column names unique
+// with a ":N" suffix as SQLite does for views and subqueries
+func resultRelation(rs *resultSet, alias string, names []string) *relation {
+	if names == nil {
+		names = uniqueColumnNames(rs.columns)
+	}
+	rel := &relation{}
+	for i, name := range names {
+		rel.columns = append(rel.columns, relationColumn{table: alias, name: name, collation: rs.collation(i)})
+	}
+	for i, row := range rs.rows {
+		rel.rows = append(rel.rows, relationRow{values: row, rowid: i + 1})
+	}
+	return rel
+}
+
+func uniqueColumnNames(columns []string) []string {
+	names := make([]string, len(columns))
+	used := make(map[string]bool)
+	for i, name := range columns {
+		candidate := name
+		for n := 1; used[strings.ToLower(candidate)]; n++ {
+			candidate = name + ":" + strconv.Itoa(n)
+		}
+		used[strings.ToLower(candidate)] = true
+		names[i] = candidate
+	}
+	return names
+}
+
+func joinTableRelation(db *database, join *sqlparser.JoinTableExpr) (*relation, error) {
+	left, err := tableExprRelation(db, join.LeftExpr, nil)
+	if err != nil {
+		return nil, err
+	}
+	if fn := tableFunctionCall(join.RightExpr); fn != nil {
+		leftOuter := join.Join == sqlparser.LeftJoinStr
+		return fn.lateralJoin(db, left, join.Condition.On, leftOuter)
+	}
+	right, err := tableExprRelation(db, join.RightExpr, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	on := join.Condition.On
+	using := join.Condition.Using
+	switch join.Join {
+	case sqlparser.NaturalJoinStr, sqlparser.NaturalLeftJoinStr:
+		rightIndex := right.columnIndex()
+		for _, col := range left.columns {
+			if _, ok := rightIndex[strings.ToLower(col.name)]; ok {
+				using = append(using, sqlparser.NewColIdent(col.name))
+			}
+		}
+	case sqlparser.RightJoinStr, sqlparser.NaturalRightJoinStr:
+		return nil, fmt.Errorf("RIGHT and FULL OUTER JOINs are not currently supported")
+	}
+	for _, col := range using {
+		for i := range right.columns {
+			if strings.EqualFold(right.columns[i].name, col.String()) {
+				right.columns[i].hidden = true
+			}
+		}
+		eq := &sqlparser.ComparisonExpr{
+			Operator: sqlparser.EqualStr,
+			Left:     &sqlparser.ColName{Name: col, Qualifier: sqlparser.TableName{Name: sqlparser.NewTableIdent(qualifierFor(left, col.String()))}},
+			Right:    &sqlparser.ColName{Name: col, Qualifier: sqlparser.TableName{Name: sqlparser.NewTableIdent(qualifierFor(right, col.String()))}},
+		}
+		if on == nil {
+			on = eq
+		} else {
+			on = &sqlparser.AndExpr{Left: on, Right: eq}
+		}
+	}
+
+	leftOuter := join.Join == sqlparser.LeftJoinStr || join.Join == sqlparser.NaturalLeftJoinStr
+	joined := joinRelations(left, right, on, leftOuter)
+	if on != nil {
+		if err := checkColumns(on, joined.columnIndex()); err != nil {
+			return nil, err
+		}
+	}
+	return joined, nil
+}
+
+// tableFunction is a table-valued function call in FROM, such as
+// pragma_table_info('t'), which prepareSQL passes through as a quoted name
+type tableFunction struct {
+	name  string // pragma name without the pragma_ prefix
+	args  []sqlparser.Expr
+	alias string
+}
+
+func tableFunctionCall(tableExpr sqlparser.TableExpr) *tableFunction {
+	aliased, ok := tableExpr.(*sqlparser.AliasedTableExpr)
+	if !ok {
+		return nil
+	}
+	table, ok := aliased.Expr.(sqlparser.TableName)
+	if !ok {
+		return nil
+	}
+	text := table.Name.String()
+	open := strings.IndexByte(text, '(')
+	if open < 0 || !strings.HasSuffix(text, ")") {
+		return nil
+	}
+	name, ok := pragmaFunctionName(strings.TrimSpace(text[:open]))
+	if !ok {
+		return nil
+	}
+	fn := &tableFunction{name: name, alias: aliased.As.String()}
+	if fn.alias == "" {
+		fn.alias = strings.TrimSpace(text[:open])
+	}
+	if argsText := strings.TrimSpace(text[open+1 : len(text)-1]); argsText != "" {
+		stmt, err := sqlparser.Parse("select " + prepareSQL(argsText))
+		if err != nil {
+			raiseEvalError("%v", err)
+		}
+		for _, expr := range stmt.(*sqlparser.Select).SelectExprs {
+			if arg, ok := expr.(*sqlparser.AliasedExpr); ok {
+				fn.args = append(fn.args, arg.Expr)
+			}
+		}
+	}
+	return fn
+}
+
+// Evaluates the arguments against a row of the tables to the left and
+// returns the function's rows
+func (f *tableFunction) relation(db *database, index map[string]int, names []string, values []interface{}, rowid int) (*relation, error) {
+	args := make([]interface{}, len(f.args))
+	for i, arg := range f.args {
+		args[i] = getExprValue(arg, index, names, "", values, rowid)
+	}
+	pragma, _ := lookupPragma(f.name)
+	rs, err := pragma(db, args)
+	if err != nil {
+		return nil, err
+	}
+	return resultRelation(rs, f.alias, nil), nil
+}
+
+// Joins each left row with the rows the function returns for it
+func (f *tableFunction) lateralJoin(db *database, left *relation, on sqlparser.Expr, leftOuter bool) (*relation, error) {
+	pragma, _ := lookupPragma(f.name)
+	empty, err := pragma(db, nil)
+	if err != nil {
+		return nil, err
+	}
+	joined := joinRelations(left, resultRelation(empty, f.alias, nil), nil, false)
+	index, names := left.columnIndex(), left.columnNames()
+	for _, l := range left.rows {
+		right, err := f.relation(db, index, names, l.values, l.rowid)
+		if err != nil {
+			return nil, err
+		}
+		single := &relation{columns: left.columns, rows: []relationRow{l}}
+		joined.rows = append(joined.rows, joinRelations(single, right, on, leftOuter).rows...)
+	}
+	if on != nil {
+		if err := checkColumns(on, joined.columnIndex()); err != nil {
+			return nil, err
+		}
+	}
+	return joined, nil
+}
+
+func qualifierFor(rel *relation, column string) string {
+	for _, col := range rel.columns {
+		if strings.EqualFold(col.name, column) {
+			return col.table
+		}
+	}
+	return ""
+}
+
+// Nested-loop join; a left outer join pads unmatched left rows with NULLs
+func joinRelations(left, right *relation, on sqlparser.Expr, leftOuter bool) *relation {
+	joined := &relation{columns: append(append([]relationColumn{}, left.columns...), right.columns...)}
+	index := joined.columnIndex()
+	names := joined.columnNames()
+	on = joined.withCollations(on)
+	for _, l := range left.rows {
+		matched := false
+		for _, r := range right.rows {
+			values := append(append(make([]interface{}, 0, len(joined.columns)), l.values...), r.values...)
+			if on != nil && !evaluateWhereClause(on, index, names, "", values, l.rowid) {
+				continue
+			}
+			matched = true
+			joined.rows = append(joined.rows, relationRow{values: values, rowid: l.rowid})
+		}
+		if !matched && leftOuter {
+			values := append(append(make([]interface{}, 0, len(joined.columns)), l.values...), make([]interface{}, len(right.columns))...)
+			joined.rows = append(joined.rows, relationRow{values: values, rowid: l.rowid})
+		}
+	}
+	return joined
+}
+
+const aggregateColumnPrefix = "agg:"
+
+// Synthetic column holding the value of the i-th aggregate of a group
+func aggregateColumnName(i int) string {
+	return aggregateColumnPrefix + strconv.Itoa(i)
+}
+
+// aggregateCall is an aggregate function call found in a SELECT
+type aggregateCall struct {
+	name     string
+	distinct bool
+	args     []sqlparser.Expr // empty for count(*)
+}
+
+// Finds the aggregate calls in the select list, HAVING and ORDER BY and
+// replaces each with a reference to its synthetic group column
+func collectAggregates(sel *sqlparser.Select) []aggregateCall {
+	var calls []aggregateCall
+	rewrite := func(root sqlparser.Expr) sqlparser.Expr {
+		var found []sqlparser.Expr
+		_ = sqlparser.Walk(func(node sqlparser.SQLNode) (bool, error) {
+			switch n := node.(type) {
+			case *sqlparser.Subquery:
+				return false, nil
+			case *sqlparser.FuncExpr:
+				name := n.Name.Lowered()
+				if isAggregateFunction(name) && !((name == "min" || name == "max") && len(n.Exprs) > 1) {
+					found = append(found, n)
+					return false, nil
+				}
+			case *sqlparser.GroupConcatExpr:
+				found = append(found, n)
+				return false, nil
+			}
+			return true, nil
+		}, root)
+		for _, node := range found {
+			call := aggregateCall{}
+			var exprs sqlparser.SelectExprs
+			switch n := node.(type) {
+			case *sqlparser.FuncExpr:
+				call.name, call.distinct, exprs = n.Name.Lowered(), n.Distinct, n.Exprs
+			case *sqlparser.GroupConcatExpr:
+				call.name, call.distinct, exprs = "group_concat", n.Distinct != "", n.Exprs
+			}
+			for _, e := range exprs {
+				if aliased, ok := e.(*sqlparser.AliasedExpr); ok {
+					call.args = append(call.args, aliased.Expr)
+				}
+			}
+			ref := &sqlparser.ColName{Name: sqlparser.NewColIdent(aggregateColumnName(len(calls)))}
+			calls = append(calls, call)
+			root = sqlparser.ReplaceExpr(root, node, ref)
+		}
+		return root
+	}
+
+	for _, selectExpr := range sel.SelectExprs {
+		if aliased, ok := selectExpr.(*sqlparser.AliasedExpr); ok {
+			aliased.Expr = rewrite(aliased.Expr)
+		}
+	}
+	if sel.Having != nil {
+		sel.Having.Expr = rewrite(sel.Having.Expr)
+	}
+	for _, order := range sel.OrderBy {
+		order.Expr = rewrite(order.Expr)
+	}
+	return calls
+}
+
+// Groups rows by the GROUP BY terms and computes the aggregates of each
+// group, returning one row per group with the aggregate values appended
+func groupRows(sel *sqlparser.Select, rel *relation, rows []relationRow, index map[string]int, names []string, projections []projection, aggregates []aggregateCall) ([]relationRow, error) {
+	var groupExprs []sqlparser.Expr
+	var collations []string
+	for _, expr := range sel.GroupBy {
+		resolved := expr
+		if n, ok := positionalTerm(expr); ok {
+			if n < 1 || n > len(projections) || projections[n-1].expr == nil {
+				return nil, fmt.Errorf("GROUP BY term out of range - should be between 1 and %d", len(projections))
+			}
+			resolved = projections[n-1].expr
+		} else if col, ok := expr.(*sqlparser.ColName); ok && col.Qualifier.IsEmpty() {
+			if _, isColumn := index[columnKey(col)]; !isColumn {
+				for _, p := range projections {
+					if p.expr != nil && strings.EqualFold(p.name, col.Name.String()) {
+						resolved = p.expr
+					}
+				}
+			}
+		}
+		if err := checkColumns(resolved, index); err != nil {
+			return nil, err
+		}
+		groupExprs = append(groupExprs, resolved)
+		collations = append(collations, rel.collationOf(resolved))
+	}
+
+	type group struct {
+		key    []interface{}
+		first  relationRow // gives the values of bare columns
+		states []*aggregateState
+	}
+	newGroup := func(key []interface{}, row relationRow) *group {
+		g := &group{key: key, first: row}
+		for _, call := range aggregates {
+			g.states = append(g.states, newAggregateState(call.name, call.distinct))
+		}
+		return g
+	}
+
+	var groups []*group
+	byKey := make(map[string]*group)
+	for _, row := range rows {
+		key := make([]interface{}, len(groupExprs))
+		for i, expr := range groupExprs {
+			key[i] = getExprValue(expr, index, names, "", row.values, row.rowid)
+		}
+		k := collatedRowKey(key, collations)
+		g, ok := byKey[k]
+		if !ok {
+			g = newGroup(key, row)
+			byKey[k] = g
+			groups = append(groups, g)
+		}
+		for i, call := range aggregates {
+			args := make([]interface{}, len(call.args))
+			for j, arg := range call.args {
+				args[j] = getExprValue(arg, index, names, "", row.values, row.rowid)
+			}
+			g.states[i].step(args)
+		}
+	}
+
+	// Without GROUP BY an empty input still produces one row
+	if len(groupExprs) == 0 && len(groups) == 0 {
+		groups = append(groups, newGroup(nil, relationRow{values: make([]interface{}, len(names))}))
+	}
+	sort.SliceStable(groups, func(a, b int) bool {
+		for i := range groups[a].key {
+			if c := compareSortValues(groups[a].key[i], groups[b].key[i], collations[i]); c != 0 {
+				return c < 0
+			}
+		}
+		return false
+	})
+
+	result := make([]relationRow, 0, len(groups))
+	for _, g := range groups {
+		values := append(make([]interface{}, 0, len(names)+len(aggregates)), g.first.values...)
+		for _, state := range g.states {
+			v, err := state.result()
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, v)
+		}
+		result = append(result, relationRow{values: values, rowid: g.first.rowid})
+	}
+	return result, nil
+}
+
+// Reports whether expr is an integer literal such as the 2 in ORDER BY 2
+func positionalTerm(expr sqlparser.Expr) (int, bool) {
+	val, ok := expr.(*sqlparser.SQLVal)
+	if !ok || val.Type != sqlparser.IntVal {
+		return 0, false
+	}
+	n, err := strconv.Atoi(string(val.Val))
+	return n, err == nil
+}
+
+type sortKey struct {
+	column    int
+	desc      bool
+	collation string
+}
+
+// Sorts result rows by ORDER BY terms, which may name an output column,
+// give its position, or be any expression over the source row
+func orderResult(orderBy sqlparser.OrderBy, rs *resultSet, sources []relationRow, rel *relation, index map[string]int, names []string) error {
+	width := len(rs.columns)
+	var keys []sortKey
+	var extra []sqlparser.Expr
+	for i, order := range orderBy {
+		key := sortKey{desc: order.Direction == sqlparser.DescScr, collation: orderCollation(order.Expr)}
+		expr := stripCollate(order.Expr)
+		if n, ok := positionalTerm(expr); ok {
+			if n < 1 || n > width {
+				return fmt.Errorf("%s ORDER BY term out of range - should be between 1 and %d", ordinal(i+1), width)
+			}
+			key.column = n - 1
+		} else if col, ok := outputColumnRef(expr, rs.columns); ok && !isSourceColumn(expr, index) {
+			key.column = col
+		} else {
+			if err := checkColumns(expr, index); err != nil {
+				return err
+			}
+			key.column = width + len(extra)
+			extra = append(extra, expr)
+		}
+		if key.collation == "" {
+			if key.column < width {
+				key.collation = rs.collation(key.column)
+			} else {
+				key.collation = rel.collationOf(expr)
+			}
+		}
+		keys = append(keys, key)
+	}
+
+	// Append hidden sort values, sort, then drop them again
+	for r, row := range rs.rows {
+		for _, expr := range extra {
+			row = append(row, getExprValue(expr, index, names, "", sources[r].values, sources[r].rowid))
+		}
+		rs.rows[r] = row
+	}
+	sortRows(rs.rows, keys)
+	for r := range rs.rows {
+		rs.rows[r] = rs.rows[r][:width]
+	}
+	return nil
+}
+
+func ordinal(n int) string {
+	switch n {
+	case 1:
+		return "1st"
+	case 2:
+		return "2nd"
+	case 3:
+		return "3rd"
+	}
+	return strconv.Itoa(n) + "th"
+}
+
+// Matches an ORDER BY term against the output column names
+func outputColumnRef(expr sqlparser.Expr, columns []string) (int, bool) {
+	expr = stripCollate(expr)
+	if n, ok := positionalTerm(expr); ok && n >= 1 && n <= len(columns) {
+		return n - 1, true
+	}
+	col, ok := expr.(*sqlparser.ColName)
+	if !ok || !col.Qualifier.IsEmpty() {
+		return 0, false
+	}
+	for i, name := range columns {
+		if strings.EqualFold(name, col.Name.String()) {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+func isSourceColumn(expr sqlparser.Expr, index map[string]int) bool {
+	col, ok := expr.(*sqlparser.ColName)
+	if !ok {
+		return false
+	}
+	_, found := index[columnKey(col)]
+	return found
+}
+
+func stripCollate(expr sqlparser.Expr) sqlparser.Expr {
+	if c, ok := expr.(*sqlparser.CollateExpr); ok {
+		return c.Expr
+	}
+	return expr
+}
+
+func orderCollation(expr sqlparser.Expr) string {
+	if c, ok := expr.(*sqlparser.CollateExpr); ok {
+		return c.Charset
+	}
+	return ""
+}
+
+func allColumnsOrder(rs *resultSet) []sortKey {
+	keys := make([]sortKey, len(rs.columns))
+	for i := range keys {
+		keys[i] = sortKey{column: i, collation: rs.collation(i)}
+	}
+	return keys
+}
+
+func sortRows(rows [][]interface{}, keys []sortKey) {
+	sort.SliceStable(rows, func(a, b int) bool {
+		for _, key := range keys {
+			c := compareSortValues(rows[a][key.column], rows[b][key.column], key.collation)
+			if c != 0 {
+				if key.desc {
+					return c > 0
+				}
+				return c < 0
+			}
+		}
+		return false
+	})
+}
+
+// Identity of a row for DISTINCT, UNION and GROUP BY
+func rowKey(values []interface{}) string {
+	var sb strings.Builder
+	for _, v := range values {
+		v = normalizeValue(v)
+		if f, ok := v.(float64); ok && f == float64(int64(f)) {
+			v = int64(f) // 1 and 1.0 are the same value
+		}
+		sb.WriteString(storageClass(v))
+		sb.WriteByte(':')
+		sb.WriteString(strconv.Quote(formatValue(v)))
+		sb.WriteByte(',')
+	}
+	return sb.String()
+}
+
+// Like rowKey, with text folded so that values equal under the collation
+// of their column have the same key
+func collatedRowKey(values []interface{}, collations []string) string {
+	folded := make([]interface{}, len(values))
+	for i, v := range values {
+		folded[i] = v
+		if s, ok := v.(string); ok && i < len(collations) {
+			folded[i] = collationKey(s, collations[i])
+		}
+	}
+	return rowKey(folded)
+}
+
+func distinctRows(rows [][]interface{}, collations []string) [][]interface{} {
+	seen := make(map[string]bool)
+	result := rows[:0]
+	for _, row := range rows {
+		k := collatedRowKey(row, collations)
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+		result = append(result, row)
+	}
+	return result
+}
+
+func applyLimit(rows [][]interface{}, limit *sqlparser.Limit) ([][]interface{}, error) {
+	if limit == nil {
+		return rows, nil
+	}
+	if limit.Offset != nil {
+		offset, err := constantInt(limit.Offset)
+		if err != nil {
+			return nil, err
+		}
+		if offset > int64(len(rows)) {
+			offset = int64(len(rows))
+		}
+		if offset > 0 {
+			rows = rows[offset:]
+		}
+	}
+	if limit.Rowcount != nil {
+		count, err := constantInt(limit.Rowcount)
+		if err != nil {
+			return nil, err
+		}
+		if count >= 0 && count < int64(len(rows)) {
+			rows = rows[:count]
+		}
+	}
+	return rows, nil
+}
+
+func constantInt(expr sqlparser.Expr) (n int64, err error) {
+	defer recoverEvalError(&err)
+	v := getExprValue(expr, nil, nil, "", nil, 0)
+	i, _, isInt := toNumber(v)
+	if !isInt {
+		return 0, fmt.Errorf("datatype mismatch")
+	}
+	return i, nil
+}
+
+// Parses a standalone SQL expression such as a CHECK or generated column
+func parseExpression(text string) (sqlparser.Expr, error) {
+	stmt, err := sqlparser.Parse("select " + prepareSQL(text))
+	if err != nil {
+		return nil, err
+	}
+	sel, ok := stmt.(*sqlparser.Select)
+	if !ok || len(sel.SelectExprs) != 1 {
+		return nil, fmt.Errorf("malformed expression: %s", text)
+	}
+	aliased, ok := sel.SelectExprs[0].(*sqlparser.AliasedExpr)
+	if !ok {
+		return nil, fmt.Errorf("malformed expression: %s", text)
+	}
+	return aliased.Expr, nil
+}
+
+// Runs the uncorrelated subqueries of a SELECT once and substitutes their
+// results: IN (SELECT ...) becomes a value list, EXISTS a boolean and a
+// scalar subquery its first value. Correlated ones are left for
+// bindOuterRow to run once per row.
+func resolveSubqueries(db *database, sel *sqlparser.Select) error {
+	resolve := func(root sqlparser.Expr) (sqlparser.Expr, error) {
+		return resolveUncorrelatedSubqueries(db, root)
+	}
+
+	var err error
+	if sel.Where != nil {
+		if sel.Where.Expr, err = resolve(sel.Where.Expr); err != nil {
+			return err
+		}
+	}
+	if sel.Having != nil {
+		if sel.Having.Expr, err = resolve(sel.Having.Expr); err != nil {
+			return err
+		}
+	}
+	for _, selectExpr := range sel.SelectExprs {
+		if aliased, ok := selectExpr.(*sqlparser.AliasedExpr); ok {
+			if aliased.Expr, err = resolve(aliased.Expr); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Runs the subqueries in one expression and substitutes their results
+func resolveExprSubqueries(db *database, root sqlparser.Expr) (sqlparser.Expr, error) {
+	return substituteSubqueries(db, root, false)
+}
+
+// Like resolveExprSubqueries, but leaves in place the subqueries that
+// refer to columns of the rows the expression is evaluated over
+func resolveUncorrelatedSubqueries(db *database, root sqlparser.Expr) (sqlparser.Expr, error) {
+	return substituteSubqueries(db, root, true)
+}
+
+// A subquery naming a column its own FROM lacks may be correlated: the
+// column can belong to the row of the enclosing query
+func isCorrelationError(err error) bool {
+	return strings.HasPrefix(err.Error(), "no such column: ")
+}
+
+func substituteSubqueries(db *database, root sqlparser.Expr, keepCorrelated bool) (sqlparser.Expr, error) {
+	if root == nil {
+		return nil, nil
+	}
+	// Running a SELECT rewrites it, so a subquery that may have to run
+	// again per row is tried on a copy
+	run := func(sel sqlparser.SelectStatement) (*resultSet, error) {
+		if keepCorrelated {
+			return executeQuery(db, sqlparser.String(sel))
+		}
+		return executeSelect(db, sel, "")
+	}
+	type replacement struct{ from, to sqlparser.Expr }
+	var replacements []replacement
+	var walkErr error
+	_ = sqlparser.Walk(func(node sqlparser.SQLNode) (bool, error) {
+		if walkErr != nil {
+			return false, nil
+		}
+		switch n := node.(type) {
+		case *sqlparser.ComparisonExpr:
+			sub, ok := n.Right.(*sqlparser.Subquery)
+			if !ok || (n.Operator != sqlparser.InStr && n.Operator != sqlparser.NotInStr) {
+				return true, nil
+			}
+			rs, err := run(sub.Select)
+			if err != nil {
+				if !keepCorrelated || !isCorrelationError(err) {
+					walkErr = err
+				}
+				return false, nil
+			}
+			tuple := sqlparser.ValTuple{}
+			for _, row := range rs.rows {
+				if len(row) != 1 {
+					walkErr = fmt.Errorf("sub-select returns %d columns - expected 1", len(row))
+					return false, nil
+				}
+				tuple = append(tuple, valueToExpr(row[0]))
+			}
+			replacements = append(replacements, replacement{sub, tuple})
+			return true, nil
+		case *sqlparser.ExistsExpr:
+			rs, err := run(n.Subquery.Select)
+			if err != nil {
+				if !keepCorrelated || !isCorrelationError(err) {
+					walkErr = err
+				}
+				return false, nil
+			}
+			replacements = append(replacements, replacement{n, sqlparser.BoolVal(len(rs.rows) > 0)})
+			return false, nil
+		case *sqlparser.Subquery:
+			rs, err := run(n.Select)
+			if err != nil {
+				if !keepCorrelated || !isCorrelationError(err) {
+					walkErr = err
+				}
+				return false, nil
+			}
+			var v interface{}
+			if len(rs.rows) > 0 && len(rs.rows[0]) > 0 {
+				v = rs.rows[0][0]
+			}
+			replacements = append(replacements, replacement{n, valueToExpr(v)})
+			return false, nil
+		}
+		return true, nil
+	}, root)
+	if walkErr != nil {
+		return nil, walkErr
+	}
+	for _, r := range replacements {
+		root = sqlparser.ReplaceExpr(root, r.from, r.to)
+	}
+	return root, nil
+}
+
+// Runs the correlated subqueries of expr for one row of rel, which they
+// see as the row of their enclosing query. expr itself is left as it is:
+// the results are substituted into a copy.
+func (db *database) bindOuterRow(expr sqlparser.Expr, rel *relation, row relationRow) (sqlparser.Expr, error) {
+	bound, err := parseExpression(sqlparser.String(expr))
+	if err != nil {
+		return nil, err
+	}
+	db.outerRows = append(db.outerRows, outerRow{columns: rel.columns, row: row})
+	defer func() { db.outerRows = db.outerRows[:len(db.outerRows)-1] }()
+	return resolveExprSubqueries(db, bound)
+}
+
+// outerRow is the current row of a query whose correlated subquery is
+// running
+type outerRow struct {
+	columns []relationColumn
+	row     relationRow
+}
+
+// Adds the columns of the enclosing query's row to the relation of a
+// correlated subquery. They come after its own columns, which take
+// precedence over them, and SELECT * leaves them out.
+func (db *database) withOuterColumns(rel *relation) *relation {
+	if len(db.outerRows) == 0 {
+		return rel
+	}
+	outer := db.outerRows[len(db.outerRows)-1]
+	values := outer.row.values
+	if len(values) > len(outer.columns) {
+		values = values[:len(outer.columns)] // aggregate results of a group row
+	}
+	extended := &relation{columns: append([]relationColumn(nil), rel.columns...)}
+	for _, col := range outer.columns {
+		col.outer = true
+		extended.columns = append(extended.columns, col)
+	}
+	for _, row := range rel.rows {
+		joined := make([]interface{}, len(rel.columns), len(extended.columns))
+		copy(joined, row.values)
+		joined = append(joined, values...)
+		extended.rows = append(extended.rows, relationRow{values: joined, rowid: row.rowid})
+	}
+	return extended
+}
+
+// Reports whether expr still holds a subquery
+func containsSubquery(expr sqlparser.Expr) bool {
+	if expr == nil {
+		return false
+	}
+	found := false
+	_ = sqlparser.Walk(func(node sqlparser.SQLNode) (bool, error) {
+		if _, ok := node.(*sqlparser.Subquery); ok {
+			found = true
+		}
+		return !found, nil
+	}, expr)
+	return found
+}
+
+// Builds a literal expression node for a value
+func valueToExpr(v interface{}) sqlparser.Expr {
+	switch n := normalizeValue(v).(type) {
+	case nil:
+		return &sqlparser.NullVal{}
+	case int64:
+		return sqlparser.NewIntVal([]byte(strconv.FormatInt(n, 10)))
+	case float64:
+		return sqlparser.NewFloatVal([]byte(strconv.FormatFloat(n, 'g', -1, 64)))
+	case string:
+		return sqlparser.NewStrVal([]byte(n))
+	case []byte:
+		return sqlparser.NewHexVal([]byte(fmt.Sprintf("%x", n)))
+	}
+	return &sqlparser.NullVal{}
+}
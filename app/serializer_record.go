@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// Appends v as a SQLite varint: 7 bits per byte, high bit set on all but
+// the last byte, with a ninth byte carrying a full 8 bits
+func appendVarint(buf []byte, v uint64) []byte {
+	if v > 0x00ffffffffffffff {
+		var tmp [9]byte
+		tmp[8] = byte(v)
+		v >>= 8
+		for i := 7; i >= 0; i-- {
+			tmp[i] = byte(v&0x7f) | 0x80
+			v >>= 7
+		}
+		return append(buf, tmp[:]...)
+	}
+	var tmp [9]byte
+	n := 0
+	for {
+		tmp[n] = byte(v & 0x7f)
+		n++
+		v >>= 7
+		if v == 0 {
+			break
+		}
+	}
+	for i := n - 1; i >= 0; i-- {
+		b := tmp[i]
+		if i > 0 {
+			b |= 0x80
+		}
+		buf = append(buf, b)
+	}
+	return buf
+}
+
+func varintLen(v uint64) int {
+	return len(appendVarint(nil, v))
+}
+
+// Decodes a varint at the start of b, returning the value and its length
+func decodeVarint(b []byte) (uint64, int) {
+	var v uint64
+	for i := 0; i < 9 && i < len(b); i++ {
+		if i == 8 {
+			return v<<8 | uint64(b[i]), 9
+		}
+		v = v<<7 | uint64(b[i]&0x7f)
+		if b[i]&0x80 == 0 {
+			return v, i + 1
+		}
+	}
+	return v, len(b)
+}
+
+// Serial type and body bytes of one value in a record; the inverse of
+// parseRecordValue
+func serializeValue(v interface{}) (uint64, []byte) {
+	switch n := normalizeValue(v).(type) {
+	case nil:
+		return 0, nil
+	case int64:
+		switch {
+		case n == 0:
+			return 8, nil
+		case n == 1:
+			return 9, nil
+		case n >= math.MinInt8 && n <= math.MaxInt8:
+			return 1, []byte{byte(n)}
+		case n >= math.MinInt16 && n <= math.MaxInt16:
+			return 2, bigEndianInt(n, 2)
+		case n >= -1<<23 && n < 1<<23:
+			return 3, bigEndianInt(n, 3)
+		case n >= math.MinInt32 && n <= math.MaxInt32:
+			return 4, bigEndianInt(n, 4)
+		case n >= -1<<47 && n < 1<<47:
+			return 5, bigEndianInt(n, 6)
+		}
+		return 6, bigEndianInt(n, 8)
+	case float64:
+		body := make([]byte, 8)
+		binary.BigEndian.PutUint64(body, math.Float64bits(n))
+		return 7, body
+	case string:
+		return uint64(len(n))*2 + 13, []byte(n)
+	case []byte:
+		return uint64(len(n))*2 + 12, n
+	}
+	return 0, nil
+}
+
+func bigEndianInt(n int64, size int) []byte {
+	body := make([]byte, size)
+	for i := size - 1; i >= 0; i-- {
+		body[i] = byte(n)
+		n >>= 8
+	}
+	return body
+}
+
+// Encodes values in SQLite's record format: a header of serial types
+// followed by the value bodies
+func serializeRecord(values []interface{}) []byte {
+	var types []byte
+	var body []byte
+	for _, v := range values {
+		serialType, data := serializeValue(v)
+		types = appendVarint(types, serialType)
+		body = append(body, data...)
+	}
+
+	// The header length includes its own varint
+	headerLen := len(types) + 1
+	for varintLen(uint64(headerLen)) != headerLen-len(types) {
+		headerLen = len(types) + varintLen(uint64(headerLen))
+	}
+	record := appendVarint(make([]byte, 0, headerLen+len(body)), uint64(headerLen))
+	record = append(record, types...)
+	return append(record, body...)
+}
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/chzyer/readline"
+)
+
+// exitRequest is how .quit and .exit end the shell
+type exitRequest struct {
+	code int
+}
+
+func (e *exitRequest) Error() string {
+	return "exit " + strconv.Itoa(e.code)
+}
+
+// errScriptFailed is returned by a script that reported errors of its
+// own statements
+var errScriptFailed = errors.New("script failed")
+
+// The state of the shell around a database: the settings the command line
+// and dot-commands change
+type shell struct {
+	db         *database
+	bail       bool // stop a script at its first error
+	mode       string
+	output     resultWriter // prints results in the current mode
+	settings   outputSettings
+	headersSet bool // .headers was given, so column mode leaves it alone
+}
+
+func newShell() *shell {
+	sh := &shell{settings: outputSettings{colSep: "|", rowSep: "\n"}}
+	sh.setMode([]string{"list"})
+	return sh
+}
+
+// Switches to the output mode named by .mode's arguments. Like sqlite3,
+// csv and tabs set the separators they use, list puts back "|" in place
+// of theirs, and column turns headers on unless .headers said otherwise.
+func (sh *shell) setMode(args []string) error {
+	output, err := newResultWriter(args[0], args[1:])
+	if err != nil {
+		return err
+	}
+	sh.mode = strings.Join(args, " ")
+	sh.output = output
+	s := &sh.settings
+	switch strings.ToLower(args[0]) {
+	case "list":
+		if s.colSep == "," || s.colSep == "\t" {
+			s.colSep = "|"
+		}
+		s.rowSep = "\n"
+	case "tabs":
+		s.colSep, s.rowSep = "\t", "\n"
+	case "csv":
+		s.colSep, s.rowSep = ",", "\r\n"
+	case "column":
+		if !sh.headersSet {
+			s.headers = true
+		}
+	}
+	return nil
+}
+
+// Turns headers on or off, as .headers and -header do
+func (sh *shell) setHeaders(on bool) {
+	sh.settings.headers = on
+	sh.headersSet = true
+}
+
+// Runs a dot-command such as .tables
+func (sh *shell) runDotCommand(command string) error {
+	return sh.runDotArgs(splitDotCommand(command))
+}
+
+// Runs a dot-command split into its arguments, the first being its name
+func (sh *shell) runDotArgs(args []string) error {
+	db := sh.db
+	if err := db.beginRead(); err != nil {
+		return err
+	}
+	defer db.file.endRead()
+	switch args[0] {
+	case ".dbinfo":
+		fmt.Println("database page size: ", db.pageSize)
+		fmt.Printf("number of tables: %v\n", len(db.schema))
+	case ".tables":
+		return sh.listTables(args)
+	case ".indexes", ".indices":
+		return sh.listIndexes(args)
+	case ".schema":
+		return sh.printSchema(args)
+	case ".fullschema":
+		return sh.printFullSchema(args)
+	case ".dump":
+		return sh.dump(args)
+	case ".import":
+		return sh.importFile(args)
+	case ".recover":
+		return sh.recover(args)
+	case ".help":
+		fmt.Print(shellHelp)
+	case ".quit":
+		return &exitRequest{}
+	case ".exit":
+		code := 0
+		if len(args) > 1 {
+			code, _ = strconv.Atoi(args[1])
+		}
+		return &exitRequest{code}
+	case ".headers":
+		if len(args) != 2 {
+			return errors.New("Usage: .headers on|off")
+		}
+		sh.setHeaders(pragmaFlag(args[1]))
+	case ".nullvalue":
+		if len(args) != 2 {
+			return errors.New("Usage: .nullvalue STRING")
+		}
+		sh.settings.nullValue = args[1]
+	case ".separator":
+		if len(args) < 2 || len(args) > 3 {
+			return errors.New("Usage: .separator COL ?ROW?")
+		}
+		sh.settings.colSep = args[1]
+		if len(args) == 3 {
+			sh.settings.rowSep = args[2]
+		}
+	case ".mode":
+		if len(args) == 1 {
+			fmt.Printf("current output mode: %s\n", sh.mode)
+			return nil
+		}
+		return sh.setMode(args[1:])
+	case ".read":
+		if len(args) != 2 {
+			return errors.New("Usage: .read FILE")
+		}
+		f, err := os.Open(args[1])
+		if err != nil {
+			return fmt.Errorf("cannot open \"%s\"", args[1])
+		}
+		defer f.Close()
+		return sh.runScript(f)
+	default:
+		return fmt.Errorf("Unknown command %s", strings.Join(args, " "))
+	}
+	return nil
+}
+
+const shellHelp = `.dbinfo                  Show status information about the database
+.dump ?PATTERN ...?      Render the database, or the objects matching
+                           PATTERN, as SQL text
+.exit ?CODE?             Exit this program with return-code CODE
+.fullschema              Show schema and the content of sqlite_stat tables
+.headers on|off          Turn display of headers on or off
+.help                    Show this message
+.import FILE TABLE       Import data from FILE into TABLE, with options
+                           --csv and --skip N
+.indexes ?TABLE?         Show names of indexes, of tables matching TABLE
+.mode MODE ?TABLE?       Set output mode: box, column, csv, insert, json,
+                           line, list, markdown, quote, table or tabs
+.nullvalue STRING        Use STRING in place of NULL values
+.quit                    Exit this program
+.read FILE               Read input from FILE
+.recover                 Recover as much data as possible from a damaged
+                           database, as SQL text
+.schema ?PATTERN?        Show the CREATE statements matching PATTERN
+.separator COL ?ROW?     Change the column and row separators
+.tables ?TABLE?          List names of tables and views matching TABLE
+`
+
+// Splits a dot-command into its arguments at whitespace. An argument may
+// be quoted: in single quotes it is taken as is, and in double quotes
+// backslash escapes such as \t and \n are resolved.
+func splitDotCommand(command string) []string {
+	var args []string
+	i := 0
+	for {
+		for i < len(command) && isSpace(command[i]) {
+			i++
+		}
+		if i == len(command) {
+			return args
+		}
+		var arg strings.Builder
+		switch quote := command[i]; quote {
+		case '\'', '"':
+			i++
+			for i < len(command) && command[i] != quote {
+				if quote == '"' && command[i] == '\\' && i+1 < len(command) {
+					i++
+					switch c := command[i]; c {
+					case 't':
+						arg.WriteByte('\t')
+					case 'n':
+						arg.WriteByte('\n')
+					case 'r':
+						arg.WriteByte('\r')
+					default:
+						arg.WriteByte(c)
+					}
+				} else {
+					arg.WriteByte(command[i])
+				}
+				i++
+			}
+			i++
+		default:
+			for i < len(command) && !isSpace(command[i]) {
+				arg.WriteByte(command[i])
+				i++
+			}
+		}
+		args = append(args, arg.String())
+	}
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' || c == '\v'
+}
+
+// Runs SQL text of one or more statements, printing their rows. Stops at
+// the first error.
+func (sh *shell) runSQL(sql string) error {
+	for _, stmt := range splitStatements(sql) {
+		if err := sh.runStatement(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (sh *shell) runStatement(stmt string) error {
+	rs, err := executeStatement(sh.db, stmt)
+	if err != nil {
+		return err
+	}
+	if rs != nil {
+		writeResultSet(os.Stdout, sh.output, rs, &sh.settings)
+	}
+	return nil
+}
+
+// Runs a script of SQL statements and dot-commands, read line by line the
+// way the interactive shell reads them. An error is reported with the
+// line its statement starts on and the script goes on, unless bail is
+// set; errScriptFailed tells that there were errors.
+func (sh *shell) runScript(r io.Reader) error {
+	reader := bufio.NewReader(r)
+	failed := false
+	var pending []string
+	start, lineNo := 0, 0 // the first pending line and the last line read
+	for {
+		line, readErr := reader.ReadString('\n')
+		if line == "" && readErr != nil {
+			if readErr != io.EOF {
+				return readErr
+			}
+			break
+		}
+		lineNo++
+		line = strings.TrimRight(line, "\r\n")
+
+		if len(pending) == 0 {
+			trimmed := strings.TrimSpace(line)
+			if trimmed == "" {
+				continue
+			}
+			if strings.HasPrefix(trimmed, ".") {
+				err := sh.runDotCommand(trimmed)
+				if _, ok := err.(*exitRequest); ok {
+					return err
+				}
+				if err != nil {
+					if err != errScriptFailed {
+						fmt.Fprintf(os.Stderr, "Error near line %d: %v\n", lineNo, err)
+					}
+					failed = true
+					if sh.bail {
+						return errScriptFailed
+					}
+				}
+				continue
+			}
+			start = lineNo
+		}
+		pending = append(pending, line)
+		sql := strings.Join(pending, "\n")
+		if !sqlComplete(sql) {
+			continue
+		}
+		pending = nil
+		if !sh.runScriptSQL(sql, start) {
+			failed = true
+			if sh.bail {
+				return errScriptFailed
+			}
+		}
+	}
+
+	// Like sqlite3, run what is left at the end even without a semicolon
+	if len(pending) > 0 && !sh.runScriptSQL(strings.Join(pending, "\n"), start) {
+		failed = true
+	}
+	if failed {
+		return errScriptFailed
+	}
+	return nil
+}
+
+// Runs the statements of SQL text that starts on the given line of a
+// script, reporting errors with their line. Returns whether all of them
+// succeeded.
+func (sh *shell) runScriptSQL(sql string, line int) bool {
+	ok := true
+	for _, stmt := range splitStatementLines(sql) {
+		if err := sh.runStatement(stmt.text); err != nil {
+			fmt.Fprintf(os.Stderr, "Error near line %d: %v\n", line+stmt.line, err)
+			ok = false
+			if sh.bail {
+				break
+			}
+		}
+	}
+	return ok
+}
+
+// Runs the interactive shell. Lines are read until they end a complete
+// statement, with a continuation prompt in between; a line starting with
+// a dot is a dot-command. Ctrl-C interrupts the running statement, or
+// throws away the input read so far at the prompt, and Ctrl-D ends the
+// shell. Statements are kept in ~/.sqlite_history across sessions.
+func (sh *shell) runInteractive() error {
+	db := sh.db
+	config := &readline.Config{
+		Prompt:                 "sqlite> ",
+		DisableAutoSaveHistory: true,
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		config.HistoryFile = filepath.Join(home, ".sqlite_history")
+	}
+	rl, err := readline.NewEx(config)
+	if err != nil {
+		return err
+	}
+	defer rl.Close()
+
+	// The prompt reads Ctrl-C as a key; while a statement runs it arrives
+	// as a signal
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+	defer signal.Stop(interrupts)
+	go func() {
+		for range interrupts {
+			db.interrupted.Store(true)
+		}
+	}()
+
+	fmt.Println(`Enter ".help" for usage hints.`)
+	var pending []string
+	for {
+		if len(pending) == 0 {
+			rl.SetPrompt("sqlite> ")
+		} else {
+			rl.SetPrompt("   ...> ")
+		}
+		line, err := rl.Readline()
+		switch {
+		case err == readline.ErrInterrupt:
+			pending = nil
+			continue
+		case err == io.EOF:
+			return nil
+		case err != nil:
+			return err
+		}
+
+		if len(pending) == 0 {
+			trimmed := strings.TrimSpace(line)
+			if trimmed == "" {
+				continue
+			}
+			if strings.HasPrefix(trimmed, ".") {
+				rl.SaveHistory(trimmed)
+				db.interrupted.Store(false)
+				err := sh.runDotCommand(trimmed)
+				if _, ok := err.(*exitRequest); ok {
+					return err
+				}
+				if err != nil && err != errScriptFailed {
+					fmt.Println("Error:", err)
+				}
+				continue
+			}
+		}
+		pending = append(pending, line)
+		sql := strings.Join(pending, "\n")
+		if !sqlComplete(sql) {
+			continue
+		}
+		pending = nil
+		rl.SaveHistory(strings.ReplaceAll(sql, "\n", " "))
+		db.interrupted.Store(false)
+		if err := sh.runSQL(sql); err != nil {
+			fmt.Println("Error:", err)
+		}
+	}
+}
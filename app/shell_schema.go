@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Lists the tables and views, leaving out sqlite's own, whose names match
+// a LIKE pattern if one is given
+func (sh *shell) listTables(args []string) error {
+	if len(args) > 2 {
+		return fmt.Errorf("Usage: .tables ?LIKE-PATTERN?")
+	}
+	var names []string
+	for _, row := range sh.db.schema {
+		if (row._type == "table" || row._type == "view") && !isSystemName(row.name) && schemaPatternMatch(args, row.name) {
+			names = append(names, row.name)
+		}
+	}
+	printNameColumns(names)
+	return nil
+}
+
+// Lists the indexes, of the tables whose names match a LIKE pattern if
+// one is given
+func (sh *shell) listIndexes(args []string) error {
+	if len(args) > 2 {
+		return fmt.Errorf("Usage: .indexes ?LIKE-PATTERN?")
+	}
+	var names []string
+	for _, row := range sh.db.schema {
+		if row._type == "index" && schemaPatternMatch(args, row.tblName) {
+			names = append(names, row.name)
+		}
+	}
+	printNameColumns(names)
+	return nil
+}
+
+// Prints the CREATE statements of the schema, of the objects that are or
+// belong to a table matching a LIKE pattern if one is given
+func (sh *shell) printSchema(args []string) error {
+	if len(args) > 2 {
+		return fmt.Errorf("Usage: .schema ?LIKE-PATTERN?")
+	}
+	for _, row := range sh.db.schema {
+		if row.sql != "" && (schemaPatternMatch(args, row.name) || schemaPatternMatch(args, row.tblName)) {
+			fmt.Println(row.sql + ";")
+		}
+	}
+	return nil
+}
+
+// Prints the CREATE statements of the schema without sqlite's own tables,
+// then the statistics ANALYZE gathered as statements that restore them
+func (sh *shell) printFullSchema(args []string) error {
+	if len(args) > 2 || len(args) == 2 && args[1] != "--indent" {
+		return fmt.Errorf("Usage: .fullschema ?--indent?")
+	}
+	hasStats := false
+	for _, row := range sh.db.schema {
+		if row._type == "table" && row.name == "sqlite_stat1" {
+			hasStats = true
+		}
+		if row.sql != "" && !isSystemName(row.name) {
+			fmt.Println(row.sql + ";")
+		}
+	}
+	if !hasStats {
+		fmt.Println("/* No STAT tables available */")
+		return nil
+	}
+
+	rs, err := executeStatement(sh.db, "SELECT * FROM sqlite_stat1")
+	if err != nil {
+		return err
+	}
+	fmt.Println("ANALYZE sqlite_schema;")
+	for _, row := range rs.rows {
+		literals := make([]string, len(row))
+		for i, v := range row {
+			literals[i] = sqlLiteral(v)
+		}
+		fmt.Printf("INSERT INTO sqlite_stat1 VALUES(%s);\n", strings.Join(literals, ","))
+	}
+	fmt.Println("ANALYZE sqlite_schema;")
+	return nil
+}
+
+// Reports whether a name matches the LIKE pattern of a dot-command's
+// arguments, or whether they have none
+func schemaPatternMatch(args []string, name string) bool {
+	return len(args) < 2 || likeMatch(args[1], name, 0)
+}
+
+func isSystemName(name string) bool {
+	return strings.HasPrefix(strings.ToLower(name), "sqlite_")
+}
+
+// Prints names sorted down columns that fit in 80 characters, as sqlite3
+// lists tables and indexes
+func printNameColumns(names []string) {
+	if len(names) == 0 {
+		return
+	}
+	sort.Strings(names)
+	width := 0
+	for _, name := range names {
+		width = max(width, len(name))
+	}
+	columns := max(1, 80/(width+2))
+	rows := (len(names) + columns - 1) / columns
+	for r := 0; r < rows; r++ {
+		var line strings.Builder
+		for i := r; i < len(names); i += rows {
+			if i > r {
+				line.WriteString("  ")
+			}
+			line.WriteString(padRight(names[i], width))
+		}
+		fmt.Println(line.String())
+	}
+}
@@ -0,0 +1,467 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Evaluates a built-in scalar SQL function
+func callScalarFunction(name string, args []interface{}) (interface{}, error) {
+	arg := func(i int) interface{} {
+		if i < len(args) {
+			return args[i]
+		}
+		return nil
+	}
+	wantArgs := func(min, max int) error {
+		if len(args) < min || (max >= 0 && len(args) > max) {
+			return fmt.Errorf("wrong number of arguments to function %s()", name)
+		}
+		return nil
+	}
+
+	switch name {
+	case "coalesce", "ifnull":
+		if err := wantArgs(2, -1); err != nil {
+			return nil, err
+		}
+		for _, a := range args {
+			if a != nil {
+				return a, nil
+			}
+		}
+		return nil, nil
+	case "nullif":
+		if err := wantArgs(2, 2); err != nil {
+			return nil, err
+		}
+		if args[0] != nil && args[1] != nil && compareValues(args[0], args[1]) == 0 {
+			return nil, nil
+		}
+		return args[0], nil
+	case "iif", "if":
+		if err := wantArgs(3, 3); err != nil {
+			return nil, err
+		}
+		if isTrue(args[0]) {
+			return args[1], nil
+		}
+		return args[2], nil
+	case "typeof":
+		if err := wantArgs(1, 1); err != nil {
+			return nil, err
+		}
+		return storageClass(args[0]), nil
+	case "length":
+		if err := wantArgs(1, 1); err != nil {
+			return nil, err
+		}
+		switch v := normalizeValue(args[0]).(type) {
+		case nil:
+			return nil, nil
+		case []byte:
+			return int64(len(v)), nil
+		default:
+			return int64(utf8.RuneCountInString(formatValue(v))), nil
+		}
+	case "lower", "upper":
+		if err := wantArgs(1, 1); err != nil {
+			return nil, err
+		}
+		if args[0] == nil {
+			return nil, nil
+		}
+		if name == "lower" {
+			return asciiLower(formatValue(args[0])), nil
+		}
+		return strings.Map(func(r rune) rune {
+			if r >= 'a' && r <= 'z' {
+				return r - 32
+			}
+			return r
+		}, formatValue(args[0])), nil
+	case "abs":
+		if err := wantArgs(1, 1); err != nil {
+			return nil, err
+		}
+		if args[0] == nil {
+			return nil, nil
+		}
+		i, f, isInt := toNumber(args[0])
+		if isInt {
+			if i == math.MinInt64 {
+				return nil, fmt.Errorf("integer overflow")
+			}
+			if i < 0 {
+				return -i, nil
+			}
+			return i, nil
+		}
+		return math.Abs(f), nil
+	case "sign":
+		if err := wantArgs(1, 1); err != nil {
+			return nil, err
+		}
+		if args[0] == nil {
+			return nil, nil
+		}
+		_, f, _ := toNumber(args[0])
+		switch {
+		case f > 0:
+			return int64(1), nil
+		case f < 0:
+			return int64(-1), nil
+		}
+		return int64(0), nil
+	case "round":
+		if err := wantArgs(1, 2); err != nil {
+			return nil, err
+		}
+		if args[0] == nil {
+			return nil, nil
+		}
+		_, f, _ := toNumber(args[0])
+		digits, _, _ := toNumber(arg(1))
+		scale := math.Pow(10, float64(digits))
+		return math.Round(f*scale) / scale, nil
+	case "substr", "substring":
+		if err := wantArgs(2, 3); err != nil {
+			return nil, err
+		}
+		return substrValue(args)
+	case "trim", "ltrim", "rtrim":
+		if err := wantArgs(1, 2); err != nil {
+			return nil, err
+		}
+		if args[0] == nil {
+			return nil, nil
+		}
+		cutset := " "
+		if len(args) == 2 {
+			if args[1] == nil {
+				return nil, nil
+			}
+			cutset = formatValue(args[1])
+		}
+		s := formatValue(args[0])
+		switch name {
+		case "ltrim":
+			return strings.TrimLeft(s, cutset), nil
+		case "rtrim":
+			return strings.TrimRight(s, cutset), nil
+		}
+		return strings.Trim(s, cutset), nil
+	case "replace":
+		if err := wantArgs(3, 3); err != nil {
+			return nil, err
+		}
+		if args[0] == nil || args[1] == nil || args[2] == nil {
+			return nil, nil
+		}
+		from := formatValue(args[1])
+		if from == "" {
+			return formatValue(args[0]), nil
+		}
+		return strings.ReplaceAll(formatValue(args[0]), from, formatValue(args[2])), nil
+	case "instr":
+		if err := wantArgs(2, 2); err != nil {
+			return nil, err
+		}
+		if args[0] == nil || args[1] == nil {
+			return nil, nil
+		}
+		haystack, needle := formatValue(args[0]), formatValue(args[1])
+		i := strings.Index(haystack, needle)
+		if i < 0 {
+			return int64(0), nil
+		}
+		return int64(utf8.RuneCountInString(haystack[:i]) + 1), nil
+	case "hex":
+		if err := wantArgs(1, 1); err != nil {
+			return nil, err
+		}
+		if b, ok := args[0].([]byte); ok {
+			return strings.ToUpper(hex.EncodeToString(b)), nil
+		}
+		return strings.ToUpper(hex.EncodeToString([]byte(formatValue(args[0])))), nil
+	case "raise":
+		// RAISE(action, message) arrives with its action as a string
+		if err := wantArgs(1, 2); err != nil {
+			return nil, err
+		}
+		return nil, &raiseError{action: formatValue(args[0]), message: formatValue(arg(1))}
+	case "quote":
+		if err := wantArgs(1, 1); err != nil {
+			return nil, err
+		}
+		return sqlLiteral(args[0]), nil
+	case "char":
+		var sb strings.Builder
+		for _, a := range args {
+			i, _, _ := toNumber(a)
+			sb.WriteRune(rune(i))
+		}
+		return sb.String(), nil
+	case "unicode":
+		if err := wantArgs(1, 1); err != nil {
+			return nil, err
+		}
+		if args[0] == nil {
+			return nil, nil
+		}
+		r, _ := utf8.DecodeRuneInString(formatValue(args[0]))
+		if r == utf8.RuneError {
+			return nil, nil
+		}
+		return int64(r), nil
+	case "zeroblob":
+		if err := wantArgs(1, 1); err != nil {
+			return nil, err
+		}
+		n, _, _ := toNumber(args[0])
+		if n < 0 {
+			n = 0
+		}
+		return make([]byte, n), nil
+	case "min", "max":
+		// The multi-argument forms are scalar; one argument means aggregate
+		if err := wantArgs(2, -1); err != nil {
+			return nil, fmt.Errorf("misuse of aggregate function %s()", name)
+		}
+		best := args[0]
+		for _, a := range args {
+			if a == nil {
+				return nil, nil
+			}
+			c := compareSortValues(a, best, "")
+			if (name == "min" && c < 0) || (name == "max" && c > 0) {
+				best = a
+			}
+		}
+		return best, nil
+	case "likely", "unlikely":
+		if err := wantArgs(1, 1); err != nil {
+			return nil, err
+		}
+		return args[0], nil
+	case "sqlite_version":
+		return sqliteVersion, nil
+	}
+	if isAggregateFunction(name) {
+		return nil, fmt.Errorf("misuse of aggregate function %s()", name)
+	}
+	return nil, fmt.Errorf("no such function: %s", name)
+}
+
+// The library version reported by sqlite_version() and written to headers
+const sqliteVersion = "3.45.0"
+
+// sqliteVersion as written to offset 96 of the database header
+const sqliteVersionNumber = 3045000
+
+func substrValue(args []interface{}) (interface{}, error) {
+	if args[0] == nil || args[1] == nil {
+		return nil, nil
+	}
+	start, _, _ := toNumber(args[1])
+	var chars []rune
+	var raw []byte
+	isBlob := false
+	if b, ok := args[0].([]byte); ok {
+		raw, isBlob = b, true
+	} else {
+		chars = []rune(formatValue(args[0]))
+	}
+	size := int64(len(chars))
+	if isBlob {
+		size = int64(len(raw))
+	}
+	length := size + 1
+	if len(args) == 3 {
+		if args[2] == nil {
+			return nil, nil
+		}
+		length, _, _ = toNumber(args[2])
+	}
+
+	// Positions are 1-based; negative starts count from the end and a
+	// negative length takes characters to the left of start
+	if start < 0 {
+		start += size + 1
+	} else if start == 0 {
+		start = 1
+		if len(args) == 3 && length > 0 {
+			length--
+		}
+	}
+	from, to := start-1, start-1+length
+	if length < 0 {
+		from, to = start-1+length, start-1
+	}
+	if from < 0 {
+		from = 0
+	}
+	if to > size {
+		to = size
+	}
+	if from >= to {
+		if isBlob {
+			return []byte{}, nil
+		}
+		return "", nil
+	}
+	if isBlob {
+		return raw[from:to], nil
+	}
+	return string(chars[from:to]), nil
+}
+
+// Renders a value as an SQL literal, as quote() and .dump do
+func sqlLiteral(v interface{}) string {
+	switch n := normalizeValue(v).(type) {
+	case nil:
+		return "NULL"
+	case int64:
+		return formatValue(n)
+	case float64:
+		if math.IsInf(n, 1) {
+			return "9.0e+999"
+		} else if math.IsInf(n, -1) {
+			return "-9.0e+999"
+		}
+		return formatRealLiteral(n)
+	case string:
+		return "'" + strings.ReplaceAll(n, "'", "''") + "'"
+	case []byte:
+		return "X'" + strings.ToUpper(hex.EncodeToString(n)) + "'"
+	}
+	return formatValue(v)
+}
+
+// Formats a REAL with enough digits to round-trip exactly
+func formatRealLiteral(f float64) string {
+	s := formatReal(f)
+	if _, rf, _ := parseNumericPrefix(s); rf == f {
+		return s
+	}
+	s = strconv.FormatFloat(f, 'g', 17, 64)
+	if !strings.ContainsAny(s, ".e") {
+		s += ".0"
+	}
+	return s
+}
+
+func isAggregateFunction(name string) bool {
+	switch name {
+	case "count", "sum", "total", "avg", "min", "max", "group_concat", "string_agg":
+		return true
+	}
+	return false
+}
+
+// aggregateState accumulates one aggregate function over a group of rows
+type aggregateState struct {
+	name     string
+	distinct bool
+	seen     map[string]bool
+	count    int64
+	intSum   int64
+	realSum  float64
+	allInts  bool
+	overflow bool
+	best     interface{}
+	parts    []string
+	sep      string
+}
+
+func newAggregateState(name string, distinct bool) *aggregateState {
+	return &aggregateState{name: name, distinct: distinct, seen: make(map[string]bool), allInts: true, sep: ","}
+}
+
+// Adds one row's argument values; count(*) passes no arguments
+func (a *aggregateState) step(args []interface{}) {
+	if a.name == "count" && len(args) == 0 {
+		a.count++
+		return
+	}
+	if len(args) == 0 || args[0] == nil {
+		return
+	}
+	v := normalizeValue(args[0])
+	if a.distinct {
+		key := storageClass(v) + ":" + formatValue(v)
+		if a.seen[key] {
+			return
+		}
+		a.seen[key] = true
+	}
+	a.count++
+	switch a.name {
+	case "sum", "total", "avg":
+		i, f, isInt := toNumber(v)
+		_, isReal := v.(float64)
+		if isInt && !isReal && a.allInts && !a.overflow {
+			if s := a.intSum + i; (s > a.intSum) == (i > 0) || i == 0 {
+				a.intSum = s
+			} else {
+				a.overflow = true
+			}
+		} else {
+			a.allInts = false
+		}
+		a.realSum += f
+	case "min":
+		if a.best == nil || compareSortValues(v, a.best, "") < 0 {
+			a.best = v
+		}
+	case "max":
+		if a.best == nil || compareSortValues(v, a.best, "") > 0 {
+			a.best = v
+		}
+	case "group_concat", "string_agg":
+		if len(args) > 1 && args[1] != nil {
+			a.sep = formatValue(args[1])
+		}
+		if len(a.parts) > 0 {
+			a.parts = append(a.parts, a.sep)
+		}
+		a.parts = append(a.parts, formatValue(v))
+	}
+}
+
+func (a *aggregateState) result() (interface{}, error) {
+	switch a.name {
+	case "count":
+		return a.count, nil
+	case "sum":
+		if a.count == 0 {
+			return nil, nil
+		}
+		if a.allInts {
+			if a.overflow {
+				return nil, fmt.Errorf("integer overflow")
+			}
+			return a.intSum, nil
+		}
+		return a.realSum, nil
+	case "total":
+		return a.realSum, nil
+	case "avg":
+		if a.count == 0 {
+			return nil, nil
+		}
+		return a.realSum / float64(a.count), nil
+	case "min", "max":
+		return a.best, nil
+	case "group_concat", "string_agg":
+		if len(a.parts) == 0 {
+			return nil, nil
+		}
+		return strings.Join(a.parts, ""), nil
+	}
+	return nil, fmt.Errorf("no such function: %s", a.name)
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Values flowing through queries are nil (NULL), int64, float64, string
+// (TEXT) or []byte (BLOB), matching SQLite's storage classes.
+
+// Normalises the integer kinds produced by the parsers to int64
+func normalizeValue(v interface{}) interface{} {
+	switch n := v.(type) {
+	case int:
+		return int64(n)
+	case int8, int16, int32, uint8, uint16, uint32, uint64:
+		return int64(toInt(n))
+	}
+	return v
+}
+
+func storageClass(v interface{}) string {
+	switch normalizeValue(v).(type) {
+	case nil:
+		return "null"
+	case int64:
+		return "integer"
+	case float64:
+		return "real"
+	case string:
+		return "text"
+	default:
+		return "blob"
+	}
+}
+
+// Converts a value to a number following SQLite's rules for arithmetic:
+// text is parsed as the longest numeric prefix, anything else becomes 0
+func toNumber(v interface{}) (int64, float64, bool) {
+	switch n := normalizeValue(v).(type) {
+	case int64:
+		return n, float64(n), true
+	case float64:
+		return int64(n), n, false
+	case string:
+		return parseNumericPrefix(n)
+	case []byte:
+		return parseNumericPrefix(string(n))
+	}
+	return 0, 0, true
+}
+
+func parseNumericPrefix(s string) (int64, float64, bool) {
+	s = strings.TrimSpace(s)
+	end := 0
+	if end < len(s) && (s[end] == '+' || s[end] == '-') {
+		end++
+	}
+	digits := end
+	for end < len(s) && isDigit(s[end]) {
+		end++
+	}
+	isInt := true
+	if end < len(s) && s[end] == '.' {
+		isInt = false
+		end++
+		for end < len(s) && isDigit(s[end]) {
+			end++
+		}
+	}
+	if end > digits && end < len(s) && (s[end] == 'e' || s[end] == 'E') {
+		j := end + 1
+		if j < len(s) && (s[j] == '+' || s[j] == '-') {
+			j++
+		}
+		if j < len(s) && isDigit(s[j]) {
+			isInt = false
+			end = j
+			for end < len(s) && isDigit(s[end]) {
+				end++
+			}
+		}
+	}
+	if isInt {
+		if n, err := strconv.ParseInt(s[:end], 10, 64); err == nil {
+			return n, float64(n), true
+		}
+	}
+	f, err := strconv.ParseFloat(s[:end], 64)
+	if err != nil {
+		return 0, 0, true
+	}
+	return int64(f), f, false
+}
+
+// Reports whether text is a well-formed number in its entirety
+func looksNumeric(s string) bool {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return false
+	}
+	_, err := strconv.ParseFloat(s, 64)
+	return err == nil && !strings.ContainsAny(s, "xXnN")
+}
+
+// Applies a column affinity to a value the way SQLite does before storing
+// it or comparing it with the column
+func applyAffinity(v interface{}, affinity string) interface{} {
+	v = normalizeValue(v)
+	switch affinity {
+	case "TEXT":
+		switch n := v.(type) {
+		case int64, float64:
+			return formatValue(n)
+		}
+	case "INTEGER", "NUMERIC", "REAL":
+		var numeric interface{} = v
+		if s, ok := v.(string); ok && looksNumeric(s) {
+			i, f, isInt := parseNumericPrefix(s)
+			if isInt {
+				numeric = i
+			} else if f == math.Trunc(f) && math.Abs(f) < 1<<62 && affinity != "REAL" {
+				numeric = int64(f)
+			} else {
+				numeric = f
+			}
+		}
+		switch n := numeric.(type) {
+		case int64:
+			if affinity == "REAL" {
+				return float64(n)
+			}
+		case float64:
+			// A real that is exactly an integer is stored as one
+			if affinity != "REAL" && n == math.Trunc(n) && math.Abs(n) < 1<<62 {
+				return int64(n)
+			}
+		}
+		return numeric
+	}
+	return v
+}
+
+// Truth value of a condition result; NULL counts as false
+func isTrue(v interface{}) bool {
+	if v == nil {
+		return false
+	}
+	i, f, isInt := toNumber(v)
+	if isInt {
+		return i != 0
+	}
+	return f != 0
+}
+
+func boolValue(b bool) interface{} {
+	if b {
+		return int64(1)
+	}
+	return int64(0)
+}
+
+// Orders two values the way SQLite sorts them: NULL, then numbers, then
+// text (by collation), then blobs
+func compareSortValues(a, b interface{}, collation string) int {
+	a, b = normalizeValue(a), normalizeValue(b)
+	ca, cb := sortClassRank(a), sortClassRank(b)
+	if ca != cb {
+		return ca - cb
+	}
+	switch av := a.(type) {
+	case nil:
+		return 0
+	case int64, float64:
+		ai, af, aInt := toNumber(av)
+		bi, bf, bInt := toNumber(b)
+		if aInt && bInt {
+			switch {
+			case ai < bi:
+				return -1
+			case ai > bi:
+				return 1
+			}
+			return 0
+		}
+		switch {
+		case af < bf:
+			return -1
+		case af > bf:
+			return 1
+		}
+		return 0
+	case string:
+		return compareText(av, b.(string), collation)
+	case []byte:
+		return bytes.Compare(av, b.([]byte))
+	}
+	return 0
+}
+
+func sortClassRank(v interface{}) int {
+	switch v.(type) {
+	case nil:
+		return 0
+	case int64, float64:
+		return 1
+	case string:
+		return 2
+	default:
+		return 3
+	}
+}
+
+func compareText(a, b string, collation string) int {
+	switch strings.ToUpper(collation) {
+	case "NOCASE":
+		return strings.Compare(asciiLower(a), asciiLower(b))
+	case "RTRIM":
+		return strings.Compare(strings.TrimRight(a, " "), strings.TrimRight(b, " "))
+	}
+	return strings.Compare(a, b)
+}
+
+// Maps text to a form that is the same for all text equal to it under the
+// collation
+func collationKey(s string, collation string) string {
+	switch strings.ToUpper(collation) {
+	case "NOCASE":
+		return asciiLower(s)
+	case "RTRIM":
+		return strings.TrimRight(s, " ")
+	}
+	return s
+}
+
+// NOCASE only folds ASCII letters, like SQLite
+func asciiLower(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		if c >= 'A' && c <= 'Z' {
+			b[i] = c + 32
+		}
+	}
+	return string(b)
+}
+
+// Formats a value as sqlite3 prints it in list mode
+func formatValue(v interface{}) string {
+	switch n := normalizeValue(v).(type) {
+	case nil:
+		return ""
+	case int64:
+		return strconv.FormatInt(n, 10)
+	case float64:
+		return formatReal(n)
+	case string:
+		return n
+	case []byte:
+		return string(n)
+	}
+	return valueToString(v)
+}
+
+// Renders a REAL with 15 significant digits, always keeping a decimal point
+func formatReal(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	case math.IsNaN(f):
+		return ""
+	}
+	s := strconv.FormatFloat(f, 'g', 15, 64)
+	if i := strings.IndexByte(s, 'e'); i >= 0 {
+		mantissa, exp := s[:i], s[i+1:]
+		if !strings.Contains(mantissa, ".") {
+			mantissa += ".0"
+		}
+		return mantissa + "e" + exp
+	}
+	if !strings.Contains(s, ".") {
+		s += ".0"
+	}
+	return s
+}
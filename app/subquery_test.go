@@ -0,0 +1,100 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+var subquerySchema = []string{
+	"CREATE TABLE t(id INTEGER PRIMARY KEY, a TEXT)",
+	"CREATE TABLE u(tid INT, b TEXT)",
+	"CREATE TABLE cnt(tid INT, n INT)",
+	"INSERT INTO t VALUES (1, 'x'), (2, 'y'), (3, 'z')",
+	"INSERT INTO u VALUES (1, 'x'), (2, 'q'), (3, 'z'), (3, 'w')",
+	"INSERT INTO cnt VALUES (1, 10), (3, 30)",
+	"CREATE VIEW vc AS SELECT a, (SELECT n FROM cnt WHERE cnt.tid = t.id) FROM t",
+}
+
+// Correlated subqueries run once per row of the query around them, and
+// see its columns where their own FROM does not have them
+func TestCorrelatedSubqueries(t *testing.T) {
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"SELECT * FROM vc", []string{"x|10", "y|", "z|30"}},
+		{"SELECT a FROM t WHERE id IN (SELECT tid FROM u WHERE u.b = t.a)", []string{"x", "z"}},
+		{"SELECT a FROM t WHERE EXISTS (SELECT 1 FROM u WHERE u.tid = t.id AND u.b = 'w')", []string{"z"}},
+		{"SELECT a, (SELECT count(*) FROM u WHERE tid = id) FROM t", []string{"x|1", "y|1", "z|2"}},
+		{"SELECT a FROM t AS o WHERE (SELECT count(*) FROM t WHERE t.id < o.id) = 1", []string{"y"}},
+		{
+			"SELECT a, (SELECT group_concat(b) FROM u WHERE u.tid = t.id AND EXISTS (SELECT 1 FROM cnt WHERE cnt.tid = u.tid)) FROM t",
+			[]string{"x|x", "y|", "z|z,w"},
+		},
+		{
+			"SELECT tid, count(*) FROM u GROUP BY tid HAVING count(*) > (SELECT count(*) FROM cnt WHERE cnt.tid = u.tid)",
+			[]string{"2|1", "3|2"},
+		},
+	}
+	db := openTestDatabase(t, filepath.Join(t.TempDir(), "test.db"))
+	defer db.close()
+	for _, sql := range subquerySchema {
+		mustExec(t, db, sql)
+	}
+	for _, tt := range tests {
+		if got := mustExec(t, db, tt.query); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s = %q, want %q", tt.query, got, tt.want)
+		}
+	}
+	if _, err := executeStatement(db, "SELECT a FROM t WHERE id IN (SELECT tid FROM u WHERE nosuch = 1)"); err == nil || err.Error() != "no such column: nosuch" {
+		t.Errorf("unknown column in subquery: err = %v", err)
+	}
+}
+
+// UPDATE, DELETE and upserts run their correlated subqueries once for each
+// row they change
+func TestCorrelatedWrites(t *testing.T) {
+	tests := []struct {
+		name  string
+		write string
+		want  []string
+	}{
+		{
+			name:  "update",
+			write: "UPDATE t SET a = (SELECT max(b) FROM u WHERE u.tid = t.id)",
+			want:  []string{"1|x", "2|q", "3|z"},
+		},
+		{
+			name:  "update where",
+			write: "UPDATE t SET a = upper(a) WHERE a IN (SELECT b FROM u WHERE u.tid = t.id)",
+			want:  []string{"1|X", "2|y", "3|Z"},
+		},
+		{
+			name:  "delete",
+			write: "DELETE FROM t WHERE NOT EXISTS (SELECT 1 FROM cnt WHERE cnt.tid = t.id)",
+			want:  []string{"1|x", "3|z"},
+		},
+		{
+			name:  "upsert",
+			write: "INSERT INTO t VALUES (3, 'new') ON CONFLICT(id) DO UPDATE SET a = (SELECT group_concat(b) FROM u WHERE u.tid = t.id) || excluded.a",
+			want:  []string{"1|x", "2|y", "3|z,wnew"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := openTestDatabase(t, filepath.Join(t.TempDir(), "test.db"))
+			defer db.close()
+			for _, sql := range subquerySchema {
+				mustExec(t, db, sql)
+			}
+			mustExec(t, db, tt.write)
+			if got := mustExec(t, db, "SELECT * FROM t"); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("rows = %q, want %q", got, tt.want)
+			}
+			if got := mustExec(t, db, "PRAGMA integrity_check"); !reflect.DeepEqual(got, []string{"ok"}) {
+				t.Errorf("integrity_check = %q", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// tableLayout maps a table's declared columns onto the slots of its records
+type tableLayout struct {
+	payloadCols  []string
+	payloadIndex map[string]int
+	rowidColName string
+	defaults     []interface{} // value for each record slot missing from short records
+}
+
+func newTableLayout(defs []columnDef) tableLayout {
+	layout := tableLayout{payloadIndex: make(map[string]int)}
+	recordIndex := 0
+	for _, def := range defs {
+		if def.isVirtual() {
+			continue // Virtual generated columns are not stored in the record
+		}
+		if def.isRowid {
+			layout.rowidColName = def.name
+		} else {
+			layout.payloadCols = append(layout.payloadCols, def.name)
+			layout.payloadIndex[strings.ToLower(def.name)] = recordIndex
+		}
+		layout.defaults = append(layout.defaults, def.defaultValue())
+		recordIndex++
+	}
+	return layout
+}
+
+// Pads records written before ALTER TABLE ADD COLUMN with the default
+// values of the columns they are missing
+func (l tableLayout) applyDefaults(rec Record) Record {
+	if len(rec.values) >= len(l.defaults) {
+		return rec
+	}
+	values := make([]interface{}, len(l.defaults))
+	copy(values, rec.values)
+	copy(values[len(rec.values):], l.defaults[len(rec.values):])
+	return Record{values: values}
+}
+
+// Evaluates the column's DEFAULT clause into the value SQLite would store,
+// or nil when the column has no default. A default that is not a literal,
+// such as DEFAULT (1 + 2), is evaluated as an expression.
+func (c columnDef) defaultValue() interface{} {
+	if !c.hasDefault {
+		return nil
+	}
+	if v, ok := constantLiteral(c.defaultExpr); ok {
+		return v
+	}
+	expr, err := parseExpression(c.defaultExpr)
+	if err != nil {
+		return nil
+	}
+	var v interface{}
+	err = func() (err error) {
+		defer recoverEvalError(&err)
+		v = getExprValue(expr, nil, nil, "", nil, 0)
+		return nil
+	}()
+	if err != nil {
+		return nil
+	}
+	return v
+}
+
+// Reads a literal: a number, optionally signed, a string, blob, NULL, TRUE
+// or FALSE, a bare name, which SQLite takes as a string, or any of these in
+// parentheses. Reports false for anything else.
+func constantLiteral(text string) (interface{}, bool) {
+	tokens, err := tokenizeSQL(text)
+	if err != nil || len(tokens) == 0 {
+		return nil, false
+	}
+	negative := false
+	if len(tokens) == 2 && tokens[0].kind == tokPunct && (tokens[0].text == "-" || tokens[0].text == "+") {
+		negative = tokens[0].text == "-"
+		tokens = tokens[1:]
+	}
+	if len(tokens) == 1 {
+		t := tokens[0]
+		switch t.kind {
+		case tokNumber:
+			return numericLiteral(t.text, negative), true
+		case tokString:
+			return t.value, !negative
+		case tokBlob:
+			return []byte(decodeHexLiteral(t.value)), !negative
+		case tokIdent:
+			if negative {
+				return nil, false
+			}
+			switch strings.ToUpper(t.text) {
+			case "NULL":
+				return nil, true
+			case "TRUE":
+				return int64(1), true
+			case "FALSE":
+				return int64(0), true
+			case "CURRENT_TIME", "CURRENT_DATE", "CURRENT_TIMESTAMP":
+				return nil, false
+			}
+			return t.value, true
+		}
+		return nil, false
+	}
+
+	// Parenthesised defaults such as DEFAULT (0) hold a plain literal
+	if tokens[0].text == "(" && tokens[len(tokens)-1].text == ")" && !negative {
+		return constantLiteral(text[tokens[0].end:tokens[len(tokens)-1].pos])
+	}
+	return nil, false
+}
+
+func numericLiteral(text string, negative bool) interface{} {
+	if strings.HasPrefix(text, "0x") || strings.HasPrefix(text, "0X") {
+		if n, err := strconv.ParseUint(text[2:], 16, 64); err == nil {
+			if negative {
+				return -int64(n)
+			}
+			return int64(n)
+		}
+	}
+	if n, err := strconv.ParseInt(text, 10, 64); err == nil {
+		if negative {
+			return -n
+		}
+		return n
+	}
+	f, err := strconv.ParseFloat(text, 64)
+	if err != nil {
+		return text
+	}
+	if negative {
+		return -f
+	}
+	return f
+}
+
+func decodeHexLiteral(hex string) string {
+	out := make([]byte, 0, len(hex)/2)
+	for i := 0; i+1 < len(hex); i += 2 {
+		n, err := strconv.ParseUint(hex[i:i+2], 16, 8)
+		if err != nil {
+			break
+		}
+		out = append(out, byte(n))
+	}
+	return string(out)
+}
@@ -0,0 +1,484 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/xwb1989/sqlparser"
+)
+
+// tableWriter changes the rows of one table and keeps its indexes in step
+type tableWriter struct {
+	db          *database
+	schemaRow   *SQLiteSchemaRow
+	def         *tableDef
+	root        int
+	indexes     []*indexWriter
+	columnIndex map[string]int // lower-cased column name to position, for expressions
+	columnNames []string
+	generated   []sqlparser.Expr // generated column expressions, nil for ordinary columns
+	checks      []sqlparser.Expr // CHECK constraints, in declaration order
+	replaced    map[int64]bool   // rows deleted by REPLACE conflict resolution
+	triggers    []*triggerDef
+
+	// Foreign keys of the table, and of tables that refer to it, when
+	// they are enforced; related holds writers for the tables their
+	// actions change
+	references   []*foreignKeyLink
+	referencedBy []*foreignKeyLink
+	related      map[string]*tableWriter
+}
+
+// indexWriter derives the entries of one index from table rows
+type indexWriter struct {
+	def     *indexDef
+	columns []keyColumn      // how each key column sorts; the trailing rowid sorts as BINARY
+	sources []int            // table column of each key column, -1 for the rowid, -2 for an expression
+	exprs   []sqlparser.Expr // expression of each expression column
+	where   sqlparser.Expr   // condition of a partial index
+}
+
+func newTableWriter(db *database, name string) (*tableWriter, error) {
+	if isSchemaTableName(name) {
+		return nil, fmt.Errorf("table %s may not be modified", name)
+	}
+	row := db.findSchemaRow("table", name)
+	if row == nil {
+		if db.findSchemaRow("view", name) != nil {
+			return nil, fmt.Errorf("cannot modify %s because it is a view", name)
+		}
+		return nil, fmt.Errorf("no such table: %s", name)
+	}
+	def, err := parseCreateTable(row.sql)
+	if err != nil {
+		return nil, err
+	}
+	if def.withoutRowid {
+		return nil, fmt.Errorf("writing to WITHOUT ROWID table %s is not supported", def.name)
+	}
+
+	w := &tableWriter{db: db, schemaRow: row, def: def, root: row.rootPage, columnIndex: make(map[string]int)}
+	for i, col := range def.columns {
+		w.columnIndex[strings.ToLower(col.name)] = i
+		w.columnIndex[strings.ToLower(def.name+"."+col.name)] = i
+		w.columnNames = append(w.columnNames, col.name)
+		var expr sqlparser.Expr
+		if col.generated != "" {
+			if expr, err = parseExpression(col.generated); err != nil {
+				return nil, err
+			}
+		}
+		w.generated = append(w.generated, expr)
+	}
+	for _, check := range def.checks {
+		expr, err := parseExpression(check.expr)
+		if err != nil {
+			return nil, err
+		}
+		w.checks = append(w.checks, expr)
+	}
+
+	for _, idx := range db.tableIndexes(def.name) {
+		ix := &indexWriter{def: idx}
+		for _, col := range idx.columns {
+			key := keyColumn{collation: col.collation, desc: col.desc}
+			source := def.columnIndex(col.name)
+			var expr sqlparser.Expr
+			switch {
+			case source >= 0:
+				if key.collation == "" {
+					key.collation = def.columns[source].collation
+				}
+			case isRowidName(col.name):
+				source = -1
+			default:
+				source = -2
+				if expr, err = parseExpression(col.name); err != nil {
+					return nil, err
+				}
+			}
+			ix.columns = append(ix.columns, key)
+			ix.sources = append(ix.sources, source)
+			ix.exprs = append(ix.exprs, expr)
+		}
+		if idx.where != "" {
+			if ix.where, err = parseExpression(idx.where); err != nil {
+				return nil, err
+			}
+		}
+		w.indexes = append(w.indexes, ix)
+	}
+	if w.triggers, err = db.tableTriggers(def.name); err != nil {
+		return nil, err
+	}
+	if db.foreignKeys {
+		if err := w.resolveForeignKeys(); err != nil {
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+// Computes the generated columns of a row whose other values are set
+func (w *tableWriter) computeGenerated(values []interface{}, rowid int64) {
+	for i, expr := range w.generated {
+		if expr != nil {
+			v := getExprValue(expr, w.columnIndex, w.columnNames, "", values, int(rowid))
+			values[i] = applyAffinity(v, w.def.columns[i].affinity)
+		}
+	}
+}
+
+// The record stored for a row: virtual columns have no slot and the
+// INTEGER PRIMARY KEY is stored as NULL since it is the rowid
+func (w *tableWriter) record(values []interface{}) []byte {
+	stored := make([]interface{}, 0, len(values))
+	for i, col := range w.def.columns {
+		switch {
+		case col.isVirtual():
+		case col.isRowid:
+			stored = append(stored, nil)
+		default:
+			stored = append(stored, values[i])
+		}
+	}
+	return serializeRecord(stored)
+}
+
+// Returns the index entry for a row, or false when a partial index does
+// not cover it
+func (w *tableWriter) indexKey(ix *indexWriter, values []interface{}, rowid int64) ([]interface{}, bool) {
+	if ix.where != nil && !evaluateWhereClause(ix.where, w.columnIndex, w.columnNames, "", values, int(rowid)) {
+		return nil, false
+	}
+	key := make([]interface{}, 0, len(ix.sources)+1)
+	for i, source := range ix.sources {
+		switch {
+		case source >= 0:
+			key = append(key, normalizeValue(values[source]))
+		case source == -1:
+			key = append(key, rowid)
+		default:
+			key = append(key, getExprValue(ix.exprs[i], w.columnIndex, w.columnNames, "", values, int(rowid)))
+		}
+	}
+	return append(key, rowid), true
+}
+
+// Describes the columns of a unique index the way constraint errors do
+func (w *tableWriter) uniqueTarget(ix *indexWriter) string {
+	var names []string
+	for _, source := range ix.sources {
+		switch {
+		case source >= 0:
+			names = append(names, w.def.name+"."+w.def.columns[source].name)
+		case source == -1:
+			names = append(names, w.def.name+".rowid")
+		default:
+			return fmt.Sprintf("index '%s'", ix.def.name)
+		}
+	}
+	return strings.Join(names, ", ")
+}
+
+func (w *tableWriter) rowidTarget() string {
+	if i := w.def.rowidColumn(); i >= 0 {
+		return w.def.name + "." + w.def.columns[i].name
+	}
+	return w.def.name + ".rowid"
+}
+
+// Returns the rowid to give a new row when none was specified
+func (w *tableWriter) nextRowid() (int64, error) {
+	max, found, err := w.db.file.maxRowid(w.root)
+	if err != nil {
+		return 0, err
+	}
+	if w.def.hasAutoincrement() {
+		if seq, ok, err := w.db.sequenceValue(w.def.name); err != nil {
+			return 0, err
+		} else if ok && (!found || seq > max) {
+			max, found = seq, true
+		}
+	}
+	if !found {
+		return 1, nil
+	}
+	if max == 1<<63-1 {
+		return 0, fmt.Errorf("database or disk is full")
+	}
+	return max + 1, nil
+}
+
+// Reports whether a row with the given rowid exists
+func (w *tableWriter) rowExists(rowid int64) (bool, error) {
+	_, _, _, exact, err := w.db.file.seek(w.root, tableKeyCompare(rowid))
+	return exact, err
+}
+
+// Adds a row given its column values in declaration order, once its
+// constraints have been checked
+func (w *tableWriter) insertRow(values []interface{}, rowid int64) error {
+	if err := w.storeRecord(values, rowid); err != nil {
+		return err
+	}
+	for _, ix := range w.indexes {
+		if key, ok := w.indexKey(ix, values, rowid); ok {
+			if err := w.insertIndexEntry(ix, key); err != nil {
+				return err
+			}
+		}
+	}
+	return w.foreignKeysAfterInsert(values)
+}
+
+// Writes a row's record into the table b-tree, replacing any record with
+// the same rowid
+func (w *tableWriter) storeRecord(values []interface{}, rowid int64) error {
+	cell, err := w.db.file.tableLeafCell(rowid, w.record(values))
+	if err != nil {
+		return err
+	}
+	return w.db.file.insertTableCell(w.root, rowid, cell)
+}
+
+func (w *tableWriter) insertIndexEntry(ix *indexWriter, key []interface{}) error {
+	cell, err := w.db.file.indexLeafCell(serializeRecord(key))
+	if err != nil {
+		return err
+	}
+	return w.db.file.insertIndexCell(ix.def.rootPage, key, ix.columns, cell)
+}
+
+func (w *tableWriter) deleteIndexEntry(ix *indexWriter, key []interface{}, rowid int64) error {
+	found, err := w.db.file.deleteIndexCell(ix.def.rootPage, key, ix.columns)
+	if err == nil && !found {
+		err = fmt.Errorf("database disk image is malformed: index %s has no entry for row %d", ix.def.name, rowid)
+	}
+	return err
+}
+
+// Replaces a row's values, once its constraints have been checked. Index
+// entries are only rewritten where the key changed; a new rowid moves the
+// row.
+func (w *tableWriter) updateRow(oldValues []interface{}, oldRowid int64, values []interface{}, rowid int64) error {
+	keys := make([][]interface{}, len(w.indexes))
+	for i, ix := range w.indexes {
+		keys[i], _ = w.indexKey(ix, values, rowid)
+		oldKey, ok := w.indexKey(ix, oldValues, oldRowid)
+		if ok && keys[i] != nil && bytes.Equal(serializeRecord(oldKey), serializeRecord(keys[i])) {
+			keys[i] = nil // unchanged
+			continue
+		}
+		if ok {
+			if err := w.deleteIndexEntry(ix, oldKey, oldRowid); err != nil {
+				return err
+			}
+		}
+	}
+	if rowid != oldRowid {
+		if _, err := w.db.file.deleteTableCell(w.root, oldRowid); err != nil {
+			return err
+		}
+	}
+	if err := w.storeRecord(values, rowid); err != nil {
+		return err
+	}
+	for i, ix := range w.indexes {
+		if keys[i] != nil {
+			if err := w.insertIndexEntry(ix, keys[i]); err != nil {
+				return err
+			}
+		}
+	}
+	return w.foreignKeysAfterUpdate(oldValues, values)
+}
+
+// Removes a row and its index entries given its current column values
+func (w *tableWriter) deleteRow(values []interface{}, rowid int64) error {
+	for _, ix := range w.indexes {
+		if key, ok := w.indexKey(ix, values, rowid); ok {
+			if err := w.deleteIndexEntry(ix, key, rowid); err != nil {
+				return err
+			}
+		}
+	}
+	if _, err := w.db.file.deleteTableCell(w.root, rowid); err != nil {
+		return err
+	}
+	return w.foreignKeysAfterDelete(values)
+}
+
+// Returns the rows a WHERE clause selects, read in full before any of
+// them change. alias is how the statement names the table.
+func (w *tableWriter) matchingRows(alias string, where sqlparser.Expr) (*relation, []relationRow, error) {
+	var err error
+	if where, err = resolveUncorrelatedSubqueries(w.db, where); err != nil {
+		return nil, nil, err
+	}
+	rel, err := loadTableRelation(w.db, w.schemaRow, alias, where)
+	if err != nil {
+		return nil, nil, err
+	}
+	index, names := rel.columnIndex(), rel.columnNames()
+	if err := checkColumns(where, index); err != nil {
+		return nil, nil, err
+	}
+	if where == nil {
+		return rel, rel.rows, nil
+	}
+	correlated := containsSubquery(where)
+	unbound := where
+	where = rel.withCollations(where)
+	var rows []relationRow
+	for _, row := range rel.rows {
+		cond := where
+		if correlated {
+			if cond, err = w.db.bindOuterRow(unbound, rel, row); err != nil {
+				return nil, nil, err
+			}
+			cond = rel.withCollations(cond)
+		}
+		if evaluateWhereClause(cond, index, names, "", row.values, row.rowid) {
+			rows = append(rows, row)
+		}
+	}
+	return rel, rows, nil
+}
+
+// Looks for an index entry whose leading columns equal prefix, returning
+// the rowid stored with it. NULLs never match, as in UNIQUE constraints.
+func (p *pager) findIndexPrefix(root int, prefix []interface{}, columns []keyColumn) (int64, bool, error) {
+	for _, v := range prefix {
+		if v == nil {
+			return 0, false, nil
+		}
+	}
+	pageNum := root
+	for depth := 0; depth <= 64; depth++ {
+		node, err := p.readNode(pageNum)
+		if err != nil {
+			return 0, false, err
+		}
+		next := len(node.cells)
+		for i, cell := range node.cells {
+			key := p.indexCellKey(node.pageType, cell)
+			c := compareIndexKeys(prefix, key, columns)
+			if c == 0 {
+				rowid, _, _ := toNumber(key[len(key)-1])
+				return rowid, true, nil
+			}
+			if c < 0 {
+				next = i
+				break
+			}
+		}
+		if node.isLeaf() {
+			return 0, false, nil
+		}
+		pageNum = node.child(next)
+	}
+	return 0, false, fmt.Errorf("database disk image is malformed: b-tree too deep")
+}
+
+func (t *tableDef) hasAutoincrement() bool {
+	for _, col := range t.columns {
+		if col.autoincrement {
+			return true
+		}
+	}
+	return false
+}
+
+// Reads the AUTOINCREMENT counter of a table from sqlite_sequence
+func (db *database) sequenceValue(table string) (int64, bool, error) {
+	row := db.findSchemaRow("table", "sqlite_sequence")
+	if row == nil {
+		return 0, false, nil
+	}
+	seqRows, err := db.file.tableRows(row.rootPage)
+	if err != nil {
+		return 0, false, err
+	}
+	for _, seqRow := range seqRows {
+		values := seqRow.record.values
+		if len(values) >= 2 && strings.EqualFold(formatValue(values[0]), table) {
+			seq, _, _ := toNumber(values[1])
+			return seq, true, nil
+		}
+	}
+	return 0, false, nil
+}
+
+// Raises a table's AUTOINCREMENT counter to at least seq
+func (db *database) updateSequence(table string, seq int64) error {
+	row := db.findSchemaRow("table", "sqlite_sequence")
+	if row == nil {
+		return fmt.Errorf("no such table: sqlite_sequence")
+	}
+	var rowid int64 = 1
+	seqRows, err := db.file.tableRows(row.rootPage)
+	if err != nil {
+		return err
+	}
+	for _, seqRow := range seqRows {
+		values := seqRow.record.values
+		if len(values) >= 2 && strings.EqualFold(formatValue(values[0]), table) {
+			if current, _, _ := toNumber(values[1]); current >= seq {
+				return nil
+			}
+			rowid = int64(seqRow.rowid)
+			break
+		}
+		rowid = int64(seqRow.rowid) + 1
+	}
+	cell, err := db.file.tableLeafCell(rowid, serializeRecord([]interface{}{table, seq}))
+	if err != nil {
+		return err
+	}
+	return db.file.insertTableCell(row.rootPage, rowid, cell)
+}
+
+// Removes a dropped table's AUTOINCREMENT counter from sqlite_sequence
+func (db *database) deleteSequence(table string) error {
+	row := db.findSchemaRow("table", "sqlite_sequence")
+	if row == nil {
+		return nil
+	}
+	seqRows, err := db.file.tableRows(row.rootPage)
+	if err != nil {
+		return err
+	}
+	for _, seqRow := range seqRows {
+		values := seqRow.record.values
+		if len(values) >= 2 && strings.EqualFold(formatValue(values[0]), table) {
+			_, err := db.file.deleteTableCell(row.rootPage, int64(seqRow.rowid))
+			return err
+		}
+	}
+	return nil
+}
+
+// Moves a renamed table's AUTOINCREMENT counter to its new name
+func (db *database) renameSequence(oldName, newName string) error {
+	row := db.findSchemaRow("table", "sqlite_sequence")
+	if row == nil {
+		return nil
+	}
+	seqRows, err := db.file.tableRows(row.rootPage)
+	if err != nil {
+		return err
+	}
+	for _, seqRow := range seqRows {
+		values := seqRow.record.values
+		if len(values) >= 2 && strings.EqualFold(formatValue(values[0]), oldName) {
+			cell, err := db.file.tableLeafCell(int64(seqRow.rowid), serializeRecord([]interface{}{newName, values[1]}))
+			if err != nil {
+				return err
+			}
+			return db.file.insertTableCell(row.rootPage, int64(seqRow.rowid), cell)
+		}
+	}
+	return nil
+}
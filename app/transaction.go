@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Runs BEGIN, COMMIT (or END) and ROLLBACK. Between BEGIN and COMMIT the
+// pager keeps every change in memory; nothing reaches the file, or the
+// journal, until the commit.
+func executeTransaction(db *database, sql string) error {
+	s, err := newTokenStream(sql)
+	if err != nil {
+		return err
+	}
+	keyword := strings.ToUpper(s.next().text)
+	switch keyword {
+	case "BEGIN":
+		if s.atKeyword("DEFERRED", "IMMEDIATE", "EXCLUSIVE") {
+			s.next()
+		}
+	case "ROLLBACK":
+		if s.atKeyword("TO") {
+			return fmt.Errorf("savepoints are not supported")
+		}
+	}
+	if s.acceptKeyword("TRANSACTION") && !s.atEnd() && !s.atPunct(";") {
+		s.next() // an optional transaction name, which SQLite ignores
+	}
+	s.acceptPunct(";")
+	if !s.atEnd() {
+		return s.syntaxError()
+	}
+
+	p := db.file
+	switch keyword {
+	case "BEGIN":
+		if p.inTransaction {
+			return fmt.Errorf("cannot start a transaction within a transaction")
+		}
+		p.inTransaction = true
+	case "COMMIT", "END":
+		if !p.inTransaction {
+			return fmt.Errorf("cannot commit - no transaction is active")
+		}
+		if db.fkDeferred > 0 {
+			// The transaction stays open for the broken references to be fixed
+			return fmt.Errorf("FOREIGN KEY constraint failed")
+		}
+		return p.commit()
+	case "ROLLBACK":
+		if !p.inTransaction {
+			return fmt.Errorf("cannot rollback - no transaction is active")
+		}
+		p.rollback()
+		db.fkDeferred = 0
+		return db.reloadSchema()
+	}
+	return nil
+}
@@ -0,0 +1,432 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/xwb1989/sqlparser"
+)
+
+// SQLite's default limit on triggers firing triggers
+const maxTriggerDepth = 1000
+
+// errIgnoreRow is how RAISE(IGNORE) abandons the row whose triggers are
+// running: the statement goes on with its next row
+var errIgnoreRow = errors.New("row ignored by RAISE(IGNORE)")
+
+// raiseError is raised by RAISE() in a trigger program
+type raiseError struct {
+	action  string // IGNORE, ROLLBACK, ABORT or FAIL
+	message string
+}
+
+func (e *raiseError) Error() string {
+	return e.message
+}
+
+// triggerRow is the OLD or NEW row a trigger program sees
+type triggerRow struct {
+	columns []string
+	values  []interface{}
+	rowid   interface{} // nil for the rows of a view
+}
+
+// The value of NEW.name or OLD.name
+func (r *triggerRow) value(name string) (interface{}, bool) {
+	for i, column := range r.columns {
+		if strings.EqualFold(column, name) {
+			return r.values[i], true
+		}
+	}
+	if isRowidName(name) && r.rowid != nil {
+		return r.rowid, true
+	}
+	return nil, false
+}
+
+// The row a trigger on the writer's table sees for the given values
+func (w *tableWriter) triggerRow(values []interface{}, rowid interface{}) *triggerRow {
+	return &triggerRow{columns: w.columnNames, values: values, rowid: rowid}
+}
+
+// Loads the triggers on a table or view, most recently created first,
+// which is the order SQLite fires them in
+func (db *database) tableTriggers(table string) ([]*triggerDef, error) {
+	var triggers []*triggerDef
+	for i := len(db.schema) - 1; i >= 0; i-- {
+		row := db.schema[i]
+		if row._type != "trigger" || !strings.EqualFold(row.tblName, table) {
+			continue
+		}
+		def, err := parseCreateTrigger(row.sql)
+		if err != nil {
+			return nil, err
+		}
+		triggers = append(triggers, def)
+	}
+	return triggers, nil
+}
+
+// Reports whether any of the triggers are for event at timing
+func hasTriggers(triggers []*triggerDef, timing, event string) bool {
+	for _, t := range triggers {
+		if t.timing == timing && t.event == event {
+			return true
+		}
+	}
+	return false
+}
+
+// Runs the triggers for event at timing whose WHEN clause holds for the
+// rows. changed lists the columns an UPDATE assigns, one of which an
+// UPDATE OF trigger needs. Unless recursive_triggers is on, a trigger
+// does not fire again while its own program runs.
+func (db *database) fireTriggers(triggers []*triggerDef, timing, event string, changed []string, old, new *triggerRow) error {
+	for _, t := range triggers {
+		if t.timing != timing || t.event != event || !t.firesFor(changed) {
+			continue
+		}
+		if !db.recursiveTriggers && db.triggerRunning(t.name) {
+			continue
+		}
+		if len(db.triggerStack) >= maxTriggerDepth {
+			return fmt.Errorf("too many levels of trigger recursion")
+		}
+		db.triggerStack = append(db.triggerStack, t.name)
+		err := db.runTrigger(t, old, new)
+		db.triggerStack = db.triggerStack[:len(db.triggerStack)-1]
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *database) triggerRunning(name string) bool {
+	for _, running := range db.triggerStack {
+		if strings.EqualFold(running, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Runs one trigger program. RAISE(IGNORE) becomes errIgnoreRow, and the
+// other RAISE() actions fail the statement like a broken constraint with
+// that conflict resolution.
+func (db *database) runTrigger(t *triggerDef, old, new *triggerRow) (err error) {
+	defer func() {
+		var re *raiseError
+		if errors.As(err, &re) {
+			if re.action == "IGNORE" {
+				err = errIgnoreRow
+			} else {
+				err = &constraintError{re.message, re.action}
+			}
+		}
+	}()
+	if t.when != "" {
+		when, err := substituteTriggerRows(t.when, old, new)
+		if err != nil {
+			return err
+		}
+		if holds, err := db.triggerConditionHolds(when); err != nil || !holds {
+			return err
+		}
+	}
+	for _, stmt := range t.body {
+		sql, err := substituteTriggerRows(stmt, old, new)
+		if err != nil {
+			return err
+		}
+		if _, err := executeStatement(db, sql); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Evaluates the WHEN clause of a trigger once its rows are substituted
+func (db *database) triggerConditionHolds(when string) (holds bool, err error) {
+	defer recoverEvalError(&err)
+	expr, err := parseExpression(when)
+	if err != nil {
+		return false, fmt.Errorf("failed to parse SQL: %v", err)
+	}
+	if expr, err = resolveExprSubqueries(db, expr); err != nil {
+		return false, err
+	}
+	if err := checkColumns(expr, nil); err != nil {
+		return false, err
+	}
+	return evaluateWhereClause(expr, nil, nil, "", nil, 0), nil
+}
+
+// Replaces the NEW.column and OLD.column references of trigger program
+// text with the values of the rows as literals
+func substituteTriggerRows(sql string, old, new *triggerRow) (string, error) {
+	tokens, err := tokenizeSQL(sql)
+	if err != nil {
+		return "", err
+	}
+	var edits []sqlEdit
+	for i := 0; i+2 < len(tokens); i++ {
+		t := tokens[i]
+		if t.kind != tokIdent || tokens[i+1].kind != tokPunct || tokens[i+1].text != "." || tokens[i+2].kind != tokIdent {
+			continue
+		}
+		var row *triggerRow
+		switch strings.ToLower(t.value) {
+		case "new":
+			row = new
+		case "old":
+			row = old
+		default:
+			continue
+		}
+		name := tokens[i+2].value
+		var v interface{}
+		found := false
+		if row != nil {
+			v, found = row.value(name)
+		}
+		if !found {
+			return "", fmt.Errorf("no such column: %s.%s", t.value, name)
+		}
+		literal := sqlLiteral(v)
+		if strings.HasPrefix(literal, "-") {
+			literal = "(" + literal + ")"
+		}
+		edits = append(edits, sqlEdit{t.pos, tokens[i+2].end, literal})
+		i += 2
+	}
+	return applySQLEdits(sql, edits), nil
+}
+
+// Deletes a row, running the table's DELETE triggers around it. Returns
+// false when a trigger abandoned the row or removed it first.
+func (w *tableWriter) deleteWithTriggers(row relationRow) (bool, error) {
+	rowid := int64(row.rowid)
+	old := w.triggerRow(row.values, rowid)
+	if hasTriggers(w.triggers, "BEFORE", "DELETE") {
+		if err := w.db.fireTriggers(w.triggers, "BEFORE", "DELETE", nil, old, nil); err == errIgnoreRow {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+		if exists, err := w.rowExists(rowid); err != nil || !exists {
+			return false, err
+		}
+	}
+	if err := w.deleteRow(row.values, rowid); err != nil {
+		return false, err
+	}
+	if err := w.db.fireTriggers(w.triggers, "AFTER", "DELETE", nil, old, nil); err != nil && err != errIgnoreRow {
+		return false, err
+	}
+	return true, nil
+}
+
+// Loads the triggers on a view, which can only be written through
+// INSTEAD OF triggers for event
+func (db *database) viewTriggers(view *SQLiteSchemaRow, event string) ([]*triggerDef, error) {
+	triggers, err := db.tableTriggers(view.name)
+	if err != nil {
+		return nil, err
+	}
+	if !hasTriggers(triggers, "INSTEAD OF", event) {
+		return nil, fmt.Errorf("cannot modify %s because it is a view", view.name)
+	}
+	return triggers, nil
+}
+
+// Runs an INSERT into a view: each row goes to the INSTEAD OF INSERT
+// triggers as NEW, with the columns the statement leaves out NULL
+func insertIntoView(db *database, view *SQLiteSchemaRow, stmt *sqlparser.Insert, sqlText string, upserts []*upsertClause) (int, error) {
+	triggers, err := db.viewTriggers(view, "INSERT")
+	if err != nil {
+		return 0, err
+	}
+	if len(upserts) > 0 {
+		return 0, fmt.Errorf("cannot UPSERT a view")
+	}
+	rel, err := namedRelation(db, view.name, view.name, nil)
+	if err != nil {
+		return 0, err
+	}
+	columns := rel.columnNames()
+	targets := make([]int, 0, len(columns))
+	for _, column := range stmt.Columns {
+		i := -1
+		for j, name := range columns {
+			if strings.EqualFold(name, column.String()) {
+				i = j
+			}
+		}
+		if i < 0 {
+			return 0, fmt.Errorf("table %s has no column named %s", view.name, column.String())
+		}
+		targets = append(targets, i)
+	}
+	if len(stmt.Columns) == 0 {
+		for i := range columns {
+			targets = append(targets, i)
+		}
+	}
+
+	rows, err := insertSourceRows(db, stmt.Rows, sqlText)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, row := range rows {
+		if len(row) != len(targets) {
+			if len(stmt.Columns) == 0 {
+				return n, fmt.Errorf("table %s has %d columns but %d values were supplied", view.name, len(targets), len(row))
+			}
+			return n, fmt.Errorf("%d values for %d columns", len(row), len(targets))
+		}
+		values := make([]interface{}, len(columns))
+		for i, v := range row {
+			values[targets[i]] = v
+		}
+		newRow := &triggerRow{columns: columns, values: values}
+		if err := db.fireTriggers(triggers, "INSTEAD OF", "INSERT", nil, nil, newRow); err == errIgnoreRow {
+			continue
+		} else if err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// Reads the rows of a view that an UPDATE or DELETE on it picks
+func viewRows(db *database, view *SQLiteSchemaRow, alias string, where sqlparser.Expr) (*relation, []relationRow, error) {
+	rel, err := namedRelation(db, view.name, alias, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if where, err = resolveExprSubqueries(db, where); err != nil {
+		return nil, nil, err
+	}
+	index, names := rel.columnIndex(), rel.columnNames()
+	if err := checkColumns(where, index); err != nil {
+		return nil, nil, err
+	}
+	if where == nil {
+		return rel, rel.rows, nil
+	}
+	where = rel.withCollations(where)
+	var rows []relationRow
+	for _, row := range rel.rows {
+		if evaluateWhereClause(where, index, names, "", row.values, row.rowid) {
+			rows = append(rows, row)
+		}
+	}
+	return rel, rows, nil
+}
+
+// Runs an UPDATE of a view: each row it picks goes to the INSTEAD OF
+// UPDATE triggers as OLD, and again with the SET list applied as NEW
+func updateView(db *database, view *SQLiteSchemaRow, alias string, stmt *sqlparser.Update) (int, error) {
+	triggers, err := db.viewTriggers(view, "UPDATE")
+	if err != nil {
+		return 0, err
+	}
+	var where sqlparser.Expr
+	if stmt.Where != nil {
+		where = stmt.Where.Expr
+	}
+	rel, rows, err := viewRows(db, view, alias, where)
+	if err != nil {
+		return 0, err
+	}
+	index, names := rel.columnIndex(), rel.columnNames()
+	type viewAssignment struct {
+		column int
+		expr   sqlparser.Expr
+	}
+	var assignments []viewAssignment
+	var changed []string
+	for _, update := range stmt.Exprs {
+		name := update.Name.Name.String()
+		column := -1
+		for i, c := range names {
+			if strings.EqualFold(c, name) {
+				column = i
+			}
+		}
+		if column < 0 {
+			return 0, fmt.Errorf("no such column: %s", name)
+		}
+		expr, err := resolveExprSubqueries(db, update.Expr)
+		if err != nil {
+			return 0, err
+		}
+		if err := checkColumns(expr, index); err != nil {
+			return 0, err
+		}
+		assignments = append(assignments, viewAssignment{column, expr})
+		changed = append(changed, names[column])
+	}
+	fires := false
+	for _, t := range triggers {
+		fires = fires || t.timing == "INSTEAD OF" && t.event == "UPDATE" && t.firesFor(changed)
+	}
+	if !fires {
+		return 0, fmt.Errorf("cannot modify %s because it is a view", view.name)
+	}
+
+	n := 0
+	for _, row := range rows {
+		values := append([]interface{}(nil), row.values...)
+		for _, a := range assignments {
+			values[a.column] = getExprValue(a.expr, index, names, "", row.values, row.rowid)
+		}
+		old := &triggerRow{columns: names, values: row.values}
+		newRow := &triggerRow{columns: names, values: values}
+		if err := db.fireTriggers(triggers, "INSTEAD OF", "UPDATE", changed, old, newRow); err == errIgnoreRow {
+			continue
+		} else if err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// Runs a DELETE from a view: each row it picks goes to the INSTEAD OF
+// DELETE triggers as OLD
+func deleteFromView(db *database, view *SQLiteSchemaRow, alias string, where sqlparser.Expr) (int, error) {
+	triggers, err := db.viewTriggers(view, "DELETE")
+	if err != nil {
+		return 0, err
+	}
+	rel, rows, err := viewRows(db, view, alias, where)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, row := range rows {
+		old := &triggerRow{columns: rel.columnNames(), values: row.values}
+		if err := db.fireTriggers(triggers, "INSTEAD OF", "DELETE", nil, old, nil); err == errIgnoreRow {
+			continue
+		} else if err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// Reports whether recursive_triggers is on, first turning it on or off if
+// a value is given
+func pragmaRecursiveTriggers(db *database, args []interface{}) (*resultSet, error) {
+	if len(args) == 0 {
+		return &resultSet{columns: []string{"recursive_triggers"}, rows: [][]interface{}{{boolValue(db.recursiveTriggers)}}}, nil
+	}
+	db.recursiveTriggers = pragmaFlag(args[0])
+	return &resultSet{}, nil
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/xwb1989/sqlparser"
+)
+
+// assignment is one "column = expr" of an UPDATE; column is -1 when it
+// sets the rowid of a table without an INTEGER PRIMARY KEY
+type assignment struct {
+	column int
+	expr   sqlparser.Expr
+}
+
+// Runs an UPDATE statement, returning the number of rows changed. Rows
+// are updated one at a time, each with the values it had before the
+// statement. onConflict is the resolution from UPDATE OR <resolution>.
+func executeUpdate(db *database, stmt *sqlparser.Update, onConflict string) (n int, err error) {
+	db.beginWriteStatement()
+	defer func() { err = db.endWriteStatement(err) }()
+	defer recoverEvalError(&err)
+
+	name, alias, err := writeTarget(nil, stmt.TableExprs)
+	if err != nil {
+		return 0, err
+	}
+	if len(stmt.OrderBy) > 0 || stmt.Limit != nil {
+		return 0, fmt.Errorf("ORDER BY and LIMIT are not supported on UPDATE")
+	}
+	if view := db.findSchemaRow("view", name); view != nil {
+		return updateView(db, view, alias, stmt)
+	}
+	w, err := newTableWriter(db, name)
+	if err != nil {
+		return 0, err
+	}
+	assignments, err := w.assignments(stmt.Exprs)
+	if err != nil {
+		return 0, err
+	}
+	columns := make([]int, len(assignments))
+	for i, a := range assignments {
+		columns[i] = a.column
+	}
+	if err := w.checkReferringKeys(columns); err != nil {
+		return 0, err
+	}
+	checks, err := w.uniqueChecks(onConflict, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	var where sqlparser.Expr
+	if stmt.Where != nil {
+		where = stmt.Where.Expr
+	}
+	rel, rows, err := w.matchingRows(alias, where)
+	if err != nil {
+		return 0, err
+	}
+	index, names := rel.columnIndex(), rel.columnNames()
+	for _, a := range assignments {
+		if err := checkColumns(a.expr, index); err != nil {
+			return 0, err
+		}
+	}
+
+	for _, row := range rows {
+		if w.replaced[int64(row.rowid)] {
+			continue // already deleted by REPLACE
+		}
+		if len(w.triggers) > 0 {
+			// Triggers may have changed or removed the row since it was read
+			current, found, err := w.loadRow(int64(row.rowid))
+			if err != nil {
+				return n, err
+			}
+			if !found {
+				continue
+			}
+			row = current
+		}
+		bound, err := w.bindAssignments(assignments, rel, row)
+		if err != nil {
+			return n, err
+		}
+		changed, err := w.updateWith(row, bound, index, names, row.values, onConflict, checks)
+		if err != nil {
+			return n, err
+		}
+		if changed {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// Runs the correlated subqueries of the SET expressions for one row
+func (w *tableWriter) bindAssignments(assignments []assignment, rel *relation, row relationRow) ([]assignment, error) {
+	bound := append([]assignment(nil), assignments...)
+	for i, a := range bound {
+		if !containsSubquery(a.expr) {
+			continue
+		}
+		expr, err := w.db.bindOuterRow(a.expr, rel, row)
+		if err != nil {
+			return nil, err
+		}
+		bound[i].expr = expr
+	}
+	return bound, nil
+}
+
+// Changes one row by its SET assignments, whose expressions are evaluated
+// over values through index and names, then checks its constraints and
+// writes it, running the UPDATE triggers around the write. Returns false
+// when IGNORE or RAISE(IGNORE) skips the row.
+func (w *tableWriter) updateWith(row relationRow, assignments []assignment, index map[string]int, names []string, values []interface{}, onConflict string, checks []uniqueCheck) (bool, error) {
+	newValues := append([]interface{}(nil), row.values...)
+	oldRowid := int64(row.rowid)
+	var rowidValue interface{} = oldRowid
+	for _, a := range assignments {
+		v := getExprValue(a.expr, index, names, "", values, row.rowid)
+		if a.column < 0 {
+			rowidValue = v
+		} else {
+			newValues[a.column] = v
+		}
+	}
+	if i := w.def.rowidColumn(); i >= 0 {
+		rowidValue = newValues[i]
+	}
+	if rowidValue == nil {
+		return false, fmt.Errorf("datatype mismatch")
+	}
+	rowid, err := w.resolveRowid(rowidValue)
+	if err != nil {
+		return false, err
+	}
+	if i := w.def.rowidColumn(); i >= 0 {
+		newValues[i] = rowid
+	}
+	for _, a := range assignments {
+		if a.column >= 0 && !w.def.columns[a.column].isRowid {
+			newValues[a.column] = applyAffinity(normalizeValue(newValues[a.column]), w.def.columns[a.column].affinity)
+		}
+	}
+	w.computeGenerated(newValues, rowid)
+
+	var changed []string
+	for _, a := range assignments {
+		if a.column >= 0 {
+			changed = append(changed, w.def.columns[a.column].name)
+		} else {
+			changed = append(changed, "rowid")
+		}
+	}
+	old := w.triggerRow(row.values, oldRowid)
+	if hasTriggers(w.triggers, "BEFORE", "UPDATE") {
+		err := w.db.fireTriggers(w.triggers, "BEFORE", "UPDATE", changed, old, w.triggerRow(newValues, rowid))
+		if err == errIgnoreRow {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+		if exists, err := w.rowExists(oldRowid); err != nil || !exists {
+			return false, err
+		}
+	}
+
+	if ok, err := w.checkRow(newValues, rowid, onConflict); !ok {
+		return false, err
+	}
+	if action, _, _, err := w.settleConflicts(checks, newValues, rowid, &oldRowid); err != nil || action == "IGNORE" {
+		return false, err
+	}
+	if err := w.updateRow(row.values, oldRowid, newValues, rowid); err != nil {
+		return false, err
+	}
+	if rowid > oldRowid && w.def.hasAutoincrement() {
+		if err := w.db.updateSequence(w.def.name, rowid); err != nil {
+			return false, err
+		}
+	}
+	err = w.db.fireTriggers(w.triggers, "AFTER", "UPDATE", changed, old, w.triggerRow(newValues, rowid))
+	if err != nil && err != errIgnoreRow {
+		return false, err
+	}
+	return true, nil
+}
+
+// Resolves the SET list of an UPDATE against the table's columns, with
+// later assignments to a column replacing earlier ones
+func (w *tableWriter) assignments(exprs sqlparser.UpdateExprs) ([]assignment, error) {
+	var assignments []assignment
+	for _, update := range exprs {
+		name := update.Name.Name.String()
+		column := w.def.columnIndex(name)
+		switch {
+		case column < 0 && isRowidName(name):
+			column = w.def.rowidColumn()
+		case column < 0:
+			return nil, fmt.Errorf("no such column: %s", name)
+		case w.def.columns[column].generated != "":
+			return nil, fmt.Errorf("cannot UPDATE generated column \"%s\"", w.def.columns[column].name)
+		}
+		expr, err := resolveUncorrelatedSubqueries(w.db, update.Expr)
+		if err != nil {
+			return nil, err
+		}
+		assignments = append(assignments, assignment{column: column, expr: expr})
+	}
+	return assignments, nil
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Runs VACUUM, which rebuilds the database without free pages, and VACUUM
+// INTO 'file', which writes the rebuilt database to a new file and leaves
+// the source alone
+func executeVacuum(db *database, sql string) error {
+	s, err := newTokenStream(sql)
+	if err != nil {
+		return err
+	}
+	if err := s.expectKeyword("VACUUM"); err != nil {
+		return err
+	}
+	if !s.atEnd() && !s.atPunct(";") && !s.atKeyword("INTO") {
+		schema, err := s.expectName()
+		if err != nil {
+			return err
+		}
+		if !strings.EqualFold(schema, "main") {
+			return fmt.Errorf("unknown database %s", schema)
+		}
+	}
+	target := ""
+	if s.acceptKeyword("INTO") {
+		t := s.next()
+		if t.kind != tokString {
+			return fmt.Errorf("near \"%s\": syntax error", t.text)
+		}
+		target = t.value
+	}
+	s.acceptPunct(";")
+	if !s.atEnd() {
+		return s.syntaxError()
+	}
+
+	if db.file.inTransaction {
+		return fmt.Errorf("cannot VACUUM from within a transaction")
+	}
+	if target != "" {
+		return vacuumInto(db, target)
+	}
+	return vacuumInPlace(db)
+}
+
+// Replaces every page of the database with the compacted image. The
+// commit journals the old pages and truncates the file to the new size.
+func vacuumInPlace(db *database) (err error) {
+	p := db.file
+	if p.readOnly {
+		return fmt.Errorf("attempt to write a readonly database")
+	}
+	image := &pager{pageSize: p.pageSize, journalMode: "off"}
+	image.startEmpty()
+	if err := db.compactInto(image); err != nil {
+		return err
+	}
+
+	p.beginStatement()
+	defer func() { err = db.endSchemaStatement(err) }()
+	for pageNum := range p.pages {
+		if pageNum > image.pageCount {
+			p.saveForStatement(pageNum)
+			delete(p.pages, pageNum)
+		}
+	}
+	for pageNum, data := range image.pages {
+		p.saveForStatement(pageNum)
+		p.pages[pageNum] = data
+	}
+	p.pageCount = image.pageCount
+	return nil
+}
+
+// Writes the compacted database to a new file, which may exist only if it
+// is empty. The copy is always in rollback journal mode.
+func vacuumInto(db *database, path string) error {
+	if info, err := os.Stat(path); err == nil && info.Size() > 0 {
+		return fmt.Errorf("output file already exists")
+	}
+	out, err := openPager(path)
+	if err != nil {
+		return fmt.Errorf("unable to open database: %s", path)
+	}
+	if out.readOnly {
+		out.close()
+		return fmt.Errorf("attempt to write a readonly database")
+	}
+	out.journalMode = "off"
+	out.pageSize = db.file.pageSize
+	out.startEmpty()
+	if err := db.compactInto(out); err != nil {
+		out.close()
+		return err
+	}
+	header := out.pages[1]
+	header[18], header[19] = 1, 1
+	binary.BigEndian.PutUint32(header[24:28], 0) // the commit makes it 1
+	cookie := binary.BigEndian.Uint32(header[40:44])
+	binary.BigEndian.PutUint32(header[40:44], cookie+1)
+	if err := out.commit(); err != nil {
+		out.close()
+		return err
+	}
+	return out.close()
+}
+
+// Copies the database into an empty pager: the header settings, then
+// every table and index b-tree rebuilt with full pages and no freelist.
+// Root pages are numbered in schema order and sqlite_schema is rewritten
+// to match.
+func (db *database) compactInto(out *pager) error {
+	src := db.file
+	header, err := src.page(1)
+	if err != nil {
+		return err
+	}
+	outHeader := out.pages[1]
+	copy(outHeader[16:100], header[16:100])
+	for i := 32; i < 40; i++ {
+		outHeader[i] = 0 // no freelist
+	}
+
+	roots := make(map[int]int)
+	for _, row := range db.schema {
+		if row.rootPage == 0 {
+			continue
+		}
+		if roots[row.rootPage], err = out.allocatePage(); err != nil {
+			return err
+		}
+	}
+	for _, row := range db.schema {
+		if row.rootPage == 0 {
+			continue
+		}
+		node, err := src.readNode(row.rootPage)
+		if err != nil {
+			return err
+		}
+		pageType := node.pageType | 0x08
+		var cells [][]byte
+		err = src.walkPayloads(row.rootPage, func(rowid int64, payload []byte) error {
+			var cell []byte
+			var err error
+			if pageType == 0x0D {
+				cell, err = out.tableLeafCell(rowid, payload)
+			} else {
+				cell, err = out.indexLeafCell(payload)
+			}
+			cells = append(cells, cell)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if err := out.buildTree(roots[row.rootPage], pageType, cells); err != nil {
+			return err
+		}
+	}
+
+	var schemaCells [][]byte
+	for _, row := range db.schema {
+		var sql interface{}
+		if row.sql != "" {
+			sql = row.sql
+		}
+		record := serializeRecord([]interface{}{row._type, row.name, row.tblName, int64(roots[row.rootPage]), sql})
+		cell, err := out.tableLeafCell(int64(row.rowid), record)
+		if err != nil {
+			return err
+		}
+		schemaCells = append(schemaCells, cell)
+	}
+	return out.buildTree(1, 0x0D, schemaCells)
+}
+
+// Calls fn with the rowid (0 in index b-trees) and full payload of each
+// entry of a b-tree, in key order. The keys of interior index cells are
+// entries too and come between their subtrees.
+func (p *pager) walkPayloads(pageNum int, fn func(rowid int64, payload []byte) error) error {
+	return p.walkPayloadsFrom(pageNum, 0, fn)
+}
+
+func (p *pager) walkPayloadsFrom(pageNum, depth int, fn func(rowid int64, payload []byte) error) error {
+	// Deeper than any real b-tree, so the pages must point in a loop
+	if depth > 64 {
+		return fmt.Errorf("database disk image is malformed: b-tree at page %d is too deep", pageNum)
+	}
+	node, err := p.readNode(pageNum)
+	if err != nil {
+		return err
+	}
+	for i, cell := range node.cells {
+		if !node.isLeaf() {
+			if err := p.walkPayloadsFrom(node.child(i), depth+1, fn); err != nil {
+				return err
+			}
+		}
+		if node.pageType == 0x05 {
+			continue
+		}
+		start := 0
+		if node.pageType == 0x02 {
+			start = 4
+		}
+		payloadSize, n := decodeVarint(cell[start:])
+		start += n
+		var rowid int64
+		if node.pageType == 0x0D {
+			key, n := decodeVarint(cell[start:])
+			rowid = int64(key)
+			start += n
+		}
+		payload, err := p.cellPayload(cell, start, int(payloadSize), node.isIndex())
+		if err != nil {
+			return err
+		}
+		if err := fn(rowid, payload); err != nil {
+			return err
+		}
+	}
+	if node.isLeaf() {
+		return nil
+	}
+	return p.walkPayloadsFrom(node.rightChild, depth+1, fn)
+}
@@ -0,0 +1,826 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// Write-ahead log format: a 32-byte header, then frames of a 24-byte
+// header and one page each. Every header and frame carries a running
+// checksum and the log's salts, so frames left over from an earlier log
+// or torn by a crash are recognised. A frame with a non-zero database
+// size ends a transaction; only frames up to the last of those count.
+const (
+	walHeaderSize      = 32
+	walFrameHeaderSize = 24
+	walMagic           = 0x377f0682 // checksums over little-endian words
+	walVersion         = 3007000
+
+	// Frames after which a commit checkpoints, as SQLite does by default
+	walAutoCheckpoint = 1000
+)
+
+// The wal-index (-shm) lets other connections find pages in the log
+// without reading it. It is made of 32KB blocks, each holding the page
+// numbers of 4096 frames and a hash table from page number to frame;
+// the first block starts with the index header, so holds fewer frames.
+const (
+	walIndexHeaderSize = 136
+	walIndexBlockSize  = 32768
+	walHashPages       = 4096
+	walHashPagesFirst  = walHashPages - walIndexHeaderSize/4
+	walHashSlots       = 2 * walHashPages
+)
+
+// Connections share the log through POSIX locks on bytes of the wal-index
+// past its header, as SQLite takes them: one for the writer, one for the
+// checkpointer, and one for each read mark. A reader holds a read lock on
+// a mark no greater than the last frame it sees, which keeps checkpoints
+// from copying later frames over pages it reads from the database file,
+// and the log from starting over under it. Readers of mark 0 read the
+// database file alone. Every connection also holds a read lock on the
+// byte after them while it has the index open.
+const (
+	walWriteLock      = 120
+	walCkptLock       = 121
+	walReadLock0      = 123
+	walReaders        = 5
+	walOpenLock       = 128
+	walReadMarkUnused = 0xffffffff
+)
+
+type walLog struct {
+	file     *os.File
+	shm      *os.File // the wal-index, not opened by read-only connections
+	dbPath   string
+	pageSize int
+
+	hasHeader  bool // false until the first frame is written to an empty log
+	salt       [8]byte
+	ckptSeq    uint32
+	checksum   [2]uint32 // running checksum after the last committed frame
+	frames     []int     // page number of each committed frame
+	latest     map[int]int
+	dbSize     int // database size in pages after the last commit
+	backfilled int // frames already copied into the database file
+	change     uint32
+
+	readMark int  // the read mark this connection holds a lock on, or -1
+	writing  bool // holds the write lock
+	moved    bool // the view of the log changed since the last read began
+}
+
+// The parts of the wal-index header and checkpoint information a
+// connection compares its view of the log with
+type walIndex struct {
+	change     uint32
+	frames     int
+	dbSize     int
+	checksum   [2]uint32
+	salt       [8]byte
+	backfilled int
+	readMarks  [walReaders]uint32
+}
+
+func walPath(dbPath string) string {
+	return dbPath + "-wal"
+}
+
+func shmPath(dbPath string) string {
+	return dbPath + "-shm"
+}
+
+// SQLite's WAL checksum: two running sums over pairs of 32-bit words
+func walChecksum(data []byte, s [2]uint32) [2]uint32 {
+	for i := 0; i+8 <= len(data); i += 8 {
+		s[0] += binary.LittleEndian.Uint32(data[i:]) + s[1]
+		s[1] += binary.LittleEndian.Uint32(data[i+4:]) + s[0]
+	}
+	return s
+}
+
+// Opens the log of a database in WAL mode and reads its committed frames
+func openWAL(dbPath string, pageSize int, readOnly bool) (*walLog, error) {
+	w := &walLog{dbPath: dbPath, pageSize: pageSize, latest: make(map[int]int), readMark: -1}
+	flags := os.O_RDWR | os.O_CREATE
+	if readOnly {
+		flags = os.O_RDONLY
+	}
+	file, err := os.OpenFile(walPath(dbPath), flags, 0644)
+	if err != nil {
+		if readOnly && os.IsNotExist(err) {
+			return w, nil // nothing logged yet
+		}
+		return nil, fmt.Errorf("unable to open database file")
+	}
+	w.file = file
+	if err := w.load(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if readOnly {
+		return w, nil
+	}
+	if err := w.openIndex(); err != nil {
+		w.close(nil, false)
+		return nil, err
+	}
+	return w, nil
+}
+
+// Opens the wal-index. The first connection to open it, which finds no
+// other holding the open lock, sets it up from the log; the others take
+// the view of the log it records.
+func (w *walLog) openIndex() error {
+	shm, err := os.OpenFile(shmPath(w.dbPath), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("unable to open database file")
+	}
+	w.shm = shm
+	first := false
+	if inUse, err := rangeLocked(shm, walOpenLock, 1); err == nil && !inUse {
+		first = rangeLock(shm, rangeWrite, walOpenLock, 1) == nil
+	}
+	if err := rangeLock(shm, rangeRead, walOpenLock, 1); err != nil {
+		return err
+	}
+	if !first {
+		_, err := w.refresh()
+		return err
+	}
+	if idx, ok := w.readIndex(); ok && idx.salt == w.salt && idx.frames == len(w.frames) {
+		// A checkpoint of this same log got this far before
+		w.change = idx.change
+		if idx.backfilled <= len(w.frames) {
+			w.backfilled = idx.backfilled
+		}
+	}
+	if err := w.writeIndex(); err != nil {
+		return err
+	}
+	return w.writeCheckpointInfo()
+}
+
+// Reads the frames of the log, stopping at the first that does not
+// belong to it or fails its checksum
+func (w *walLog) load() error {
+	data, err := io.ReadAll(io.NewSectionReader(w.file, 0, 1<<62))
+	if err != nil {
+		return err
+	}
+	if len(data) < walHeaderSize {
+		return nil
+	}
+	header := data[:walHeaderSize]
+	magic := binary.BigEndian.Uint32(header)
+	if magic != walMagic {
+		if magic == walMagic|1 {
+			return fmt.Errorf("WAL files with big-endian checksums are not supported")
+		}
+		return nil
+	}
+	if int(binary.BigEndian.Uint32(header[8:])) != w.pageSize {
+		return nil
+	}
+	sum := walChecksum(header[:24], [2]uint32{})
+	if sum[0] != binary.BigEndian.Uint32(header[24:]) || sum[1] != binary.BigEndian.Uint32(header[28:]) {
+		return nil
+	}
+	w.hasHeader = true
+	w.ckptSeq = binary.BigEndian.Uint32(header[12:])
+	copy(w.salt[:], header[16:24])
+	w.checksum = sum
+
+	frameSize := walFrameHeaderSize + w.pageSize
+	var pending []int
+	for off := walHeaderSize; off+frameSize <= len(data); off += frameSize {
+		frame := data[off : off+frameSize]
+		pageNum := int(binary.BigEndian.Uint32(frame))
+		if pageNum == 0 || string(frame[8:16]) != string(w.salt[:]) {
+			break
+		}
+		sum = walChecksum(frame[:8], sum)
+		sum = walChecksum(frame[walFrameHeaderSize:], sum)
+		if sum[0] != binary.BigEndian.Uint32(frame[16:]) || sum[1] != binary.BigEndian.Uint32(frame[20:]) {
+			break
+		}
+		pending = append(pending, pageNum)
+		if dbSize := int(binary.BigEndian.Uint32(frame[4:])); dbSize != 0 {
+			for _, pageNum := range pending {
+				w.frames = append(w.frames, pageNum)
+				w.latest[pageNum] = len(w.frames)
+			}
+			pending = nil
+			w.dbSize = dbSize
+			w.checksum = sum
+		}
+	}
+	return nil
+}
+
+// Reads the wal-index header and checkpoint information, reporting false
+// when the index is not set up or its two copies of the header differ
+// because a writer is halfway through them
+func (w *walLog) readIndex() (walIndex, bool) {
+	var idx walIndex
+	if w.shm == nil {
+		return idx, false
+	}
+	buf := make([]byte, walIndexHeaderSize)
+	if _, err := w.shm.ReadAt(buf, 0); err != nil {
+		return idx, false
+	}
+	header := buf[:48]
+	if string(header) != string(buf[48:96]) || header[12] == 0 {
+		return idx, false
+	}
+	sum := walChecksum(header[:40], [2]uint32{})
+	if sum[0] != binary.LittleEndian.Uint32(header[40:]) || sum[1] != binary.LittleEndian.Uint32(header[44:]) {
+		return idx, false
+	}
+	idx.change = binary.LittleEndian.Uint32(header[8:])
+	idx.frames = int(binary.LittleEndian.Uint32(header[16:]))
+	idx.dbSize = int(binary.LittleEndian.Uint32(header[20:]))
+	idx.checksum = [2]uint32{binary.LittleEndian.Uint32(header[24:]), binary.LittleEndian.Uint32(header[28:])}
+	copy(idx.salt[:], header[32:40])
+	idx.backfilled = int(binary.LittleEndian.Uint32(buf[96:]))
+	for i := range idx.readMarks {
+		idx.readMarks[i] = binary.LittleEndian.Uint32(buf[100+4*i:])
+	}
+	return idx, true
+}
+
+// Reports whether the wal-index describes the log as this connection sees it
+func (w *walLog) current(idx walIndex) bool {
+	return idx.salt == w.salt && idx.frames == len(w.frames) && idx.change == w.change
+}
+
+// Brings this connection's view of the log up to date with the commits
+// other connections recorded in the wal-index
+func (w *walLog) refresh() (bool, error) {
+	idx, ok := w.readIndex()
+	if !ok || w.current(idx) {
+		if ok && idx.backfilled <= len(w.frames) {
+			w.backfilled = idx.backfilled
+		}
+		return false, nil
+	}
+	w.hasHeader, w.frames, w.latest, w.dbSize, w.backfilled = false, nil, make(map[int]int), 0, 0
+	if err := w.load(); err != nil {
+		return false, err
+	}
+	if idx.frames < len(w.frames) {
+		// Frames past those the index records belong to a commit that
+		// has not finished
+		w.frames = w.frames[:idx.frames]
+		w.latest = make(map[int]int)
+		for i, pageNum := range w.frames {
+			w.latest[pageNum] = i + 1
+		}
+		w.dbSize = idx.dbSize
+		w.checksum = idx.checksum
+	}
+	if !w.hasHeader {
+		w.salt = idx.salt
+	}
+	w.change = idx.change
+	if idx.backfilled <= len(w.frames) {
+		w.backfilled = idx.backfilled
+	}
+	w.moved = true
+	return true, nil
+}
+
+// Starts a read: brings the view of the log up to date and takes a read
+// mark for it. Reports whether the view changed since the last read.
+func (w *walLog) beginRead() (bool, error) {
+	if w.shm == nil || w.readMark >= 0 {
+		return false, nil
+	}
+	for try := 0; try < 100; try++ {
+		if _, err := w.refresh(); err != nil {
+			return false, err
+		}
+		mark, err := w.takeReadMark()
+		if err != nil {
+			return false, err
+		}
+		if mark < 0 {
+			continue
+		}
+		// Another connection may have committed before the mark was taken
+		if idx, ok := w.readIndex(); !ok || w.current(idx) {
+			w.readMark = mark
+			moved := w.moved
+			w.moved = false
+			return moved, nil
+		}
+		rangeLock(w.shm, rangeUnlock, walReadLock0+int64(mark), 1)
+	}
+	return false, errLocked
+}
+
+// Takes a read lock on a mark no greater than the frames this connection
+// sees, first moving a mark no reader holds up to them when none is there
+// yet. Returns -1 when the marks changed before the lock was taken.
+func (w *walLog) takeReadMark() (int, error) {
+	idx, _ := w.readIndex()
+	frames := uint32(len(w.frames))
+	if w.backfilled == len(w.frames) {
+		err := rangeLock(w.shm, rangeRead, walReadLock0, 1)
+		if err != errLocked {
+			return 0, err
+		}
+	}
+	best := 0
+	for i := 1; i < walReaders; i++ {
+		if mark := idx.readMarks[i]; mark <= frames && (best == 0 || mark > idx.readMarks[best]) {
+			best = i
+		}
+	}
+	if best == 0 || idx.readMarks[best] < frames {
+		for i := 1; i < walReaders; i++ {
+			lock := walReadLock0 + int64(i)
+			if rangeLock(w.shm, rangeWrite, lock, 1) != nil {
+				continue
+			}
+			err := w.setReadMark(i, frames)
+			if err == nil {
+				err = rangeLock(w.shm, rangeRead, lock, 1)
+			}
+			if err != nil {
+				rangeLock(w.shm, rangeUnlock, lock, 1)
+				return -1, err
+			}
+			return i, nil
+		}
+		if best == 0 {
+			return -1, errLocked
+		}
+	}
+	lock := walReadLock0 + int64(best)
+	if err := rangeLock(w.shm, rangeRead, lock, 1); err != nil {
+		if err == errLocked {
+			return -1, nil
+		}
+		return -1, err
+	}
+	if again, _ := w.readIndex(); again.readMarks[best] != idx.readMarks[best] {
+		rangeLock(w.shm, rangeUnlock, lock, 1)
+		return -1, nil
+	}
+	return best, nil
+}
+
+// Lets go of the read mark
+func (w *walLog) endRead() {
+	if w.readMark >= 0 {
+		rangeLock(w.shm, rangeUnlock, walReadLock0+int64(w.readMark), 1)
+		w.readMark = -1
+	}
+}
+
+func (w *walLog) setReadMark(i int, mark uint32) error {
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], mark)
+	_, err := w.shm.WriteAt(buf[:], int64(100+4*i))
+	return err
+}
+
+// Takes the write lock, which only a connection seeing the latest commit
+// may hold: a transaction cannot build on an older one. Once every frame
+// is in the database file the log starts over, unless a reader still
+// holds a mark on it.
+func (w *walLog) beginWrite() error {
+	if w.shm == nil || w.writing {
+		return nil
+	}
+	if err := rangeLock(w.shm, rangeWrite, walWriteLock, 1); err != nil {
+		return err
+	}
+	if idx, ok := w.readIndex(); ok && !w.current(idx) {
+		rangeLock(w.shm, rangeUnlock, walWriteLock, 1)
+		return errLocked
+	}
+	w.writing = true
+	if w.readMark != 0 || len(w.frames) == 0 {
+		return nil
+	}
+	readers := int64(walReaders - 1)
+	if rangeLock(w.shm, rangeWrite, walReadLock0+1, readers) != nil {
+		return nil
+	}
+	defer rangeLock(w.shm, rangeUnlock, walReadLock0+1, readers)
+	if err := w.restart(); err != nil {
+		return err
+	}
+	if err := w.writeIndex(); err != nil {
+		return err
+	}
+	return w.writeCheckpointInfo()
+}
+
+// Lets go of the write lock
+func (w *walLog) endWrite() {
+	if w.writing {
+		rangeLock(w.shm, rangeUnlock, walWriteLock, 1)
+		w.writing = false
+	}
+}
+
+// Reads from the latest committed version of a page, starting inPage
+// bytes into it, if the log has one. A reader of mark 0 reads the
+// database file alone.
+func (w *walLog) readPage(pageNum int, b []byte, inPage int) (bool, error) {
+	if w == nil || w.readMark == 0 {
+		return false, nil
+	}
+	frame, ok := w.latest[pageNum]
+	if !ok {
+		return false, nil
+	}
+	_, err := w.file.ReadAt(b, w.frameOffset(frame)+int64(inPage))
+	return true, err
+}
+
+// Where the page of a frame starts in the log
+func (w *walLog) frameOffset(frame int) int64 {
+	return int64(walHeaderSize) + int64(frame-1)*int64(walFrameHeaderSize+w.pageSize) + walFrameHeaderSize
+}
+
+// Starts the log over, with new salts so the old frames no longer count
+func (w *walLog) restart() error {
+	var random [8]byte
+	if _, err := rand.Read(random[:]); err != nil {
+		return err
+	}
+	if w.hasHeader {
+		binary.BigEndian.PutUint32(w.salt[:4], binary.BigEndian.Uint32(w.salt[:4])+1)
+		w.ckptSeq++
+	} else {
+		copy(w.salt[:4], random[:4])
+	}
+	copy(w.salt[4:], random[4:])
+
+	header := make([]byte, walHeaderSize)
+	binary.BigEndian.PutUint32(header, walMagic)
+	binary.BigEndian.PutUint32(header[4:], walVersion)
+	binary.BigEndian.PutUint32(header[8:], uint32(w.pageSize))
+	binary.BigEndian.PutUint32(header[12:], w.ckptSeq)
+	copy(header[16:], w.salt[:])
+	w.checksum = walChecksum(header[:24], [2]uint32{})
+	binary.BigEndian.PutUint32(header[24:], w.checksum[0])
+	binary.BigEndian.PutUint32(header[28:], w.checksum[1])
+	if _, err := w.file.WriteAt(header, 0); err != nil {
+		return err
+	}
+	w.hasHeader = true
+	w.frames = nil
+	w.latest = make(map[int]int)
+	w.backfilled = 0
+	return nil
+}
+
+// Appends a transaction's pages as frames, the last marked as the commit
+// carrying the new database size, and syncs the log
+func (w *walLog) appendCommit(pages map[int][]byte, dbSize int) error {
+	if !w.hasHeader {
+		if err := w.restart(); err != nil {
+			return err
+		}
+	}
+	pageNums := make([]int, 0, len(pages))
+	for pageNum := range pages {
+		pageNums = append(pageNums, pageNum)
+	}
+	sort.Ints(pageNums)
+
+	frameSize := walFrameHeaderSize + w.pageSize
+	buf := make([]byte, 0, len(pageNums)*frameSize)
+	sum := w.checksum
+	for i, pageNum := range pageNums {
+		frame := make([]byte, walFrameHeaderSize, frameSize)
+		binary.BigEndian.PutUint32(frame, uint32(pageNum))
+		if i == len(pageNums)-1 {
+			binary.BigEndian.PutUint32(frame[4:], uint32(dbSize))
+		}
+		copy(frame[8:], w.salt[:])
+		sum = walChecksum(frame[:8], sum)
+		sum = walChecksum(pages[pageNum], sum)
+		binary.BigEndian.PutUint32(frame[16:], sum[0])
+		binary.BigEndian.PutUint32(frame[20:], sum[1])
+		buf = append(buf, append(frame, pages[pageNum]...)...)
+	}
+	off := int64(walHeaderSize) + int64(len(w.frames))*int64(frameSize)
+	if _, err := w.file.WriteAt(buf, off); err != nil {
+		return err
+	}
+	if err := w.file.Sync(); err != nil {
+		return err
+	}
+	for _, pageNum := range pageNums {
+		w.frames = append(w.frames, pageNum)
+		w.latest[pageNum] = len(w.frames)
+	}
+	w.checksum = sum
+	w.dbSize = dbSize
+	w.change++
+	return w.writeIndex()
+}
+
+// Copies frames into the database file, up to the first that a reader's
+// mark shows it may still read the older version of a page from the file.
+// truncate also empties the log, once no reader is using it. Fails with
+// errLocked when another connection is checkpointing or the log could not
+// be copied in full.
+func (w *walLog) checkpoint(db *os.File, truncate bool) error {
+	if w.shm == nil {
+		return nil
+	}
+	w.endRead()
+	w.endWrite()
+	if err := rangeLock(w.shm, rangeWrite, walCkptLock, 1); err != nil {
+		return err
+	}
+	defer rangeLock(w.shm, rangeUnlock, walCkptLock, 1)
+	if _, err := w.refresh(); err != nil {
+		return err
+	}
+
+	idx, _ := w.readIndex()
+	safe := len(w.frames)
+	for i := 1; i < walReaders; i++ {
+		mark := idx.readMarks[i]
+		if uint32(safe) <= mark {
+			continue
+		}
+		lock := walReadLock0 + int64(i)
+		if rangeLock(w.shm, rangeWrite, lock, 1) != nil {
+			safe = int(mark)
+			continue
+		}
+		// No reader holds the mark, so it can move past what is copied
+		mark = walReadMarkUnused
+		if i == 1 {
+			mark = uint32(safe)
+		}
+		err := w.setReadMark(i, mark)
+		rangeLock(w.shm, rangeUnlock, lock, 1)
+		if err != nil {
+			return err
+		}
+	}
+	if w.backfilled < safe {
+		if err := rangeLock(w.shm, rangeWrite, walReadLock0, 1); err != nil {
+			return err
+		}
+		err := w.backfill(db, safe)
+		rangeLock(w.shm, rangeUnlock, walReadLock0, 1)
+		if err != nil {
+			return err
+		}
+	}
+	if w.backfilled < len(w.frames) {
+		return errLocked
+	}
+	if !truncate {
+		return nil
+	}
+
+	// Emptying the log keeps writers out, and needs every reader of it gone
+	if err := rangeLock(w.shm, rangeWrite, walWriteLock, 1); err != nil {
+		return err
+	}
+	defer rangeLock(w.shm, rangeUnlock, walWriteLock, 1)
+	readers := int64(walReaders - 1)
+	if err := rangeLock(w.shm, rangeWrite, walReadLock0+1, readers); err != nil {
+		return err
+	}
+	defer rangeLock(w.shm, rangeUnlock, walReadLock0+1, readers)
+	if err := w.file.Truncate(0); err != nil {
+		return err
+	}
+	w.hasHeader = false
+	w.frames = nil
+	w.latest = make(map[int]int)
+	w.backfilled = 0
+	if err := w.writeIndex(); err != nil {
+		return err
+	}
+	return w.writeCheckpointInfo()
+}
+
+// Copies the latest version of each page among the first frames of the
+// log into the database file, which is cut to size once all are copied
+func (w *walLog) backfill(db *os.File, frames int) error {
+	latest := make(map[int]int)
+	for i, pageNum := range w.frames[:frames] {
+		latest[pageNum] = i + 1
+	}
+	pageNums := make([]int, 0, len(latest))
+	for pageNum, frame := range latest {
+		if frame > w.backfilled && pageNum <= w.dbSize {
+			pageNums = append(pageNums, pageNum)
+		}
+	}
+	sort.Ints(pageNums)
+	page := make([]byte, w.pageSize)
+	for _, pageNum := range pageNums {
+		if _, err := w.file.ReadAt(page, w.frameOffset(latest[pageNum])); err != nil {
+			return err
+		}
+		if _, err := db.WriteAt(page, int64(pageNum-1)*int64(w.pageSize)); err != nil {
+			return err
+		}
+	}
+	if frames == len(w.frames) {
+		if err := db.Truncate(int64(w.dbSize) * int64(w.pageSize)); err != nil {
+			return err
+		}
+	}
+	if err := db.Sync(); err != nil {
+		return err
+	}
+	w.backfilled = frames
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], uint32(frames))
+	if _, err := w.shm.WriteAt(buf[:], 96); err != nil {
+		return err
+	}
+	_, err := w.shm.WriteAt(buf[:], 128)
+	return err
+}
+
+// Writes the wal-index header and the page numbers and hash tables of the
+// frames in the layout SQLite uses, in place, so other connections find
+// the frames without reading the log
+func (w *walLog) writeIndex() error {
+	if w.shm == nil {
+		return nil
+	}
+	blocks := 1
+	if len(w.frames) > walHashPagesFirst {
+		blocks += (len(w.frames) - walHashPagesFirst + walHashPages - 1) / walHashPages
+	}
+	shm := make([]byte, blocks*walIndexBlockSize)
+
+	header := make([]byte, 48)
+	binary.LittleEndian.PutUint32(header[0:], walVersion)
+	binary.LittleEndian.PutUint32(header[8:], w.change)
+	header[12] = 1 // isInit
+	pageSize := w.pageSize
+	if pageSize == 65536 {
+		pageSize = 1
+	}
+	binary.LittleEndian.PutUint16(header[14:], uint16(pageSize))
+	binary.LittleEndian.PutUint32(header[16:], uint32(len(w.frames)))
+	binary.LittleEndian.PutUint32(header[20:], uint32(w.dbSize))
+	binary.LittleEndian.PutUint32(header[24:], w.checksum[0])
+	binary.LittleEndian.PutUint32(header[28:], w.checksum[1])
+	copy(header[32:], w.salt[:])
+	sum := walChecksum(header[:40], [2]uint32{})
+	binary.LittleEndian.PutUint32(header[40:], sum[0])
+	binary.LittleEndian.PutUint32(header[44:], sum[1])
+	copy(shm, header)
+	copy(shm[48:], header)
+
+	for i, pageNum := range w.frames {
+		frame := i + 1
+		block, zero, pgnoOffset := 0, 0, walIndexHeaderSize
+		if frame > walHashPagesFirst {
+			block = (frame-walHashPagesFirst-1)/walHashPages + 1
+			zero = walHashPagesFirst + (block-1)*walHashPages
+			pgnoOffset = 0
+		}
+		base := block * walIndexBlockSize
+		idx := frame - zero
+		binary.LittleEndian.PutUint32(shm[base+pgnoOffset+4*(idx-1):], uint32(pageNum))
+		hash := base + 4*walHashPages
+		key := (pageNum * 383) & (walHashSlots - 1)
+		for binary.LittleEndian.Uint16(shm[hash+2*key:]) != 0 {
+			key = (key + 1) & (walHashSlots - 1)
+		}
+		binary.LittleEndian.PutUint16(shm[hash+2*key:], uint16(idx))
+	}
+
+	// The checkpoint information between the header and the frames belongs
+	// to checkpointers and readers; the header goes last, so readers never
+	// find frames missing from the hash tables
+	if _, err := w.shm.WriteAt(shm[walIndexHeaderSize:], walIndexHeaderSize); err != nil {
+		return err
+	}
+	_, err := w.shm.WriteAt(shm[:96], 0)
+	return err
+}
+
+// Writes the checkpoint information of a wal-index no reader holds a mark
+// in: how far the log is backfilled, and the read marks a new index starts
+// with
+func (w *walLog) writeCheckpointInfo() error {
+	info := make([]byte, walIndexHeaderSize-96)
+	binary.LittleEndian.PutUint32(info[0:], uint32(w.backfilled))
+	binary.LittleEndian.PutUint32(info[8:], uint32(len(w.frames)))
+	for i := 2; i < walReaders; i++ {
+		binary.LittleEndian.PutUint32(info[4+4*i:], walReadMarkUnused)
+	}
+	binary.LittleEndian.PutUint32(info[32:], uint32(w.backfilled))
+	_, err := w.shm.WriteAt(info, 96)
+	return err
+}
+
+// Closes the log. last is set for the last connection to the database,
+// which checkpoints the log and removes it with its index, as SQLite does.
+func (w *walLog) close(db *os.File, last bool) error {
+	w.endRead()
+	w.endWrite()
+	var err error
+	if last && w.file != nil {
+		if err = w.checkpoint(db, true); err == nil {
+			os.Remove(walPath(w.dbPath))
+			os.Remove(shmPath(w.dbPath))
+		}
+	}
+	if w.file != nil {
+		w.file.Close()
+	}
+	if w.shm != nil {
+		w.shm.Close()
+	}
+	return err
+}
+
+// Switches between WAL and the rollback journal modes. Entering WAL mode
+// marks the file format as version 2; leaving it checkpoints the whole
+// log into the file and removes it.
+func (p *pager) setJournalMode(mode string) error {
+	if mode == p.journalMode {
+		return nil
+	}
+	if mode != "wal" && p.journalMode != "wal" {
+		p.journalMode = mode
+		return nil
+	}
+	if p.inTransaction {
+		direction := "into"
+		if mode != "wal" {
+			direction = "out of"
+		}
+		return fmt.Errorf("cannot change %s wal mode from within a transaction", direction)
+	}
+
+	version := byte(2)
+	if p.journalMode == "wal" {
+		// Only a connection with the database to itself may leave WAL mode
+		if err := p.lock(lockExclusive); err != nil {
+			p.unlock(lockShared)
+			return err
+		}
+		if err := p.wal.close(p.file, true); err != nil {
+			return err
+		}
+		p.wal = nil
+		p.journalMode = mode
+		version = 1
+	}
+	header, err := p.writablePage(1)
+	if err != nil {
+		return err
+	}
+	header[18], header[19] = version, version
+	if err := p.commit(); err != nil {
+		return err
+	}
+	if version == 2 {
+		if p.wal, err = openWAL(p.path, p.pageSize, false); err != nil {
+			return err
+		}
+		p.journalMode = "wal"
+	}
+	return nil
+}
+
+// Runs a checkpoint, returning whether it was kept from copying the whole
+// log by other connections, the number of frames in the log and how many
+// of them are now in the database file, or -1 for both when the database
+// is not in WAL mode. TRUNCATE also empties the log; RESTART leaves that
+// to the next write, as the log starts over once it is all copied.
+func (p *pager) checkpoint(mode string) (bool, int, int, error) {
+	if p.wal == nil {
+		return false, -1, -1, nil
+	}
+	if p.inTransaction || len(p.pages) > 0 {
+		return false, 0, 0, fmt.Errorf("database table is locked")
+	}
+	if p.readOnly {
+		return false, 0, 0, fmt.Errorf("attempt to write a readonly database")
+	}
+	err := p.wal.checkpoint(p.file, mode == "TRUNCATE")
+	if err != nil && err != errLocked {
+		return false, 0, 0, err
+	}
+	return err == errLocked, len(p.wal.frames), p.wal.backfilled, nil
+}
@@ -2,8 +2,9 @@ module github.com/codecrafters-io/sqlite-starter-go
 
 go 1.24.0
 
-require github.com/xwb1989/sqlparser v0.0.0-20180606152119-120387863bf2
-
 require (
-	golang.org/x/sys v0.0.0-20220310020820-b874c991c1a5 // indirect
+	github.com/chzyer/readline v1.5.1
+	github.com/xwb1989/sqlparser v0.0.0-20180606152119-120387863bf2
 )
+
+require golang.org/x/sys v0.0.0-20220310020820-b874c991c1a5 // indirect